@@ -0,0 +1,202 @@
+//
+// Pools of reusable buffers.
+//
+// Under heavy load the buffers we allocate to hold request bodies, and
+// to copy responses, cause a lot of garbage-collection.  Instead we
+// recycle them via the pools here.
+//
+// The size of the buffers used to copy responses may be changed via the
+// `-copy-buffer-size` flag of both servers.
+//
+// Uploads are hashed as they're read, in chunks whose size may be changed
+// via the `-hash-chunk-size` flag of the API-server, rather than being
+// read fully and then hashed in a second pass.  crypto/sha256 uses the
+// SHA extensions of the CPU, where present, without any configuration.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// maxPooledBody is the capacity beyond which a body-buffer is discarded
+// rather than pooled, so that a single large upload does not pin that
+// much memory for the lifetime of the process.
+const maxPooledBody = 4 * 1024 * 1024
+
+// bodyPool holds the buffers we read request-bodies into.
+var bodyPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// getBodyBuffer returns an empty buffer from our pool.
+func getBodyBuffer() *bytes.Buffer {
+	return bodyPool.Get().(*bytes.Buffer)
+}
+
+// putBodyBuffer returns the given buffer to our pool.
+func putBodyBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBody {
+		return
+	}
+	buf.Reset()
+	bodyPool.Put(buf)
+}
+
+// copyBufferSize is the size of the buffers used to copy responses, and
+// so the amount of data written between extending the write-deadline.
+//
+// Zero means copyChunkSize.
+var copyBufferSize atomic.Int64
+
+// copyPool holds the buffers we copy responses through.
+var copyPool sync.Pool
+
+// setCopyBufferSize changes the size of the buffers used to copy
+// responses.  Buffers of the previous size are discarded as they're
+// taken from the pool.
+func setCopyBufferSize(size int) {
+	copyBufferSize.Store(int64(max(size, 0)))
+}
+
+// getCopyBuffer returns a buffer from our pool.
+func getCopyBuffer() *[]byte {
+	size := copyBufferSize.Load()
+	if size == 0 {
+		size = copyChunkSize
+	}
+
+	if buf, ok := copyPool.Get().(*[]byte); ok && int64(len(*buf)) == size {
+		return buf
+	}
+	buf := make([]byte, size)
+	return &buf
+}
+
+// putCopyBuffer returns the given buffer to our pool.
+func putCopyBuffer(buf *[]byte) {
+	copyPool.Put(buf)
+}
+
+// sharedBody is a pooled request-body which is sent to several
+// blob-servers, perhaps at once.
+//
+// The transport may still be reading a request-body after the response
+// has been received, so the buffer is only returned to the pool once
+// the handler, and every reader, has released it.
+type sharedBody struct {
+	buf  *bytes.Buffer
+	refs atomic.Int64
+
+	// digest is the hex-encoded SHA256 of the content, if known.
+	digest string
+}
+
+// readSharedBody reads the given request-body into a pooled buffer.
+//
+// The caller holds the first reference, and must release it.
+func readSharedBody(src io.Reader) (*sharedBody, error) {
+	body := &sharedBody{buf: getBodyBuffer()}
+	body.refs.Store(1)
+
+	if _, err := body.buf.ReadFrom(src); err != nil {
+		body.release()
+		return nil, err
+	}
+	return body, nil
+}
+
+// hashChunkSize is the default amount of data we read, and hash, at a
+// time when receiving an upload.
+const hashChunkSize = 64 * 1024
+
+// readHashedBody reads the given request-body into a pooled buffer, as
+// readSharedBody does, and returns the SHA256 hash of its content.
+//
+// The hash is computed as the body is read, chunkSize bytes at a time,
+// so that large uploads are only walked once.  A chunkSize of zero
+// means hashChunkSize.
+func readHashedBody(src io.Reader, chunkSize int) (*sharedBody, [sha256.Size]byte, error) {
+	body := &sharedBody{buf: getBodyBuffer()}
+	body.refs.Store(1)
+
+	sum, err := hashCopy(body.buf, src, chunkSize)
+	if err != nil {
+		body.release()
+		return nil, sum, err
+	}
+
+	body.digest = hex.EncodeToString(sum[:])
+	return body, sum, nil
+}
+
+// hashCopy copies src to dst, chunkSize bytes at a time, and returns the
+// SHA256 hash of the content copied.
+//
+// Only a single chunk is held in memory, so objects of any size may be
+// hashed by copying them to io.Discard.  A chunkSize of zero means
+// hashChunkSize.
+func hashCopy(dst io.Writer, src io.Reader, chunkSize int) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	if chunkSize <= 0 {
+		chunkSize = hashChunkSize
+	}
+
+	//
+	// Hide any ReaderFrom of the destination, so that our chunk is used.
+	//
+	hasher := sha256.New()
+	if _, err := io.CopyBuffer(struct{ io.Writer }{dst}, io.TeeReader(src, hasher), make([]byte, chunkSize)); err != nil {
+		return sum, err
+	}
+
+	hasher.Sum(sum[:0])
+	return sum, nil
+}
+
+// bytes returns the content of the body, which must not be retained
+// once the body has been released.
+func (s *sharedBody) bytes() []byte {
+	return s.buf.Bytes()
+}
+
+// hold takes a reference to the body, returning the function which
+// releases it.
+func (s *sharedBody) hold() func() {
+	s.refs.Add(1)
+
+	var once sync.Once
+	return func() { once.Do(s.release) }
+}
+
+// release drops a reference to the body, returning the buffer to our
+// pool once the last has gone.
+func (s *sharedBody) release() {
+	if s.refs.Add(-1) == 0 {
+		putBodyBuffer(s.buf)
+	}
+}
+
+// reader returns a new reader of the body, which holds a reference
+// until it is closed.
+func (s *sharedBody) reader() io.ReadCloser {
+	return &bodyReader{Reader: bytes.NewReader(s.bytes()), done: s.hold()}
+}
+
+// bodyReader reads a sharedBody, releasing it when closed.
+type bodyReader struct {
+	*bytes.Reader
+	done func()
+}
+
+// Close releases our reference to the body.
+func (r *bodyReader) Close() error {
+	r.done()
+	return nil
+}
@@ -0,0 +1,160 @@
+// Testing, and benchmarking, of our buffer pools.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// Test that a shared body survives until every reader is closed.
+func TestSharedBody(t *testing.T) {
+	body, err := readSharedBody(strings.NewReader("Content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := body.reader()
+	body.release()
+
+	data, _ := io.ReadAll(reader)
+	if string(data) != "Content" {
+		t.Errorf("Unexpected content: %s", data)
+	}
+	_ = reader.Close()
+	_ = reader.Close()
+
+	if refs := body.refs.Load(); refs != 0 {
+		t.Errorf("Unexpected references: %d", refs)
+	}
+}
+
+// Test that the hash of a body is computed as it is read, whatever the
+// chunk size.
+func TestHashedBody(t *testing.T) {
+	content := strings.Repeat("Content", 10000)
+	expected := sha256.Sum256([]byte(content))
+
+	for _, size := range []int{0, 1, 7, 4096, len(content) * 2} {
+		body, sum, err := readHashedBody(strings.NewReader(content), size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum != expected {
+			t.Errorf("Unexpected hash with chunk size %d: %x", size, sum)
+		}
+		if string(body.bytes()) != content {
+			t.Errorf("Unexpected content with chunk size %d", size)
+		}
+		body.release()
+	}
+}
+
+// Test that the copy-buffer size may be changed.
+func TestCopyBufferSize(t *testing.T) {
+	defer setCopyBufferSize(0)
+
+	tests := map[int]int{
+		0:  copyChunkSize,
+		10: 10,
+		-1: copyChunkSize,
+	}
+
+	for size, expected := range tests {
+		setCopyBufferSize(size)
+
+		buf := getCopyBuffer()
+		if len(*buf) != expected {
+			t.Errorf("Unexpected buffer size for %d: %d", size, len(*buf))
+		}
+		putCopyBuffer(buf)
+	}
+}
+
+// Benchmark reading request-bodies, with and without our pool.
+func BenchmarkReadBody(b *testing.B) {
+	content := bytes.Repeat([]byte("x"), 256*1024)
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				body, _ := readSharedBody(bytes.NewReader(content))
+				body.release()
+			}
+		})
+	})
+
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				_, _ = io.ReadAll(bytes.NewReader(content))
+			}
+		})
+	})
+}
+
+// Benchmark hashing uploads: reading the body and then hashing it,
+// against hashing it as it is read with a number of chunk sizes.
+func BenchmarkHashBody(b *testing.B) {
+	content := bytes.Repeat([]byte("x"), 16*1024*1024)
+
+	b.Run("read-then-hash", func(b *testing.B) {
+		b.SetBytes(int64(len(content)))
+		for b.Loop() {
+			body, _ := readSharedBody(bytes.NewReader(content))
+			_ = sha256.Sum256(body.bytes())
+			body.release()
+		}
+	})
+
+	for _, size := range []int{4 * 1024, hashChunkSize, 1024 * 1024} {
+		b.Run(fmt.Sprintf("tee-%dKiB", size/1024), func(b *testing.B) {
+			b.SetBytes(int64(len(content)))
+			for b.Loop() {
+				body, _, _ := readHashedBody(bytes.NewReader(content), size)
+				body.release()
+			}
+		})
+	}
+}
+
+// Benchmark streaming responses to the client.
+func BenchmarkCopyWithDeadline(b *testing.B) {
+	content := bytes.Repeat([]byte("x"), 256*1024)
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, _ = copyWithDeadline(httptest.NewRecorder(), bytes.NewReader(content), 0)
+		}
+	})
+}
+
+// Benchmark uploads via the API-server, under concurrent load.
+func BenchmarkAPIUpload(b *testing.B) {
+	blob := fakeBlobServer(http.StatusOK)
+	defer blob.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("default", blob.URL)
+
+	content := strings.Repeat("x", 64*1024)
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(content))
+			APIUploadHandler(httptest.NewRecorder(), req)
+		}
+	})
+}
@@ -6,16 +6,19 @@ package main
 
 import (
 	"bytes"
+	"cmp"
 	"context"
-	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/skx/sos/libconfig"
@@ -26,8 +29,11 @@ import (
 var apiOptions apiServerCmd
 
 // setAPIOptions stores the API server options for use by handlers.
+//
+// The number of replicas may later be changed via `/admin/replicas`.
 func setAPIOptions(opts apiServerCmd) {
 	apiOptions = opts
+	replicaCount.Store(int64(max(opts.replicas, 0)))
 }
 
 // getAPIOptions returns the current API server options.
@@ -35,24 +41,46 @@ func getAPIOptions() apiServerCmd {
 	return apiOptions
 }
 
-// Start the upload/download servers running.
-func apiServer(options apiServerCmd) {
+// Start the upload/download servers running, returning an error if they
+// could not be started, or failed.
+func apiServer(options apiServerCmd) error {
+	//
+	// Our blob-servers, embedded or not, serve objects upon this path.
 	//
-	// If we received blob-servers on the command-line use them too.
+	if err := libconfig.SetBlobPath(cmp.Or(options.blobPath, libconfig.DefaultBlobPath)); err != nil {
+		return fmt.Errorf("invalid -blob-path: %w", err)
+	}
+
 	//
-	// NOTE: blob-servers added on the command-line are placed in the
-	// "default" group.
+	// If we're to store objects ourselves then the embedded
+	// blob-server is our only blob-server.
 	//
-	if options.blob != "" {
-		servers := strings.SplitSeq(options.blob, ",")
-		for entry := range servers {
-			libconfig.AddServer("default", entry)
+	if options.embeddedBlob != "" {
+		location, err := startEmbeddedBlob(options.embeddedBlob)
+		if err != nil {
+			return fmt.Errorf("failed to start embedded blob-server: %w", err)
+		}
+		options.blob = location
+	}
+
+	//
+	// Present our certificate to the blob-servers, if we have one.
+	//
+	if err := setClientTLS(options.clientCert, options.clientKey, options.blobCA); err != nil {
+		return fmt.Errorf("invalid TLS configuration: %w", err)
+	}
+
+	//
+	// Setup our blob-servers, preferring those given on the
+	// command-line, then the environment, then our config file(s).
+	//
+	// Those of our config directory, if any, are merged in.
+	//
+	libconfig.Configure(options.blob)
+	if options.configDir != "" {
+		if err := loadConfigDir(options.configDir); err != nil {
+			return fmt.Errorf("failed to read -config-dir: %w", err)
 		}
-	} else {
-		//
-		//  Initialize the servers from our config file(s).
-		//
-		libconfig.InitServers()
 	}
 
 	//
@@ -63,11 +91,57 @@ func apiServer(options apiServerCmd) {
 		for _, entry := range libconfig.Servers() {
 			GetLogger().Info("Blob server entry", "group", entry.Group, "location", entry.Location)
 		}
-		return
+		return nil
 	}
 
 	// Store options for later use by handlers
 	setAPIOptions(options)
+	setCopyBufferSize(options.copyBufferSize)
+	setServerConnections(options.serverConnections)
+	setMissingTTL(options.notFoundTTL)
+
+	//
+	// Record each object we store, if we've been asked to.
+	//
+	if options.manifest != "" {
+		file, err := openAuditLog(options.manifest)
+		if err != nil {
+			return fmt.Errorf("failed to open manifest: %w", err)
+		}
+		defer file.Close()
+		setUploadManifest(file)
+	}
+
+	//
+	// Configure the circuit-breaker, so that failing servers
+	// are temporarily avoided.
+	//
+	libconfig.SetBreaker(options.breakerThreshold, options.breakerCooldown)
+	libconfig.SetProbeClient(newBlobClient())
+
+	//
+	// Configure how the blob-servers are ordered.
+	//
+	if err := libconfig.SetSelection(options.selection); err != nil {
+		return fmt.Errorf("invalid -selection: %w", err)
+	}
+
+	if err := checkIDScheme(options.idScheme); err != nil {
+		return fmt.Errorf("invalid -id-scheme: %w", err)
+	}
+
+	if options.namespaceUploads {
+		if cmp.Or(options.idScheme, idSchemeSHA256) != idSchemeSHA256 {
+			return errors.New("-namespace-uploads requires -id-scheme " + idSchemeSHA256)
+		}
+		if len(namespaceSalt()) == 0 {
+			return errors.New("-namespace-uploads needs a secret, via -namespace-salt or $" + envNamespaceSalt)
+		}
+	}
+
+	if options.requireSignature && len(signingKey()) == 0 {
+		return errors.New("-require-signature needs a signing key, via -signing-key or $" + envSigningKey)
+	}
 
 	//
 	// Otherwise show a banner, then launch the server-threads.
@@ -89,72 +163,110 @@ func apiServer(options apiServerCmd) {
 	//
 	GetLogger().Info("Blob-servers:")
 	for _, entry := range libconfig.Servers() {
-		GetLogger().Info("Blob server", "group", entry.Group, "location", entry.Location)
+		GetLogger().Info("Blob server", "group", entry.Group, "location", entry.Location, "weight", entry.Weight)
+	}
+
+	//
+	// Optionally test that each of them is reachable.
+	//
+	if options.probeServers || options.requireAllServers {
+		unreachable := probeServers(libconfig.Servers())
+		if unreachable > 0 && options.requireAllServers {
+			return fmt.Errorf("refusing to start with %d unreachable blob-servers", unreachable)
+		}
 	}
 
 	//
 	// Create a route for uploading.
 	//
 	upRouter := mux.NewRouter()
-	upRouter.HandleFunc("/upload", APIUploadHandler).Methods("POST")
+	upRouter.HandleFunc("/upload", instrument("api-server", "/upload", APIUploadHandler)).Methods("POST")
+	upRouter.HandleFunc("/config", APIConfigHandler).Methods("GET")
+	upRouter.HandleFunc("/sign", APISignHandler).Methods("POST")
+	upRouter.HandleFunc("/admin/maintenance", APIMaintenanceHandler).Methods("POST")
+	upRouter.HandleFunc("/admin/replicas", APIReplicasHandler).Methods("POST")
+	upRouter.HandleFunc("/alive", HealthHandler).Methods("GET")
+	upRouter.HandleFunc("/", APIIndexHandler("upload", "POST /upload", "GET /config", "POST /sign", "GET /alive")).Methods("GET")
+	upRouter.HandleFunc("/favicon.ico", APIFaviconHandler).Methods("GET")
 	upRouter.PathPrefix("/").HandlerFunc(APIMissingHandler)
+	upRouter.Use(maintenanceMiddleware)
 
 	//
 	// Create a route for downloading.
 	//
 	downRouter := mux.NewRouter()
-	downRouter.HandleFunc("/fetch/{id}", APIDownloadHandler).Methods("GET")
-	downRouter.HandleFunc("/fetch/{id}", APIDownloadHandler).Methods("HEAD")
+	downRouter.HandleFunc("/fetch/{id}", instrument("api-server", "/fetch/{id}", APIDownloadHandler)).Methods("GET")
+	downRouter.HandleFunc("/fetch/{id}", instrument("api-server", "/fetch/{id}", APIExistsHandler)).Methods("HEAD")
+	downRouter.HandleFunc("/info/{id}", instrument("api-server", "/info/{id}", APIInfoHandler)).Methods("GET")
+	downRouter.HandleFunc("/alive", HealthHandler).Methods("GET")
+	downRouter.HandleFunc("/", APIIndexHandler("download", "GET /fetch/{id}", "HEAD /fetch/{id}", "GET /info/{id}", "GET /alive")).Methods("GET")
+	downRouter.HandleFunc("/favicon.ico", APIFaviconHandler).Methods("GET")
 	downRouter.PathPrefix("/").HandlerFunc(APIMissingHandler)
+	downRouter.Use(maintenanceMiddleware)
 
 	//
-	// The following code is a hack to allow us to run two distinct
-	// HTTP-servers on different ports.
+	// Run two distinct HTTP-servers, on different ports, shutting
+	// both down if either fails.
+	//
+	upServer := newServer(net.JoinHostPort(options.host, strconv.Itoa(options.uport)), upRouter,
+		options.readTimeout, options.writeTimeout, options.idleTimeout,
+		options.h2c, options.maxStreams, options.keepAlive)
+	downServer := newServer(net.JoinHostPort(options.host, strconv.Itoa(options.dport)), downRouter,
+		options.readTimeout, options.writeTimeout, options.idleTimeout,
+		options.h2c, options.maxStreams, options.keepAlive)
+	limitServer(upServer, options.maxHeaderBytes, options.maxURLLength)
+	limitServer(downServer, options.maxHeaderBytes, options.maxURLLength)
+
+	return serveAll(options.bindAttempts, options.bindBackoff, upServer, downServer)
+}
+
+// newUploadRequest builds the request which will POST the given body
+// to the blob-server at the specified location.
+//
+// Any X-headers present on the incoming request are propagated, along
+// with the `Content-Type`, `Content-Disposition` & `Cache-Control`
+// headers so that the blob-server may store them.
+//
+// If the digest of the body is known it is sent as the trailer
+// `X-Content-SHA256`, so that the blob-server may detect corruption.
+//
+// When uploads are namespaced the `X-Tenant` header is not propagated,
+// so that it is not revealed to those who download the object.
+func newUploadRequest(
+	ctx context.Context,
+	req *http.Request,
+	location string,
+	id string,
+	body *sharedBody,
+) *http.Request {
+	child, _ := http.NewRequestWithContext(ctx, http.MethodPost, libconfig.BlobURL(location, id), body.reader())
+	child.ContentLength = int64(len(body.bytes()))
+	child.GetBody = func() (io.ReadCloser, error) { return body.reader(), nil }
 	//
-	// It's almost sexy the way it worked the first time :)
+	// Trailers may only follow a chunked body, so the length is then
+	// left unset.
 	//
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		server := &http.Server{
-			Addr:         net.JoinHostPort(options.host, strconv.Itoa(options.uport)),
-			Handler:      upRouter,
-			ReadTimeout:  serverReadTimeout,
-			WriteTimeout: serverWriteTimeout,
-			IdleTimeout:  serverIdleTimeout,
-		}
-		err := server.ListenAndServe()
-		if err != nil {
-			panic(err)
+	if body.digest != "" {
+		child.ContentLength = -1
+		child.Trailer = http.Header{contentSHA256: {body.digest}}
+	}
+
+	for header, value := range req.Header {
+		if header == tenantHeader && getAPIOptions().namespaceUploads {
+			continue
 		}
-		wg.Done()
-	}()
-	wg.Add(1)
-	go func() {
-		server := &http.Server{
-			Addr:         net.JoinHostPort(options.host, strconv.Itoa(options.dport)),
-			Handler:      downRouter,
-			ReadTimeout:  serverReadTimeout,
-			WriteTimeout: serverWriteTimeout,
-			IdleTimeout:  serverIdleTimeout,
+		if strings.HasPrefix(header, "X-") {
+			child.Header[header] = slices.Clone(value)
 		}
-		err := server.ListenAndServe()
-		if err != nil {
-			panic(err)
+	}
+	for _, header := range []string{"Content-Type", "Content-Disposition", "Cache-Control", "Expires"} {
+		if value := req.Header.Get(header); value != "" {
+			child.Header.Set(header, value)
 		}
-		wg.Done()
-	}()
-	wg.Wait()
-}
-
-// This is a helper for allowing us to consume a HTTP-body more than once.
-type myReader struct {
-	*bytes.Buffer
+	}
+	return child
 }
 
-// So that it implements the io.ReadCloser interface.
-func (m myReader) Close() error { return nil }
-
 // APIUploadHandler handles uploads to the API server.
 //
 // This should attempt to upload against the blob-servers and return
@@ -168,28 +280,75 @@ func (m myReader) Close() error { return nil }
 //
 //   - There are N defined groups.
 //
-// Both cases are handled by the call to OrderedServers() which
+// Both cases are handled by the call to UploadServersFor() which
 // returns the known blob-servers in a suitable order to minimize
-// lookups.  See `SCALING.md` for more details.
+// lookups, and to spread uploads between the members of a single
+// group - or by their position upon a hash-ring, if the API-server
+// was launched with `-selection ring`.  See `SCALING.md` for more
+// details.
 func APIUploadHandler(res http.ResponseWriter, req *http.Request) {
 	//
 	// We create a new buffer to hold the request-body.
 	//
-	buf, _ := io.ReadAll(req.Body)
+	// A client which aborts part-way through must not result in a
+	// truncated object being stored, nor should an empty body unless
+	// we've been told to allow that.
+	//
+	if req.Body == nil {
+		writeJSONError(res, http.StatusBadRequest, "missing body")
+		return
+	}
 
 	//
-	// Create a copy of the buffer, so that we can consume
-	// it initially to hash the data.
+	// Refuse excessive meta-data, rather than passing it on to be
+	// refused by each blob-server in turn.
 	//
-	rdr1 := myReader{bytes.NewBuffer(buf)}
+	if err := checkMetaHeaders(req.Header, getAPIOptions().maxMetaHeaders, getAPIOptions().maxMetaBytes); err != nil {
+		writeJSONError(res, http.StatusRequestHeaderFieldsTooLarge, err.Error())
+		return
+	}
 
 	//
-	// Get the SHA256 hash of the uploaded data.
+	// The body is read into a pooled buffer, which is shared by
+	// each of the requests we make to the blob-servers.
 	//
-	hasher := sha256.New()
-	b, _ := io.ReadAll(rdr1)
-	hasher.Write(b)
-	hash := hasher.Sum(nil)
+	// Get the SHA256 hash of the uploaded data as we do so.
+	//
+	limitUploadRate(res, req, getAPIOptions().minUploadRate, getAPIOptions().readTimeout)
+	body, hash, err := readHashedBody(req.Body, getAPIOptions().hashChunkSize)
+	if errors.Is(err, errUploadTooSlow) {
+		writeJSONError(res, http.StatusRequestTimeout, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(res, http.StatusBadRequest, "failed to read body")
+		return
+	}
+	defer body.release()
+
+	if len(body.bytes()) == 0 && !getAPIOptions().allowEmpty {
+		writeJSONError(res, http.StatusBadRequest, "empty body")
+		return
+	}
+
+	//
+	// Objects are named by their hash, unless we've been told to
+	// name each upload afresh.
+	//
+	id := newObjectID(getAPIOptions().idScheme, hash)
+	if tenant := req.Header.Get(tenantHeader); tenant != "" && getAPIOptions().namespaceUploads {
+		id = tenantObjectID(namespaceSalt(), tenant, hash)
+	}
+	forgetMissing(id)
+
+	//
+	// If we've been configured to write several replicas at once
+	// then we fan the upload out concurrently, and wait for a quorum.
+	//
+	if currentReplicas() > 0 {
+		uploadWithQuorum(res, req, body, id)
+		return
+	}
 
 	//
 	// Now we're going to attempt to re-POST the uploaded
@@ -198,72 +357,140 @@ func APIUploadHandler(res http.ResponseWriter, req *http.Request) {
 	// We try each blob-server in turn, and if/when we receive
 	// a successful result we'll return it to the caller.
 	//
-	for _, s := range libconfig.OrderedServers() {
+	var failures []uploadFailure
+
+	for _, s := range libconfig.UploadServersFor(id) {
 		//
-		// Replace the request body with the (second) copy we made.
+		// Build up a new request, to the blob-server, with context.
 		//
-		rdr2 := myReader{bytes.NewBuffer(buf)}
-		req.Body = rdr2
+		child := newUploadRequest(req.Context(), req, s.Location, id, body)
 
 		//
-		// This is where we'll POST to.
+		// Wait for a free connection to the blob-server, if
+		// they're limited.
 		//
-		url := fmt.Sprintf("%s%s%x", s.Location, "/blob/", hash)
+		release, err := acquireServer(req.Context(), s.Location)
+		if err != nil {
+			failures = append(failures, uploadFailure{Server: s.Location, Error: err.Error()})
+			continue
+		}
 
 		//
-		// Build up a new request with context.
+		// Send the request.
 		//
-		child, _ := http.NewRequestWithContext(req.Context(), http.MethodPost, url, req.Body)
+		client := newBlobClient()
+		start := time.Now()
+		r, err := client.Do(child)
+		recordLatency(s.Location, child.Method, start, getAPIOptions().verbose)
+		if r != nil {
+			defer r.Body.Close()
+		}
+		recordOutcome(s.Location, r, err)
+
+		event := ObservedEvent{Service: "api-server", Server: s.Location, ID: id, Size: int64(len(body.bytes()))}
 
 		//
-		// Propagate any incoming X-headers
+		// If there was an error we'll record it, and move on.
 		//
-		for header, value := range req.Header {
-			if strings.HasPrefix(header, "X-") {
-				child.Header.Set(header, value[0])
-			}
+		if err != nil {
+			release()
+			observeUpload(event, start, err)
+			failures = append(failures, uploadFailure{Server: s.Location, Error: err.Error()})
+			continue
 		}
+		event.Status = r.StatusCode
 
 		//
-		// Send the request.
+		// If the blob-server refused the upload we record why,
+		// and move on.
 		//
-		client := &http.Client{}
-		r, err := client.Do(child)
-		if r != nil {
-			defer r.Body.Close()
+		if r.StatusCode != http.StatusOK {
+			reply, _ := io.ReadAll(r.Body)
+			release()
+			observeUpload(event, start, fmt.Errorf("status-code %d", r.StatusCode))
+			failures = append(failures, uploadFailure{
+				Server: s.Location,
+				Status: r.StatusCode,
+				Error:  truncateError(string(reply)),
+			})
+			continue
 		}
 
 		//
-		// If there was no error we're good.
+		// The blob-server accepted the upload, so the object is
+		// stored even if we fail to read its reply - for example
+		// if the connection was reset after the write committed.
+		// In that case we answer on its behalf.
 		//
-		if err == nil {
-			//
-			// We read the reply we received from the
-			// blob-server and return it to the caller.
-			//
-			response, _ := io.ReadAll(r.Body)
+		response, readErr := io.ReadAll(r.Body)
+		release()
+		if readErr != nil {
+			GetLogger().Warn("Upload stored, but the reply was unreadable", "id", id, "server", s.Location, "error", readErr)
+			response = storedReply(id, len(body.bytes()))
+		}
 
-			if response != nil {
-				if _, writeErr := res.Write(response); writeErr != nil {
-					panic(writeErr)
-				}
-				return
-			}
+		//
+		// Otherwise we return the reply to the caller.
+		//
+		observeUpload(event, start, nil)
+		recordUpload(id, int64(len(body.bytes())))
+		if _, writeErr := res.Write(response); writeErr != nil {
+			panic(writeErr)
 		}
+		return
 	}
 
 	//
 	// If we reach here we've attempted our upload on every
 	// known blob-server and none accepted it.
 	//
-	// Let the caller know.
+	// Let the caller know, and if we're being verbose tell them
+	// why each blob-server refused.
 	//
+	out := uploadFailedResponse{Error: "upload failed"}
+	if getAPIOptions().verbose {
+		out.Failures = failures
+	}
+	encoded, _ := json.Marshal(out)
+
+	res.Header().Set("Content-Type", "application/json")
 	res.WriteHeader(http.StatusInternalServerError)
-	if _, err := res.Write([]byte("{\"error\":\"upload failed\"}")); err != nil {
+	if _, err := res.Write(encoded); err != nil {
 		panic(err)
 	}
 }
 
+// maxErrorLength is the longest error-body from a blob-server we'll
+// return to our caller.
+const maxErrorLength = 256
+
+// truncateError trims an error-body received from a blob-server, so
+// that it is suitable for returning to our caller.
+func truncateError(body string) string {
+	body = strings.TrimSpace(body)
+	if len(body) > maxErrorLength {
+		body = body[:maxErrorLength] + "..."
+	}
+	return body
+}
+
+// recordOutcome updates the circuit-breaker with the result of a request
+// made to the given blob-server.
+func recordOutcome(location string, response *http.Response, err error) {
+	//
+	// Requests we cancelled ourselves say nothing about the server.
+	//
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	if err != nil || response.StatusCode >= http.StatusInternalServerError {
+		libconfig.RecordFailure(location)
+		return
+	}
+	libconfig.RecordSuccess(location)
+}
+
 // logDownloadError logs error details when verbose mode is enabled.
 func logDownloadError(err error, response *http.Response) {
 	if !getAPIOptions().verbose {
@@ -278,63 +505,143 @@ func logDownloadError(err error, response *http.Response) {
 }
 
 // handleSuccessfulDownload processes a successful response from a blob server.
-func handleSuccessfulDownload(res http.ResponseWriter, req *http.Request, response *http.Response) bool {
-	body, _ := io.ReadAll(response.Body)
-
-	if body == nil {
-		return false
-	}
-
-	if getAPIOptions().verbose {
-		GetLogger().Info("Found data", "bytes", len(body))
+//
+// The body is streamed through to the client untouched, so if the
+// blob-server sent compressed content it stays compressed.
+//
+// If the API-server was launched with `-blob-server-header` the location
+// of the blob-server which answered is sent as `X-Blob-Server`, so that
+// inconsistent replicas may be tracked down.
+//
+// The number of bytes sent is returned.
+func handleSuccessfulDownload(res http.ResponseWriter, req *http.Request, server libconfig.BlobServer, response *http.Response) int64 {
+	// Copy X-Headers from the response
+	for header, value := range response.Header {
+		if strings.HasPrefix(header, "X-") {
+			res.Header()[header] = slices.Clone(value)
+		}
 	}
 
-	// Handle HEAD requests
-	if req.Method == http.MethodHead {
-		res.Header().Set("Connection", "close")
-		res.WriteHeader(http.StatusOK)
-		return true
+	// Name the blob-server, replacing any stored header of the same name
+	if getAPIOptions().blobServerHeader {
+		res.Header().Set("X-Blob-Server", server.Location)
 	}
 
-	// Copy X-Headers from the response
-	for header, value := range response.Header {
-		if strings.HasPrefix(header, "X-") {
-			res.Header().Set(header, value[0])
+	// Copy the content, caching & encoding-related headers too
+	for _, header := range []string{"Content-Type", "Content-Disposition", "Cache-Control", "ETag", "Last-Modified", "Expires", "Content-Encoding", "Vary"} {
+		if value := response.Header.Get(header); value != "" {
+			res.Header().Set(header, value)
 		}
 	}
 
-	// Send back the body
-	if _, copyErr := io.Copy(res, bytes.NewReader(body)); copyErr != nil {
+	// Send back the body, allowing as long as it takes providing
+	// the client keeps reading.
+	copied, copyErr := copyWithDeadline(res, response.Body, getAPIOptions().writeTimeout)
+	if copyErr != nil {
 		panic(copyErr)
 	}
-	return true
+
+	if getAPIOptions().verbose {
+		GetLogger().Info("Found data", "bytes", copied)
+	}
+	return copied
 }
 
-// tryDownloadFromServer attempts to download from a single blob server.
-func tryDownloadFromServer(server libconfig.BlobServer, id string, res http.ResponseWriter, req *http.Request) bool {
+// fetchFromServer requests the given object from a single blob-server,
+// returning the response only if it was successful, in which case the
+// caller must close its body.  Otherwise it returns true if the server
+// reported that it does not hold the object.
+//
+// Requests which we cancelled ourselves are neither logged nor observed.
+func fetchFromServer(ctx context.Context, server libconfig.BlobServer, id string, req *http.Request) (*http.Response, time.Time, bool) {
 	if getAPIOptions().verbose {
-		GetLogger().Info("Attempting retrieval", "url", fmt.Sprintf("%s%s%s", server.Location, "/blob/", id))
+		GetLogger().Info("Attempting retrieval", "url", libconfig.BlobURL(server.Location, id))
 	}
 
-	ctx := context.Background()
 	request, _ := http.NewRequestWithContext(
 		ctx,
 		http.MethodGet,
-		fmt.Sprintf("%s%s%s", server.Location, "/blob/", id),
+		libconfig.BlobURL(server.Location, id),
 		nil,
 	)
-	client := &http.Client{}
+
+	//
+	// Forward the client's Accept-Encoding.  Setting it explicitly
+	// means the transport will not transparently decompress the
+	// response, so any compression survives the hop to the client.
+	//
+	if encoding := req.Header.Get("Accept-Encoding"); encoding != "" {
+		request.Header.Set("Accept-Encoding", encoding)
+	}
+
+	client := newBlobClient()
+	start := time.Now()
 	response, err := client.Do(request)
-	if response != nil {
-		defer response.Body.Close()
+	recordLatency(server.Location, request.Method, start, getAPIOptions().verbose)
+	recordOutcome(server.Location, response, err)
+
+	if errors.Is(err, context.Canceled) {
+		return nil, start, false
 	}
 
-	if err != nil || response == nil || response.StatusCode != http.StatusOK {
+	//
+	// An object missing from one server is not an error, since it
+	// is expected to be found upon another.
+	//
+	event := ObservedEvent{Service: "api-server", Server: server.Location, ID: id}
+	if err != nil {
+		observeDownload(event, start, err)
+	} else if response.StatusCode >= http.StatusInternalServerError {
+		event.Status = response.StatusCode
+		observeDownload(event, start, fmt.Errorf("status-code %d", response.StatusCode))
+	}
+
+	if err != nil || response.StatusCode != http.StatusOK {
 		logDownloadError(err, response)
-		return false
+		if response != nil {
+			_ = response.Body.Close()
+			return nil, start, response.StatusCode == http.StatusNotFound
+		}
+		return nil, start, false
+	}
+	return response, start, false
+}
+
+// serveDownload sends the successful response of the given blob-server
+// to the client, and closes it.
+//
+// The object is then copied to each of the servers to repair, if any.
+func serveDownload(server libconfig.BlobServer, id string, response *http.Response, start time.Time, res http.ResponseWriter, req *http.Request, repair []libconfig.BlobServer) {
+	defer response.Body.Close()
+
+	//
+	// Objects held only in another group may be copied into ours,
+	// and those missing from members of their group copied back
+	// to them, as they're sent to the client.
+	//
+	capture := newPullThroughCapture(server, response)
+	if len(repair) > 0 {
+		if capture == nil {
+			capture = newCapture(response)
+		}
+		if capture != nil {
+			capture.repair = repair
+		}
+	}
+	if capture != nil {
+		response.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(response.Body, capture), response.Body}
 	}
 
-	return handleSuccessfulDownload(res, req, response)
+	event := ObservedEvent{Service: "api-server", Server: server.Location, ID: id, Status: response.StatusCode}
+	event.Size = handleSuccessfulDownload(res, req, server, response)
+	observeDownload(event, start, nil)
+
+	if capture != nil {
+		capture.store(id, response.Header)
+	}
 }
 
 // APIDownloadHandler handles downloads from the API server.
@@ -350,9 +657,9 @@ func tryDownloadFromServer(server libconfig.BlobServer, id string, res http.Resp
 //
 //   - There are N defined groups.
 //
-// Both cases are handled by the call to OrderedServers() which
-// returns the known blob-servers in a suitable order to minimize
-// lookups.  See `SCALING.md` for more details.
+// Both cases are handled by the call to ServersFor() which returns
+// the known blob-servers in a suitable order to minimize lookups.
+// See `SCALING.md` for more details.
 func APIDownloadHandler(res http.ResponseWriter, req *http.Request) {
 	// Extract ID from request
 	vars := mux.Vars(req)
@@ -362,23 +669,191 @@ func APIDownloadHandler(res http.ResponseWriter, req *http.Request) {
 	extension := filepath.Ext(id)
 	id = id[0 : len(id)-len(extension)]
 
-	// Try each blob-server in turn
-	for _, server := range libconfig.OrderedServers() {
-		if tryDownloadFromServer(server, id, res, req) {
+	// Refuse expired, or forged, signed URLs
+	if !verifySignature(req, id) {
+		writeJSONError(res, http.StatusForbidden, "invalid or expired signature")
+		return
+	}
+
+	// Fail quickly if every blob-server recently reported it missing
+	if isMissing(id) {
+		res.Header().Set("Connection", "close")
+		writeJSONError(res, http.StatusNotFound, "not found")
+		return
+	}
+
+	// Try each blob-server in turn, or several at once
+	servers := libconfig.ServersFor(id)
+	var missing []libconfig.BlobServer
+	if parallelism := getAPIOptions().downloadParallelism; parallelism > 1 {
+		var served bool
+		if served, missing = raceDownload(servers, id, res, req, parallelism); served {
 			return
 		}
+	} else {
+		for _, server := range servers {
+			response, start, absent := fetchFromServer(context.Background(), server, id, req)
+			if response != nil {
+				serveDownload(server, id, response, start, res, req, repairTargets(server, missing))
+				return
+			}
+			if absent {
+				missing = append(missing, server)
+			}
+		}
 	}
 
-	// If we reach here, no server succeeded
+	// If we reach here, no server succeeded, and if each of them
+	// reported the object missing we remember that.
+	if len(servers) > 0 && len(missing) == len(servers) {
+		rememberMissing(id)
+	}
 	res.Header().Set("Connection", "close")
-	res.WriteHeader(http.StatusNotFound)
+	writeJSONError(res, http.StatusNotFound, "not found")
+}
+
+// APIInfoHandler returns the meta-data of an object, without its content.
+//
+// Like APIDownloadHandler this tries each blob-server in turn, returning
+// the first successful response.
+func APIInfoHandler(res http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+
+	// Refuse expired, or forged, signed URLs
+	if !verifySignature(req, id) {
+		writeJSONError(res, http.StatusForbidden, "invalid or expired signature")
+		return
+	}
+
+	for _, server := range libconfig.ServersFor(id) {
+		if tryInfoFromServer(server, id, res, req) {
+			return
+		}
+	}
+
+	writeJSONError(res, http.StatusNotFound, "not found")
+}
+
+// tryInfoFromServer attempts to fetch an object's meta-data from a single
+// blob server.
+func tryInfoFromServer(server libconfig.BlobServer, id string, res http.ResponseWriter, req *http.Request) bool {
+	request, _ := http.NewRequestWithContext(
+		req.Context(),
+		http.MethodGet,
+		libconfig.Endpoint(server.Location, "/info/"+id),
+		nil,
+	)
+	client := newBlobClient()
+	start := time.Now()
+	response, err := client.Do(request)
+	recordLatency(server.Location, request.Method, start, getAPIOptions().verbose)
+	if response != nil {
+		defer response.Body.Close()
+	}
+	recordOutcome(server.Location, response, err)
+
+	if err != nil || response == nil || response.StatusCode != http.StatusOK {
+		logDownloadError(err, response)
+		return false
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	if _, copyErr := io.Copy(res, response.Body); copyErr != nil {
+		panic(copyErr)
+	}
+	return true
+}
+
+// configGroup describes a group of blob-servers, and its members, as
+// returned by our `/config` end-point.
+type configGroup struct {
+	Group   string         `json:"group"`
+	Members []configMember `json:"members"`
+}
+
+// configMember describes a single blob-server within a configGroup.
+type configMember struct {
+	Location string `json:"location"`
+	Weight   int    `json:"weight"`
+}
+
+// apiConfig is the document returned by our `/config` end-point.
+type apiConfig struct {
+	Replicas int           `json:"replicas"`
+	Groups   []configGroup `json:"groups"`
+}
+
+// UnmarshalJSON decodes our configuration, also accepting the bare list
+// of groups returned by older API-servers.
+func (c *apiConfig) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		*c = apiConfig{}
+		return json.Unmarshal(trimmed, &c.Groups)
+	}
+
+	type plain apiConfig
+	return json.Unmarshal(data, (*plain)(c))
+}
+
+// APIConfigHandler returns the blob-servers we're using, grouped, so
+// that other tools may share our topology.
+//
+// This is served upon the upload-port, since it is an internal detail
+// which shouldn't be visible to the world.
+//
+// The number of replicas written by each upload is reported too.
+func APIConfigHandler(res http.ResponseWriter, _ *http.Request) {
+	config := apiConfig{Replicas: currentReplicas(), Groups: []configGroup{}}
+	for _, group := range libconfig.Groups() {
+		entry := configGroup{Group: group, Members: []configMember{}}
+		for _, server := range libconfig.GroupMembers(group) {
+			entry.Members = append(entry.Members, configMember{Location: server.Location, Weight: server.Weight})
+		}
+		config.Groups = append(config.Groups, entry)
+	}
+
+	body, _ := json.Marshal(config)
+	res.Header().Set("Content-Type", "application/json")
+	_, _ = res.Write(body)
+}
+
+// apiIndex is the JSON body returned by the root of each API-server port.
+type apiIndex struct {
+	Service   string   `json:"service"`
+	Role      string   `json:"role"`
+	Endpoints []string `json:"endpoints"`
+}
+
+// APIIndexHandler returns a handler which describes the service, and the
+// given endpoints, so that browsers & probes which request `/` receive
+// something more useful than a 404.
+func APIIndexHandler(role string, endpoints ...string) http.HandlerFunc {
+	return func(res http.ResponseWriter, _ *http.Request) {
+		body, _ := json.Marshal(apiIndex{
+			Service:   getAPIOptions().serviceName,
+			Role:      role,
+			Endpoints: endpoints,
+		})
+
+		res.Header().Set("Content-Type", "application/json")
+		_, _ = res.Write(body)
+	}
+}
+
+// APIFaviconHandler answers the requests browsers make for an icon, which
+// we don't have, without filling the logs with 404s.
+func APIFaviconHandler(res http.ResponseWriter, _ *http.Request) {
+	res.WriteHeader(http.StatusNoContent)
 }
 
 // APIMissingHandler is a fall-back handler for all requests which are
 // neither upload nor download.
 func APIMissingHandler(res http.ResponseWriter, _ *http.Request) {
-	res.WriteHeader(http.StatusNotFound)
-	if _, err := res.Write([]byte("Invalid method or location.")); err != nil {
-		panic(err)
-	}
+	writeJSONError(res, http.StatusNotFound, "invalid method or location")
+}
+
+// storedReply returns the reply a blob-server makes to a successful
+// upload, for when we cannot read the one it sent.
+func storedReply(id string, size int) []byte {
+	return fmt.Appendf(nil, "{\"id\":\"%s\",\"status\":\"OK\",\"size\":%d}", id, size)
 }
@@ -0,0 +1,189 @@
+//
+// Administration of the API-server.
+//
+// If the API-server is launched with an admin-token, via `-admin-token`
+// or the SOS_ADMIN_TOKEN environment variable, then requests bearing it
+// may change the state of the running server:
+//
+//	POST /admin/maintenance?enabled=true
+//	POST /admin/replicas {"count":3}
+//
+// While in maintenance mode every request, other than those to `/alive`
+// and `/admin`, is refused with a 503 and a `Retry-After` header, so that
+// load-balancers drain traffic away ahead of a deploy.
+//
+// The number of replicas written by each upload, initially `-replicas`,
+// may be changed without a restart, and is reported by `/config`.
+//
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// envAdminToken is the environment variable from which the admin-token
+// is read, if the flag was not given.
+const envAdminToken = "SOS_ADMIN_TOKEN"
+
+// defaultMaintenanceRetry is the default Retry-After we send while in
+// maintenance mode.
+const defaultMaintenanceRetry = 5 * time.Minute
+
+// defaultMaintenanceMessage is the default error we return while in
+// maintenance mode.
+const defaultMaintenanceMessage = "down for maintenance"
+
+// maintenance records whether we're in maintenance mode.
+var maintenance atomic.Bool
+
+// maintenanceState is the body returned by our `/admin/maintenance`
+// end-point.
+type maintenanceState struct {
+	Maintenance bool   `json:"maintenance"`
+	Message     string `json:"message"`
+}
+
+// adminToken returns the token which authorizes admin requests, if any.
+func adminToken() []byte {
+	if token := getAPIOptions().adminToken; token != "" {
+		return []byte(token)
+	}
+	return []byte(os.Getenv(envAdminToken))
+}
+
+// authorizeAdmin tests that the request bears our admin-token, reporting
+// an error to the client if it does not.
+func authorizeAdmin(res http.ResponseWriter, req *http.Request) bool {
+	token := adminToken()
+	if len(token) == 0 {
+		writeJSONError(res, http.StatusNotImplemented, "administration is not enabled")
+		return false
+	}
+
+	given, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(given), token) != 1 {
+		res.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSONError(res, http.StatusUnauthorized, "invalid admin token")
+		return false
+	}
+	return true
+}
+
+// APIMaintenanceHandler enables, or disables, maintenance mode.
+//
+// This is called with requests like `POST /admin/maintenance?enabled=true`,
+// without the parameter the mode is toggled.
+func APIMaintenanceHandler(res http.ResponseWriter, req *http.Request) {
+	if !authorizeAdmin(res, req) {
+		return
+	}
+
+	enabled := !maintenance.Load()
+	if value := req.URL.Query().Get("enabled"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			writeJSONError(res, http.StatusBadRequest, "invalid value for enabled")
+			return
+		}
+		enabled = parsed
+	}
+
+	if maintenance.Swap(enabled) != enabled {
+		GetLogger().Warn("Maintenance mode changed", "maintenance", enabled)
+	}
+
+	body, _ := json.Marshal(maintenanceState{Maintenance: enabled, Message: getAPIOptions().maintenanceMessage})
+	res.Header().Set("Content-Type", "application/json")
+	_, _ = res.Write(body)
+}
+
+// maintenanceMiddleware refuses requests while we're in maintenance mode,
+// other than those to `/alive` and `/admin`.
+func maintenanceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !maintenance.Load() || req.URL.Path == "/alive" || strings.HasPrefix(req.URL.Path, "/admin/") {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		retry := getAPIOptions().maintenanceRetry
+		if retry <= 0 {
+			retry = defaultMaintenanceRetry
+		}
+		message := getAPIOptions().maintenanceMessage
+		if message == "" {
+			message = defaultMaintenanceMessage
+		}
+
+		res.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())))
+		writeJSONError(res, http.StatusServiceUnavailable, message)
+	})
+}
+
+// replicaCount is the number of replicas written by each upload, zero
+// meaning that the blob-servers are tried in turn.
+var replicaCount atomic.Int64
+
+// currentReplicas returns the number of replicas written by each upload.
+func currentReplicas() int {
+	return int(replicaCount.Load())
+}
+
+// replicasRequest is the body of a request to our `/admin/replicas`
+// end-point.
+type replicasRequest struct {
+	Count *int `json:"count"`
+}
+
+// replicasState is the body returned by our `/admin/replicas` end-point.
+type replicasState struct {
+	Replicas int `json:"replicas"`
+	Quorum   int `json:"quorum"`
+}
+
+// APIReplicasHandler changes the number of replicas written by each
+// upload.
+//
+// This is called with requests like `POST /admin/replicas` and a body of
+// `{"count":3}`.  The count may not exceed the number of blob-servers
+// which are currently available to receive uploads.
+func APIReplicasHandler(res http.ResponseWriter, req *http.Request) {
+	if !authorizeAdmin(res, req) {
+		return
+	}
+
+	var body replicasRequest
+	if err := json.NewDecoder(http.MaxBytesReader(res, req.Body, 1024)).Decode(&body); err != nil || body.Count == nil {
+		writeJSONError(res, http.StatusBadRequest, "expected a body of {\"count\":N}")
+		return
+	}
+
+	count := *body.Count
+	if servers := len(libconfig.OrderedServers()); count < 0 || count > servers {
+		writeJSONError(res, http.StatusBadRequest, fmt.Sprintf("invalid count %d, expected 0-%d", count, servers))
+		return
+	}
+
+	if previous := replicaCount.Swap(int64(count)); previous != int64(count) {
+		GetLogger().Warn("Replicas changed", "replicas", count, "previous", previous)
+	}
+
+	state := replicasState{Replicas: count}
+	if count > 0 {
+		state.Quorum = writeQuorum(count, getAPIOptions().quorum)
+	}
+	encoded, _ := json.Marshal(state)
+	res.Header().Set("Content-Type", "application/json")
+	_, _ = res.Write(encoded)
+}
@@ -0,0 +1,151 @@
+// Test the administration of the API-server.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/skx/sos/libconfig"
+)
+
+// Test that maintenance mode requires the admin-token, and refuses other
+// requests while enabled.
+func TestAPIMaintenance(t *testing.T) {
+	defer maintenance.Store(false)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/maintenance", APIMaintenanceHandler).Methods("POST")
+	router.HandleFunc("/alive", HealthHandler).Methods("GET")
+	router.PathPrefix("/").HandlerFunc(APIMissingHandler)
+	router.Use(maintenanceMiddleware)
+
+	request := func(method string, path string, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	setAPIOptions(apiServerCmd{})
+	if status := request(http.MethodPost, "/admin/maintenance", "secret").Code; status != http.StatusNotImplemented {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+
+	setAPIOptions(apiServerCmd{adminToken: "secret"})
+	defer setAPIOptions(apiServerCmd{})
+
+	for _, token := range []string{"", "wrong"} {
+		if status := request(http.MethodPost, "/admin/maintenance?enabled=true", token).Code; status != http.StatusUnauthorized {
+			t.Errorf("Unexpected status-code: %v", status)
+		}
+	}
+	if maintenance.Load() {
+		t.Fatalf("Maintenance mode enabled without the token")
+	}
+
+	if status := request(http.MethodPost, "/admin/maintenance?enabled=true", "secret").Code; status != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+
+	rr := request(http.MethodGet, "/fetch/abc", "")
+	if status := rr.Code; status != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+	if retry := rr.Header().Get("Retry-After"); retry != "300" {
+		t.Errorf("Unexpected Retry-After: %s", retry)
+	}
+	if status := request(http.MethodGet, "/alive", "").Code; status != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+
+	// Toggle it off again.
+	if status := request(http.MethodPost, "/admin/maintenance", "secret").Code; status != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+	if status := request(http.MethodGet, "/fetch/abc", "").Code; status != http.StatusNotFound {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+}
+
+// Test that the number of replicas may be changed at runtime, within the
+// number of blob-servers, and is reported by /config.
+func TestAPIReplicas(t *testing.T) {
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("default", "http://localhost:4001")
+	libconfig.AddServer("default", "http://localhost:4002")
+	libconfig.AddServer("default", "http://localhost:4003")
+
+	setAPIOptions(apiServerCmd{adminToken: "secret", replicas: 2})
+	defer setAPIOptions(apiServerCmd{})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/replicas", APIReplicasHandler).Methods("POST")
+	router.HandleFunc("/config", APIConfigHandler).Methods("GET")
+
+	request := func(body string, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/replicas", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		body     string
+		token    string
+		expected int
+		replicas int
+	}{
+		{`{"count":3}`, "", http.StatusUnauthorized, 2},
+		{`{"count":4}`, "secret", http.StatusBadRequest, 2},
+		{`{"count":-1}`, "secret", http.StatusBadRequest, 2},
+		{`{}`, "secret", http.StatusBadRequest, 2},
+		{`three`, "secret", http.StatusBadRequest, 2},
+		{`{"count":3}`, "secret", http.StatusOK, 3},
+		{`{"count":0}`, "secret", http.StatusOK, 0},
+	}
+
+	for _, test := range tests {
+		rr := request(test.body, test.token)
+		if rr.Code != test.expected {
+			t.Errorf("Unexpected status-code for %s: %v", test.body, rr.Code)
+		}
+		if currentReplicas() != test.replicas {
+			t.Errorf("Unexpected replicas after %s: %d", test.body, currentReplicas())
+		}
+	}
+
+	request(`{"count":3}`, "secret")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/config", nil))
+
+	var config apiConfig
+	if err := json.Unmarshal(rr.Body.Bytes(), &config); err != nil || config.Replicas != 3 {
+		t.Errorf("Unexpected configuration: %v %v", config, err)
+	}
+
+	//
+	// Servers which are failing are not counted.
+	//
+	libconfig.SetBreaker(1, time.Hour)
+	defer libconfig.SetBreaker(0, 0)
+	libconfig.RecordFailure("http://localhost:4003")
+
+	if rr = request(`{"count":3}`, "secret"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected status-code with a failing server: %v", rr.Code)
+	}
+	if rr = request(`{"count":2}`, "secret"); rr.Code != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", rr.Code)
+	}
+}
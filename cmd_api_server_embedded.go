@@ -0,0 +1,167 @@
+//
+// An embedded blob-server for the API-server.
+//
+// For local development, and small single-node deployments, running an
+// API-server and a separate blob-server is more than is required.  If
+// the API-server is launched with `-embedded-blob DIR` it stores objects
+// in that directory itself, via the usual blob-server handlers.
+//
+// The embedded blob-server is addressed as `sos-embedded://blob`, and
+// requests to it are passed directly to its handler rather than being
+// sent over the network.
+//
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// embeddedScheme is the URL scheme of our embedded blob-server.
+const embeddedScheme = "sos-embedded"
+
+// embeddedLocation is the location of our embedded blob-server.
+const embeddedLocation = embeddedScheme + "://blob"
+
+// embedded is the transport of our embedded blob-server.
+var embedded = &handlerTransport{}
+
+// embeddedOnce ensures that our scheme is only registered once, since
+// the transport refuses to register it again.
+var embeddedOnce sync.Once
+
+// handlerTransport is a RoundTripper which passes requests to a handler,
+// within our process, rather than sending them over the network.
+type handlerTransport struct {
+	handler http.Handler
+}
+
+// RoundTrip implements http.RoundTripper.
+//
+// The handler runs concurrently, so that its response is streamed to the
+// caller as it is written rather than being buffered.
+func (t *handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	server := req.Clone(req.Context())
+	if server.Body == nil {
+		server.Body = http.NoBody
+	}
+	server.RequestURI = req.URL.RequestURI()
+
+	reader, writer := io.Pipe()
+	res := &pipeResponseWriter{header: http.Header{}, body: writer, ready: make(chan struct{})}
+
+	go func() {
+		//
+		// Our handlers panic if the client goes away, which the
+		// server would usually recover from, so we do too.
+		//
+		defer func() {
+			if r := recover(); r != nil {
+				res.WriteHeader(http.StatusInternalServerError)
+				_ = writer.CloseWithError(fmt.Errorf("handler failed: %v", r))
+				return
+			}
+			res.WriteHeader(http.StatusOK)
+			_ = writer.Close()
+		}()
+		t.handler.ServeHTTP(res, server)
+	}()
+
+	select {
+	case <-res.ready:
+	case <-req.Context().Done():
+		_ = reader.CloseWithError(req.Context().Err())
+		return nil, req.Context().Err()
+	}
+
+	length, err := strconv.ParseInt(res.sent.Get("Content-Length"), 10, 64)
+	if err != nil {
+		length = -1
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(res.status) + " " + http.StatusText(res.status),
+		StatusCode:    res.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        res.sent,
+		Body:          reader,
+		ContentLength: length,
+		Request:       req,
+	}, nil
+}
+
+// pipeResponseWriter is the ResponseWriter given to the handler of a
+// handlerTransport, which writes the body to a pipe.
+type pipeResponseWriter struct {
+	header http.Header
+	sent   http.Header
+	status int
+	body   *io.PipeWriter
+	ready  chan struct{}
+	once   sync.Once
+}
+
+// Header implements http.ResponseWriter.
+func (w *pipeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader implements http.ResponseWriter, only the first call has
+// any effect.
+func (w *pipeResponseWriter) WriteHeader(status int) {
+	w.once.Do(func() {
+		w.status = status
+		w.sent = w.header.Clone()
+		close(w.ready)
+	})
+}
+
+// Write implements http.ResponseWriter.
+func (w *pipeResponseWriter) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(data)
+}
+
+// startEmbeddedBlob launches a blob-server storing objects beneath the
+// given directory, and returns its location.
+//
+// The directory is accessed via its path, rather than by chroot()ing
+// into it, so the other files of the API-server remain reachable.
+func startEmbeddedBlob(store string) (string, error) {
+	//
+	// Use the defaults of every blob-server flag, other than the
+	// location of the store, and the path of our objects.
+	//
+	var options blobServerCmd
+	flags := flag.NewFlagSet("embedded-blob", flag.ContinueOnError)
+	options.SetFlags(flags)
+	if err := flags.Parse([]string{"-store", store, "-blob-path", libconfig.BlobPath()}); err != nil {
+		return "", err
+	}
+	options.embedded = true
+
+	router, ok := setupBlobServer(options)
+	if !ok {
+		return "", errors.New("failed to setup the embedded blob-server")
+	}
+
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return "", errors.New("the default transport cannot be extended")
+	}
+
+	embedded.handler = router
+	embeddedOnce.Do(func() {
+		transport.RegisterProtocol(embeddedScheme, embedded)
+	})
+	return embeddedLocation, nil
+}
@@ -0,0 +1,123 @@
+// Test the embedded blob-server of the API-server.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/skx/sos/libconfig"
+)
+
+// Test that objects may be uploaded to, and downloaded from, the
+// embedded blob-server.
+func TestEmbeddedBlob(t *testing.T) {
+	defer setBlobOptions(blobServerCmd{})
+
+	location, err := startEmbeddedBlob(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("default", location)
+
+	setAPIOptions(apiServerCmd{})
+	defer setAPIOptions(apiServerCmd{})
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("Content"))
+	req.Header.Set("X-Owner", "steve")
+	rr := httptest.NewRecorder()
+	APIUploadHandler(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v %s", status, rr.Body.String())
+	}
+
+	var uploaded struct {
+		ID string `json:"id"`
+	}
+	if err = json.Unmarshal(rr.Body.Bytes(), &uploaded); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/fetch/{id}", APIDownloadHandler).Methods("GET")
+	router.HandleFunc("/fetch/{id}", APIExistsHandler).Methods("HEAD")
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/fetch/"+uploaded.ID, nil))
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", status)
+	}
+	if rr.Body.String() != "Content" || rr.Header().Get("X-Owner") != "steve" {
+		t.Errorf("Unexpected download: %s %v", rr.Body.String(), rr.Header())
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodHead, "/fetch/"+uploaded.ID, nil))
+	if status := rr.Code; status != http.StatusOK || rr.Header().Get("Content-Length") != "7" {
+		t.Errorf("Unexpected HEAD response: %v %v", status, rr.Header())
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/fetch/missing", nil))
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+}
+
+// Test that the embedded blob-server leaves the working directory of the
+// API-server alone, so that its other files are still found.
+func TestEmbeddedBlobInPlace(t *testing.T) {
+	defer setBlobOptions(blobServerCmd{})
+
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	if _, err := startEmbeddedBlob("store"); err != nil {
+		t.Fatal(err)
+	}
+	if fss, ok := getStorage().(*FilesystemStorage); !ok || fss.cwd || fss.prefix != "store" {
+		t.Errorf("Expected the store to be used in place: %+v", getStorage())
+	}
+
+	file, err := openAuditLog("manifest.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	setUploadManifest(file)
+	defer setUploadManifest(nil)
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("default", embeddedLocation)
+
+	setAPIOptions(apiServerCmd{})
+	defer setAPIOptions(apiServerCmd{})
+
+	rr := httptest.NewRecorder()
+	APIUploadHandler(rr, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("Content")))
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v %s", status, rr.Body.String())
+	}
+
+	var uploaded struct {
+		ID string `json:"id"`
+	}
+	if err = json.Unmarshal(rr.Body.Bytes(), &uploaded); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "store", uploaded.ID)); err != nil {
+		t.Errorf("Object was not stored beneath the store: %v", err)
+	}
+	if manifest, _ := os.ReadFile(filepath.Join(dir, "manifest.log")); !strings.Contains(string(manifest), uploaded.ID) {
+		t.Errorf("Upload was not recorded in the manifest: %s", manifest)
+	}
+}
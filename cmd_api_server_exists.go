@@ -0,0 +1,94 @@
+//
+// Existence checks for the API-server.
+//
+// A `HEAD /fetch/{id}` request asks whether the cluster holds an object,
+// without downloading it.  Rather than fetching the object we send a
+// HEAD request to every blob-server which might hold it, at once, and
+// answer as soon as one of them reports that it does.
+//
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/skx/sos/libconfig"
+)
+
+// headFromServer asks a single blob-server whether it holds the given
+// object, returning its response if it does.
+func headFromServer(ctx context.Context, location string, id string) *http.Response {
+	request, _ := http.NewRequestWithContext(ctx, http.MethodHead, libconfig.BlobURL(location, id), nil)
+
+	client := newBlobClient()
+	start := time.Now()
+	response, err := client.Do(request)
+	recordLatency(location, request.Method, start, getAPIOptions().verbose)
+	recordOutcome(location, response, err)
+
+	if err != nil {
+		logDownloadError(err, nil)
+		return nil
+	}
+	_ = response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil
+	}
+	return response
+}
+
+// APIExistsHandler reports whether an object exists, along with its size
+// and type, without downloading it.
+func APIExistsHandler(res http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	id = id[0 : len(id)-len(filepath.Ext(id))]
+
+	// Refuse expired, or forged, signed URLs
+	if !verifySignature(req, id) {
+		res.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	//
+	// Ask every candidate at once.  The channel is large enough to
+	// hold every reply, so the requests we stop waiting for will
+	// not block forever.
+	//
+	servers := libconfig.ServersFor(id)
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	found := make(chan *http.Response, len(servers))
+	for _, server := range servers {
+		go func(location string) {
+			found <- headFromServer(ctx, location, id)
+		}(server.Location)
+	}
+
+	res.Header().Set("Connection", "close")
+	for range servers {
+		response := <-found
+		if response == nil {
+			continue
+		}
+
+		if response.ContentLength >= 0 {
+			res.Header().Set("Content-Length", strconv.FormatInt(response.ContentLength, 10))
+		}
+		for _, header := range []string{"Content-Type", "Last-Modified", "ETag"} {
+			if value := response.Header.Get(header); value != "" {
+				res.Header().Set(header, value)
+			}
+		}
+		res.WriteHeader(http.StatusOK)
+		return
+	}
+	res.WriteHeader(http.StatusNotFound)
+}
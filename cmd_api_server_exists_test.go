@@ -0,0 +1,74 @@
+// Testing of existence checks via the API-server.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/skx/sos/libconfig"
+)
+
+// Test that HEAD requests probe the blob-servers, without downloading.
+func TestAPIExists(t *testing.T) {
+	var gets atomic.Int32
+
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+	storageHandler.Store("steve", []byte("Content"), Metadata{"X-Mime-Type": {"text/plain"}})
+
+	blobRouter := newBlobRouter("")
+	blob := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet {
+			gets.Add(1)
+		}
+		blobRouter.ServeHTTP(res, req)
+	}))
+	defer blob.Close()
+	down := fakeBlobServer(http.StatusNotFound)
+	defer down.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("default", down.URL)
+	libconfig.AddServer("default", blob.URL)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/fetch/{id}", APIExistsHandler).Methods("HEAD")
+
+	tests := map[string]int{
+		"/fetch/steve":     http.StatusOK,
+		"/fetch/steve.txt": http.StatusOK,
+		"/fetch/missing":   http.StatusNotFound,
+	}
+
+	for path, expected := range tests {
+		req, err := http.NewRequest(http.MethodHead, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != expected {
+			t.Errorf("Unexpected status-code for %s: %v", path, status)
+		}
+		if expected != http.StatusOK {
+			continue
+		}
+		if length := rr.Header().Get("Content-Length"); length != "7" {
+			t.Errorf("Unexpected content-length for %s: %v", path, length)
+		}
+		if mime := rr.Header().Get("Content-Type"); mime != "text/plain" {
+			t.Errorf("Unexpected content-type for %s: %v", path, mime)
+		}
+	}
+
+	if n := gets.Load(); n != 0 {
+		t.Errorf("The blob-server received %d GET requests", n)
+	}
+}
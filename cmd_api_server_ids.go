@@ -0,0 +1,106 @@
+//
+// Object naming for the API-server.
+//
+// By default an object is named by the SHA256 hash of its content, so
+// uploading the same content twice stores it once.  Launching the
+// API-server with `-id-scheme uuid`, or `-id-scheme random`, instead
+// gives each upload a new random name, so that every upload is distinct
+// and the name reveals nothing about the content.
+//
+// In a multi-tenant deployment content-addressing means that tenants
+// uploading the same content share a single object.  Launching the
+// API-server with `-namespace-uploads` mixes the `X-Tenant` header of
+// each upload into its hash, so that each tenant's objects are stored
+// separately, while uploads within a tenant are still deduplicated.
+//
+// The tenant, and hash, are mixed via an HMAC keyed by `-namespace-salt`,
+// or the SOS_NAMESPACE_SALT environment variable, so that nobody may
+// compute the ID a tenant's file would receive, and probe for it.  The
+// header is trusted as given, so it must be set by a proxy which strips
+// any sent by clients.
+//
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// The schemes by which uploaded objects may be named.
+const (
+	// idSchemeSHA256 names objects by the hash of their content.
+	idSchemeSHA256 = "sha256"
+
+	// idSchemeUUID names objects by a random, version 4, UUID.
+	idSchemeUUID = "uuid"
+
+	// idSchemeRandom names objects by 128 random bits, hex-encoded.
+	//
+	// These are deliberately shorter than a SHA256 hash, so that they
+	// are never mistaken for one by `sos scrub`.
+	idSchemeRandom = "random"
+)
+
+// checkIDScheme returns an error if the given naming scheme is unknown.
+func checkIDScheme(scheme string) error {
+	switch scheme {
+	case "", idSchemeSHA256, idSchemeUUID, idSchemeRandom:
+		return nil
+	}
+	return fmt.Errorf("unknown scheme '%s', expected %s, %s, or %s", scheme, idSchemeSHA256, idSchemeUUID, idSchemeRandom)
+}
+
+// newObjectID returns the ID of an upload whose content has the given
+// hash, according to the given naming scheme.
+func newObjectID(scheme string, hash [sha256.Size]byte) string {
+	var id [16]byte
+
+	switch scheme {
+	case idSchemeUUID:
+		_, _ = rand.Read(id[:])
+		id[6] = (id[6] & 0x0f) | 0x40
+		id[8] = (id[8] & 0x3f) | 0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+	case idSchemeRandom:
+		_, _ = rand.Read(id[:])
+		return hex.EncodeToString(id[:])
+	}
+	return hex.EncodeToString(hash[:])
+}
+
+// tenantHeader is the header naming the tenant an upload belongs to.
+const tenantHeader = "X-Tenant"
+
+// tenantPrefix begins the IDs of objects uploaded by a tenant, so that
+// they are not mistaken for the SHA256 hash of their content by `sos
+// scrub`, which would find them corrupt.
+const tenantPrefix = "ns-"
+
+// envNamespaceSalt is the environment variable from which the secret
+// mixed into namespaced IDs is read, if the flag was not given.
+const envNamespaceSalt = "SOS_NAMESPACE_SALT"
+
+// namespaceSalt returns the secret mixed into namespaced IDs, if any.
+func namespaceSalt() []byte {
+	if salt := getAPIOptions().namespaceSalt; salt != "" {
+		return []byte(salt)
+	}
+	return []byte(os.Getenv(envNamespaceSalt))
+}
+
+// tenantObjectID returns the ID of an upload, by the given tenant, whose
+// content has the given hash.
+//
+// The ID is an HMAC, keyed by the given secret, of the tenant and hash.
+// The tenant is length-prefixed, so that no two tenants may collide.
+func tenantObjectID(salt []byte, tenant string, hash [sha256.Size]byte) string {
+	mac := hmac.New(sha256.New, salt)
+	_, _ = fmt.Fprintf(mac, "%d:%s:", len(tenant), tenant)
+	mac.Write(hash[:])
+	return tenantPrefix + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,169 @@
+// Testing of object naming via the API-server.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// Test that uploads are named according to the -id-scheme.
+func TestAPIUploadIDScheme(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+
+	blob := httptest.NewServer(newBlobRouter(""))
+	defer blob.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("default", blob.URL)
+
+	defer setAPIOptions(apiServerCmd{})
+
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte("Content")))
+
+	for _, scheme := range []string{idSchemeSHA256, idSchemeUUID, idSchemeRandom} {
+		setAPIOptions(apiServerCmd{idScheme: scheme})
+
+		var ids []string
+		for range 2 {
+			req, err := http.NewRequest(http.MethodPost, "/upload", strings.NewReader("Content"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			APIUploadHandler(rr, req)
+
+			if status := rr.Code; status != http.StatusOK {
+				t.Fatalf("Unexpected status-code for %s: %v", scheme, status)
+			}
+
+			var body struct {
+				ID string `json:"id"`
+			}
+			if err = json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatalf("Response was not JSON: %v", err)
+			}
+			if !getStorage().Exists(body.ID) {
+				t.Errorf("Object %s was not stored", body.ID)
+			}
+			ids = append(ids, body.ID)
+		}
+
+		switch scheme {
+		case idSchemeSHA256:
+			if ids[0] != hash || ids[1] != hash {
+				t.Errorf("Unexpected IDs for %s: %v", scheme, ids)
+			}
+		default:
+			if ids[0] == ids[1] || hashPattern.MatchString(ids[0]) {
+				t.Errorf("Unexpected IDs for %s: %v", scheme, ids)
+			}
+		}
+	}
+
+	if len(newObjectID(idSchemeUUID, [sha256.Size]byte{})) != 36 {
+		t.Errorf("Unexpected UUID length")
+	}
+	if checkIDScheme("md5") == nil {
+		t.Errorf("Expected an error for an unknown scheme")
+	}
+}
+
+// Test that namespaced uploads are deduplicated within, but not across,
+// tenants, and that the tenant is not stored.
+func TestAPIUploadNamespace(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+
+	blob := httptest.NewServer(newBlobRouter(""))
+	defer blob.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("default", blob.URL)
+
+	defer setAPIOptions(apiServerCmd{})
+
+	upload := func(tenant string) string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("Content"))
+		if tenant != "" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+		rr := httptest.NewRecorder()
+		APIUploadHandler(rr, req)
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("Unexpected status-code: %v", status)
+		}
+
+		var body struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Response was not JSON: %v", err)
+		}
+		return body.ID
+	}
+
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte("Content")))
+
+	// Without the flag the tenant is ignored.
+	setAPIOptions(apiServerCmd{})
+	if id := upload("alice"); id != hash {
+		t.Errorf("Unexpected ID without -namespace-uploads: %s", id)
+	}
+
+	setAPIOptions(apiServerCmd{namespaceUploads: true, namespaceSalt: "secret"})
+	alice, bob := upload("alice"), upload("bob")
+	if alice == bob || alice == hash || hashPattern.MatchString(alice) {
+		t.Errorf("Unexpected IDs: %s %s", alice, bob)
+	}
+	if again := upload("alice"); again != alice {
+		t.Errorf("Expected uploads by a tenant to be deduplicated: %s %s", alice, again)
+	}
+	if id := upload(""); id != hash {
+		t.Errorf("Unexpected ID without a tenant: %s", id)
+	}
+
+	if !getStorage().Exists(alice) {
+		t.Fatalf("Object %s was not stored", alice)
+	}
+	if meta := getStorage().Meta(alice); meta.Get("X-Tenant") != "" {
+		t.Errorf("The tenant was stored: %v", meta)
+	}
+
+	// The ID cannot be computed without the secret.
+	setAPIOptions(apiServerCmd{namespaceUploads: true, namespaceSalt: "other"})
+	if id := upload("alice"); id == alice {
+		t.Errorf("Expected the secret to change the ID: %s", id)
+	}
+}
+
+// Test that namespacing is refused without a secret, or with IDs which
+// are not named by their content.
+func TestAPINamespaceInvalid(t *testing.T) {
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	defer setAPIOptions(apiServerCmd{})
+	t.Setenv(envNamespaceSalt, "")
+
+	for _, options := range []apiServerCmd{
+		{selection: "groups", namespaceUploads: true},
+		{selection: "groups", namespaceUploads: true, namespaceSalt: "secret", idScheme: idSchemeUUID},
+	} {
+		if err := apiServer(options); err == nil || !strings.Contains(err.Error(), "-namespace-uploads") {
+			t.Errorf("Expected -namespace-uploads to be refused, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+//
+// Manifest of the objects uploaded via the API-server.
+//
+// If the API-server is launched with `-manifest /path/to/file` then a JSON
+// line is appended to that file for each object it successfully stores:
+//
+//   {"time":"...","id":"...","size":1234}
+//
+// This records what a particular API-server has ingested, for building
+// external indexes, separately from the blob-servers' `-audit-log`.  The
+// record is written before the client receives its response.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// manifestRecord is a single line of the upload manifest.
+type manifestRecord struct {
+	// Time is the time the upload completed.
+	Time time.Time `json:"time"`
+
+	// ID is the ID of the object.
+	ID string `json:"id"`
+
+	// Size is the size of the object.
+	Size int64 `json:"size"`
+}
+
+// uploadManifest holds our manifest, or nil if it is disabled.
+var uploadManifest struct {
+	sync.Mutex
+	file *os.File
+}
+
+// setUploadManifest stores the manifest for use by handlers.
+func setUploadManifest(file *os.File) {
+	uploadManifest.Lock()
+	defer uploadManifest.Unlock()
+
+	uploadManifest.file = file
+}
+
+// recordUpload appends a record of the given object to the manifest, if
+// any.
+func recordUpload(id string, size int64) {
+	uploadManifest.Lock()
+	defer uploadManifest.Unlock()
+
+	if uploadManifest.file == nil {
+		return
+	}
+
+	encoded, _ := json.Marshal(manifestRecord{Time: time.Now().UTC(), ID: id, Size: size})
+	if _, err := uploadManifest.file.Write(append(encoded, '\n')); err != nil {
+		GetLogger().Error("Failed to write manifest", "object", id, "error", err)
+	}
+}
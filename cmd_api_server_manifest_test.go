@@ -0,0 +1,87 @@
+// Testing of the manifest of uploads.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// Test that each object stored, and only those, is appended to the
+// manifest, whether uploaded in turn or with a quorum.
+func TestAPIUploadManifest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manifest.log")
+	file, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setUploadManifest(file)
+	defer func() {
+		setUploadManifest(nil)
+		_ = file.Close()
+	}()
+
+	up := fakeBlobServer(http.StatusOK)
+	defer up.Close()
+	down := fakeBlobServer(http.StatusInternalServerError)
+	defer down.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	defer setAPIOptions(apiServerCmd{})
+
+	uploads := []struct {
+		server   string
+		replicas int
+		body     string
+		status   int
+	}{
+		{up.URL, 0, "First", http.StatusOK},
+		{down.URL, 0, "Failed", http.StatusInternalServerError},
+		{up.URL, 1, "Second!", http.StatusOK},
+		{down.URL, 1, "Refused", http.StatusInternalServerError},
+	}
+	for _, upload := range uploads {
+		libconfig.ResetServers()
+		libconfig.AddServer("default", upload.server)
+		setAPIOptions(apiServerCmd{replicas: upload.replicas})
+
+		rr := httptest.NewRecorder()
+		APIUploadHandler(rr, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(upload.body)))
+		if rr.Code != upload.status {
+			t.Errorf("Unexpected status-code uploading %s: %v", upload.body, rr.Code)
+		}
+	}
+
+	content, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+
+	var records []manifestRecord
+	scanner := bufio.NewScanner(content)
+	for scanner.Scan() {
+		var record manifestRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Invalid manifest line %s: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("Unexpected manifest: %v", records)
+	}
+	for i, size := range []int64{5, 7} {
+		if records[i].Size != size || records[i].ID == "" || records[i].Time.IsZero() {
+			t.Errorf("Unexpected manifest record: %v", records[i])
+		}
+	}
+}
@@ -0,0 +1,128 @@
+//
+// Caching of missing objects.
+//
+// A download of an object which exists nowhere asks every blob-server
+// which might hold it, so a client repeatedly requesting a missing ID is
+// expensive.  If the API-server is launched with `-not-found-ttl 5s` then
+// an ID which every blob-server reported missing is remembered for that
+// long, and further downloads of it fail immediately.
+//
+// The TTL should be kept small, since an object might appear later via
+// replication.  An upload of the object, via this API-server, forgets it
+// at once.
+//
+// The number of downloads answered from the cache is served upon the
+// debug-server, as `sos_not_found_cache_hits_total`.
+//
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxMissingEntries is the number of missing IDs we remember, so that a
+// client requesting random IDs cannot exhaust our memory.
+const maxMissingEntries = 100000
+
+// missingCache holds the IDs known to be missing, and when each expires.
+var missingCache = struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]time.Time
+}{entries: make(map[string]time.Time)}
+
+// Counters of the lookups made in the missingCache.
+var (
+	missingHits   atomic.Int64
+	missingMisses atomic.Int64
+)
+
+// setMissingTTL changes how long a missing ID is remembered, zero
+// disabling the cache, and forgets every ID.
+func setMissingTTL(ttl time.Duration) {
+	missingCache.Lock()
+	defer missingCache.Unlock()
+
+	missingCache.ttl = max(ttl, 0)
+	clear(missingCache.entries)
+	missingHits.Store(0)
+	missingMisses.Store(0)
+}
+
+// isMissing returns true if the given ID was recently found to be missing
+// from every blob-server.
+func isMissing(id string) bool {
+	missingCache.Lock()
+	defer missingCache.Unlock()
+
+	if missingCache.ttl == 0 {
+		return false
+	}
+
+	expires, ok := missingCache.entries[id]
+	if ok && time.Now().After(expires) {
+		delete(missingCache.entries, id)
+		ok = false
+	}
+
+	if ok {
+		missingHits.Add(1)
+	} else {
+		missingMisses.Add(1)
+	}
+	return ok
+}
+
+// rememberMissing records that the given ID is missing from every
+// blob-server.
+func rememberMissing(id string) {
+	missingCache.Lock()
+	defer missingCache.Unlock()
+
+	if missingCache.ttl == 0 {
+		return
+	}
+
+	//
+	// When full, discard the expired entries, and failing that every
+	// entry, rather than tracking the oldest.
+	//
+	now := time.Now()
+	if len(missingCache.entries) >= maxMissingEntries {
+		for key, expires := range missingCache.entries {
+			if now.After(expires) {
+				delete(missingCache.entries, key)
+			}
+		}
+		if len(missingCache.entries) >= maxMissingEntries {
+			clear(missingCache.entries)
+		}
+	}
+	missingCache.entries[id] = now.Add(missingCache.ttl)
+}
+
+// forgetMissing removes the given ID from the cache, since it has been
+// uploaded.
+func forgetMissing(id string) {
+	missingCache.Lock()
+	defer missingCache.Unlock()
+
+	delete(missingCache.entries, id)
+}
+
+// writeMissingMetrics writes the counters of the cache in the Prometheus
+// text format.
+func writeMissingMetrics(out *strings.Builder) {
+	missingCache.Lock()
+	entries := len(missingCache.entries)
+	missingCache.Unlock()
+
+	fmt.Fprintf(out, "# HELP sos_not_found_cache_hits_total Downloads answered from the cache of missing objects.\n# TYPE sos_not_found_cache_hits_total counter\nsos_not_found_cache_hits_total %d\n", missingHits.Load())
+	fmt.Fprintf(out, "# HELP sos_not_found_cache_misses_total Downloads of objects not in the cache of missing objects.\n# TYPE sos_not_found_cache_misses_total counter\nsos_not_found_cache_misses_total %d\n", missingMisses.Load())
+	fmt.Fprintf(out, "# HELP sos_not_found_cache_entries Objects in the cache of missing objects.\n# TYPE sos_not_found_cache_entries gauge\nsos_not_found_cache_entries %d\n", entries)
+}
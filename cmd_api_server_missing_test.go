@@ -0,0 +1,93 @@
+// Testing of the cache of missing objects.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/skx/sos/libconfig"
+)
+
+// Test that an object missing from every blob-server is remembered,
+// until it is uploaded, and that failures are not.
+func TestAPIDownloadNotFoundCache(t *testing.T) {
+	var requests atomic.Int32
+	var status atomic.Int32
+	status.Store(http.StatusNotFound)
+	blob := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		res.WriteHeader(int(status.Load()))
+	}))
+	defer blob.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("default", blob.URL)
+
+	setMissingTTL(time.Minute)
+	defer setMissingTTL(0)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/fetch/{id}", APIDownloadHandler).Methods("GET")
+
+	fetch := func(id string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, "/fetch/"+id, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("Unexpected status-code: %v", rr.Code)
+		}
+	}
+
+	fetch("missing")
+	fetch("missing")
+	fetch("missing")
+	if requests.Load() != 1 {
+		t.Errorf("Expected a single request to the blob-server, got %d", requests.Load())
+	}
+
+	metrics := httptest.NewRecorder()
+	MetricsHandler(metrics, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(metrics.Body.String(), "sos_not_found_cache_hits_total 2\n") {
+		t.Errorf("Expected two cache hits in the metrics:\n%s", metrics.Body.String())
+	}
+
+	//
+	// An upload forgets the object.
+	//
+	forgetMissing("missing")
+	fetch("missing")
+	if requests.Load() != 2 {
+		t.Errorf("Expected the blob-server to be asked again, got %d requests", requests.Load())
+	}
+
+	//
+	// A failing blob-server says nothing about the object.
+	//
+	requests.Store(0)
+	status.Store(http.StatusInternalServerError)
+	fetch("failed")
+	fetch("failed")
+	if requests.Load() != 2 {
+		t.Errorf("Expected failures not to be cached, got %d requests", requests.Load())
+	}
+
+	//
+	// Entries expire.
+	//
+	setMissingTTL(time.Nanosecond)
+	status.Store(http.StatusNotFound)
+	requests.Store(0)
+	fetch("expired")
+	time.Sleep(time.Millisecond)
+	fetch("expired")
+	if requests.Load() != 2 {
+		t.Errorf("Expected expired entries to be ignored, got %d requests", requests.Load())
+	}
+}
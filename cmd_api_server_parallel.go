@@ -0,0 +1,101 @@
+//
+// Parallel downloads for the API-server.
+//
+// By default the blob-servers which might hold an object are tried in
+// turn, so a slow server delays every download it is asked for.  If the
+// API-server is launched with `-download-parallelism 2`, or more, then
+// that many are asked at once, in the same order, with another being
+// asked whenever one fails.  The first successful response is sent to
+// the client, and the other requests are cancelled.
+//
+// Asking every server at once would multiply the load upon them, so a
+// small number, 2-3, is recommended.
+//
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// downloadAttempt is the outcome of asking one blob-server for an object.
+type downloadAttempt struct {
+	index    int
+	response *http.Response
+	start    time.Time
+	missing  bool
+}
+
+// raceDownload asks up to the given number of the servers for an object
+// at once, sending the first successful response to the client, and
+// returns false if none succeeded, along with the servers which reported
+// that they do not hold it.
+func raceDownload(servers []libconfig.BlobServer, id string, res http.ResponseWriter, req *http.Request, parallelism int) (bool, []libconfig.BlobServer) {
+	//
+	// The channel is large enough to hold every result, so that the
+	// requests which lose the race will not block forever.
+	//
+	results := make(chan downloadAttempt, len(servers))
+	cancels := make([]context.CancelFunc, len(servers))
+
+	next, running := 0, 0
+	launch := func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels[next] = cancel
+
+		go func(index int, server libconfig.BlobServer) {
+			response, start, missing := fetchFromServer(ctx, server, id, req)
+			results <- downloadAttempt{index: index, response: response, start: start, missing: missing}
+		}(next, servers[next])
+
+		next++
+		running++
+	}
+
+	for running < parallelism && next < len(servers) {
+		launch()
+	}
+
+	var missing []libconfig.BlobServer
+	for running > 0 {
+		attempt := <-results
+		running--
+
+		if attempt.response == nil {
+			cancels[attempt.index]()
+			if attempt.missing {
+				missing = append(missing, servers[attempt.index])
+			}
+			if next < len(servers) {
+				launch()
+			}
+			continue
+		}
+
+		//
+		// We have a winner, so cancel the others, and discard any
+		// which succeed regardless.
+		//
+		for i := range next {
+			if i != attempt.index {
+				cancels[i]()
+			}
+		}
+		go func(pending int) {
+			for range pending {
+				if loser := <-results; loser.response != nil {
+					_ = loser.response.Body.Close()
+				}
+			}
+		}(running)
+
+		serveDownload(servers[attempt.index], id, attempt.response, attempt.start, res, req, repairTargets(servers[attempt.index], missing))
+		cancels[attempt.index]()
+		return true, missing
+	}
+	return false, missing
+}
@@ -0,0 +1,86 @@
+// Testing of parallel downloads via the API-server.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/skx/sos/libconfig"
+)
+
+// Test that a slow blob-server doesn't delay a parallel download, and
+// that its request is cancelled once another has succeeded.
+func TestAPIDownloadParallel(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+	storageHandler.Store("steve", []byte("Content"), Metadata{"X-Mime-Type": {"text/plain"}})
+
+	cancelled := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	down := fakeBlobServer(http.StatusNotFound)
+	defer down.Close()
+	blob := httptest.NewServer(newBlobRouter(""))
+	defer blob.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("default", slow.URL)
+	libconfig.AddServer("default", down.URL)
+	libconfig.AddServer("default", blob.URL)
+
+	setAPIOptions(apiServerCmd{downloadParallelism: 2})
+	defer setAPIOptions(apiServerCmd{})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/fetch/{id}", APIDownloadHandler).Methods("GET")
+
+	tests := []struct {
+		path     string
+		expected int
+	}{
+		{"/fetch/steve", http.StatusOK},
+		{"/fetch/missing", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		path, expected := test.path, test.expected
+
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != expected {
+			t.Errorf("Unexpected status-code for %s: %v", path, status)
+		}
+		if expected != http.StatusOK {
+			continue
+		}
+		if body := rr.Body.String(); body != "Content" {
+			t.Errorf("Unexpected body for %s: %v", path, body)
+		}
+
+		select {
+		case <-cancelled:
+		case <-time.After(time.Second):
+			t.Errorf("The slow request was not cancelled")
+		}
+
+		// Every server must now answer before we give up
+		slow.Close()
+	}
+}
@@ -0,0 +1,95 @@
+//
+// Startup probing of the blob-servers.
+//
+// A mistyped blob-server location would otherwise only be noticed when
+// the first request fails.  If the API-server is launched with
+// `-probe-servers` it sends a `HEAD /alive` request to each blob-server
+// at startup, and logs whether each was reachable.
+//
+// Unreachable servers are merely warned about, since they may yet come
+// up, unless `-require-all-servers` is given, in which case we refuse
+// to start.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// probeTimeout is how long we wait for each blob-server to respond to
+// our startup probe.
+const probeTimeout = 5 * time.Second
+
+// probeServer tests whether the blob-server at the given location
+// responds to its health-check.
+func probeServer(ctx context.Context, location string) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	//
+	// Older blob-servers only answer GET requests to `/alive`, and
+	// refuse a HEAD either outright, or via their catch-all 404.
+	//
+	status, err := probeStatus(ctx, location, http.MethodHead)
+	if err == nil && (status == http.StatusMethodNotAllowed || status == http.StatusNotFound) {
+		status, err = probeStatus(ctx, location, http.MethodGet)
+	}
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("status-code %d", status)
+	}
+	return nil
+}
+
+// probeStatus sends a request to the health-check of the blob-server at
+// the given location, with the given method, and returns the status-code
+// it replied with.
+func probeStatus(ctx context.Context, location string, method string) (int, error) {
+	request, err := http.NewRequestWithContext(ctx, method, libconfig.Endpoint(location, "/alive"), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	response, err := newBlobClient().Do(request)
+	if err != nil {
+		return 0, err
+	}
+	_ = response.Body.Close()
+	return response.StatusCode, nil
+}
+
+// probeServers probes each of the given blob-servers at once, logging
+// the result of each, and returns the number which were unreachable.
+func probeServers(servers []libconfig.BlobServer) int {
+	errs := make([]error, len(servers))
+
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = probeServer(context.Background(), server.Location)
+		}()
+	}
+	wg.Wait()
+
+	unreachable := 0
+	for i, server := range servers {
+		if errs[i] != nil {
+			GetLogger().Warn("Blob-server unreachable", "group", server.Group, "location", server.Location, "error", errs[i])
+			unreachable++
+			continue
+		}
+		GetLogger().Info("Blob-server reachable", "group", server.Group, "location", server.Location)
+	}
+	return unreachable
+}
@@ -0,0 +1,79 @@
+// Test the startup probing of blob-servers.
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// Test that reachable, and unreachable, servers are counted.
+func TestProbeServers(t *testing.T) {
+	good := httptest.NewServer(newBlobRouter(""))
+	defer good.Close()
+
+	bad := fakeBlobServer(http.StatusInternalServerError)
+	defer bad.Close()
+
+	down := fakeBlobServer(http.StatusOK)
+	down.Close()
+
+	servers := []libconfig.BlobServer{
+		{Location: good.URL, Group: "default"},
+		{Location: bad.URL, Group: "default"},
+		{Location: down.URL, Group: "default"},
+	}
+
+	if unreachable := probeServers(servers); unreachable != 2 {
+		t.Errorf("Unexpected unreachable count: %d", unreachable)
+	}
+	if unreachable := probeServers(servers[:1]); unreachable != 0 {
+		t.Errorf("Unexpected unreachable count: %d", unreachable)
+	}
+}
+
+// Test that servers which only answer GET requests are still found,
+// whether they refuse a HEAD outright or via a catch-all 404.
+func TestProbeServerGetOnly(t *testing.T) {
+	for _, refusal := range []int{http.StatusMethodNotAllowed, http.StatusNotFound} {
+		server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if req.Method != http.MethodGet {
+				res.WriteHeader(refusal)
+				return
+			}
+			_, _ = res.Write([]byte("alive"))
+		}))
+
+		if err := probeServer(context.Background(), server.URL); err != nil {
+			t.Errorf("Unexpected error when HEAD receives %d: %v", refusal, err)
+		}
+		server.Close()
+	}
+
+	//
+	// A server which has no health-check at all is still unreachable.
+	//
+	missing := fakeBlobServer(http.StatusNotFound)
+	defer missing.Close()
+
+	if err := probeServer(context.Background(), missing.URL); err == nil {
+		t.Errorf("Expected a missing health-check to fail")
+	}
+}
+
+// Test that probes share the redirect policy of our other requests, so
+// a server redirecting its health-check elsewhere is unreachable.
+func TestProbeServerRedirect(t *testing.T) {
+	target := fakeBlobServer(http.StatusOK)
+	defer target.Close()
+
+	server := httptest.NewServer(http.RedirectHandler(target.URL+"/alive", http.StatusFound))
+	defer server.Close()
+
+	if err := probeServer(context.Background(), server.URL); err == nil {
+		t.Errorf("Expected a redirected probe to fail")
+	}
+}
@@ -0,0 +1,180 @@
+//
+// Pull-through copying for the API-server.
+//
+// When blob-servers are split into groups by datacenter an object which
+// is only held remotely is fetched across the datacenters each time it
+// is read.  If the API-server is launched with `-pull-through GROUP` an
+// object downloaded from a server outside that group is copied into it,
+// in the background, so that later reads are served locally.
+//
+// Copying is best-effort: only objects small enough to be held in memory
+// are copied, the client is never made to wait, and a blob-server which
+// refuses the copy, for example because it is full, is skipped.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// pullThroughMax is the size of the largest object we copy into our
+// local group.
+const pullThroughMax = 16 * 1024 * 1024
+
+// pullThroughTimeout is how long we allow for copying an object.
+const pullThroughTimeout = time.Minute
+
+// pullThroughSlots bounds the number of copies in progress at once;
+// beyond that objects are simply not copied.
+var pullThroughSlots = make(chan struct{}, 8)
+
+// pullThroughCapture records the content of a download, as it is sent
+// to the client, so that it may be copied into our local group, or back
+// to the servers which were missing it.
+type pullThroughCapture struct {
+	buf      *bytes.Buffer
+	overflow bool
+
+	// group is the group to copy the object into, if any.
+	group string
+
+	// repair holds the servers to copy the object back to, if any.
+	repair []libconfig.BlobServer
+}
+
+// newCapture returns a capture for the given download, or nil if it
+// cannot be copied.
+func newCapture(response *http.Response) *pullThroughCapture {
+	//
+	// Compressed responses differ from the object itself.
+	//
+	if response.Header.Get("Content-Encoding") != "" || response.ContentLength > pullThroughMax {
+		return nil
+	}
+	return &pullThroughCapture{buf: getBodyBuffer()}
+}
+
+// newPullThroughCapture returns a capture for the given download from
+// the given server, or nil if it should not be copied.
+func newPullThroughCapture(server libconfig.BlobServer, response *http.Response) *pullThroughCapture {
+	local := getAPIOptions().pullThrough
+	if local == "" || server.Group == local {
+		return nil
+	}
+
+	capture := newCapture(response)
+	if capture != nil {
+		capture.group = local
+	}
+	return capture
+}
+
+// Write records the given data, unless the object is too large.
+func (c *pullThroughCapture) Write(data []byte) (int, error) {
+	if !c.overflow && c.buf.Len()+len(data) > pullThroughMax {
+		c.overflow = true
+		c.buf.Reset()
+	}
+	if !c.overflow {
+		c.buf.Write(data)
+	}
+	return len(data), nil
+}
+
+// store copies the captured object into our local group, and back to
+// any servers which were missing it, in the background.  The capture
+// must not be used afterwards.
+func (c *pullThroughCapture) store(id string, header http.Header) {
+	if c.overflow {
+		putBodyBuffer(c.buf)
+		return
+	}
+
+	select {
+	case pullThroughSlots <- struct{}{}:
+	default:
+		putBodyBuffer(c.buf)
+		return
+	}
+
+	options := getAPIOptions()
+	go func() {
+		defer func() { <-pullThroughSlots }()
+		defer putBodyBuffer(c.buf)
+
+		if c.group != "" {
+			pullThrough(c.group, id, c.buf.Bytes(), header, options.verbose)
+		}
+		if len(c.repair) > 0 {
+			readRepair(c.repair, id, c.buf.Bytes(), header, options.verbose)
+		}
+	}()
+}
+
+// pullThrough stores the given object upon a member of the given group,
+// trying each in turn until one accepts it.
+func pullThrough(group string, id string, content []byte, header http.Header, verbose bool) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), pullThroughTimeout)
+	defer cancel()
+
+	for _, server := range libconfig.GroupMembers(group) {
+		if !libconfig.Available(server.Location) {
+			continue
+		}
+
+		status, err := copyObject(ctx, server.Location, id, content, header, verbose)
+		if err != nil {
+			GetLogger().Warn("Pull-through copy failed", "id", id, "location", server.Location, "error", err)
+			continue
+		}
+
+		if status == http.StatusOK {
+			if verbose {
+				GetLogger().Info("Pull-through copy stored", "id", id, "location", server.Location)
+			}
+			return true
+		}
+		GetLogger().Warn("Pull-through copy refused", "id", id, "location", server.Location, "status", status)
+	}
+	return false
+}
+
+// copyObject stores the given object upon the blob-server at the given
+// location, returning the status-code it replied with.
+func copyObject(ctx context.Context, location string, id string, content []byte, header http.Header, verbose bool) (int, error) {
+	child, _ := http.NewRequestWithContext(ctx, http.MethodPost, libconfig.BlobURL(location, id), bytes.NewReader(content))
+
+	//
+	// Preserve the meta-data, modification time, and expiry, as
+	// the replicator does.
+	//
+	for name, value := range header {
+		if strings.HasPrefix(name, "X-") {
+			child.Header[name] = slices.Clone(value)
+		}
+	}
+	for _, name := range []string{"Last-Modified", "Content-Disposition", "Expires"} {
+		if value := header.Get(name); value != "" {
+			child.Header.Set(name, value)
+		}
+	}
+
+	client := newBlobClient()
+	start := time.Now()
+	response, err := client.Do(child)
+	recordLatency(location, child.Method, start, verbose)
+	recordOutcome(location, response, err)
+	if err != nil {
+		return 0, err
+	}
+	_ = response.Body.Close()
+	return response.StatusCode, nil
+}
@@ -0,0 +1,105 @@
+// Test the copying of remote objects into the local group.
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/skx/sos/libconfig"
+)
+
+// Test that an object downloaded from a remote group is copied into the
+// local group, skipping a server which refuses it.
+func TestAPIPullThrough(t *testing.T) {
+	expires := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+
+	remote := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		res.Header().Set("X-Owner", "steve")
+		res.Header().Set("Expires", expires)
+		_, _ = res.Write([]byte("Content"))
+	}))
+	defer remote.Close()
+
+	full := fakeBlobServer(http.StatusInsufficientStorage)
+	defer full.Close()
+
+	type upload struct {
+		body    string
+		owner   string
+		expires string
+	}
+	uploads := make(chan upload, 1)
+	local := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			res.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		uploads <- upload{string(body), req.Header.Get("X-Owner"), req.Header.Get("Expires")}
+	}))
+	defer local.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("local", full.URL)
+	libconfig.AddServer("remote", remote.URL)
+	libconfig.AddServer("local", local.URL)
+
+	setAPIOptions(apiServerCmd{pullThrough: "local"})
+	defer setAPIOptions(apiServerCmd{})
+
+	req := httptest.NewRequest(http.MethodGet, "/fetch/abc", nil)
+	rr := httptest.NewRecorder()
+	router := mux.NewRouter()
+	router.HandleFunc("/fetch/{id}", APIDownloadHandler).Methods("GET")
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", status)
+	}
+	if rr.Body.String() != "Content" {
+		t.Errorf("Unexpected body: %s", rr.Body.String())
+	}
+
+	select {
+	case got := <-uploads:
+		if got.body != "Content" || got.owner != "steve" || got.expires != expires {
+			t.Errorf("Unexpected copy: %v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The object was not copied into the local group")
+	}
+}
+
+// Test that objects found in the local group are not copied.
+func TestAPIPullThroughLocal(t *testing.T) {
+	server := libconfig.BlobServer{Location: "http://example.com", Group: "local"}
+	response := &http.Response{Header: http.Header{}, ContentLength: 7}
+
+	setAPIOptions(apiServerCmd{pullThrough: "local"})
+	defer setAPIOptions(apiServerCmd{})
+
+	if newPullThroughCapture(server, response) != nil {
+		t.Errorf("Expected no copy of a local object")
+	}
+
+	server.Group = "remote"
+	response.ContentLength = pullThroughMax + 1
+	if newPullThroughCapture(server, response) != nil {
+		t.Errorf("Expected no copy of a large object")
+	}
+
+	response.ContentLength = -1
+	capture := newPullThroughCapture(server, response)
+	if capture == nil {
+		t.Fatalf("Expected a copy of a remote object")
+	}
+	_, _ = capture.Write(make([]byte, pullThroughMax+1))
+	if !capture.overflow {
+		t.Errorf("Expected a large object of unknown size to be abandoned")
+	}
+}
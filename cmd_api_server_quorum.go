@@ -0,0 +1,189 @@
+//
+// Concurrent, quorum-based, uploads for the API-server.
+//
+// When the API-server is launched with `-replicas N` an upload is sent
+// to the first N blob-servers, as returned by UploadServersFor(), at the
+// same time.  As soon as enough of them have accepted the object to
+// satisfy the write-quorum we return to the caller, and any attempts
+// still outstanding are cancelled.
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// uploadFailure records why an upload to a single blob-server failed.
+type uploadFailure struct {
+	Server string `json:"server"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error"`
+}
+
+// uploadFailedResponse is the JSON body returned when an upload failed
+// upon every blob-server.
+type uploadFailedResponse struct {
+	Error    string          `json:"error"`
+	Failures []uploadFailure `json:"failures,omitempty"`
+}
+
+// quorumResponse is the JSON body returned from a fan-out upload.
+type quorumResponse struct {
+	ID        string          `json:"id"`
+	Size      int             `json:"size"`
+	Status    string          `json:"status"`
+	Quorum    int             `json:"quorum"`
+	Succeeded []string        `json:"succeeded"`
+	Failed    []uploadFailure `json:"failed"`
+	Cancelled []string        `json:"cancelled,omitempty"`
+}
+
+// writeQuorum returns the number of successful writes we require, given
+// the number of replicas we're attempting and the configured quorum.
+//
+// A quorum of zero means "a majority".
+func writeQuorum(replicas int, quorum int) int {
+	if quorum <= 0 {
+		return replicas/2 + 1
+	}
+	return min(quorum, replicas)
+}
+
+// uploadToServer POSTs the given body to a single blob-server, returning
+// a nil error only if the blob-server accepted it.
+func uploadToServer(ctx context.Context, req *http.Request, location string, id string, body *sharedBody) (err error) {
+	release, err := acquireServer(ctx, location)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	child := newUploadRequest(ctx, req, location, id, body)
+
+	client := newBlobClient()
+	start := time.Now()
+	r, err := client.Do(child)
+	recordLatency(location, child.Method, start, getAPIOptions().verbose)
+	recordOutcome(location, r, err)
+
+	event := ObservedEvent{Service: "api-server", Server: location, ID: id, Size: int64(len(body.bytes()))}
+	defer func() { observeUpload(event, start, err) }()
+
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	event.Status = r.StatusCode
+
+	if r.StatusCode != http.StatusOK {
+		reply, _ := io.ReadAll(r.Body)
+		return fmt.Errorf("status-code %d: %s", r.StatusCode, truncateError(string(reply)))
+	}
+
+	//
+	// The object is stored, even if we fail to read the reply.
+	//
+	if _, readErr := io.Copy(io.Discard, r.Body); readErr != nil {
+		GetLogger().Warn("Upload stored, but the reply was unreadable", "id", id, "server", location, "error", readErr)
+	}
+	return nil
+}
+
+// uploadWithQuorum uploads the given body to several blob-servers at
+// once, returning a JSON summary of the outcome to the caller.
+func uploadWithQuorum(res http.ResponseWriter, req *http.Request, body *sharedBody, id string) {
+	targets := libconfig.UploadServersFor(id)
+	if replicas := currentReplicas(); len(targets) > replicas {
+		targets = targets[:replicas]
+	}
+
+	out := quorumResponse{
+		ID:        id,
+		Size:      len(body.bytes()),
+		Quorum:    writeQuorum(len(targets), getAPIOptions().quorum),
+		Succeeded: []string{},
+		Failed:    []uploadFailure{},
+	}
+
+	//
+	// Launch an upload to each target.
+	//
+	// The channel is large enough to hold every result, so that
+	// the uploads we stop waiting for will not block forever.  Each
+	// upload also holds the body until it is complete, since we may
+	// return before they are.
+	//
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	type result struct {
+		server string
+		err    error
+	}
+	results := make(chan result, len(targets))
+
+	for _, s := range targets {
+		go func(location string, done func()) {
+			defer done()
+			results <- result{server: location, err: uploadToServer(ctx, req, location, id, body)}
+		}(s.Location, body.hold())
+	}
+
+	//
+	// Collect results until we have a quorum, or we know that
+	// reaching one is impossible.
+	//
+	pending := make(map[string]bool)
+	for _, s := range targets {
+		pending[s.Location] = true
+	}
+
+	for range targets {
+		r := <-results
+		delete(pending, r.server)
+
+		if r.err == nil {
+			out.Succeeded = append(out.Succeeded, r.server)
+		} else {
+			out.Failed = append(out.Failed, uploadFailure{Server: r.server, Error: r.err.Error()})
+		}
+
+		if len(out.Succeeded) >= out.Quorum || len(out.Failed) > len(targets)-out.Quorum {
+			break
+		}
+	}
+
+	//
+	// Cancel anything still outstanding, and record what it was.
+	//
+	cancel()
+	for _, s := range targets {
+		if pending[s.Location] {
+			out.Cancelled = append(out.Cancelled, s.Location)
+		}
+	}
+
+	status := http.StatusOK
+	out.Status = "OK"
+	if out.Quorum == 0 || len(out.Succeeded) < out.Quorum {
+		status = http.StatusInternalServerError
+		out.Status = "upload failed"
+	} else {
+		recordUpload(id, int64(out.Size))
+	}
+
+	encoded, _ := json.Marshal(out)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	if _, err := res.Write(encoded); err != nil {
+		panic(err)
+	}
+}
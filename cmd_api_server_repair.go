@@ -0,0 +1,64 @@
+//
+// Read-repair for the API-server.
+//
+// Objects are copied between the members of each group by the replicator,
+// so between its passes a download may find an object missing from one
+// member of a group and present upon another.  If the API-server is
+// launched with `-read-repair` the object is then copied back to each
+// member which reported it missing, in the background, so that the
+// number of replicas heals without waiting for the next pass.
+//
+// Only servers which replied `404` are repaired; a server which could not
+// be reached may well hold the object.  As with `-pull-through` copying
+// is best-effort, and limited to objects small enough to hold in memory.
+//
+
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// repairTargets returns the servers which should receive a copy of an
+// object which was found upon the given server, having been reported
+// missing by the others.
+//
+// Servers in other groups aren't expected to hold the object, so only
+// the members of the same group are repaired.
+func repairTargets(found libconfig.BlobServer, missing []libconfig.BlobServer) []libconfig.BlobServer {
+	if !getAPIOptions().readRepair {
+		return nil
+	}
+
+	var targets []libconfig.BlobServer
+	for _, server := range missing {
+		if server.Group == found.Group && server.Location != found.Location {
+			targets = append(targets, server)
+		}
+	}
+	return targets
+}
+
+// readRepair stores the given object upon each of the given servers.
+func readRepair(servers []libconfig.BlobServer, id string, content []byte, header http.Header, verbose bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), pullThroughTimeout)
+	defer cancel()
+
+	for _, server := range servers {
+		status, err := copyObject(ctx, server.Location, id, content, header, verbose)
+		if err != nil {
+			GetLogger().Warn("Read-repair failed", "id", id, "location", server.Location, "error", err)
+			continue
+		}
+		if status != http.StatusOK {
+			GetLogger().Warn("Read-repair refused", "id", id, "location", server.Location, "status", status)
+			continue
+		}
+		if verbose {
+			GetLogger().Info("Read-repair stored", "id", id, "location", server.Location)
+		}
+	}
+}
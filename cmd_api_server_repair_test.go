@@ -0,0 +1,79 @@
+// Testing of read-repair via the API-server.
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/skx/sos/libconfig"
+)
+
+// Test that objects are copied back to the members of their group which
+// reported them missing, and to no others.
+func TestAPIReadRepair(t *testing.T) {
+	repaired := make(chan string, 4)
+	missingServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if req.Method == http.MethodPost {
+				body, _ := io.ReadAll(req.Body)
+				repaired <- name + ":" + string(body)
+				return
+			}
+			res.WriteHeader(http.StatusNotFound)
+		}))
+	}
+
+	missing := missingServer("missing")
+	defer missing.Close()
+	other := missingServer("other")
+	defer other.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	holder := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		_, _ = res.Write([]byte("Content"))
+	}))
+	defer holder.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("default", missing.URL)
+	libconfig.AddServer("other", other.URL)
+	libconfig.AddServer("default", down.URL)
+	libconfig.AddServer("default", holder.URL)
+
+	setAPIOptions(apiServerCmd{readRepair: true})
+	defer setAPIOptions(apiServerCmd{})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/fetch/{id}", APIDownloadHandler).Methods("GET")
+
+	req := httptest.NewRequest(http.MethodGet, "/fetch/abc", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", status)
+	}
+	if rr.Body.String() != "Content" {
+		t.Errorf("Unexpected body: %s", rr.Body.String())
+	}
+
+	select {
+	case got := <-repaired:
+		if got != "missing:Content" {
+			t.Errorf("Unexpected repair: %v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The object was not repaired")
+	}
+
+	select {
+	case got := <-repaired:
+		t.Errorf("Unexpected repair: %v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,634 @@
+// Simple testing of the API-server
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/skx/sos/libconfig"
+)
+
+// Test our 404-handler returns a JSON error.
+func TestAPIMissing(t *testing.T) {
+	router := mux.NewRouter()
+	router.PathPrefix("/").HandlerFunc(APIMissingHandler)
+
+	paths := []string{"/", "/robots.txt", "/fetch"}
+
+	for _, path := range paths {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != http.StatusNotFound {
+			t.Errorf("Unexpected status-code for %s: %v", path, status)
+		}
+
+		// Check the content-type & body are what we expect.
+		if rr.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected content-type: %v", rr.Header().Get("Content-Type"))
+		}
+
+		var body errorResponse
+		if jsonErr := json.Unmarshal(rr.Body.Bytes(), &body); jsonErr != nil {
+			t.Fatalf("Response for %s was not JSON: %v", path, jsonErr)
+		}
+		if body.Status != http.StatusNotFound || body.Error != "invalid method or location" {
+			t.Errorf("Unexpected JSON body for %s: %v", path, rr.Body.String())
+		}
+	}
+}
+
+// Test that the root describes the service, and the favicon is quiet.
+func TestAPIIndex(t *testing.T) {
+	setAPIOptions(apiServerCmd{serviceName: "objects"})
+	defer setAPIOptions(apiServerCmd{})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/", APIIndexHandler("download", "GET /fetch/{id}")).Methods("GET")
+	router.HandleFunc("/favicon.ico", APIFaviconHandler).Methods("GET")
+	router.PathPrefix("/").HandlerFunc(APIMissingHandler)
+
+	tests := map[string]int{
+		"/":            http.StatusOK,
+		"/favicon.ico": http.StatusNoContent,
+		"/robots.txt":  http.StatusNotFound,
+	}
+
+	for path, expected := range tests {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != expected {
+			t.Errorf("Unexpected status-code for %s: %v", path, status)
+		}
+		if path != "/" {
+			continue
+		}
+
+		var index apiIndex
+		if jsonErr := json.Unmarshal(rr.Body.Bytes(), &index); jsonErr != nil {
+			t.Fatalf("Response was not JSON: %v", jsonErr)
+		}
+		if index.Service != "objects" || index.Role != "download" || len(index.Endpoints) != 1 {
+			t.Errorf("Unexpected index: %v", rr.Body.String())
+		}
+	}
+}
+
+// fakeBlobServer returns a test-server which responds to every upload
+// with the given status-code.
+func fakeBlobServer(status int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		res.WriteHeader(status)
+	}))
+}
+
+// Test that fan-out uploads succeed, or fail, based upon the quorum.
+func TestAPIUploadQuorum(t *testing.T) {
+	good1 := fakeBlobServer(http.StatusOK)
+	defer good1.Close()
+	good2 := fakeBlobServer(http.StatusOK)
+	defer good2.Close()
+	bad := fakeBlobServer(http.StatusInternalServerError)
+	defer bad.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("default", good1.URL)
+	libconfig.AddServer("default", bad.URL)
+	libconfig.AddServer("default", good2.URL)
+
+	tests := []struct {
+		quorum   int
+		expected int
+	}{
+		{quorum: 0, expected: http.StatusOK},
+		{quorum: 2, expected: http.StatusOK},
+		{quorum: 3, expected: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		setAPIOptions(apiServerCmd{replicas: 3, quorum: test.quorum})
+
+		req, err := http.NewRequest(http.MethodPost, "/upload", strings.NewReader("Content goes here"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		APIUploadHandler(rr, req)
+
+		if status := rr.Code; status != test.expected {
+			t.Errorf("Unexpected status-code for quorum %d: %v", test.quorum, status)
+		}
+
+		var body quorumResponse
+		if jsonErr := json.Unmarshal(rr.Body.Bytes(), &body); jsonErr != nil {
+			t.Fatalf("Response was not JSON: %v", jsonErr)
+		}
+		if test.expected == http.StatusOK && len(body.Succeeded) < body.Quorum {
+			t.Errorf("Upload succeeded without a quorum: %v", rr.Body.String())
+		}
+		if test.expected != http.StatusOK && (len(body.Failed) != 1 || body.Failed[0].Server != bad.URL) {
+			t.Errorf("Failure was not reported: %v", rr.Body.String())
+		}
+	}
+	setAPIOptions(apiServerCmd{})
+}
+
+// Test that a compressed response from a blob-server is relayed untouched.
+func TestAPIDownloadEncoding(t *testing.T) {
+	compressed := []byte{0x1f, 0x8b, 0x08, 0x00}
+
+	blob := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("Accept-Encoding was not forwarded: %v", req.Header.Get("Accept-Encoding"))
+		}
+		res.Header().Set("Content-Encoding", "gzip")
+		_, _ = res.Write(compressed)
+	}))
+	defer blob.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("default", blob.URL)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/fetch/{id}", APIDownloadHandler).Methods("GET")
+
+	req, err := http.NewRequest(http.MethodGet, "/fetch/steve", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+	if rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("Content-Encoding was not relayed: %v", rr.Header().Get("Content-Encoding"))
+	}
+	if !bytes.Equal(rr.Body.Bytes(), compressed) {
+		t.Errorf("Body was modified in transit: %v", rr.Body.Bytes())
+	}
+}
+
+// Test that the blob-server which answered a download may be named.
+func TestAPIDownloadBlobServer(t *testing.T) {
+	missing := fakeBlobServer(http.StatusNotFound)
+	defer missing.Close()
+
+	found := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		res.Header().Set("X-Blob-Server", "forged")
+		_, _ = res.Write([]byte("Content"))
+	}))
+	defer found.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("default", missing.URL)
+	libconfig.AddServer("default", found.URL)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/fetch/{id}", APIDownloadHandler).Methods("GET")
+	defer setAPIOptions(apiServerCmd{})
+
+	for enabled, expected := range map[bool]string{true: found.URL, false: "forged"} {
+		setAPIOptions(apiServerCmd{blobServerHeader: enabled})
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/fetch/steve", nil))
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("Unexpected status-code: %v", status)
+		}
+		if value := rr.Header().Get("X-Blob-Server"); value != expected {
+			t.Errorf("Unexpected X-Blob-Server with the option %v: got %v want %v", enabled, value, expected)
+		}
+	}
+}
+
+// Test that object meta-data may be fetched via the API-server.
+func TestAPIInfo(t *testing.T) {
+	//
+	// Launch a real blob-server, with an object stored upon it.
+	//
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+	storageHandler.Store("steve", []byte("Content"), Metadata{"X-Mime-Type": {"text/plain"}})
+
+	blob := httptest.NewServer(newBlobRouter(""))
+	defer blob.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("default", blob.URL)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/info/{id}", APIInfoHandler).Methods("GET")
+
+	tests := map[string]int{
+		"/info/steve":   http.StatusOK,
+		"/info/missing": http.StatusNotFound,
+	}
+
+	for path, expected := range tests {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != expected {
+			t.Errorf("Unexpected status-code for %s: %v", path, status)
+		}
+		if expected != http.StatusOK {
+			continue
+		}
+
+		var info BlobInfo
+		if jsonErr := json.Unmarshal(rr.Body.Bytes(), &info); jsonErr != nil {
+			t.Fatalf("Response was not JSON: %v", jsonErr)
+		}
+		if info.ID != "steve" || info.Size != 7 || info.Metadata.Get("X-Mime-Type") != "text/plain" {
+			t.Errorf("Unexpected meta-data: %v", rr.Body.String())
+		}
+	}
+}
+
+// Test that the content-type & disposition of an upload survive the hop
+// from the API-server to the blob-server, and back.
+func TestAPIUploadContentType(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+
+	blob := httptest.NewServer(newBlobRouter(""))
+	defer blob.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("default", blob.URL)
+
+	req, err := http.NewRequest(http.MethodPost, "/upload", strings.NewReader("Content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/csv")
+	req.Header.Set("Content-Disposition", `attachment; filename="steve.csv"`)
+
+	rr := httptest.NewRecorder()
+	APIUploadHandler(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", status)
+	}
+
+	var uploaded struct {
+		ID string `json:"id"`
+	}
+	if jsonErr := json.Unmarshal(rr.Body.Bytes(), &uploaded); jsonErr != nil {
+		t.Fatalf("Response was not JSON: %v", jsonErr)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/fetch/{id}", APIDownloadHandler).Methods("GET")
+
+	req, err = http.NewRequest(http.MethodGet, "/fetch/"+uploaded.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if value := rr.Header().Get("Content-Type"); value != "text/csv" {
+		t.Errorf("Unexpected content-type: %v", value)
+	}
+	if value := rr.Header().Get("Content-Disposition"); value != `attachment; filename="steve.csv"` {
+		t.Errorf("Unexpected content-disposition: %v", value)
+	}
+}
+
+// Test that the reasons for a failed upload are reported, when verbose.
+func TestAPIUploadFailures(t *testing.T) {
+	full := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		http.Error(res, "quota exceeded", http.StatusInsufficientStorage)
+	}))
+	defer full.Close()
+	bad := fakeBlobServer(http.StatusInternalServerError)
+	defer bad.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("1", full.URL)
+	libconfig.AddServer("2", bad.URL)
+
+	for _, verbose := range []bool{false, true} {
+		setAPIOptions(apiServerCmd{verbose: verbose})
+
+		req, err := http.NewRequest(http.MethodPost, "/upload", strings.NewReader("Content goes here"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		APIUploadHandler(rr, req)
+
+		if status := rr.Code; status != http.StatusInternalServerError {
+			t.Errorf("Unexpected status-code: %v", status)
+		}
+
+		var body uploadFailedResponse
+		if jsonErr := json.Unmarshal(rr.Body.Bytes(), &body); jsonErr != nil {
+			t.Fatalf("Response was not JSON: %v", jsonErr)
+		}
+
+		if !verbose {
+			if len(body.Failures) != 0 {
+				t.Errorf("Failures were reported without -verbose: %v", rr.Body.String())
+			}
+			continue
+		}
+
+		if len(body.Failures) != 2 {
+			t.Fatalf("Unexpected failures: %v", rr.Body.String())
+		}
+		if body.Failures[0].Status != http.StatusInsufficientStorage || body.Failures[0].Error != "quota exceeded" {
+			t.Errorf("Unexpected failure: %v", body.Failures[0])
+		}
+	}
+	setAPIOptions(apiServerCmd{})
+}
+
+// Test that an upload accepted by a blob-server succeeds, even if the
+// connection is reset before its reply is read.
+func TestAPIUploadReplyUnreadable(t *testing.T) {
+	blob := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		res.Header().Set("Content-Length", "100")
+		res.WriteHeader(http.StatusOK)
+		_, _ = res.Write([]byte("{"))
+		res.(http.Flusher).Flush()
+
+		conn, _, err := http.NewResponseController(res).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer blob.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("default", blob.URL)
+	defer setAPIOptions(apiServerCmd{})
+
+	for _, replicas := range []int{0, 1} {
+		setAPIOptions(apiServerCmd{replicas: replicas})
+
+		req, err := http.NewRequest(http.MethodPost, "/upload", strings.NewReader("Content goes here"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		APIUploadHandler(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("Unexpected status-code with %d replicas: %v", replicas, status)
+		}
+
+		var body struct {
+			ID   string `json:"id"`
+			Size int    `json:"size"`
+		}
+		if jsonErr := json.Unmarshal(rr.Body.Bytes(), &body); jsonErr != nil {
+			t.Fatalf("Response was not JSON: %v", jsonErr)
+		}
+		if body.ID == "" || body.Size != len("Content goes here") {
+			t.Errorf("Unexpected response with %d replicas: %v", replicas, rr.Body.String())
+		}
+	}
+}
+
+// Test that the replicator may share the topology of the API-server.
+func TestAPIConfig(t *testing.T) {
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServerWithWeight("1", "http://a", 2)
+	libconfig.AddServer("1", "http://b")
+	libconfig.AddServer("2", "http://c")
+
+	expected := libconfig.Servers()
+
+	//
+	// Capture the configuration, since we share the server-list
+	// with the replicator in this process.
+	//
+	rr := httptest.NewRecorder()
+	APIConfigHandler(rr, httptest.NewRequest(http.MethodGet, "/config", nil))
+	captured := rr.Body.Bytes()
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		_, _ = res.Write(captured)
+	}))
+	defer server.Close()
+
+	libconfig.ResetServers()
+	if err := serversFromAPI(server.URL); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(libconfig.Servers(), expected) {
+		t.Errorf("Topology mismatch: got %v want %v", libconfig.Servers(), expected)
+	}
+
+	//
+	// The bare list of groups from older API-servers is accepted.
+	//
+	var config apiConfig
+	if err := json.Unmarshal(captured, &config); err != nil {
+		t.Fatal(err)
+	}
+	legacy, _ := json.Marshal(config.Groups)
+	config = apiConfig{}
+	if err := json.Unmarshal(legacy, &config); err != nil || len(config.Groups) != 2 {
+		t.Errorf("Failed to decode a list of groups: %v %v", config, err)
+	}
+
+	//
+	// An unreachable API-server is reported.
+	//
+	server.Close()
+	libconfig.ResetServers()
+	if err := serversFromAPI(server.URL); err == nil {
+		t.Errorf("Expected an error from an unreachable API-server")
+	}
+}
+
+// failingReader returns an error part-way through a body.
+type failingReader struct{}
+
+// Read implements io.Reader.
+func (failingReader) Read(_ []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+// Test that empty, and truncated, uploads are refused.
+func TestAPIUploadEmpty(t *testing.T) {
+	blob := fakeBlobServer(http.StatusOK)
+	defer blob.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("1", blob.URL)
+
+	tests := []struct {
+		body       io.Reader
+		allowEmpty bool
+		status     int
+	}{
+		{strings.NewReader(""), false, http.StatusBadRequest},
+		{strings.NewReader(""), true, http.StatusOK},
+		{failingReader{}, true, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		setAPIOptions(apiServerCmd{allowEmpty: test.allowEmpty})
+
+		req, err := http.NewRequest(http.MethodPost, "/upload", test.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		APIUploadHandler(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("Unexpected status-code: %v", status)
+		}
+	}
+	setAPIOptions(apiServerCmd{})
+}
+
+// Test that signed URLs are verified.
+func TestAPISignedURL(t *testing.T) {
+	blob := fakeBlobServer(http.StatusOK)
+	defer blob.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("1", blob.URL)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/sign", APISignHandler).Methods("POST")
+	router.HandleFunc("/fetch/{id}", APIDownloadHandler).Methods("GET")
+	router.HandleFunc("/info/{id}", APIInfoHandler).Methods("GET")
+
+	fetch := func(path string) int {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	//
+	// Signing is disabled without a key.
+	//
+	setAPIOptions(apiServerCmd{})
+	t.Setenv(envSigningKey, "")
+	req, _ := http.NewRequest(http.MethodPost, "/sign?id=abc", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotImplemented {
+		t.Errorf("Unexpected status-code: %v", rr.Code)
+	}
+
+	setAPIOptions(apiServerCmd{signingKey: "secret", requireSignature: true})
+	defer setAPIOptions(apiServerCmd{})
+
+	req, _ = http.NewRequest(http.MethodPost, "/sign?id=abc&ttl=1m", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var signed signedURL
+	if err := json.Unmarshal(rr.Body.Bytes(), &signed); err != nil {
+		t.Fatalf("Response was not JSON: %v", err)
+	}
+
+	tests := map[string]int{
+		signed.URL:   http.StatusOK,
+		"/fetch/abc": http.StatusForbidden,
+		"/fetch/abc?exp=" + strconv.FormatInt(signed.Expires, 10) + "&sig=bogus": http.StatusForbidden,
+		strings.Replace(signed.URL, "/fetch/abc", "/fetch/def", 1):               http.StatusForbidden,
+		"/fetch/abc?exp=1&sig=" + signature([]byte("secret"), "abc", 1):          http.StatusForbidden,
+		strings.Replace(signed.URL, "/fetch/", "/info/", 1):                      http.StatusOK,
+		"/info/abc": http.StatusForbidden,
+	}
+	for path, expected := range tests {
+		if status := fetch(path); status != expected {
+			t.Errorf("Unexpected status-code for %s: %v", path, status)
+		}
+	}
+}
+
+// Test that uploads with excessive meta-data are refused before being
+// sent to any blob-server.
+func TestAPIUploadMetaLimits(t *testing.T) {
+	calls := 0
+	blob := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		calls++
+	}))
+	defer blob.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("1", blob.URL)
+
+	setAPIOptions(apiServerCmd{maxMetaHeaders: 1})
+	defer setAPIOptions(apiServerCmd{})
+
+	req, err := http.NewRequest(http.MethodPost, "/upload", strings.NewReader("Content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-One", "1")
+	req.Header.Set("X-Two", "2")
+
+	rr := httptest.NewRecorder()
+	APIUploadHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+	if calls != 0 {
+		t.Errorf("The upload was sent to a blob-server")
+	}
+}
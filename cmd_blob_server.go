@@ -6,22 +6,61 @@ package main
 
 import (
 	"bytes"
+	"cmp"
+	"crypto/md5" //nolint:gosec // MD5 is used for S3-compatible ETags, not for security.
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/skx/sos/libconfig"
 )
 
+// md5MetaKey is the meta-data key under which the MD5 digest of an
+// object is stored, when we're running in S3-compatible mode.
+const md5MetaKey = "Content-Md5"
+
+// idPattern matches the only IDs we're prepared to store or serve.
+//
+// Hyphens are permitted between alphanumeric runs, so that UUIDs may be
+// used as IDs.
+var idPattern = regexp.MustCompile("^([a-z0-9]+(-[a-z0-9]+)*)$")
+
+// maxIDLength is the length of the longest ID we accept, which is ample
+// for a SHA256 digest, or a bucket and key.
+const maxIDLength = 256
+
 // storage holds a handle to our selected storage-method.
 var storage StorageHandler
 
+// blobOptions holds options passed to this sub-command, so that the
+// handlers can test which optional behaviours are in-force.
+var blobOptions blobServerCmd
+
+// setBlobOptions stores the blob-server options for use by handlers.
+func setBlobOptions(opts blobServerCmd) {
+	blobOptions = opts
+}
+
+// getBlobOptions returns the current blob-server options.
+func getBlobOptions() blobServerCmd {
+	return blobOptions
+}
+
 // setStorage stores the storage handler for use by handlers.
 func setStorage(s StorageHandler) {
 	storage = s
@@ -32,12 +71,74 @@ func getStorage() StorageHandler {
 	return storage
 }
 
+// validateID ensures the given ID is acceptable, returning the HTTP
+// status-code and error to report to the client if it is not.
+//
+// IDs must be alphanumeric, and if an explicit length was configured
+// they must also be exactly that long - since IDs are normally SHA256
+// digests anything else is certainly bogus.
+//
+// Overly long IDs are rejected before any pattern is matched.
+func validateID(id string) (int, error) {
+	if len(id) > maxIDLength {
+		return http.StatusBadRequest, fmt.Errorf("IDs must be at most %d characters long", maxIDLength)
+	}
+
+	//
+	// An ID within a bucket has a single separator, each side of
+	// which must be a valid ID in its own right.  Such IDs are
+	// only accepted if buckets are enabled.
+	//
+	if bucket, key, ok := splitBucket(id); ok && getBlobOptions().buckets {
+		if !idPattern.MatchString(bucket) || !idPattern.MatchString(key) {
+			return http.StatusInternalServerError, errors.New("alphanumeric IDs only")
+		}
+		return 0, nil
+	}
+
+	if !idPattern.MatchString(id) {
+		return http.StatusInternalServerError, errors.New("alphanumeric IDs only")
+	}
+
+	if length := getBlobOptions().idLength; length > 0 && len(id) != length {
+		return http.StatusBadRequest, fmt.Errorf("IDs must be %d characters long", length)
+	}
+	return 0, nil
+}
+
 // HealthHandler is a status end-point which can be polled remotely
 // to test health.
 func HealthHandler(res http.ResponseWriter, _ *http.Request) {
 	_, _ = res.Write([]byte("alive"))
 }
 
+// blobStats is the document returned by our `/stats` end-point.
+type blobStats struct {
+	Objects   int    `json:"objects"`
+	DiskFree  uint64 `json:"disk_free,omitempty"`
+	DiskTotal uint64 `json:"disk_total,omitempty"`
+}
+
+// StatsHandler reports the number of objects we hold, and the free
+// space upon our store, as JSON.
+func StatsHandler(res http.ResponseWriter, _ *http.Request) {
+	list, err := getStorage().Existing()
+	if err != nil {
+		GetLogger().Error("Failed to list objects", "error", err)
+		writeJSONError(res, http.StatusInternalServerError, "failed to list objects")
+		return
+	}
+
+	stats := blobStats{Objects: len(list)}
+	if free, total, err := diskFree(); err == nil {
+		stats.DiskFree, stats.DiskTotal = free, total
+	}
+
+	body, _ := json.Marshal(stats)
+	res.Header().Set("Content-Type", "application/json")
+	_, _ = res.Write(body)
+}
+
 // GetHandler allows a blob to be retrieved by name.
 //
 // This is called with requests like `GET /blob/XXXXXX`.
@@ -45,6 +146,7 @@ func GetHandler(res http.ResponseWriter, req *http.Request) {
 	var (
 		status int
 		err    error
+		start  = time.Now()
 	)
 	defer func() {
 		if nil != err {
@@ -52,11 +154,18 @@ func GetHandler(res http.ResponseWriter, req *http.Request) {
 		}
 	}()
 
+	//
+	// Identify ourselves, if we've been asked to.
+	//
+	if getBlobOptions().servedBy && getBlobOptions().name != "" {
+		res.Header().Set("X-Served-By", getBlobOptions().name)
+	}
+
 	//
 	// Get the ID which is requested.
 	//
 	vars := mux.Vars(req)
-	id := vars["id"]
+	id := resolveAlias(vars["id"])
 
 	//
 	// We're in a chroot() so we shouldn't need to worry
@@ -64,26 +173,34 @@ func GetHandler(res http.ResponseWriter, req *http.Request) {
 	// will have failed if we were not launched by root, so
 	// we need to make sure we avoid directory-traversal attacks.
 	//
-	r := regexp.MustCompile("^([a-z0-9]+)$")
-	if !r.MatchString(id) {
-		status = http.StatusInternalServerError
-		err = errors.New("alphanumeric IDs only")
+	if status, err = validateID(id); err != nil {
 		return
 	}
 
 	//
 	// If the request method was HEAD we don't need to
-	// lookup & return n the data, just see if it exists.
+	// lookup & return the data, just see if it exists.
 	//
-	//  We'll terminate early and just return the status-code
-	// 200 vs. 404.
+	// We'll terminate early and just return the status-code
+	// 200 vs. 404, along with the size & meta-data of the object.
 	//
 	if req.Method == http.MethodHead {
 		res.Header().Set("Connection", "close")
 
-		if !getStorage().Exists(id) {
-			res.WriteHeader(http.StatusNotFound)
+		size, ok := getStorage().Size(id)
+		meta := getStorage().Meta(id)
+		if !ok || expired(meta) {
+			if !serveNotFound(res, req) {
+				res.WriteHeader(http.StatusNotFound)
+			}
+			return
 		}
+
+		//
+		// The meta-data is returned as it would be by a GET.
+		//
+		setMetaHeaders(res.Header(), meta)
+		res.Header().Set("Content-Length", strconv.FormatInt(size, 10))
 		return
 	}
 
@@ -91,53 +208,326 @@ func GetHandler(res http.ResponseWriter, req *http.Request) {
 	// If we reached this point then the request was a GET
 	// so we lookup the data, returning it if present.
 	//
-	data, meta := getStorage().Get(id)
+	data, meta := openObject(id)
+	if data != nil {
+		defer data.Close()
+	}
 
 	//
-	// The data was missing..
+	// The data was missing, or has expired..
 	//
-	if data == nil {
-		http.NotFound(res, req)
+	if data == nil || expired(meta) {
+		if !serveNotFound(res, req) {
+			writeJSONError(res, http.StatusNotFound, "not found")
+		}
 	} else {
+		recordAccess(id)
+
 		//
 		// The meta-data will be used to populate the HTTP-response
 		// headers.
 		//
-		for k, v := range meta {
-			//
-			// Special case to set the content-type
-			// of the returned value.
-			//
-			if k == "X-Mime-Type" {
-				res.Header().Set(k, v)
-				k = "Content-Type"
-			}
+		setMetaHeaders(res.Header(), meta)
 
-			//
-			// Add the response header.
-			//
-			res.Header().Set(k, v)
+		//
+		// If the client already holds an up-to-date copy
+		// there's no need to send it again.
+		//
+		if notModified(req, res, meta) {
+			res.WriteHeader(http.StatusNotModified)
+			return
 		}
-		if _, copyErr := io.Copy(res, bytes.NewReader(*data)); copyErr != nil {
+
+		//
+		// The write-deadline is extended as the data is sent, so
+		// large objects aren't truncated by the WriteTimeout.
+		//
+		copied, copyErr := copyWithDeadline(res, data, getBlobOptions().writeTimeout)
+		observeDownload(ObservedEvent{Service: "blob-server", ID: id, Size: copied, Status: http.StatusOK}, start, copyErr)
+		if copyErr != nil {
 			panic(copyErr)
 		}
 	}
 }
 
+// serveNotFound sends the placeholder object, configured via the
+// `-not-found-blob` flag, in place of a missing object.
+//
+// It returns false if there is no placeholder, leaving the caller to
+// report the object as missing.
+func serveNotFound(res http.ResponseWriter, req *http.Request) bool {
+	placeholder := getBlobOptions().notFoundBlob
+	if placeholder == "" {
+		return false
+	}
+
+	data, meta := getStorage().Get(placeholder)
+	if data == nil {
+		GetLogger().Warn("Placeholder object is missing", "object", placeholder)
+		return false
+	}
+
+	if mime := meta.Get("X-Mime-Type"); mime != "" {
+		res.Header().Set("Content-Type", mime)
+	}
+	res.Header().Set("Content-Length", strconv.Itoa(len(*data)))
+
+	status := getBlobOptions().notFoundStatus
+	if status == 0 {
+		status = http.StatusNotFound
+	}
+	res.WriteHeader(status)
+
+	if req.Method != http.MethodHead {
+		_, _ = res.Write(*data)
+	}
+	return true
+}
+
+// managedHeaders are the response headers which we set ourselves, or
+// which only concern a single connection, so they're never copied from
+// the meta-data of an object.
+var managedHeaders = map[string]bool{
+	"Connection":          true,
+	"Content-Encoding":    true,
+	"Content-Length":      true,
+	"Content-Range":       true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// validHeaderName returns true if the given string is a legal header
+// name, as defined by RFC 9110: a non-empty sequence of token characters.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if c >= 0x80 || !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// validHeaderValue returns true if the given string may be sent as the
+// value of a header, without splitting it.
+func validHeaderValue(value string) bool {
+	for _, c := range []byte(value) {
+		if c == 0x7f || (c < ' ' && c != '\t') {
+			return false
+		}
+	}
+	return true
+}
+
+// setMetaHeaders populates the given HTTP-response headers from the
+// meta-data which was stored alongside an object.
+//
+// A header which was uploaded with several values is returned with each
+// of them, in their original order.
+//
+// Meta-data which would produce a malformed response, or replace the
+// headers we manage ourselves, is logged and dropped.
+func setMetaHeaders(header http.Header, meta Metadata) {
+	for k, values := range meta {
+		if !validHeaderName(k) || managedHeaders[http.CanonicalHeaderKey(k)] {
+			GetLogger().Warn("Dropping meta-data header", "header", k)
+			continue
+		}
+		if slices.ContainsFunc(values, func(v string) bool { return !validHeaderValue(v) }) {
+			GetLogger().Warn("Dropping meta-data header with an invalid value", "header", k)
+			continue
+		}
+
+		//
+		// Special case to set the content-type
+		// of the returned value.
+		//
+		if k == "X-Mime-Type" {
+			header.Set("Content-Type", meta.Get(k))
+		}
+		if k == "X-Cache-Control" {
+			header.Set("Cache-Control", meta.Get(k))
+		}
+
+		//
+		// The stored MD5 digest is only exposed, as an
+		// ETag, when we're in S3-compatible mode.
+		//
+		if k == md5MetaKey {
+			if etag := md5ETag(meta.Get(k)); etag != "" && getBlobOptions().s3compat {
+				header.Set("ETag", etag)
+			}
+			continue
+		}
+
+		//
+		// Add the response header(s).
+		//
+		header.Del(k)
+		for _, v := range values {
+			header.Add(k, v)
+		}
+	}
+
+	//
+	// Objects stored without their own directives receive ours.
+	//
+	if header.Get("Cache-Control") == "" && getBlobOptions().defaultCacheControl != "" {
+		header.Set("Cache-Control", getBlobOptions().defaultCacheControl)
+	}
+}
+
+// notModified returns true if the request carried an `If-None-Match`
+// header matching the ETag we're sending, or an `If-Modified-Since`
+// header and the object has not been modified since that time.
+//
+// As RFC 7232 requires `If-Modified-Since` is ignored if the request
+// carried an `If-None-Match` header.
+func notModified(req *http.Request, res http.ResponseWriter, meta Metadata) bool {
+	if header := strings.Join(req.Header.Values("If-None-Match"), ","); header != "" {
+		return noneMatch(header, res.Header().Get("ETag"))
+	}
+
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	modified, err := http.ParseTime(meta.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !modified.After(since)
+}
+
 // MissingHandler is a handler which is used as a fall-back if no matching
 // handler is found.
 func MissingHandler(res http.ResponseWriter, _ *http.Request) {
-	res.WriteHeader(http.StatusNotFound)
-	if _, err := res.Write([]byte("404 - content is not hosted here.")); err != nil {
-		panic(err)
+	writeJSONError(res, http.StatusNotFound, "content is not hosted here")
+}
+
+// BlobDetail describes a single object, in a detailed listing.
+type BlobDetail struct {
+	ID      string `json:"id"`
+	Size    int64  `json:"size"`
+	Mime    string `json:"mime,omitempty"`
+	Created string `json:"created,omitempty"`
+}
+
+// BlobInfo is the document describing a single object, including all
+// of the meta-data which was stored alongside it.
+type BlobInfo struct {
+	BlobDetail
+
+	Metadata Metadata `json:"metadata"`
+
+	// Accesses and LastAccess are only present with -track-access.
+	Accesses   int64  `json:"accesses,omitempty"`
+	LastAccess string `json:"last_access,omitempty"`
+}
+
+// InfoHandler returns the meta-data of a single object, as JSON.
+//
+// This is called with requests like `GET /info/XXXXXX`.
+func InfoHandler(res http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	if status, err := validateID(id); err != nil {
+		http.Error(res, err.Error(), status)
+		return
+	}
+
+	info, ok := describeBlob(id)
+	if !ok {
+		writeJSONError(res, http.StatusNotFound, "not found")
+		return
 	}
+
+	body, _ := json.Marshal(info)
+	res.Header().Set("Content-Type", "application/json")
+	_, _ = res.Write(body)
 }
 
 // ListHandler returns the IDs of all blobs we know about.
 //
 // This is used by the replication utility.
-func ListHandler(res http.ResponseWriter, _ *http.Request) {
-	list := getStorage().Existing()
+//
+// If the request has the parameter `detail=true` then rather than an
+// array of IDs we return an array of BlobDetail objects.
+//
+// If the request has one, or more, `tag=X-Name:value` parameters then
+// only objects with matching meta-data are returned.
+//
+// If the request has a `since` parameter, of seconds since the epoch,
+// only objects stored at, or after, that time are returned.
+func ListHandler(res http.ResponseWriter, req *http.Request) {
+	//
+	// A plain listing is streamed, if the storage allows it, since
+	// stores may hold millions of objects.
+	//
+	query := req.URL.Query()
+	if enumerator, ok := getStorage().(Enumerator); ok && query.Get("detail") != "true" && len(query["tag"]) == 0 && !query.Has("since") {
+		streamList(res, enumerator, query.Get("prefix"))
+		return
+	}
+
+	//
+	// A failure must not be reported as an empty list, since the
+	// replicator would believe we had lost every object.
+	//
+	list, err := getStorage().Existing()
+	if err != nil {
+		GetLogger().Error("Failed to list objects", "error", err)
+		writeJSONError(res, http.StatusInternalServerError, "failed to list objects")
+		return
+	}
+
+	//
+	// A prefix selects a range of the keyspace, so that several
+	// replicators may share the work.
+	//
+	if prefix := req.URL.Query().Get("prefix"); prefix != "" {
+		list = slices.DeleteFunc(list, func(id string) bool {
+			return !strings.HasPrefix(id, prefix)
+		})
+	}
+
+	if tags := req.URL.Query()["tag"]; len(tags) > 0 {
+		if list, err = filterTags(list, tags); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if since := req.URL.Query().Get("since"); since != "" {
+		seconds, parseErr := strconv.ParseInt(since, 10, 64)
+		if parseErr != nil {
+			writeJSONError(res, http.StatusBadRequest, "invalid since, expected seconds since the epoch")
+			return
+		}
+		list = filterSince(list, time.Unix(seconds, 0))
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+
+	if req.URL.Query().Get("detail") == "true" {
+		details := []BlobDetail{}
+		for _, id := range list {
+			if info, ok := describeBlob(id); ok {
+				details = append(details, info.BlobDetail)
+			}
+		}
+		mapB, _ := json.Marshal(details)
+		_, _ = res.Write(mapB)
+		return
+	}
 
 	//
 	// If the list is non-empty then build up an array
@@ -151,6 +541,132 @@ func ListHandler(res http.ResponseWriter, _ *http.Request) {
 	}
 }
 
+// streamList writes the IDs which begin with the given prefix as a JSON
+// array, encoding each as it is enumerated, so that the complete list
+// is never held in memory.
+func streamList(res http.ResponseWriter, enumerator Enumerator, prefix string) {
+	var element bytes.Buffer
+	encoder := json.NewEncoder(&element)
+	count := 0
+
+	res.Header().Set("Content-Type", "application/json")
+
+	err := enumerator.Enumerate(func(id string) error {
+		if !strings.HasPrefix(id, prefix) {
+			return nil
+		}
+
+		element.Reset()
+		if count == 0 {
+			element.WriteByte('[')
+		} else {
+			element.WriteByte(',')
+		}
+		if err := encoder.Encode(id); err != nil {
+			return err
+		}
+		count++
+
+		// The encoder terminates each value with a newline, which we drop.
+		_, err := res.Write(bytes.TrimSuffix(element.Bytes(), []byte("\n")))
+		return err
+	})
+
+	//
+	// Once we've started to send the array we can no longer report an
+	// error, so the response is aborted instead, leaving the client
+	// with truncated JSON rather than a short list.
+	//
+	if err != nil {
+		GetLogger().Error("Failed to list objects", "error", err)
+		if count == 0 {
+			writeJSONError(res, http.StatusInternalServerError, "failed to list objects")
+			return
+		}
+		panic(http.ErrAbortHandler)
+	}
+
+	end := "]"
+	if count == 0 {
+		end = "[]"
+	}
+	if _, err = res.Write([]byte(end)); err != nil {
+		panic(err)
+	}
+}
+
+// filterTags returns those IDs whose meta-data matches every one of the
+// given `X-Name:value` tags.
+//
+// NOTE: Unless the storage keeps an index of meta-data, as the pack
+// storage does, this reads the meta-data of every object.
+func filterTags(list []string, tags []string) ([]string, error) {
+	want := make(map[string]string)
+	for _, tag := range tags {
+		name, value, ok := strings.Cut(tag, ":")
+		if !ok || !strings.HasPrefix(http.CanonicalHeaderKey(name), "X-") {
+			return nil, fmt.Errorf("invalid tag '%s', expected X-Name:value", tag)
+		}
+		want[http.CanonicalHeaderKey(name)] = value
+	}
+
+	var matched []string
+	for _, id := range list {
+		meta := getStorage().Meta(id)
+
+		ok := true
+		for name, value := range want {
+			if !slices.Contains(meta[name], value) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			matched = append(matched, id)
+		}
+	}
+	return matched, nil
+}
+
+// filterSince returns those of the given objects which were stored at, or
+// after, the given time.
+//
+// Objects without a recorded time are always returned, since we cannot
+// tell that they're old.
+func filterSince(list []string, since time.Time) []string {
+	return slices.DeleteFunc(list, func(id string) bool {
+		stored, err := http.ParseTime(getStorage().Meta(id).Get("Last-Modified"))
+		return err == nil && stored.Before(since)
+	})
+}
+
+// describeBlob returns the details of the object with the given ID,
+// without reading the object itself.
+func describeBlob(id string) (BlobInfo, bool) {
+	size, ok := getStorage().Size(id)
+	if !ok {
+		return BlobInfo{}, false
+	}
+
+	meta := getStorage().Meta(id)
+	if meta == nil {
+		meta = make(Metadata)
+	}
+
+	info := BlobInfo{
+		BlobDetail: BlobDetail{
+			ID:      id,
+			Size:    size,
+			Mime:    meta.Get("X-Mime-Type"),
+			Created: meta.Get("Last-Modified"),
+		},
+		Metadata: meta,
+	}
+	info.Accesses, info.LastAccess = accessInfo(id)
+
+	return info, true
+}
+
 // UploadHandler is invoked to handle storing data in the blob-server.
 func UploadHandler(res http.ResponseWriter, req *http.Request) {
 	var (
@@ -178,44 +694,231 @@ func UploadHandler(res http.ResponseWriter, req *http.Request) {
 	// Ensure the ID is entirely alphanumeric, to prevent
 	// traversal attacks.
 	//
-	r := regexp.MustCompile("^([a-z0-9]+)$")
-	if !r.MatchString(id) {
-		err = errors.New("alphanumeric IDs only")
-		status = http.StatusInternalServerError
+	if status, err = validateID(id); err != nil {
+		return
+	}
+
+	//
+	// Refuse excessive meta-data, which we'd otherwise store and
+	// serve back with the object.
+	//
+	if err = checkMetaHeaders(req.Header, getBlobOptions().maxMetaHeaders, getBlobOptions().maxMetaBytes); err != nil {
+		status = http.StatusRequestHeaderFieldsTooLarge
+		return
+	}
+	if err = checkExpires(req.Header); err != nil {
+		status = http.StatusBadRequest
+		return
+	}
+
+	//
+	// Refuse new objects if we're running out of space, so that
+	// they'll be stored elsewhere.
+	//
+	if diskNearlyFull() || objectLimitReached(id) {
+		err = errors.New("insufficient storage")
+		status = http.StatusInsufficientStorage
 		return
 	}
 
 	//
 	// Read the body of the request.
 	//
+	if req.Body == nil {
+		err = errors.New("missing body")
+		status = http.StatusBadRequest
+		return
+	}
+	limitUploadRate(res, req, getBlobOptions().minUploadRate, getBlobOptions().readTimeout)
 	content, err := io.ReadAll(req.Body)
+	if errors.Is(err, errUploadTooSlow) {
+		status = http.StatusRequestTimeout
+		return
+	}
 	if err != nil {
 		err = errors.New("failed to read body")
-		status = http.StatusInternalServerError
+		status = http.StatusBadRequest
+		return
+	}
+	if len(content) == 0 && !getBlobOptions().allowEmpty {
+		err = errors.New("empty body")
+		status = http.StatusBadRequest
 		return
 	}
 
+	//
+	// Trailers are only available once the body has been read.
+	//
+	if err = checkContentSHA256(req.Trailer, content); err != nil {
+		status = http.StatusBadRequest
+		return
+	}
+
+	//
+	// Collect the meta-data which is persisted alongside the object.
+	//
+	extras := uploadMeta(req.Header)
+
+	//
+	// Refuse content of a type we've been told not to store.
+	//
+	if err = checkMime(req.Header, content, extras); err != nil {
+		status = http.StatusUnsupportedMediaType
+		return
+	}
+
+	//
+	// In S3-compatible mode we verify any `Content-MD5` header the
+	// client sent, and record the digest so that it may later be
+	// returned as the ETag without being recomputed.
+	//
+	if getBlobOptions().s3compat {
+		digest := contentMD5(content)
+
+		if expected := req.Header.Get("Content-MD5"); expected != "" && expected != digest {
+			err = errors.New("content-md5 mismatch")
+			status = http.StatusBadRequest
+			return
+		}
+		extras.Set(md5MetaKey, digest)
+	}
+
+	storeUpload(res, req, id, content, extras)
+}
+
+// contentSHA256 is the trailer in which the hex-encoded SHA256 of an
+// upload may be sent, after the body.
+const contentSHA256 = "X-Content-Sha256"
+
+// checkContentSHA256 verifies the given content against the digest in
+// the `X-Content-SHA256` trailer, if one was sent.
+//
+// Unlike `Content-Length` this detects an upload which was truncated,
+// or corrupted, along the way.
+func checkContentSHA256(trailer http.Header, content []byte) error {
+	expected := trailer.Get(contentSHA256)
+	if expected == "" {
+		return nil
+	}
+
+	sum := sha256.Sum256(content)
+	if !strings.EqualFold(expected, hex.EncodeToString(sum[:])) {
+		return errors.New("content-sha256 mismatch")
+	}
+	return nil
+}
+
+// checkMetaHeaders ensures the X-headers of an upload, which we store as
+// meta-data, are within the given limits of number & total size.
+//
+// A zero limit is not enforced.
+func checkMetaHeaders(header http.Header, maxCount int, maxBytes int) error {
+	count, size := 0, 0
+	for name, values := range header {
+		if !strings.HasPrefix(name, "X-") {
+			continue
+		}
+		count++
+		for _, value := range values {
+			size += len(name) + len(value)
+		}
+	}
+
+	if maxCount > 0 && count > maxCount {
+		return fmt.Errorf("too many X-headers, the limit is %d", maxCount)
+	}
+	if maxBytes > 0 && size > maxBytes {
+		return fmt.Errorf("X-headers too large, the limit is %d bytes", maxBytes)
+	}
+	return nil
+}
+
+// uploadMeta builds the meta-data to store alongside an uploaded object,
+// from the headers of the upload request.
+func uploadMeta(header http.Header) Metadata {
 	//
 	// If we received any X-headers in our request then save
 	// them to our extra-hash.  These will be persisted and
-	// restored
+	// restored, along with every value of a repeated header.
+	//
+	extras := make(Metadata)
+
+	for name, values := range header {
+		if strings.HasPrefix(name, "X-") {
+			extras[name] = slices.Clone(values)
+		}
+	}
+
+	//
+	// Without an explicit `X-Mime-Type` we keep the `Content-Type`
+	// the client sent, unless it tells us nothing.  Clients such as
+	// curl send a form-type by default.
 	//
-	extras := make(map[string]string)
+	if len(extras["X-Mime-Type"]) == 0 {
+		if parsed, _, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil && !genericTypes[parsed] {
+			extras.Set("X-Mime-Type", header.Get("Content-Type"))
+		}
+	}
+	if disposition := header.Get("Content-Disposition"); disposition != "" {
+		extras.Set("Content-Disposition", disposition)
+	}
+	if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		extras.Set("Expires", expires.UTC().Format(http.TimeFormat))
+	}
 
-	for header, value := range req.Header {
-		if strings.HasPrefix(header, "X-") {
-			extras[header] = value[0]
+	//
+	// Similarly a `Cache-Control` is kept as `X-Cache-Control`, which
+	// is served back as the `Cache-Control` of the object.
+	//
+	if len(extras["X-Cache-Control"]) == 0 {
+		if cache := header.Get("Cache-Control"); cache != "" {
+			extras.Set("X-Cache-Control", cache)
 		}
 	}
 
+	//
+	// Record the time the object was modified.
+	//
+	// When an object is mirrored by the replication utility the
+	// original time is sent along with it, and we preserve that so
+	// that each copy reports a consistent modification time.
+	//
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		modified = time.Now()
+	}
+	extras.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+
+	return extras
+}
+
+// storeUpload writes the uploaded content to storage, and reports the
+// result to the client.  It returns false if the content was not stored.
+func storeUpload(res http.ResponseWriter, req *http.Request, id string, content []byte, extras Metadata) bool {
+	return storeUploadWith(res, req, id, int64(len(content)), extras, func() bool {
+		return storeCounted(id, content, extras)
+	})
+}
+
+// storeUploadWith is storeUpload, for content of the given size which is
+// written to storage by the given function.
+func storeUploadWith(res http.ResponseWriter, req *http.Request, id string, size int64, extras Metadata, store func() bool) bool {
+	start := time.Now()
+	event := ObservedEvent{Service: "blob-server", ID: id, Size: size}
+
 	//
 	// Store the body, via our interface.
 	//
-	if ok := getStorage().Store(id, content, extras); !ok {
-		err = errors.New("failed to write to storage")
-		status = http.StatusInternalServerError
-		return
+	if ok := store(); !ok {
+		http.Error(res, "failed to write to storage", http.StatusInternalServerError)
+		event.Status = http.StatusInternalServerError
+		observeUpload(event, start, errors.New("failed to write to storage"))
+		return false
 	}
+	event.Status = http.StatusOK
+	observeUpload(event, start, nil)
+	audit(req, "store", id, size)
+	notifyWebhook(id, int(size), extras)
 
 	//
 	// Output the result - horrid.
@@ -225,51 +928,263 @@ func UploadHandler(res http.ResponseWriter, req *http.Request) {
 	//   "status": "ok",
 	//  }
 	//
-	out := fmt.Sprintf("{\"id\":\"%s\",\"status\":\"OK\",\"size\":%d}", id, len(content))
+	out := fmt.Sprintf("{\"id\":\"%s\",\"status\":\"OK\",\"size\":%d}", id, size)
 	_, _ = res.Write([]byte(out))
+	return true
 }
 
-// blobServer is our entry-point to the sub-command.
-func blobServer(options blobServerCmd) {
-	//
-	// Create a storage system.
+// contentMD5 returns the base64-encoded MD5 digest of the given content,
+// in the form used by the `Content-MD5` header.
+func contentMD5(content []byte) string {
+	sum := md5.Sum(content) //nolint:gosec // S3-compatible ETag, not security.
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// md5ETag converts a base64-encoded MD5 digest, as stored in our
+// meta-data, to the quoted hex-string S3 clients expect as an ETag.
+func md5ETag(digest string) string {
+	raw, err := base64.StdEncoding.DecodeString(digest)
+	if err != nil {
+		return ""
+	}
+	return "\"" + hex.EncodeToString(raw) + "\""
+}
+
+// newBlobRouter creates the router for the blob-server, with each of
+// our routes placed beneath the given path-prefix.
+func newBlobRouter(prefix string) *mux.Router {
+	router := mux.NewRouter()
+
 	//
-	// At the moment we only have a filesystem-based storage
-	// class.  In the future it is possible we'd have more, and we'd
-	// choose between them via a command-line flag.
+	// Normalize the prefix to have a leading, but no trailing, slash.
 	//
-	storageHandler := new(FilesystemStorage)
-	storageHandler.Setup(options.store)
-	setStorage(storageHandler)
+	routes := router
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		routes = router.PathPrefix("/" + prefix).Subrouter()
+	}
 
 	//
-	// Create a new router and our route-mappings.
+	// Objects are served beneath `/blob/{id}`, unless -blob-path
+	// chose another layout.
 	//
-	router := mux.NewRouter()
-	router.HandleFunc("/alive", HealthHandler).Methods("GET")
-	router.HandleFunc("/blob/{id}", GetHandler).Methods("GET")
-	router.HandleFunc("/blob/{id}", GetHandler).Methods("HEAD")
-	router.HandleFunc("/blob/{id}", UploadHandler).Methods("POST")
-	router.HandleFunc("/blobs", ListHandler).Methods("GET")
+	blobPath := libconfig.BlobPath()
+
+	routes.HandleFunc("/alias/{name}", AliasHandler).Methods("PUT")
+	routes.HandleFunc("/alias/{name}", DeleteAliasHandler).Methods("DELETE")
+	routes.HandleFunc("/alive", HealthHandler).Methods("GET")
+	routes.HandleFunc("/b/{bucket}/{key}", instrument("blob-server", "/b/{bucket}/{key}", BucketHandler(GetHandler))).Methods("GET", "HEAD")
+	routes.HandleFunc("/b/{bucket}/{key}", instrument("blob-server", "/b/{bucket}/{key}", BucketHandler(UploadHandler))).Methods("POST")
+	routes.HandleFunc("/alive", HealthHandler).Methods("HEAD")
+	routes.HandleFunc(blobPath, instrument("blob-server", blobPath, GetHandler)).Methods("GET")
+	routes.HandleFunc(blobPath, instrument("blob-server", blobPath, GetHandler)).Methods("HEAD")
+	routes.HandleFunc(blobPath, instrument("blob-server", blobPath, UploadHandler)).Methods("POST")
+	routes.HandleFunc(blobPath, DeleteHandler).Methods("DELETE")
+	routes.HandleFunc("/blobs", ListHandler).Methods("GET")
+	routes.HandleFunc("/blobs/get", instrument("blob-server", "/blobs/get", BatchGetHandler)).Methods("POST")
+	routes.HandleFunc("/info", ServerInfoHandler).Methods("GET")
+	routes.HandleFunc("/info/{id}", InfoHandler).Methods("GET")
+	routes.HandleFunc("/manifest", ManifestHandler).Methods("GET")
+	routes.HandleFunc("/restore/{id}", RestoreHandler).Methods("POST")
+	routes.HandleFunc("/stats", StatsHandler).Methods("GET")
+	routes.HandleFunc("/uploads", CreateUploadHandler).Methods("POST")
+	routes.HandleFunc("/uploads/{uid}", UploadStatusHandler).Methods("HEAD")
+	routes.HandleFunc("/uploads/{uid}", AppendUploadHandler).Methods("PATCH")
+	routes.HandleFunc("/uploads/{uid}/complete", CompleteUploadHandler).Methods("POST")
+	routes.HandleFunc("/verify/{id}", VerifyHandler).Methods("GET")
 	router.PathPrefix("/").HandlerFunc(MissingHandler)
-	http.Handle("/", router)
+	return router
+}
+
+// newStorage creates the storage-class with the given name.
+func newStorage(name string) (StorageHandler, error) {
+	switch name {
+	case "filesystem":
+		return new(FilesystemStorage), nil
+	case "pack":
+		return new(PackStorage), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend '%s'", name)
+}
+
+// blobServer is our entry-point to the sub-command, returning an error
+// if the server could not be started, or failed.
+func blobServer(options blobServerCmd) error {
+	if options.name != "" {
+		setLoggerNode(options.name)
+	}
+
+	//
+	// The certificates are loaded before the storage is setup, since
+	// that might chroot() us away from them.
+	//
+	tlsConfig, err := serverTLSConfig(options.tlsCert, options.tlsKey, options.clientCA)
+	if err != nil {
+		return fmt.Errorf("invalid TLS configuration: %w", err)
+	}
+
+	//
+	// Likewise the webhook is resolved, and the certificate
+	// authorities with which we'll contact it loaded.
+	//
+	if err = setupWebhookClient(options.webhookURL); err != nil {
+		return fmt.Errorf("invalid -webhook-url: %w", err)
+	}
+
+	router, ok := setupBlobServer(options)
+	if !ok {
+		return errors.New("failed to setup the blob-server")
+	}
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
 
 	//
 	// Launch the server
 	//
 	GetLogger().Info("blob-server starting",
-		"url", "http://"+net.JoinHostPort(options.host, strconv.Itoa(options.port))+"/",
-		"storage_path", options.store)
+		"url", scheme+"://"+net.JoinHostPort(options.host, strconv.Itoa(options.port))+"/",
+		"storage_path", options.store,
+		"storage", options.storage,
+		"path_prefix", options.prefix)
+
+	server := newServer(net.JoinHostPort(options.host, strconv.Itoa(options.port)), router,
+		options.readTimeout, options.writeTimeout, options.idleTimeout,
+		options.h2c, options.maxStreams, options.keepAlive)
+	limitServer(server, options.maxHeaderBytes, options.maxURLLength)
+	server.TLSConfig = tlsConfig
+	return listenAndServe(server, options.bindAttempts, options.bindBackoff)
+}
 
-	server := &http.Server{
-		Addr:         net.JoinHostPort(options.host, strconv.Itoa(options.port)),
-		Handler:      nil,
-		ReadTimeout:  serverReadTimeout,
-		WriteTimeout: serverWriteTimeout,
-		IdleTimeout:  serverIdleTimeout,
+// setupBlobServer prepares our storage, with the given options, and
+// returns the handler which serves it.  Any problem is logged, and
+// false returned.
+func setupBlobServer(options blobServerCmd) (http.Handler, bool) {
+	//
+	// Store options for later use by handlers.
+	//
+	setBlobOptions(options)
+	setCopyBufferSize(options.copyBufferSize)
+	blobStarted = time.Now()
+
+	if options.notFoundStatus != http.StatusNotFound && options.notFoundStatus != http.StatusOK {
+		GetLogger().Error("Invalid -not-found-status, expected 404 or 200", "status", options.notFoundStatus)
+		return nil, false
+	}
+
+	if err := libconfig.SetBlobPath(cmp.Or(options.blobPath, libconfig.DefaultBlobPath)); err != nil {
+		GetLogger().Error("Invalid -blob-path", "error", err)
+		return nil, false
 	}
-	err := server.ListenAndServe()
+
+	//
+	// Create a storage system, of the type the user chose.
+	//
+	storageHandler, err := newStorage(options.storage)
 	if err != nil {
-		panic(err)
+		GetLogger().Error("Failed to create storage", "error", err)
+		return nil, false
+	}
+	if _, ok := storageHandler.(*FilesystemStorage); !ok && len(storeRoots(options.store)) > 1 {
+		GetLogger().Error("Only the filesystem storage supports several -store directories", "storage", options.storage)
+		return nil, false
+	}
+	if _, ok := storageHandler.(*FilesystemStorage); !ok && options.buckets {
+		GetLogger().Error("Only the filesystem storage supports -buckets", "storage", options.storage)
+		return nil, false
+	}
+
+	//
+	// Open the directories holding our upload-sessions, aliases, and
+	// trash, before the storage is setup, since that might chroot() us away
+	// from them.
+	//
+	sessions := filepath.Join(primaryRoot(options.store), uploadDirectory)
+	if err = os.MkdirAll(sessions, 0750); err != nil {
+		GetLogger().Error("Failed to create upload-session directory", "error", err)
+		return nil, false
+	}
+	root, err := os.OpenRoot(sessions)
+	if err != nil {
+		GetLogger().Error("Failed to open upload-session directory", "error", err)
+		return nil, false
+	}
+	setUploadRoot(root)
+	if options.uploadTTL > 0 {
+		go uploadJanitor(root, options.uploadTTL)
+	}
+
+	if options.aliases {
+		aliases := filepath.Join(primaryRoot(options.store), aliasDirectory)
+		if err = os.MkdirAll(aliases, 0750); err != nil {
+			GetLogger().Error("Failed to create alias directory", "error", err)
+			return nil, false
+		}
+		root, err = os.OpenRoot(aliases)
+		if err != nil {
+			GetLogger().Error("Failed to open alias directory", "error", err)
+			return nil, false
+		}
+		setAliasRoot(root)
+	}
+
+	if options.auditLog != "" {
+		var file *os.File
+		if file, err = openAuditLog(options.auditLog); err != nil {
+			GetLogger().Error("Failed to open audit log", "error", err)
+			return nil, false
+		}
+		setAuditLog(file)
+	}
+
+	if options.softDelete > 0 {
+		trash := filepath.Join(primaryRoot(options.store), trashDirectory)
+		if err = os.MkdirAll(trash, 0750); err != nil {
+			GetLogger().Error("Failed to create trash directory", "error", err)
+			return nil, false
+		}
+		root, err = os.OpenRoot(trash)
+		if err != nil {
+			GetLogger().Error("Failed to open trash directory", "error", err)
+			return nil, false
+		}
+		setTrashRoot(root)
+		go trashJanitor(root, options.softDelete)
+	}
+
+	for _, root := range storeRoots(options.store) {
+		if err = os.MkdirAll(root, 0750); err != nil {
+			GetLogger().Error("Failed to create store", "error", err)
+			return nil, false
+		}
+
+		var dir *os.File
+		if dir, err = os.Open(root); err != nil {
+			GetLogger().Error("Failed to open store", "error", err)
+			return nil, false
+		}
+		storeDirectories = append(storeDirectories, dir)
+	}
+
+	//
+	// An embedded blob-server shares the process of the API-server,
+	// whose files are found outside our store, so it doesn't chroot().
+	//
+	if fss, ok := storageHandler.(*FilesystemStorage); ok && options.embedded {
+		fss.SetupInPlace(options.store)
+	} else {
+		storageHandler.Setup(options.store)
 	}
+	setStorage(storageHandler)
+
+	if err = initObjectCount(); err != nil {
+		GetLogger().Error("Failed to count objects", "error", err)
+		return nil, false
+	}
+
+	//
+	// Create a new router and our route-mappings.
+	//
+	return newBlobRouter(options.prefix), true
 }
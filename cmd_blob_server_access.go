@@ -0,0 +1,67 @@
+//
+// Access tracking for the blob-server.
+//
+// If the blob-server is launched with `-track-access` we count the
+// number of times each object is read, and the time of the most recent
+// read, so that popular (or neglected) objects may be identified.
+//
+// The counters are updated atomically, so recording an access never
+// serializes reads behind a lock.
+//
+
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// accessStats holds the access counters of a single object.
+type accessStats struct {
+	// count is the number of times the object has been read.
+	count atomic.Int64
+
+	// last is the time of the most recent read, in nanoseconds.
+	last atomic.Int64
+}
+
+// accesses maps object IDs to their *accessStats.
+var accesses sync.Map
+
+// recordAccess notes that the given object was read, if we're tracking
+// accesses.
+func recordAccess(id string) {
+	if !getBlobOptions().trackAccess {
+		return
+	}
+
+	now := time.Now()
+
+	value, _ := accesses.LoadOrStore(id, new(accessStats))
+	stats := value.(*accessStats)
+	stats.count.Add(1)
+	stats.last.Store(now.UnixNano())
+
+	//
+	// If the storage can persist the access-time then let it, in
+	// the background so the read isn't delayed.
+	//
+	if recorder, ok := getStorage().(AccessRecorder); ok {
+		go recorder.RecordAccess(id, now)
+	}
+}
+
+// accessInfo returns the number of times the given object was read, and
+// the time of the most recent read, formatted as a HTTP-date.
+func accessInfo(id string) (int64, string) {
+	value, ok := accesses.Load(id)
+	if !ok {
+		return 0, ""
+	}
+
+	stats := value.(*accessStats)
+	last := time.Unix(0, stats.last.Load()).UTC().Format(http.TimeFormat)
+	return stats.count.Load(), last
+}
@@ -0,0 +1,160 @@
+//
+// Aliases for the blob-server.
+//
+// Objects are addressed by the hash of their content, which isn't very
+// friendly.  If the blob-server is launched with `-aliases` a name may
+// be pointed at an object:
+//
+//   PUT    /alias/{name}  - point the name at the ID given in the body.
+//   DELETE /alias/{name}  - remove the name, leaving the object alone.
+//
+// Requests for `/blob/{name}` are then resolved to the object.
+//
+// Aliases are small records, written to disk beneath our store, rather
+// than copies of the data.  Since the object served for a name may be
+// changed they break the content-addressed model, so they're opt-in.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// aliasDirectory is the directory, beneath our store, which holds the
+// alias records.
+const aliasDirectory = ".aliases"
+
+// aliasRoot holds the directory containing our aliases, or nil if
+// aliases are disabled.
+//
+// We open this before we chroot(), so that it remains accessible.
+var aliasRoot *os.Root
+
+// setAliasRoot stores the alias directory for use by handlers.
+func setAliasRoot(root *os.Root) {
+	aliasRoot = root
+}
+
+// getAliasRoot returns the alias directory.
+func getAliasRoot() *os.Root {
+	return aliasRoot
+}
+
+// aliasRecord is the record persisted for each alias.
+type aliasRecord struct {
+	// Alias is the name of the alias.
+	Alias string `json:"alias"`
+
+	// ID is the ID of the object the alias points at.
+	ID string `json:"id"`
+}
+
+// resolveAlias returns the ID the given name points at, or the name
+// itself if it is not an alias.
+func resolveAlias(name string) string {
+	if getAliasRoot() == nil || !idPattern.MatchString(name) {
+		return name
+	}
+
+	encoded, err := readRootFile(getAliasRoot(), name)
+	if err != nil {
+		return name
+	}
+
+	var record aliasRecord
+	if err = json.Unmarshal(encoded, &record); err != nil || record.ID == "" {
+		return name
+	}
+	return record.ID
+}
+
+// aliasName returns the validated alias name of the request, reporting
+// an error to the client if it is unusable.
+func aliasName(res http.ResponseWriter, req *http.Request) (string, bool) {
+	if getAliasRoot() == nil {
+		writeJSONError(res, http.StatusNotFound, "aliases are disabled")
+		return "", false
+	}
+
+	name := mux.Vars(req)["name"]
+	if !idPattern.MatchString(name) {
+		writeJSONError(res, http.StatusBadRequest, "alphanumeric names only")
+		return "", false
+	}
+	return name, true
+}
+
+// AliasHandler points an alias at an existing object.
+//
+// This is called with requests like `PUT /alias/NAME`, with the ID of
+// the object as the body.
+func AliasHandler(res http.ResponseWriter, req *http.Request) {
+	name, ok := aliasName(res, req)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, 1024))
+	if err != nil {
+		writeJSONError(res, http.StatusBadRequest, "failed to read body")
+		return
+	}
+
+	id := strings.TrimSpace(string(body))
+	if status, idErr := validateID(id); idErr != nil {
+		writeJSONError(res, status, idErr.Error())
+		return
+	}
+	if !getStorage().Exists(id) {
+		writeJSONError(res, http.StatusNotFound, "object not found")
+		return
+	}
+
+	//
+	// An alias would hide the object with the same name.
+	//
+	if getStorage().Exists(name) {
+		writeJSONError(res, http.StatusConflict, "an object with that name exists")
+		return
+	}
+
+	encoded, _ := json.Marshal(aliasRecord{Alias: name, ID: id})
+	if err = writeRootFile(getAliasRoot(), name, encoded); err != nil {
+		writeJSONError(res, http.StatusInternalServerError, "failed to write alias")
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	_, _ = res.Write(encoded)
+}
+
+// DeleteAliasHandler removes an alias, leaving the object it pointed at
+// in place.
+//
+// This is called with requests like `DELETE /alias/NAME`.
+func DeleteAliasHandler(res http.ResponseWriter, req *http.Request) {
+	name, ok := aliasName(res, req)
+	if !ok {
+		return
+	}
+
+	err := getAliasRoot().Remove(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		writeJSONError(res, http.StatusNotFound, "alias not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(res, http.StatusInternalServerError, "failed to remove alias")
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
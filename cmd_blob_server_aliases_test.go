@@ -0,0 +1,90 @@
+// Testing of blob-server aliases.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// sendAlias issues a request against the router, returning the status
+// and body of the response.
+func sendAlias(t *testing.T, router http.Handler, method string, path string, body string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr.Code, rr.Body.String()
+}
+
+// Test that aliases may be created, resolved, and removed.
+func TestAliases(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+	storageHandler.Store("target", []byte("Content"), nil)
+
+	router := newBlobRouter("")
+
+	//
+	// Aliases are disabled by default.
+	//
+	if code, _ := sendAlias(t, router, http.MethodPut, "/alias/latest", "target"); code != http.StatusNotFound {
+		t.Errorf("Unexpected status-code: %v", code)
+	}
+
+	root, err := os.OpenRoot(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setAliasRoot(root)
+	defer func() {
+		_ = root.Close()
+		setAliasRoot(nil)
+	}()
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"a_b", "target", http.StatusBadRequest},
+		{"latest", "missing", http.StatusNotFound},
+		{"latest", "a_b", http.StatusInternalServerError},
+		{"target", "target", http.StatusConflict},
+		{"latest", "target\n", http.StatusOK},
+	}
+	for _, test := range tests {
+		if code, _ := sendAlias(t, router, http.MethodPut, "/alias/"+test.name, test.body); code != test.status {
+			t.Errorf("Unexpected status-code for %s -> %s: %v", test.name, test.body, code)
+		}
+	}
+
+	code, body := sendAlias(t, router, http.MethodGet, "/blob/latest", "")
+	if code != http.StatusOK || body != "Content" {
+		t.Errorf("Alias was not resolved: %v %v", code, body)
+	}
+
+	//
+	// Removing the alias leaves the object.
+	//
+	if code, _ = sendAlias(t, router, http.MethodDelete, "/alias/latest", ""); code != http.StatusNoContent {
+		t.Errorf("Unexpected status-code: %v", code)
+	}
+	if code, _ = sendAlias(t, router, http.MethodDelete, "/alias/latest", ""); code != http.StatusNotFound {
+		t.Errorf("Unexpected status-code: %v", code)
+	}
+	if code, _ = sendAlias(t, router, http.MethodGet, "/blob/latest", ""); code != http.StatusNotFound {
+		t.Errorf("Unexpected status-code: %v", code)
+	}
+	if !storageHandler.Exists("target") {
+		t.Errorf("Removing the alias removed the object")
+	}
+}
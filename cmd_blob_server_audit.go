@@ -0,0 +1,88 @@
+//
+// Audit trail for the blob-server.
+//
+// If the blob-server is launched with `-audit-log /path/to/file` then a
+// JSON line is appended to that file for each object stored or deleted,
+// separately from our operational log:
+//
+//   {"time":"...","action":"store","id":"...","size":1234,"remote":"10.0.0.1:4312"}
+//
+// Each record is written, and synced to disk, before the client receives
+// its response, so that a crash does not lose recent records.  The
+// blob-server has no authentication of its own, so the remote address is
+// the only record of who made a change.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditRecord is a single line of the audit log.
+type auditRecord struct {
+	// Time is the time of the change.
+	Time time.Time `json:"time"`
+
+	// Action is either "store" or "delete".
+	Action string `json:"action"`
+
+	// ID is the ID of the object.
+	ID string `json:"id"`
+
+	// Size is the size of the object.
+	Size int64 `json:"size"`
+
+	// Remote is the address of the client which made the change.
+	Remote string `json:"remote"`
+}
+
+// auditLog holds our audit log, or nil if auditing is disabled.
+//
+// We open this before we chroot(), so that it remains accessible.
+var auditLog struct {
+	sync.Mutex
+	file *os.File
+}
+
+// openAuditLog opens the given file for appending audit records to,
+// creating it if necessary.
+func openAuditLog(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+}
+
+// setAuditLog stores the audit log for use by handlers.
+func setAuditLog(file *os.File) {
+	auditLog.Lock()
+	defer auditLog.Unlock()
+
+	auditLog.file = file
+}
+
+// audit appends a record of the given change to the audit log, if any.
+func audit(req *http.Request, action string, id string, size int64) {
+	auditLog.Lock()
+	defer auditLog.Unlock()
+
+	if auditLog.file == nil {
+		return
+	}
+
+	record := auditRecord{Time: time.Now().UTC(), Action: action, ID: id, Size: size}
+	if req != nil {
+		record.Remote = req.RemoteAddr
+	}
+
+	encoded, _ := json.Marshal(record)
+	if _, err := auditLog.file.Write(append(encoded, '\n')); err != nil {
+		GetLogger().Error("Failed to write audit log", "object", id, "action", action, "error", err)
+		return
+	}
+	if err := auditLog.file.Sync(); err != nil {
+		GetLogger().Error("Failed to sync audit log", "object", id, "action", action, "error", err)
+	}
+}
@@ -0,0 +1,99 @@
+// Testing of the blob-server audit log.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Test that stores and deletions are appended to the audit log.
+func TestAuditLog(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+
+	root, err := os.OpenRoot(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTrashRoot(root)
+	defer func() {
+		_ = root.Close()
+		setTrashRoot(nil)
+	}()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err = os.WriteFile(path, []byte("{\"action\":\"earlier\"}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setAuditLog(file)
+	defer func() {
+		setAuditLog(nil)
+		_ = file.Close()
+	}()
+
+	router := newBlobRouter("")
+
+	requests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodPost, "/blob/steve", "Content", http.StatusOK},
+		{http.MethodPost, "/blob/failed", "", http.StatusBadRequest},
+		{http.MethodDelete, "/blob/steve", "", http.StatusNoContent},
+	}
+	for _, test := range requests {
+		req, reqErr := http.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if reqErr != nil {
+			t.Fatal(reqErr)
+		}
+		req.RemoteAddr = "10.0.0.1:4312"
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if status := rr.Code; status != test.status {
+			t.Fatalf("Unexpected status-code for %s %s: %v", test.method, test.path, status)
+		}
+	}
+
+	handle, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+
+	var records []auditRecord
+	scanner := bufio.NewScanner(handle)
+	for scanner.Scan() {
+		var record auditRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Audit record was not JSON: %v", err)
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != 3 {
+		t.Fatalf("Unexpected audit records: %v", records)
+	}
+	if records[0].Action != "earlier" {
+		t.Errorf("The audit log was not appended to: %v", records[0])
+	}
+	for i, action := range []string{"store", "delete"} {
+		record := records[i+1]
+		if record.Action != action || record.ID != "steve" || record.Size != 7 || record.Remote != "10.0.0.1:4312" || record.Time.IsZero() {
+			t.Errorf("Unexpected audit record: %v", record)
+		}
+	}
+}
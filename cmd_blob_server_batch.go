@@ -0,0 +1,128 @@
+//
+// Fetching several objects at once.
+//
+// Clients needing many small objects, such as thumbnails, may fetch them
+// in a single request rather than one apiece:
+//
+//   curl -d '["id1","id2"]' http://localhost:4001/blobs/get
+//
+// The response is a `multipart/mixed` stream holding a part for each
+// object found, in the order requested.  Each part carries the ID of
+// its object as `X-Object-Id`, along with the headers a GET of it would
+// return.  The final part is a JSON object mapping every requested ID to
+// its status: 200 if it was sent, 404 if it was missing, or the error a
+// GET would receive if the ID is invalid.
+//
+// At most maxBatchSize objects may be fetched at once.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"time"
+)
+
+// maxBatchSize is the number of objects which may be fetched in a single
+// batch.
+const maxBatchSize = 1000
+
+// BatchGetHandler returns several objects, in one multipart response.
+//
+// This is called with requests like `POST /blobs/get`.
+func BatchGetHandler(res http.ResponseWriter, req *http.Request) {
+	var ids []string
+	if err := json.NewDecoder(http.MaxBytesReader(res, req.Body, 1024*1024)).Decode(&ids); err != nil {
+		writeJSONError(res, http.StatusBadRequest, "expected a JSON array of IDs")
+		return
+	}
+	if len(ids) > maxBatchSize {
+		writeJSONError(res, http.StatusBadRequest, fmt.Sprintf("at most %d objects may be fetched at once", maxBatchSize))
+		return
+	}
+
+	timeout := getBlobOptions().writeTimeout
+	out := multipart.NewWriter(&deadlineWriter{res: res, rc: http.NewResponseController(res), timeout: timeout})
+	res.Header().Set("Content-Type", "multipart/mixed; boundary="+out.Boundary())
+
+	//
+	// A failure to write means the client has gone away, so we stop
+	// rather than reading the remaining objects for nobody.
+	//
+	statuses := make(map[string]int, len(ids))
+	for _, id := range ids {
+		if _, seen := statuses[id]; seen {
+			continue
+		}
+
+		status, err := writeBatchObject(out, id)
+		if err != nil {
+			GetLogger().Warn("Batch abandoned", "object", id, "error", err)
+			return
+		}
+		statuses[id] = status
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "application/json")
+	part, err := out.CreatePart(header)
+	if err == nil {
+		err = json.NewEncoder(part).Encode(statuses)
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		GetLogger().Warn("Batch abandoned", "error", err)
+	}
+}
+
+// writeBatchObject writes the object with the given ID as the next part
+// of a batch, returning the status to report for it, or an error if it
+// could not be written.
+func writeBatchObject(out *multipart.Writer, id string) (int, error) {
+	start := time.Now()
+
+	resolved := resolveAlias(id)
+	if status, err := validateID(resolved); err != nil {
+		return status, nil
+	}
+
+	data, meta := openObject(resolved)
+	if data == nil {
+		return http.StatusNotFound, nil
+	}
+	defer data.Close()
+	if expired(meta) {
+		return http.StatusNotFound, nil
+	}
+	recordAccess(resolved)
+
+	header := http.Header{}
+	setMetaHeaders(header, meta)
+	header.Set("X-Object-Id", id)
+	if size, ok := getStorage().Size(resolved); ok {
+		header.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+
+	part, err := out.CreatePart(textproto.MIMEHeader(header))
+	if err != nil {
+		return 0, err
+	}
+
+	buf := getCopyBuffer()
+	defer putCopyBuffer(buf)
+
+	copied, err := io.CopyBuffer(part, struct{ io.Reader }{data}, *buf)
+	observeDownload(ObservedEvent{Service: "blob-server", ID: resolved, Size: copied, Status: http.StatusOK}, start, err)
+	if err != nil {
+		return 0, err
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,113 @@
+// Testing of fetching several objects at once.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Test that a batch returns the objects found, and the status of each.
+func TestBlobBatchGet(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+
+	storageHandler.Store("one", []byte("First"), Metadata{"X-Mime-Type": {"text/plain"}})
+	storageHandler.Store("two", []byte("Second"), nil)
+
+	router := newBlobRouter("")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/blobs/get", strings.NewReader(`["two","missing","../etc","one","two"]`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", rr.Code)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(rr.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Unexpected Content-Type: %v", rr.Header().Get("Content-Type"))
+	}
+
+	var objects []string
+	var statuses map[string]int
+	reader := multipart.NewReader(rr.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read part: %v", err)
+		}
+
+		id := part.Header.Get("X-Object-Id")
+		if id == "" {
+			if err := json.NewDecoder(part).Decode(&statuses); err != nil {
+				t.Fatalf("Status was not JSON: %v", err)
+			}
+			continue
+		}
+		data, _ := io.ReadAll(part)
+		objects = append(objects, id+"="+string(data))
+
+		if id == "one" && part.Header.Get("Content-Type") != "text/plain" {
+			t.Errorf("Unexpected Content-Type of %s: %v", id, part.Header.Get("Content-Type"))
+		}
+	}
+
+	if !reflect.DeepEqual(objects, []string{"two=Second", "one=First"}) {
+		t.Errorf("Unexpected objects: %v", objects)
+	}
+	invalid, _ := validateID("../etc")
+	expected := map[string]int{"one": 200, "two": 200, "missing": 404, "../etc": invalid}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("Unexpected statuses: %v", statuses)
+	}
+}
+
+// Test that malformed, and oversized, batches are refused.
+func TestBlobBatchGetInvalid(t *testing.T) {
+	router := newBlobRouter("")
+
+	large, _ := json.Marshal(make([]string, maxBatchSize+1))
+	for _, body := range []string{"", "{}", `"one"`, string(large)} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/blobs/get", strings.NewReader(body)))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Unexpected status-code for %.20q: %v", body, rr.Code)
+		}
+	}
+}
+
+// brokenWriter fails every write, as a connection whose client has gone
+// away would.
+type brokenWriter struct{}
+
+// Write implements io.Writer.
+func (brokenWriter) Write(_ []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+// Test that a batch whose client has gone away is abandoned, with an
+// error rather than a panic.
+func TestBlobBatchGetDisconnect(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+	storageHandler.Store("one", []byte("First"), nil)
+
+	out := multipart.NewWriter(brokenWriter{})
+	if _, err := writeBatchObject(out, "one"); err == nil {
+		t.Errorf("Expected an error writing to a broken connection")
+	}
+	if status, err := writeBatchObject(out, "missing"); status != http.StatusNotFound || err != nil {
+		t.Errorf("Unexpected result for a missing object: %v %v", status, err)
+	}
+}
@@ -0,0 +1,53 @@
+//
+// Buckets for the blob-server.
+//
+// Some integrations expect S3-like `bucket/key` addressing, rather than
+// flat IDs.  If the blob-server is launched with `-buckets` then objects
+// may also be stored, and fetched, via:
+//
+//   POST /b/{bucket}/{key}  - store the body as the key, within the bucket.
+//   GET  /b/{bucket}/{key}  - retrieve the key, as `GET /blob/{id}` would.
+//   HEAD /b/{bucket}/{key}  - test whether the key exists.
+//
+// The object is stored with the ID `bucket/key`, which the filesystem
+// storage holds in a sub-directory named for the bucket.  Both parts of
+// the ID must be alphanumeric, so they cannot be used for traversal, and
+// such IDs are refused entirely unless `-buckets` is given.  A bucket
+// may not share its name with a flat object, nor the reverse.
+//
+// Bucketed objects are not listed by `/blobs`, so the flat namespace,
+// and the replication of it, is unchanged.
+//
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// bucketSeparator separates the bucket from the key, within an ID.
+const bucketSeparator = "/"
+
+// splitBucket splits the given ID into its bucket and key, returning
+// false if the ID has no bucket.
+func splitBucket(id string) (string, string, bool) {
+	return strings.Cut(id, bucketSeparator)
+}
+
+// BucketHandler wraps the given handler of `/blob/{id}` requests, so
+// that it serves `/b/{bucket}/{key}` requests instead.
+func BucketHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if !getBlobOptions().buckets {
+			writeJSONError(res, http.StatusNotFound, "buckets are disabled")
+			return
+		}
+
+		vars := mux.Vars(req)
+		id := vars["bucket"] + bucketSeparator + vars["key"]
+		next(res, mux.SetURLVars(req, map[string]string{"id": id}))
+	}
+}
@@ -0,0 +1,101 @@
+// Testing of blob-server buckets.
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test that objects may be stored, and fetched, within buckets.
+func TestBuckets(t *testing.T) {
+	dir := t.TempDir()
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(dir)
+	setStorage(storageHandler)
+
+	router := newBlobRouter("")
+
+	//
+	// Buckets are disabled by default.
+	//
+	if code, _ := sendAlias(t, router, http.MethodPost, "/b/photos/cat", "Meow"); code != http.StatusNotFound {
+		t.Errorf("Unexpected status-code: %v", code)
+	}
+
+	setBlobOptions(blobServerCmd{buckets: true})
+	defer setBlobOptions(blobServerCmd{})
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodPost, "/b/photos/cat", "Meow", http.StatusOK},
+		{http.MethodPost, "/b/photos/Dog", "Woof", http.StatusInternalServerError},
+		{http.MethodPost, "/b/photos/cat.json", "Escape", http.StatusInternalServerError},
+		{http.MethodPost, "/b/../cat", "Escape", http.StatusMovedPermanently},
+		{http.MethodGet, "/b/photos/cat", "", http.StatusOK},
+		{http.MethodHead, "/b/photos/cat", "", http.StatusOK},
+		{http.MethodGet, "/b/photos/dog", "", http.StatusNotFound},
+		{http.MethodGet, "/b/other/cat", "", http.StatusNotFound},
+		{http.MethodGet, "/blob/cat", "", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		code, body := sendAlias(t, router, test.method, test.path, test.body)
+		if code != test.status {
+			t.Errorf("Unexpected status-code for %s %s: %v", test.method, test.path, code)
+		}
+		if test.method == http.MethodGet && code == http.StatusOK && body != "Meow" {
+			t.Errorf("Unexpected body for %s: %v", test.path, body)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "photos", "cat")); err != nil {
+		t.Errorf("The object was not stored within its bucket: %v", err)
+	}
+
+	//
+	// The flat namespace is unchanged.
+	//
+	list, err := storageHandler.Existing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 0 {
+		t.Errorf("Bucketed objects were listed: %v", list)
+	}
+
+	//
+	// A bucket and a flat object may not share a name.
+	//
+	if code, _ := sendAlias(t, router, http.MethodPost, "/blob/photos", "Clash"); code == http.StatusOK {
+		t.Errorf("Stored a flat object over a bucket")
+	}
+	if storageHandler.Exists("photos") {
+		t.Errorf("A bucket was reported as an object")
+	}
+	if code, _ := sendAlias(t, router, http.MethodPost, "/blob/dog", "Woof"); code != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", code)
+	}
+	if code, _ := sendAlias(t, router, http.MethodPost, "/b/dog/cat", "Clash"); code == http.StatusOK {
+		t.Errorf("Stored a bucket over a flat object")
+	}
+}
+
+// Test that bucketed IDs are refused unless buckets are enabled.
+func TestBucketIDs(t *testing.T) {
+	if _, err := validateID("photos/cat"); err == nil {
+		t.Errorf("Accepted a bucketed ID with buckets disabled")
+	}
+
+	setBlobOptions(blobServerCmd{buckets: true})
+	defer setBlobOptions(blobServerCmd{})
+
+	if _, err := validateID("photos/cat"); err != nil {
+		t.Errorf("Refused a bucketed ID: %v", err)
+	}
+}
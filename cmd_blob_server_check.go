@@ -0,0 +1,136 @@
+//
+// Configuration checking for the blob-server.
+//
+// When launched with `-check` the blob-server validates its options,
+// logs a summary, and exits without binding to a port.  This allows a
+// deployment pipeline to test the configuration of a node before it is
+// rolled out.
+//
+
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// checkWritable tests that the given directory exists, or could be
+// created, and that we're able to create files within it.
+//
+// Nothing is created beyond a temporary file, which is removed.
+func checkWritable(dir string) error {
+	info, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		//
+		// A missing store is created at startup, so test that its
+		// nearest existing parent is writable instead.
+		//
+		parent := filepath.Dir(filepath.Clean(dir))
+		if parent == dir {
+			return err
+		}
+		if parentErr := checkWritable(parent); parentErr != nil {
+			return fmt.Errorf("%s cannot be created: %w", dir, parentErr)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	probe, err := os.CreateTemp(dir, ".check-")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	_ = probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// checkBlobConfig validates the given options, returning each of the
+// problems found.
+func checkBlobConfig(options blobServerCmd) []error {
+	var problems []error
+
+	if _, err := newStorage(options.storage); err != nil {
+		problems = append(problems, err)
+	}
+
+	roots := storeRoots(options.store)
+	for _, root := range roots {
+		if err := checkWritable(root); err != nil {
+			problems = append(problems, fmt.Errorf("invalid -store: %w", err))
+		}
+	}
+	if len(roots) == 0 {
+		problems = append(problems, errors.New("invalid -store: no directory given"))
+	}
+	if len(roots) > 1 && options.storage != "filesystem" {
+		problems = append(problems, fmt.Errorf("invalid -store: the %s storage supports a single directory", options.storage))
+	}
+	if options.buckets && options.storage != "filesystem" {
+		problems = append(problems, fmt.Errorf("invalid -buckets: the %s storage does not support buckets", options.storage))
+	}
+
+	if err := libconfig.CheckBlobPath(cmp.Or(options.blobPath, libconfig.DefaultBlobPath)); err != nil {
+		problems = append(problems, fmt.Errorf("invalid -blob-path: %w", err))
+	}
+
+	if _, err := serverTLSConfig(options.tlsCert, options.tlsKey, options.clientCA); err != nil {
+		problems = append(problems, fmt.Errorf("invalid TLS configuration: %w", err))
+	}
+
+	if options.notFoundStatus != http.StatusNotFound && options.notFoundStatus != http.StatusOK {
+		problems = append(problems, fmt.Errorf("invalid -not-found-status %d, expected 404 or 200", options.notFoundStatus))
+	}
+	if options.notFoundBlob != "" && !idPattern.MatchString(options.notFoundBlob) {
+		problems = append(problems, fmt.Errorf("invalid -not-found-blob '%s', alphanumeric IDs only", options.notFoundBlob))
+	}
+
+	if options.idLength < 0 {
+		problems = append(problems, fmt.Errorf("invalid -id-length %d", options.idLength))
+	}
+	if options.maxObjects < 0 {
+		problems = append(problems, fmt.Errorf("invalid -max-objects %d", options.maxObjects))
+	}
+	if options.softDelete < 0 {
+		problems = append(problems, fmt.Errorf("invalid -soft-delete %v", options.softDelete))
+	}
+	if options.minFreePercent < 0 || options.minFreePercent >= 100 {
+		problems = append(problems, fmt.Errorf("invalid -min-free-percent %v, expected 0-100", options.minFreePercent))
+	}
+	if options.webhookURL != "" {
+		if target, err := url.Parse(options.webhookURL); err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			problems = append(problems, fmt.Errorf("invalid -webhook-url '%s', expected an HTTP URL", options.webhookURL))
+		}
+	}
+	if options.port <= 0 || options.port > 65535 {
+		problems = append(problems, fmt.Errorf("invalid -port %d", options.port))
+	}
+
+	return problems
+}
+
+// checkBlobServer logs the result of validating the given options, and
+// returns true if there were no problems.
+func checkBlobServer(options blobServerCmd) bool {
+	problems := checkBlobConfig(options)
+	for _, problem := range problems {
+		GetLogger().Error("Configuration problem", "error", problem)
+	}
+
+	GetLogger().Info("blob-server configuration checked",
+		"storage_path", options.store,
+		"storage", options.storage,
+		"problems", len(problems))
+	return len(problems) == 0
+}
@@ -0,0 +1,55 @@
+// Testing of the blob-server configuration check.
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test that valid configurations pass, and bogus ones are reported.
+func TestCheckBlobConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	valid := blobServerCmd{store: dir, storage: "filesystem", port: defaultBlobServerPort, notFoundStatus: http.StatusNotFound}
+
+	tests := []struct {
+		modify   func(*blobServerCmd)
+		problems int
+	}{
+		{func(*blobServerCmd) {}, 0},
+		{func(o *blobServerCmd) { o.store = filepath.Join(dir, "new", "store") }, 0},
+		{func(o *blobServerCmd) { o.store = file }, 1},
+		{func(o *blobServerCmd) { o.store = filepath.Join(file, "store") }, 1},
+		{func(o *blobServerCmd) { o.storage = "redis" }, 1},
+		{func(o *blobServerCmd) { o.store = dir + "," + filepath.Join(dir, "new", "second") }, 0},
+		{func(o *blobServerCmd) { o.store = dir + "," + file }, 1},
+		{func(o *blobServerCmd) { o.store = dir + "," + dir; o.storage = "pack" }, 1},
+		{func(o *blobServerCmd) { o.store = " , " }, 1},
+		{func(o *blobServerCmd) { o.buckets = true }, 0},
+		{func(o *blobServerCmd) { o.buckets = true; o.storage = "pack" }, 1},
+		{func(o *blobServerCmd) { o.notFoundStatus = 500; o.notFoundBlob = "a_b" }, 2},
+		{func(o *blobServerCmd) { o.minFreePercent = 100; o.port = 0 }, 2},
+		{func(o *blobServerCmd) { o.webhookURL = "https://index.example.com/hook" }, 0},
+		{func(o *blobServerCmd) { o.webhookURL = "index.example.com" }, 1},
+	}
+
+	for i, test := range tests {
+		options := valid
+		test.modify(&options)
+
+		if problems := checkBlobConfig(options); len(problems) != test.problems {
+			t.Errorf("Unexpected problems for test %d: %v", i, problems)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "new")); !os.IsNotExist(err) {
+		t.Errorf("Checking created the store")
+	}
+}
@@ -0,0 +1,80 @@
+//
+// Object-count limits for the blob-server.
+//
+// Some filesystems run out of inodes long before they run out of space.
+// If the blob-server is launched with `-max-objects` we refuse uploads
+// of new objects once we hold that many, so that they are sent to other
+// servers, whilst continuing to serve reads and accept overwrites.
+//
+// Listing the store upon each upload would be slow, so the count is
+// taken once at startup and then maintained as objects are written.
+//
+
+package main
+
+import (
+	"sync/atomic"
+)
+
+// objectCount holds the number of objects in our store.
+var objectCount atomic.Int64
+
+// initObjectCount counts the objects in our store, if we've been given
+// a limit to enforce.
+func initObjectCount() error {
+	if getBlobOptions().maxObjects <= 0 {
+		return nil
+	}
+
+	list, err := getStorage().Existing()
+	if err != nil {
+		return err
+	}
+	objectCount.Store(int64(len(list)))
+	return nil
+}
+
+// objectLimitReached returns true if the given object would be new, and
+// we already hold the `-max-objects` limit.
+func objectLimitReached(id string) bool {
+	limit := getBlobOptions().maxObjects
+	if limit <= 0 || objectCount.Load() < int64(limit) {
+		return false
+	}
+	return !getStorage().Exists(id)
+}
+
+// storeCounted stores the given object, via our storage, counting it if
+// it is new.
+//
+// Concurrent uploads of the same new object may both be counted, which
+// errs towards refusing uploads early rather than exceeding the limit.
+func storeCounted(id string, content []byte, extras Metadata) bool {
+	return countStored(id, func() bool {
+		return getStorage().Store(id, content, extras)
+	})
+}
+
+// countStored stores an object via the given function, counting it if
+// it is new.
+func countStored(id string, store func() bool) bool {
+	if getBlobOptions().maxObjects <= 0 {
+		return store()
+	}
+
+	existed := getStorage().Exists(id)
+	if !store() {
+		return false
+	}
+	if !existed {
+		objectCount.Add(1)
+	}
+	return true
+}
+
+// uncountObject notes that an object has been removed.
+func uncountObject() {
+	if getBlobOptions().maxObjects > 0 {
+		objectCount.Add(-1)
+	}
+}
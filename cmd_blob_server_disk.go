@@ -0,0 +1,75 @@
+//
+// Disk-space back-pressure for the blob-server.
+//
+// If the blob-server is launched with `-min-free-percent` we refuse new
+// uploads once the free space upon the store drops below that level,
+// so that they are sent to other servers, whilst continuing to serve
+// reads.
+//
+
+package main
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+)
+
+// storeDirectories holds each root of our store, which we open before
+// we chroot() so that we may later measure their free space.
+var storeDirectories []*os.File
+
+// diskFree returns the free, and total, bytes of the filesystems holding
+// our store, summed across each root.  It is a variable so that tests
+// may replace it.
+var diskFree = func() (uint64, uint64, error) {
+	if len(storeDirectories) == 0 {
+		return 0, 0, errors.New("store is not open")
+	}
+
+	var free, total uint64
+	for _, dir := range storeDirectories {
+		f, t, err := SOSDiskFree(dir)
+		if err != nil {
+			return 0, 0, err
+		}
+		free += f
+		total += t
+	}
+	return free, total, nil
+}
+
+// diskLow records whether we're currently below our free-space limit, so
+// we only warn when the limit is crossed.
+var diskLow atomic.Bool
+
+// diskNearlyFull returns true if the free space upon our store is below
+// the `-min-free-percent` limit.
+//
+// If the free space cannot be determined we assume there is plenty,
+// leaving the storage to fail if there isn't.
+func diskNearlyFull() bool {
+	limit := getBlobOptions().minFreePercent
+	if limit <= 0 {
+		return false
+	}
+
+	free, total, err := diskFree()
+	if err != nil || total == 0 {
+		return false
+	}
+
+	percent := float64(free) * 100 / float64(total)
+	low := percent < limit
+
+	if diskLow.Swap(low) != low {
+		if low {
+			GetLogger().Warn("Free disk space below limit, refusing uploads",
+				"free_percent", percent, "limit_percent", limit)
+		} else {
+			GetLogger().Info("Free disk space recovered, accepting uploads",
+				"free_percent", percent, "limit_percent", limit)
+		}
+	}
+	return low
+}
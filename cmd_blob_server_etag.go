@@ -0,0 +1,93 @@
+//
+// Conditional requests for the blob-server.
+//
+// When an object is served with an ETag a client may send the tags of
+// the copies it already holds, via `If-None-Match`, and receive a 304
+// if any of them is current.  The header is parsed, and compared, as
+// RFC 7232 describes:
+//
+//   If-None-Match: *
+//   If-None-Match: "abc", W/"def"
+//
+// `If-None-Match` uses the weak comparison, so `W/"abc"` matches `"abc"`.
+//
+
+package main
+
+import (
+	"strings"
+)
+
+// scanETag returns the first entity-tag from the given list, along with
+// the rest of the list, or "" if the list does not begin with a valid
+// entity-tag.
+//
+// Leading whitespace is skipped, and any `W/` prefix is retained.
+func scanETag(list string) (string, string) {
+	list = strings.TrimLeft(list, " \t")
+
+	start := 0
+	if strings.HasPrefix(list, "W/") {
+		start = 2
+	}
+	if len(list[start:]) < 2 || list[start] != '"' {
+		return "", ""
+	}
+
+	//
+	// The opaque-tag is quoted, and may hold any visible character
+	// other than a quote; a comma included.
+	//
+	for i := start + 1; i < len(list); i++ {
+		switch c := list[i]; {
+		case c == '"':
+			return list[:i+1], list[i+1:]
+		case c == 0x21 || (c >= 0x23 && c <= 0x7E) || c >= 0x80:
+		default:
+			return "", ""
+		}
+	}
+	return "", ""
+}
+
+// weakETagMatch reports whether the two entity-tags match, ignoring any
+// weakness indicator.
+func weakETagMatch(a string, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// noneMatch returns true if the given `If-None-Match` header matches an
+// object with the given entity-tag, such that the object should not be
+// sent again.
+//
+// The tag "*" matches any object which exists, even one without an
+// entity-tag.  Malformed entries end the comparison.
+func noneMatch(header string, etag string) bool {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+
+	for header != "" {
+		var candidate string
+		if candidate, header = scanETag(header); candidate == "" {
+			return false
+		}
+		if weakETagMatch(candidate, etag) {
+			return true
+		}
+
+		header = strings.TrimLeft(header, " \t")
+		if header == "" {
+			break
+		}
+		if header[0] != ',' {
+			return false
+		}
+		header = header[1:]
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+// Testing of blob-server conditional requests.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Test the parsing, and comparison, of If-None-Match headers.
+func TestNoneMatch(t *testing.T) {
+	etag := "\"abc\""
+
+	tests := []struct {
+		header string
+		etag   string
+		match  bool
+	}{
+		{"*", etag, true},
+		{" * ", "", true},
+		{"\"abc\"", "", false},
+		{"\"abc\"", etag, true},
+		{"W/\"abc\"", etag, true},
+		{"\"abc\"", "W/\"abc\"", true},
+		{"\"ABC\"", etag, false},
+		{"abc", etag, false},
+		{"\"xyz\", \"abc\"", etag, true},
+		{"\"xyz\",W/\"abc\"", etag, true},
+		{"  \"xyz\" ,\t\"abc\"  ", etag, true},
+		{"\"x,y\", \"abc\"", etag, true},
+		{"\"xyz\", \"uvw\"", etag, false},
+		{"\"xyz\" \"abc\"", etag, false},
+		{"\"xyz\", bogus, \"abc\"", etag, false},
+		{"\"abc", etag, false},
+		{"w/\"abc\"", etag, false},
+	}
+
+	for _, test := range tests {
+		if match := noneMatch(test.header, test.etag); match != test.match {
+			t.Errorf("Unexpected match of '%s' against '%s': got %v", test.header, test.etag, match)
+		}
+	}
+}
+
+// Test that If-None-Match is honoured by GET requests.
+func TestBlobIfNoneMatch(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+	setBlobOptions(blobServerCmd{s3compat: true})
+	defer setBlobOptions(blobServerCmd{})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/blob/{id}", UploadHandler).Methods("POST")
+	router.HandleFunc("/blob/{id}", GetHandler).Methods("GET")
+
+	req, err := http.NewRequest(http.MethodPost, "/blob/valid", strings.NewReader("Content goes here, honest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Modified", "Tue, 01 Jun 2021 10:00:00 GMT")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", status)
+	}
+
+	etag := "\"09c81a9265aab4f3a1766b604de8dfe2\""
+
+	tests := []struct {
+		headers []string
+		since   string
+		status  int
+	}{
+		{nil, "", http.StatusOK},
+		{[]string{"*"}, "", http.StatusNotModified},
+		{[]string{etag}, "", http.StatusNotModified},
+		{[]string{"W/" + etag}, "", http.StatusNotModified},
+		{[]string{"\"stale\", " + etag}, "", http.StatusNotModified},
+		{[]string{"\"stale\"", etag}, "", http.StatusNotModified},
+		{[]string{"\"stale\""}, "", http.StatusOK},
+
+		// If-Modified-Since is ignored alongside If-None-Match.
+		{[]string{"\"stale\""}, "Wed, 02 Jun 2021 10:00:00 GMT", http.StatusOK},
+		{nil, "Wed, 02 Jun 2021 10:00:00 GMT", http.StatusNotModified},
+	}
+
+	for _, test := range tests {
+		req, err = http.NewRequest(http.MethodGet, "/blob/valid", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, header := range test.headers {
+			req.Header.Add("If-None-Match", header)
+		}
+		if test.since != "" {
+			req.Header.Set("If-Modified-Since", test.since)
+		}
+
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if status := rr.Code; status != test.status {
+			t.Errorf("Unexpected status-code for %v: got %v want %v", test.headers, status, test.status)
+		}
+	}
+}
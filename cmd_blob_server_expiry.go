@@ -0,0 +1,45 @@
+//
+// Expiry of objects.
+//
+// An object uploaded with an `Expires` header records that time in its
+// meta-data, and it is sent back as the `Expires` header of downloads so
+// that caches discard their copies in time.  Once the time has passed
+// the object is reported as missing, by GET and HEAD, even though it
+// remains upon disk until it is deleted.
+//
+// The expiry is copied along with the object by the replication utility,
+// so that every copy expires at the same moment.
+//
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// errInvalidExpires is returned for an upload with a malformed `Expires`.
+var errInvalidExpires = errors.New("invalid Expires header, expected an HTTP-date")
+
+// checkExpires tests that the `Expires` header of an upload, if present,
+// is a valid HTTP-date.
+func checkExpires(header http.Header) error {
+	if value := header.Get("Expires"); value != "" {
+		if _, err := http.ParseTime(value); err != nil {
+			return errInvalidExpires
+		}
+	}
+	return nil
+}
+
+// expired returns true if the given meta-data records an expiry which
+// has passed.
+func expired(meta Metadata) bool {
+	value := meta.Get("Expires")
+	if value == "" {
+		return false
+	}
+	expires, err := http.ParseTime(value)
+	return err == nil && !time.Now().Before(expires)
+}
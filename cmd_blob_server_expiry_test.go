@@ -0,0 +1,96 @@
+// Testing of the expiry of objects.
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that objects are served with their expiry, and are missing once
+// it has passed.
+func TestBlobExpiry(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+
+	router := newBlobRouter("")
+	request := func(method string, path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader("Content"))
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+
+	if status := request(http.MethodPost, "/blob/future", http.Header{"Expires": {future}}).Code; status != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+	if status := request(http.MethodPost, "/blob/invalid", http.Header{"Expires": {"tomorrow"}}).Code; status != http.StatusBadRequest {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+	if status := request(http.MethodPost, "/blob/past", http.Header{"Expires": {past}}).Code; status != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		rr := request(method, "/blob/future", nil)
+		if rr.Code != http.StatusOK {
+			t.Errorf("Unexpected status-code for %s: %v", method, rr.Code)
+		}
+		if expires := rr.Header().Get("Expires"); expires != future {
+			t.Errorf("Unexpected Expires for %s: %s", method, expires)
+		}
+
+		if status := request(method, "/blob/past", nil).Code; status != http.StatusNotFound {
+			t.Errorf("Unexpected status-code for expired object via %s: %v", method, status)
+		}
+	}
+}
+
+// Test that the expiry of an object is preserved when it is mirrored,
+// and that expired objects are not mirrored.
+func TestReplicateExpiry(t *testing.T) {
+	srcStorage := new(FilesystemStorage)
+	srcStorage.Setup(t.TempDir())
+	dstStorage := new(FilesystemStorage)
+	dstStorage.Setup(t.TempDir())
+
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	srcStorage.Store("future", []byte("Content"), Metadata{"Expires": {future}})
+	srcStorage.Store("past", []byte("Content"), Metadata{"Expires": {past}})
+
+	//
+	// Each server is given its own storage, switched upon each request.
+	//
+	serve := func(storage StorageHandler) *httptest.Server {
+		router := newBlobRouter("")
+		return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			setStorage(storage)
+			router.ServeHTTP(res, req)
+		}))
+	}
+	src, dst := serve(srcStorage), serve(dstStorage)
+	defer src.Close()
+	defer dst.Close()
+
+	if !MirrorObject(context.Background(), src.URL, dst.URL, "future", replicateCmd{}) {
+		t.Errorf("Failed to mirror object")
+	}
+	if expires := dstStorage.Meta("future").Get("Expires"); expires != future {
+		t.Errorf("Unexpected expiry of mirrored object: %s", expires)
+	}
+
+	if MirrorObject(context.Background(), src.URL, dst.URL, "past", replicateCmd{}) || dstStorage.Exists("past") {
+		t.Errorf("Expired object was mirrored")
+	}
+}
@@ -0,0 +1,70 @@
+//
+// Self-description of the blob-server.
+//
+// `GET /info` reports the name and version of the blob-server, the
+// storage it is using, and how long it has been running, so that a node
+// started with the wrong `-store`, or `-storage`, may be spotted remotely:
+//
+//   {"service":"blob-server","name":"node1","version":"unreleased","storage":"filesystem",
+//    "store":["/srv/sos"],"started":"...","uptime":3600,"objects":1234}
+//
+// If the blob-server streams large objects their minimum size is also
+// reported, as `stream_threshold`.
+//
+// The `sos status` sub-command shows these alongside each node.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// blobStarted records the time at which the blob-server was set up.
+var blobStarted = time.Now()
+
+// serverInfo is the document returned by our `/info` end-point.
+type serverInfo struct {
+	Service string   `json:"service"`
+	Name    string   `json:"name,omitempty"`
+	Version string   `json:"version"`
+	Storage string   `json:"storage"`
+	Store   []string `json:"store"`
+	Started string   `json:"started"`
+	Uptime  int64    `json:"uptime"`
+	Objects int      `json:"objects"`
+
+	StreamThreshold int64 `json:"stream_threshold,omitempty"`
+}
+
+// ServerInfoHandler describes the blob-server, as JSON.
+//
+// This is called with requests like `GET /info`.
+func ServerInfoHandler(res http.ResponseWriter, _ *http.Request) {
+	list, err := getStorage().Existing()
+	if err != nil {
+		GetLogger().Error("Failed to list objects", "error", err)
+		writeJSONError(res, http.StatusInternalServerError, "failed to list objects")
+		return
+	}
+
+	options := getBlobOptions()
+	info := serverInfo{
+		Service: "blob-server",
+		Name:    options.name,
+		Version: version,
+		Storage: options.storage,
+		Store:   storeRoots(options.store),
+		Started: blobStarted.UTC().Format(time.RFC3339),
+		Uptime:  int64(time.Since(blobStarted).Seconds()),
+		Objects: len(list),
+
+		StreamThreshold: options.streamThreshold,
+	}
+
+	body, _ := json.Marshal(info)
+	res.Header().Set("Content-Type", "application/json")
+	_, _ = res.Write(body)
+}
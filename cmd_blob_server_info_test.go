@@ -0,0 +1,50 @@
+// Testing of the blob-server self-description.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// Test that the blob-server reports its storage, and object-count.
+func TestServerInfo(t *testing.T) {
+	dir := t.TempDir()
+	store := filepath.Join(dir, "one") + "," + filepath.Join(dir, "two")
+
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(store)
+	setStorage(storageHandler)
+	storageHandler.Store("steve", []byte("Content"), nil)
+
+	setBlobOptions(blobServerCmd{storage: "filesystem", store: store, name: "node1"})
+	defer setBlobOptions(blobServerCmd{})
+
+	req, err := http.NewRequest(http.MethodGet, "/info", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	newBlobRouter("").ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", status)
+	}
+
+	var info serverInfo
+	if err = json.Unmarshal(rr.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Response was not JSON: %v", err)
+	}
+	if info.Service != "blob-server" || info.Name != "node1" || info.Version != version || info.Storage != "filesystem" || info.Objects != 1 {
+		t.Errorf("Unexpected info: %v", info)
+	}
+	if !slices.Equal(info.Store, []string{filepath.Join(dir, "one"), filepath.Join(dir, "two")}) {
+		t.Errorf("Unexpected store: %v", info.Store)
+	}
+	if info.Started == "" || info.Uptime < 0 {
+		t.Errorf("Unexpected uptime: %v", info)
+	}
+}
@@ -0,0 +1,63 @@
+//
+// Object manifests for the blob-server.
+//
+// Comparing the complete lists of objects held by each member of a group
+// is expensive upon a large store, and almost always reveals that they
+// already match.  Instead the replicator first fetches a manifest from
+// each member: the number of objects held, and a digest of their sorted
+// IDs.  If every member reports the same digest the group is in sync,
+// and the lists need never be fetched.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// blobManifest is the document returned by our `/manifest` end-point.
+type blobManifest struct {
+	// Count is the number of objects listed.
+	Count int `json:"count"`
+
+	// Digest is the SHA256 digest of the sorted IDs of the objects,
+	// each followed by a newline.
+	Digest string `json:"digest"`
+}
+
+// newManifest returns the manifest of the given object IDs.
+func newManifest(ids []string) blobManifest {
+	sorted := slices.Sorted(slices.Values(ids))
+
+	hasher := sha256.New()
+	for _, id := range sorted {
+		_, _ = hasher.Write([]byte(id + "\n"))
+	}
+	return blobManifest{Count: len(sorted), Digest: hex.EncodeToString(hasher.Sum(nil))}
+}
+
+// ManifestHandler returns the manifest of the objects we hold, or of
+// those whose IDs begin with the `prefix` parameter.
+func ManifestHandler(res http.ResponseWriter, req *http.Request) {
+	list, err := getStorage().Existing()
+	if err != nil {
+		GetLogger().Error("Failed to list objects", "error", err)
+		writeJSONError(res, http.StatusInternalServerError, "failed to list objects")
+		return
+	}
+
+	if prefix := req.URL.Query().Get("prefix"); prefix != "" {
+		list = slices.DeleteFunc(list, func(id string) bool {
+			return !strings.HasPrefix(id, prefix)
+		})
+	}
+
+	body, _ := json.Marshal(newManifest(list))
+	res.Header().Set("Content-Type", "application/json")
+	_, _ = res.Write(body)
+}
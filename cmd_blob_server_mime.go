@@ -0,0 +1,85 @@
+//
+// Content-type filtering for the blob-server.
+//
+// If the blob-server is launched with `-allow-mime` then only uploads
+// with a matching content-type are accepted, and if launched with
+// `-deny-mime` uploads with a matching content-type are refused.
+//
+// Patterns may be globs, such as `image/*`, or prefixes ending in a
+// slash, such as `image/`.
+//
+
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// genericTypes are the content-types which tell us nothing about the
+// content, so we sniff the content instead.
+var genericTypes = map[string]bool{
+	"":                                  true,
+	"application/octet-stream":          true,
+	"application/x-www-form-urlencoded": true,
+}
+
+// mimeMatches returns true if the content-type matches any of the
+// comma-separated patterns.
+func mimeMatches(contentType string, patterns string) bool {
+	for pattern := range strings.SplitSeq(patterns, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+
+		if strings.HasSuffix(pattern, "/") && strings.HasPrefix(contentType, pattern) {
+			return true
+		}
+		if ok, _ := path.Match(pattern, contentType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadMime determines the content-type of an upload, from the type the
+// client declared, or by sniffing the content if they didn't.
+func uploadMime(declared string, content []byte) string {
+	if parsed, _, err := mime.ParseMediaType(declared); err == nil && !genericTypes[parsed] {
+		return parsed
+	}
+
+	parsed, _, _ := mime.ParseMediaType(http.DetectContentType(content))
+	return parsed
+}
+
+// checkMime tests the content-type of an upload against our allow and
+// deny lists, recording the type in the meta-data if it is acceptable.
+//
+// The type declared via `X-Mime-Type` is preferred, then `Content-Type`.
+func checkMime(header http.Header, content []byte, extras Metadata) error {
+	options := getBlobOptions()
+	if options.allowMime == "" && options.denyMime == "" {
+		return nil
+	}
+
+	declared := header.Get("X-Mime-Type")
+	if declared == "" {
+		declared = header.Get("Content-Type")
+	}
+	contentType := uploadMime(declared, content)
+
+	if options.allowMime != "" && !mimeMatches(contentType, options.allowMime) {
+		return fmt.Errorf("content-type '%s' is not allowed", contentType)
+	}
+	if options.denyMime != "" && mimeMatches(contentType, options.denyMime) {
+		return fmt.Errorf("content-type '%s' is denied", contentType)
+	}
+
+	extras.Set("X-Mime-Type", contentType)
+	return nil
+}
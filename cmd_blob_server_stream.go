@@ -0,0 +1,41 @@
+//
+// Buffering, or streaming, of downloads.
+//
+// By default an object is read fully into memory and then sent, which
+// is fastest for small objects, but a single huge object might exhaust
+// our memory.  If the blob-server is launched with `-stream-threshold`
+// then objects of at least that many bytes are instead read from their
+// storage as they're sent, where the storage allows it.
+//
+// The threshold is reported by `/info`, as `stream_threshold`.
+//
+
+package main
+
+import (
+	"bytes"
+	"io"
+)
+
+// openObject returns a reader of the object with the given ID, along
+// with its meta-data, or nil if it is missing.
+//
+// Objects smaller than our threshold are read into memory first, while
+// larger ones are streamed from the storage.
+func openObject(id string) (io.ReadCloser, Metadata) {
+	threshold := getBlobOptions().streamThreshold
+	if streamer, ok := getStorage().(Streamer); ok && threshold > 0 {
+		if size, found := getStorage().Size(id); found && size >= threshold {
+			reader, meta := streamer.GetReader(id)
+			if reader != nil {
+				return reader, meta
+			}
+		}
+	}
+
+	data, meta := getStorage().Get(id)
+	if data == nil {
+		return nil, nil
+	}
+	return io.NopCloser(bytes.NewReader(*data)), meta
+}
@@ -0,0 +1,77 @@
+// Testing of the streaming of large objects.
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// countingStorage records whether objects were read into memory.
+type countingStorage struct {
+	*FilesystemStorage
+	gets int
+}
+
+// Get reads the object into memory, counting the read.
+func (cs *countingStorage) Get(id string) (*[]byte, Metadata) {
+	cs.gets++
+	return cs.FilesystemStorage.Get(id)
+}
+
+// Test that objects above the threshold are streamed, and smaller ones
+// buffered, with the same content either way.
+func TestBlobStreamThreshold(t *testing.T) {
+	storageHandler := &countingStorage{FilesystemStorage: new(FilesystemStorage)}
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+
+	setBlobOptions(blobServerCmd{streamThreshold: 1024})
+	defer setBlobOptions(blobServerCmd{})
+
+	small := []byte("Content")
+	large := bytes.Repeat([]byte("0123456789"), 1000)
+	storageHandler.Store("small", small, Metadata{"X-Tag": {"small"}})
+	storageHandler.Store("large", large, Metadata{"X-Tag": {"large"}})
+
+	router := newBlobRouter("")
+	for _, test := range []struct {
+		id   string
+		data []byte
+		gets int
+	}{
+		{"small", small, 1},
+		{"large", large, 0},
+	} {
+		storageHandler.gets = 0
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/blob/"+test.id, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Unexpected status-code: %v", rr.Code)
+		}
+		if !bytes.Equal(rr.Body.Bytes(), test.data) {
+			t.Errorf("Unexpected body of %s: %d bytes", test.id, rr.Body.Len())
+		}
+		if tag := rr.Header().Get("X-Tag"); tag != test.id {
+			t.Errorf("Unexpected X-Tag: %v", tag)
+		}
+		if storageHandler.gets != test.gets {
+			t.Errorf("Expected %s to be read into memory %d times, got %d", test.id, test.gets, storageHandler.gets)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/blob/missing", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status-code: %v", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/info", nil))
+	if !strings.Contains(rr.Body.String(), `"stream_threshold":1024`) {
+		t.Errorf("Expected the threshold in the info:\n%s", rr.Body.String())
+	}
+}
@@ -3,15 +3,24 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/skx/sos/libconfig"
 )
 
 // Upload IDs must be alphanumeric.  Submit some bogus requests to
@@ -22,10 +31,10 @@ func TestGetIDNames(t *testing.T) {
 	router.HandleFunc("/blob/{id}", GetHandler).Methods("GET")
 
 	//
-	// Table driven test - each of these should fail as not
-	// matching "a-z0-9".
+	// Table driven test - each of these should fail, as IDs are
+	// runs of "a-z0-9" joined by single hyphens.
 	//
-	ids := []string{"/blob/xXx", "/blob/34l'", "/blob/a-b-c", "/blob/<fdf>"}
+	ids := []string{"/blob/xXx", "/blob/34l'", "/blob/a_b_c", "/blob/-ab", "/blob/a--b", "/blob/<fdf>"}
 
 	for _, id := range ids {
 		req, err := http.NewRequest(http.MethodGet, id, nil)
@@ -146,6 +155,14 @@ func TestHeadAccess(t *testing.T) {
 		if status := rr.Code; status != http.StatusOK {
 			t.Errorf("Unexpected status-code, post-create: %v", status)
 		}
+
+		// The size should be reported, without the body.
+		if length := rr.Header().Get("Content-Length"); length != "7" {
+			t.Errorf("Unexpected content-length: %v", length)
+		}
+		if rr.Body.Len() != 0 {
+			t.Errorf("HEAD returned a body: %v", rr.Body.String())
+		}
 	}
 
 	//
@@ -195,11 +212,14 @@ func TestMissingBlob(t *testing.T) {
 		}
 
 		// Check the response body is what we expect.
-		expected := "404 page not found\n"
+		expected := `{"error":"not found","status":404}`
 		if rr.Body.String() != expected {
 			t.Errorf("handler returned unexpected body: got '%v' want '%v'",
 				rr.Body.String(), expected)
 		}
+		if rr.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected content-type: %v", rr.Header().Get("Content-Type"))
+		}
 	}
 
 	//
@@ -398,7 +418,7 @@ func TestBlobUploadBogusID(t *testing.T) {
 	//
 	// Test a bogus name.
 	//
-	url := ts.URL + "/blob/foo-bar"
+	url := ts.URL + "/blob/foo_bar"
 
 	resp, err := http.Post(url, url, bytes.NewReader(content))
 	if err != nil {
@@ -600,6 +620,1096 @@ func TestMissing(t *testing.T) {
 			if status := rr.Code; status != http.StatusNotFound {
 				t.Errorf("Unexpected status-code for %s - %s: %v", method, path, status)
 			}
+
+			// Check the body is a JSON error.
+			var body errorResponse
+			if jsonErr := json.Unmarshal(rr.Body.Bytes(), &body); jsonErr != nil {
+				t.Errorf("Response for %s - %s was not JSON: %v", method, path, jsonErr)
+			}
+			if body.Status != http.StatusNotFound || body.Error == "" {
+				t.Errorf("Unexpected JSON body for %s - %s: %v", method, path, rr.Body.String())
+			}
+		}
+	}
+}
+
+// Test that S3-compatible mode verifies Content-MD5, and returns an ETag.
+func TestBlobS3Compat(t *testing.T) {
+	//
+	// Create a temporary directory.
+	//
+	p := t.TempDir()
+
+	//
+	// Init the filesystem storage-class, and enable S3-compatibility.
+	//
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(p)
+	setStorage(storageHandler)
+	setBlobOptions(blobServerCmd{s3compat: true})
+	defer setBlobOptions(blobServerCmd{})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/blob/{id}", UploadHandler).Methods("POST")
+	router.HandleFunc("/blob/{id}", GetHandler).Methods("GET")
+
+	content := "Content goes here, honest"
+
+	//
+	// An upload with a bogus digest should be rejected.
+	//
+	req, err := http.NewRequest(http.MethodPost, "/blob/bogus", strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-MD5", "AAAAAAAAAAAAAAAAAAAAAA==")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+	if getStorage().Exists("bogus") {
+		t.Errorf("Upload with a bad digest was stored!")
+	}
+
+	//
+	// An upload with the correct digest should succeed.
+	//
+	req, err = http.NewRequest(http.MethodPost, "/blob/valid", strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-MD5", "CcgakmWqtPOhdmtgTejf4g==")
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+
+	//
+	// Downloading should return the MD5 as the ETag.
+	//
+	req, err = http.NewRequest(http.MethodGet, "/blob/valid", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	expected := "\"09c81a9265aab4f3a1766b604de8dfe2\""
+	if rr.Header().Get("ETag") != expected {
+		t.Errorf("Unexpected ETag: got '%v' want '%v'", rr.Header().Get("ETag"), expected)
+	}
+}
+
+// Test that objects may be served beneath another path.
+func TestBlobCustomPath(t *testing.T) {
+	store := new(FilesystemStorage)
+	store.Setup(t.TempDir())
+	setStorage(store)
+	defer setStorage(nil)
+
+	if err := libconfig.SetBlobPath("/objects/{shard}/{id}"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = libconfig.SetBlobPath(libconfig.DefaultBlobPath) }()
+	router := newBlobRouter("")
+
+	req := httptest.NewRequest(http.MethodPost, libconfig.BlobURL("", "abcdef"), strings.NewReader("content"))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", rr.Code)
+	}
+
+	tests := map[string]int{
+		"/objects/ab/abcdef": http.StatusOK,
+		"/blob/abcdef":       http.StatusNotFound,
+	}
+	for path, expected := range tests {
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != expected {
+			t.Errorf("Unexpected status-code for %s: got %v want %v", path, rr.Code, expected)
+		}
+		if expected == http.StatusOK && rr.Body.String() != "content" {
+			t.Errorf("Unexpected body for %s: %s", path, rr.Body.String())
+		}
+	}
+}
+
+// Test that our routes may be placed beneath a path-prefix.
+func TestBlobPathPrefix(t *testing.T) {
+	router := newBlobRouter("/sos/")
+
+	//
+	// The prefixed health-check should succeed, the bare one should fail.
+	//
+	tests := map[string]int{
+		"/sos/alive": http.StatusOK,
+		"/alive":     http.StatusNotFound,
+	}
+
+	for path, expected := range tests {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != expected {
+			t.Errorf("Unexpected status-code for %s: got %v want %v", path, status, expected)
+		}
+	}
+}
+
+// Test that IDs of the wrong length are rejected, when configured.
+func TestGetIDLength(t *testing.T) {
+	setBlobOptions(blobServerCmd{idLength: 64})
+	defer setBlobOptions(blobServerCmd{})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/blob/{id}", GetHandler).Methods("GET")
+	router.HandleFunc("/blob/{id}", UploadHandler).Methods("POST")
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		req, err := http.NewRequest(method, "/blob/a", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("Unexpected status-code for %s: %v", method, status)
+		}
+
+		expected := "IDs must be 64 characters long\n"
+		if rr.Body.String() != expected {
+			t.Errorf("handler returned unexpected body: got '%v' want '%v'",
+				rr.Body.String(), expected)
+		}
+	}
+}
+
+// Test that overly long IDs are rejected.
+func TestGetIDTooLong(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/blob/{id}", GetHandler).Methods("GET")
+
+	req, err := http.NewRequest(http.MethodGet, "/blob/"+strings.Repeat("a", maxIDLength+1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+}
+
+// Test that Last-Modified is preserved, and If-Modified-Since honoured.
+func TestBlobLastModified(t *testing.T) {
+	//
+	// Create a temporary directory.
+	//
+	p := t.TempDir()
+
+	//
+	// Init the filesystem storage-class - defined in `cmd_blob_server.go`
+	//
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(p)
+	setStorage(storageHandler)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/blob/{id}", UploadHandler).Methods("POST")
+	router.HandleFunc("/blob/{id}", GetHandler).Methods("GET")
+
+	//
+	// Upload, as the replication utility would, with an explicit time.
+	//
+	modified := "Tue, 01 Jun 2021 10:00:00 GMT"
+
+	req, err := http.NewRequest(http.MethodPost, "/blob/steve", strings.NewReader("Content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Modified", modified)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", status)
+	}
+
+	//
+	// Now fetch with various If-Modified-Since values.
+	//
+	tests := map[string]int{
+		"":                              http.StatusOK,
+		"Mon, 31 May 2021 10:00:00 GMT": http.StatusOK,
+		modified:                        http.StatusNotModified,
+		"Wed, 02 Jun 2021 10:00:00 GMT": http.StatusNotModified,
+	}
+
+	for since, expected := range tests {
+		req, err = http.NewRequest(http.MethodGet, "/blob/steve", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if since != "" {
+			req.Header.Set("If-Modified-Since", since)
+		}
+
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != expected {
+			t.Errorf("Unexpected status-code for '%s': got %v want %v", since, status, expected)
+		}
+		if rr.Header().Get("Last-Modified") != modified {
+			t.Errorf("Unexpected Last-Modified: %v", rr.Header().Get("Last-Modified"))
+		}
+	}
+}
+
+// Test the detailed blob-list.
+func TestBlobListDetail(t *testing.T) {
+	//
+	// Create a temporary directory.
+	//
+	p := t.TempDir()
+
+	//
+	// Init the filesystem storage-class - defined in `cmd_blob_server.go`
+	//
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(p)
+	setStorage(storageHandler)
+
+	meta := Metadata{"X-Mime-Type": {"text/plain"}, "Last-Modified": {"Tue, 01 Jun 2021 10:00:00 GMT"}}
+	if !storageHandler.Store("steve", []byte("Content"), meta) {
+		t.Fatalf("Failed to store content")
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/blobs", ListHandler).Methods("GET")
+
+	req, err := http.NewRequest(http.MethodGet, "/blobs?detail=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	expected := `[{"id":"steve","size":7,"mime":"text/plain","created":"Tue, 01 Jun 2021 10:00:00 GMT"}]`
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got '%v' want '%v'",
+			rr.Body.String(), expected)
+	}
+}
+
+// brokenStorage is a storage-class whose objects cannot be listed.
+type brokenStorage struct {
+	FilesystemStorage
+
+	after int
+}
+
+// Existing always fails.
+func (*brokenStorage) Existing() ([]string, error) {
+	return nil, errors.New("disk on fire")
+}
+
+// Enumerate fails after the given number of objects.
+func (b *brokenStorage) Enumerate(fn func(id string) error) error {
+	for i := range b.after {
+		if err := fn(fmt.Sprintf("object%d", i)); err != nil {
+			return err
+		}
+	}
+	return errors.New("disk on fire")
+}
+
+// Test that a failure to list objects is not reported as an empty list.
+func TestBlobListFailure(t *testing.T) {
+	storageHandler := new(brokenStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+
+	router := newBlobRouter("")
+
+	for _, path := range []string{"/blobs", "/stats"} {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusInternalServerError {
+			t.Errorf("Unexpected status-code for %s: %v", path, status)
+		}
+
+		var body errorResponse
+		if jsonErr := json.Unmarshal(rr.Body.Bytes(), &body); jsonErr != nil {
+			t.Errorf("Response was not JSON: %v", jsonErr)
+		}
+	}
+}
+
+// Test that a failure part-way through a streamed listing aborts the
+// response, rather than completing a short list.
+func TestBlobListStreamFailure(t *testing.T) {
+	storageHandler := &brokenStorage{after: 3}
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+
+	router := newBlobRouter("")
+
+	req, err := http.NewRequest(http.MethodGet, "/blobs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if recovered := recover(); recovered != http.ErrAbortHandler {
+			t.Errorf("Unexpected panic: %v", recovered)
+		}
+	}()
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	t.Errorf("The listing was not aborted")
+}
+
+// Test that the listing may be restricted to a prefix.
+func TestBlobListPrefix(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+	for _, id := range []string{"abc", "abd", "bcd"} {
+		storageHandler.Store(id, []byte(id), nil)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/blobs", ListHandler).Methods("GET")
+
+	tests := map[string][]string{
+		"/blobs?prefix=ab":  {"abc", "abd"},
+		"/blobs?prefix=b":   {"bcd"},
+		"/blobs?prefix=xyz": {},
+	}
+
+	for path, expected := range tests {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		//
+		// A streamed listing is in no particular order.
+		//
+		var list []string
+		if jsonErr := json.Unmarshal(rr.Body.Bytes(), &list); jsonErr != nil {
+			t.Errorf("Response was not JSON: %v", jsonErr)
+		}
+		slices.Sort(list)
+		if list == nil || !slices.Equal(list, expected) {
+			t.Errorf("Unexpected body for %s: %v", path, rr.Body.String())
+		}
+	}
+}
+
+// Test that manifests depend upon the objects held, not their order.
+func TestBlobManifest(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+	for _, id := range []string{"bcd", "abc", "abd"} {
+		storageHandler.Store(id, []byte(id), nil)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/manifest", ManifestHandler).Methods("GET")
+
+	tests := map[string][]string{
+		"/manifest":           {"abc", "abd", "bcd"},
+		"/manifest?prefix=ab": {"abd", "abc"},
+		"/manifest?prefix=x":  {},
+	}
+
+	for path, ids := range tests {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		var manifest blobManifest
+		if err = json.Unmarshal(rr.Body.Bytes(), &manifest); err != nil {
+			t.Fatalf("Failed to decode manifest for %s: %v", path, err)
+		}
+		if manifest != newManifest(ids) || manifest.Count != len(ids) {
+			t.Errorf("Unexpected manifest for %s: %v", path, manifest)
+		}
+	}
+
+	if newManifest([]string{"abc"}) == newManifest([]string{"abd"}) {
+		t.Errorf("Different objects have the same manifest")
+	}
+}
+
+// Test that a placeholder may be served in place of missing objects.
+func TestNotFoundBlob(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+	storageHandler.Store("placeholder", []byte("PNG"), Metadata{"X-Mime-Type": {"image/png"}})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/blob/{id}", GetHandler).Methods("GET", "HEAD")
+
+	for _, status := range []int{http.StatusNotFound, http.StatusOK} {
+		setBlobOptions(blobServerCmd{notFoundBlob: "placeholder", notFoundStatus: status})
+
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			req, err := http.NewRequest(method, "/blob/missing", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != status {
+				t.Errorf("Unexpected status-code: %v", rr.Code)
+			}
+			if rr.Header().Get("Content-Type") != "image/png" {
+				t.Errorf("Unexpected content-type: %v", rr.Header().Get("Content-Type"))
+			}
+
+			expected := "PNG"
+			if method == http.MethodHead {
+				expected = ""
+			}
+			if rr.Body.String() != expected {
+				t.Errorf("Unexpected body for %s: %v", method, rr.Body.String())
+			}
+		}
+	}
+	setBlobOptions(blobServerCmd{})
+}
+
+// Test that listings may be filtered by meta-data.
+func TestBlobListTags(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+
+	storageHandler.Store("alpha", []byte("a"), Metadata{"X-Project": {"alpha"}, "X-Owner": {"steve"}})
+	storageHandler.Store("beta", []byte("b"), Metadata{"X-Project": {"beta"}, "X-Owner": {"steve"}})
+	storageHandler.Store("plain", []byte("c"), nil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/blobs", ListHandler).Methods("GET")
+
+	tests := map[string]string{
+		"/blobs?tag=X-Project:alpha":                  `["alpha"]`,
+		"/blobs?tag=x-owner:steve":                    `["alpha","beta"]`,
+		"/blobs?tag=X-Owner:steve&tag=X-Project:beta": `["beta"]`,
+		"/blobs?tag=X-Project:gamma":                  `[]`,
+		"/blobs?tag=X-Project:alpha&tag=X-Owner:kemp": `[]`,
+	}
+
+	for path, expected := range tests {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Body.String() != expected {
+			t.Errorf("Unexpected listing for %s: got '%v' want '%v'", path, rr.Body.String(), expected)
+		}
+	}
+
+	//
+	// Tags must name an X-header.
+	//
+	req, err := http.NewRequest(http.MethodGet, "/blobs?tag=Project", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+}
+
+// Test that a listing may be restricted to recently stored objects.
+func TestBlobListSince(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+
+	old := time.Unix(1000000000, 0).UTC().Format(http.TimeFormat)
+	recent := time.Unix(2000000000, 0).UTC().Format(http.TimeFormat)
+	storageHandler.Store("old", []byte("a"), Metadata{"Last-Modified": {old}})
+	storageHandler.Store("recent", []byte("b"), Metadata{"Last-Modified": {recent}})
+	storageHandler.Store("unknown", []byte("c"), nil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/blobs", ListHandler).Methods("GET")
+
+	tests := map[string]string{
+		"/blobs?since=1500000000": `["recent","unknown"]`,
+		"/blobs?since=2000000000": `["recent","unknown"]`,
+		"/blobs?since=2000000001": `["unknown"]`,
+		"/blobs?since=0":          `["old","recent","unknown"]`,
+	}
+
+	for path, expected := range tests {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if rr.Body.String() != expected {
+			t.Errorf("Unexpected listing for %s: got '%v' want '%v'", path, rr.Body.String(), expected)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/blobs?since=yesterday", nil))
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+}
+
+// Test that reads are counted, when enabled.
+func TestTrackAccess(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+	storageHandler.Store("steve", []byte("Content"), nil)
+
+	setBlobOptions(blobServerCmd{trackAccess: true})
+	defer setBlobOptions(blobServerCmd{})
+	defer accesses.Clear()
+
+	router := newBlobRouter("")
+
+	for range 2 {
+		req, err := http.NewRequest(http.MethodGet, "/blob/steve", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("Unexpected status-code: %v", status)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "/info/steve", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var info BlobInfo
+	if jsonErr := json.Unmarshal(rr.Body.Bytes(), &info); jsonErr != nil {
+		t.Fatalf("Response was not JSON: %v", jsonErr)
+	}
+	if info.Accesses != 2 || info.LastAccess == "" {
+		t.Errorf("Unexpected access details: %v", rr.Body.String())
+	}
+}
+
+// Test that uploads are refused when the disk is nearly full.
+func TestBlobUploadDiskFull(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+	storageHandler.Store("steve", []byte("Content"), nil)
+
+	setBlobOptions(blobServerCmd{minFreePercent: 10})
+	defer setBlobOptions(blobServerCmd{})
+
+	original := diskFree
+	defer func() { diskFree = original }()
+
+	router := newBlobRouter("")
+
+	tests := map[uint64]int{
+		50: http.StatusOK,
+		5:  http.StatusInsufficientStorage,
+	}
+	for free, expected := range tests {
+		diskFree = func() (uint64, uint64, error) { return free, 100, nil }
+
+		req, err := http.NewRequest(http.MethodPost, "/blob/kemp", strings.NewReader("Content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if status := rr.Code; status != expected {
+			t.Errorf("Unexpected status-code with %d%% free: %v", free, status)
+		}
+
+		//
+		// Reads always succeed.
+		//
+		req, err = http.NewRequest(http.MethodGet, "/blob/steve", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("Unexpected status-code: %v", status)
+		}
+	}
+}
+
+// Test that new objects are refused once the object-count limit is hit.
+func TestBlobUploadMaxObjects(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+	storageHandler.Store("steve", []byte("Content"), nil)
+
+	setBlobOptions(blobServerCmd{maxObjects: 2})
+	defer setBlobOptions(blobServerCmd{})
+
+	if err := initObjectCount(); err != nil {
+		t.Fatal(err)
+	}
+
+	router := newBlobRouter("")
+
+	tests := []struct {
+		id       string
+		expected int
+	}{
+		{"kemp", http.StatusOK},
+		{"kemp", http.StatusOK},
+		{"other", http.StatusInsufficientStorage},
+		{"steve", http.StatusOK},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodPost, "/blob/"+test.id, strings.NewReader("Content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if status := rr.Code; status != test.expected {
+			t.Errorf("Unexpected status-code uploading %s: %v", test.id, status)
+		}
+	}
+
+	if count := objectCount.Load(); count != 2 {
+		t.Errorf("Unexpected object count: %d", count)
+	}
+}
+
+// Test that empty uploads are refused, unless permitted.
+func TestBlobUploadEmpty(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+
+	router := newBlobRouter("")
+
+	for _, allow := range []bool{false, true} {
+		setBlobOptions(blobServerCmd{allowEmpty: allow})
+
+		req, err := http.NewRequest(http.MethodPost, "/blob/empty", strings.NewReader(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if getStorage().Exists("empty") != allow {
+			t.Errorf("Unexpected result storing an empty object, allowed=%v: %v", allow, rr.Code)
+		}
+	}
+	setBlobOptions(blobServerCmd{})
+}
+
+// Test that uploads may be filtered by content-type.
+func TestBlobUploadMime(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+
+	setBlobOptions(blobServerCmd{allowMime: "image/*", denyMime: "image/svg+xml"})
+	defer setBlobOptions(blobServerCmd{})
+
+	router := newBlobRouter("")
+
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 16)
+
+	tests := []struct {
+		id       string
+		body     string
+		header   map[string]string
+		status   int
+		storedAs string
+	}{
+		{"sniffed", png, nil, http.StatusOK, "image/png"},
+		{"declared", "GIF89a", map[string]string{"Content-Type": "image/gif; charset=binary"}, http.StatusOK, "image/gif"},
+		{"xmime", "data", map[string]string{"X-Mime-Type": "image/jpeg"}, http.StatusOK, "image/jpeg"},
+		{"text", "Hello, world", nil, http.StatusUnsupportedMediaType, ""},
+		{"svg", "<svg/>", map[string]string{"Content-Type": "image/svg+xml"}, http.StatusUnsupportedMediaType, ""},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodPost, "/blob/"+test.id, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range test.header {
+			req.Header.Set(k, v)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("Unexpected status-code for %s: %v", test.id, status)
+		}
+		if mime := storageHandler.Meta(test.id).Get("X-Mime-Type"); mime != test.storedAs {
+			t.Errorf("Unexpected stored type for %s: %v", test.id, mime)
+		}
+	}
+}
+
+// Test that uploads with excessive meta-data are refused.
+func TestBlobUploadMetaLimits(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+
+	setBlobOptions(blobServerCmd{maxMetaHeaders: 2, maxMetaBytes: 64})
+	defer setBlobOptions(blobServerCmd{})
+
+	router := newBlobRouter("")
+
+	tests := []struct {
+		header map[string]string
+		status int
+	}{
+		{map[string]string{"X-One": "1", "X-Two": "2"}, http.StatusOK},
+		{map[string]string{"X-One": "1", "X-Two": "2", "X-Three": "3"}, http.StatusRequestHeaderFieldsTooLarge},
+		{map[string]string{"X-Big": strings.Repeat("x", 64)}, http.StatusRequestHeaderFieldsTooLarge},
+		{map[string]string{"Accept": strings.Repeat("x", 64)}, http.StatusOK},
+	}
+
+	for i, test := range tests {
+		req, err := http.NewRequest(http.MethodPost, "/blob/steve", strings.NewReader("Content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range test.header {
+			req.Header.Set(k, v)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("Unexpected status-code for test %d: %v", i, status)
+		}
+	}
+}
+
+// Test that every value of a repeated X-header survives a round-trip.
+func TestBlobUploadRepeatedHeader(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+
+	router := newBlobRouter("")
+
+	req, err := http.NewRequest(http.MethodPost, "/blob/steve", strings.NewReader("Content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Tag", "red")
+	req.Header.Add("X-Tag", "blue")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", status)
+	}
+
+	req, err = http.NewRequest(http.MethodGet, "/blob/steve", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if tags := rr.Header().Values("X-Tag"); strings.Join(tags, ",") != "red,blue" {
+		t.Errorf("Unexpected X-Tag values: %v", tags)
+	}
+}
+
+// Test that HEAD requests return the stored meta-data of an object.
+func TestHeadMetaHeaders(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+
+	storageHandler.Store("steve", []byte("Content"), Metadata{
+		"X-Mime-Type": {"text/plain"},
+		"X-Project":   {"alpha"},
+	})
+
+	router := newBlobRouter("")
+
+	req, err := http.NewRequest(http.MethodHead, "/blob/steve", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", status)
+	}
+	if mime := rr.Header().Get("Content-Type"); mime != "text/plain" {
+		t.Errorf("Unexpected content-type: %v", mime)
+	}
+	if project := rr.Header().Get("X-Project"); project != "alpha" {
+		t.Errorf("Unexpected X-Project: %v", project)
+	}
+	if length := rr.Header().Get("Content-Length"); length != "7" {
+		t.Errorf("Unexpected content-length: %v", length)
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("HEAD returned a body: %v", rr.Body.String())
+	}
+}
+
+// Test that downloads name the node which served them, if requested.
+func TestBlobServedBy(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+	storageHandler.Store("steve", []byte("Content"), nil)
+
+	router := newBlobRouter("")
+	defer setBlobOptions(blobServerCmd{})
+
+	for _, servedBy := range []bool{false, true} {
+		setBlobOptions(blobServerCmd{name: "node1", servedBy: servedBy})
+
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			req, err := http.NewRequest(method, "/blob/steve", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			expected := ""
+			if servedBy {
+				expected = "node1"
+			}
+			if name := rr.Header().Get("X-Served-By"); name != expected {
+				t.Errorf("Unexpected X-Served-By for %s: %v", method, name)
+			}
+		}
+	}
+}
+
+// Test that meta-data which would corrupt the response is dropped.
+func TestBlobIllegalMetaHeaders(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+
+	storageHandler.Store("steve", []byte("Content"), Metadata{
+		"Content-Length":    {"1000"},
+		"Transfer-Encoding": {"chunked"},
+		"Bad Name":          {"value"},
+		"X-Split":           {"one\r\nX-Injected: two"},
+		"X-Tag":             {"red"},
+	})
+
+	router := newBlobRouter("")
+
+	req, err := http.NewRequest(http.MethodGet, "/blob/steve", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", status)
+	}
+	for _, header := range []string{"Content-Length", "Transfer-Encoding", "Bad Name", "X-Split", "X-Injected"} {
+		if value := rr.Header().Get(header); value != "" {
+			t.Errorf("Unexpected %s header: %v", header, value)
+		}
+	}
+	if tag := rr.Header().Get("X-Tag"); tag != "red" {
+		t.Errorf("Unexpected X-Tag: %v", tag)
+	}
+}
+
+// Test that an object's Cache-Control is stored, served, and mirrored,
+// and that objects without one receive the default.
+func TestBlobCacheControl(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+
+	setBlobOptions(blobServerCmd{defaultCacheControl: "no-cache"})
+	defer setBlobOptions(blobServerCmd{})
+
+	router := newBlobRouter("")
+
+	uploads := map[string]http.Header{
+		"cached":   {"Cache-Control": {"public, max-age=60"}},
+		"explicit": {"X-Cache-Control": {"private"}},
+		"plain":    {},
+	}
+	for id, header := range uploads {
+		req, err := http.NewRequest(http.MethodPost, "/blob/"+id, strings.NewReader("Content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = header
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("Unexpected status-code: %v", status)
+		}
+	}
+
+	expected := map[string]string{
+		"cached":   "public, max-age=60",
+		"explicit": "private",
+		"plain":    "no-cache",
+	}
+	for id, cache := range expected {
+		req, err := http.NewRequest(http.MethodGet, "/blob/"+id, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if got := rr.Header().Get("Cache-Control"); got != cache {
+			t.Errorf("Unexpected Cache-Control for %s: %s", id, got)
+		}
+	}
+
+	//
+	// Mirrored copies carry the object's own directive, but not
+	// our default.
+	//
+	src := httptest.NewServer(router)
+	defer src.Close()
+
+	mirrored := make(chan string, 1)
+	dst := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		mirrored <- req.Header.Get("X-Cache-Control")
+	}))
+	defer dst.Close()
+
+	for id, cache := range map[string]string{"cached": "public, max-age=60", "plain": ""} {
+		if !MirrorObject(context.Background(), src.URL, dst.URL, id, replicateCmd{}) {
+			t.Fatalf("Failed to mirror %s", id)
+		}
+		if got := <-mirrored; got != cache {
+			t.Errorf("Unexpected mirrored X-Cache-Control for %s: %s", id, got)
+		}
+	}
+}
+
+// Test that uploads are verified against an X-Content-SHA256 trailer.
+func TestBlobUploadTrailer(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+
+	server := httptest.NewServer(newBlobRouter(""))
+	defer server.Close()
+
+	content := "Content"
+	sum := sha256.Sum256([]byte(content))
+	digest := strings.Repeat("0", sha256.Size*2)
+
+	tests := []struct {
+		id      string
+		trailer string
+		status  int
+	}{
+		{"none", "", http.StatusOK},
+		{"valid", hex.EncodeToString(sum[:]), http.StatusOK},
+		{"upper", strings.ToUpper(hex.EncodeToString(sum[:])), http.StatusOK},
+		{"corrupt", digest, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/blob/"+test.id, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.trailer != "" {
+			req.ContentLength = -1
+			req.Trailer = http.Header{"X-Content-Sha256": {test.trailer}}
+		}
+
+		response, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = response.Body.Close()
+
+		if response.StatusCode != test.status {
+			t.Errorf("Unexpected status-code for %s: %v", test.id, response.StatusCode)
+		}
+		if storageHandler.Exists(test.id) != (test.status == http.StatusOK) {
+			t.Errorf("Unexpected storage of %s", test.id)
 		}
 	}
 }
@@ -0,0 +1,227 @@
+//
+// Soft-deletion for the blob-server.
+//
+// If the blob-server is launched with `-soft-delete 168h` objects may be
+// deleted, and a deleted object is moved to a trash directory beneath
+// our store rather than being removed:
+//
+//   DELETE /blob/{id}            - move the object to the trash.
+//   DELETE /blob/{id}?hard=true  - remove the object immediately.
+//   POST   /restore/{id}         - move the object back from the trash.
+//
+// Objects in the trash are not served, listed, or replicated, and once
+// they've been there longer than the retention period a janitor removes
+// them for good.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// trashDirectory is the directory, beneath our store, which holds the
+// deleted objects.
+const trashDirectory = ".trash"
+
+// maxJanitorInterval is the longest we wait between reaping the trash.
+const maxJanitorInterval = time.Hour
+
+// trashRoot holds the directory containing deleted objects, or nil if
+// deletion is disabled.
+//
+// We open this before we chroot(), so that it remains accessible.
+var trashRoot *os.Root
+
+// setTrashRoot stores the trash directory for use by handlers.
+func setTrashRoot(root *os.Root) {
+	trashRoot = root
+}
+
+// getTrashRoot returns the trash directory.
+func getTrashRoot() *os.Root {
+	return trashRoot
+}
+
+// trashRecord is the record persisted, alongside the data, for each
+// deleted object.
+type trashRecord struct {
+	// ID is the ID of the deleted object.
+	ID string `json:"id"`
+
+	// Deleted is the time the object was deleted.
+	Deleted time.Time `json:"deleted"`
+
+	// Meta is the meta-data of the object.
+	Meta Metadata `json:"meta,omitempty"`
+}
+
+// deleteObject removes the given object from our storage.
+func deleteObject(id string) bool {
+	deleter, ok := getStorage().(Deleter)
+	if !ok || !deleter.Delete(id) {
+		return false
+	}
+	uncountObject()
+	return true
+}
+
+// DeleteHandler deletes an object, moving it to the trash unless the
+// `hard` parameter is given.
+//
+// This is called with requests like `DELETE /blob/XXXXXX`.
+func DeleteHandler(res http.ResponseWriter, req *http.Request) {
+	if getTrashRoot() == nil {
+		writeJSONError(res, http.StatusNotFound, "deletion is disabled")
+		return
+	}
+
+	id := mux.Vars(req)["id"]
+	if status, err := validateID(id); err != nil {
+		writeJSONError(res, status, err.Error())
+		return
+	}
+	size, ok := getStorage().Size(id)
+	if !ok {
+		writeJSONError(res, http.StatusNotFound, "not found")
+		return
+	}
+
+	if req.URL.Query().Get("hard") != "true" {
+		data, meta := getStorage().Get(id)
+		if data == nil {
+			writeJSONError(res, http.StatusNotFound, "not found")
+			return
+		}
+
+		//
+		// The data is written first, so that a record is never
+		// present without it.
+		//
+		encoded, _ := json.Marshal(trashRecord{ID: id, Deleted: time.Now(), Meta: meta})
+		if err := writeRootFile(getTrashRoot(), id, *data); err != nil {
+			writeJSONError(res, http.StatusInternalServerError, "failed to write to trash")
+			return
+		}
+		if err := writeRootFile(getTrashRoot(), id+".json", encoded); err != nil {
+			writeJSONError(res, http.StatusInternalServerError, "failed to write to trash")
+			return
+		}
+	}
+
+	if !deleteObject(id) {
+		writeJSONError(res, http.StatusInternalServerError, "failed to delete object")
+		return
+	}
+	audit(req, "delete", id, size)
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// RestoreHandler moves an object back from the trash.
+//
+// This is called with requests like `POST /restore/XXXXXX`.
+func RestoreHandler(res http.ResponseWriter, req *http.Request) {
+	if getTrashRoot() == nil {
+		writeJSONError(res, http.StatusNotFound, "deletion is disabled")
+		return
+	}
+
+	id := mux.Vars(req)["id"]
+	if status, err := validateID(id); err != nil {
+		writeJSONError(res, status, err.Error())
+		return
+	}
+
+	encoded, err := readRootFile(getTrashRoot(), id+".json")
+	if errors.Is(err, fs.ErrNotExist) {
+		writeJSONError(res, http.StatusNotFound, "not in trash")
+		return
+	}
+	var record trashRecord
+	if err == nil {
+		err = json.Unmarshal(encoded, &record)
+	}
+	data, readErr := readRootFile(getTrashRoot(), id)
+	if err != nil || readErr != nil {
+		writeJSONError(res, http.StatusInternalServerError, "failed to read from trash")
+		return
+	}
+
+	//
+	// The object may have been uploaded again since it was deleted.
+	//
+	if getStorage().Exists(id) {
+		writeJSONError(res, http.StatusConflict, "an object with that ID exists")
+		return
+	}
+
+	if !storeUpload(res, req, id, data, record.Meta) {
+		return
+	}
+	_ = getTrashRoot().Remove(id + ".json")
+	_ = getTrashRoot().Remove(id)
+}
+
+// reapTrash permanently removes the objects which were deleted longer
+// ago than the given retention period, returning how many were removed.
+func reapTrash(root *os.Root, retention time.Duration, now time.Time) (int, error) {
+	dir, err := root.Open(".")
+	if err != nil {
+		return 0, err
+	}
+	entries, err := dir.ReadDir(-1)
+	_ = dir.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	reaped := 0
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+
+		encoded, readErr := readRootFile(root, entry.Name())
+		if readErr != nil {
+			continue
+		}
+		var record trashRecord
+		if json.Unmarshal(encoded, &record) != nil || now.Sub(record.Deleted) < retention {
+			continue
+		}
+
+		if removeErr := root.Remove(id); removeErr != nil && !errors.Is(removeErr, fs.ErrNotExist) {
+			continue
+		}
+		_ = root.Remove(entry.Name())
+		reaped++
+	}
+	return reaped, nil
+}
+
+// trashJanitor reaps the trash periodically, forever.
+func trashJanitor(root *os.Root, retention time.Duration) {
+	interval := min(retention, maxJanitorInterval)
+
+	for {
+		time.Sleep(interval)
+
+		reaped, err := reapTrash(root, retention, time.Now())
+		if err != nil {
+			GetLogger().Error("Failed to reap trash", "error", err)
+			continue
+		}
+		if reaped > 0 {
+			GetLogger().Info("Reaped deleted objects", "count", reaped)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Testing of blob-server soft-deletion.
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// Test that objects may be deleted, restored, and reaped.
+func TestSoftDelete(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+	storageHandler.Store("target", []byte("Content"), Metadata{"X-Mime-Type": {"text/plain"}})
+	storageHandler.Store("other", []byte("Other"), nil)
+
+	router := newBlobRouter("")
+
+	//
+	// Deletion is disabled by default.
+	//
+	if code, _ := sendAlias(t, router, http.MethodDelete, "/blob/target", ""); code != http.StatusNotFound {
+		t.Errorf("Unexpected status-code: %v", code)
+	}
+	if !storageHandler.Exists("target") {
+		t.Fatalf("Object was deleted while deletion was disabled")
+	}
+
+	root, err := os.OpenRoot(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTrashRoot(root)
+	defer func() {
+		_ = root.Close()
+		setTrashRoot(nil)
+	}()
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodDelete, "/blob/missing", http.StatusNotFound},
+		{http.MethodDelete, "/blob/a_b", http.StatusInternalServerError},
+		{http.MethodDelete, "/blob/target", http.StatusNoContent},
+		{http.MethodGet, "/blob/target", http.StatusNotFound},
+		{http.MethodPost, "/restore/missing", http.StatusNotFound},
+		{http.MethodPost, "/restore/target", http.StatusOK},
+		{http.MethodGet, "/blob/target", http.StatusOK},
+		{http.MethodPost, "/restore/target", http.StatusNotFound},
+		{http.MethodDelete, "/blob/other?hard=true", http.StatusNoContent},
+		{http.MethodPost, "/restore/other", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if code, _ := sendAlias(t, router, test.method, test.path, ""); code != test.status {
+			t.Errorf("Unexpected status-code for %s %s: %v", test.method, test.path, code)
+		}
+	}
+
+	_, meta := storageHandler.Get("target")
+	if meta.Get("X-Mime-Type") != "text/plain" {
+		t.Errorf("Restoring lost the meta-data: %v", meta)
+	}
+
+	//
+	// A restore is refused if the object was uploaded again.
+	//
+	if code, _ := sendAlias(t, router, http.MethodDelete, "/blob/target", ""); code != http.StatusNoContent {
+		t.Errorf("Unexpected status-code: %v", code)
+	}
+	storageHandler.Store("target", []byte("Replaced"), nil)
+	if code, _ := sendAlias(t, router, http.MethodPost, "/restore/target", ""); code != http.StatusConflict {
+		t.Errorf("Unexpected status-code: %v", code)
+	}
+
+	//
+	// Only objects deleted longer ago than the retention are reaped.
+	//
+	reaped, err := reapTrash(root, time.Hour, time.Now())
+	if err != nil || reaped != 0 {
+		t.Errorf("Unexpected reaping: %v %v", reaped, err)
+	}
+	reaped, err = reapTrash(root, time.Hour, time.Now().Add(2*time.Hour))
+	if err != nil || reaped != 1 {
+		t.Errorf("Unexpected reaping: %v %v", reaped, err)
+	}
+	if _, err = root.Stat("target"); !os.IsNotExist(err) {
+		t.Errorf("Reaped object remains in the trash: %v", err)
+	}
+}
@@ -0,0 +1,500 @@
+//
+// Resumable uploads for the blob-server.
+//
+// Large objects may be uploaded in pieces, via an upload-session:
+//
+//   POST  /uploads?id=XXX         - create a session, for the object XXX.
+//   PATCH /uploads/{uid}          - append a range of bytes to the session.
+//   HEAD  /uploads/{uid}          - report how many bytes have been received.
+//   POST  /uploads/{uid}/complete - verify the content, and store it.
+//
+// Adding `resume=true` to the creation returns the existing session for
+// the object, if there is one, rather than starting afresh.
+//
+// Sessions are written to disk beneath our store, so that an upload
+// may be resumed even if the blob-server restarts part-way through.
+// A session which receives nothing for `-upload-ttl`, by default a day,
+// is presumed abandoned and removed.
+//
+// A completed session is hashed, and stored, as it is read from disk,
+// so that large objects are never held in memory.
+//
+
+package main
+
+import (
+	"crypto/md5" //nolint:gosec // S3-compatible ETag, not security.
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// uploadDirectory is the directory, beneath our store, which holds
+// in-progress upload sessions.
+//
+// Directories are ignored by Existing(), so sessions are never listed.
+const uploadDirectory = ".uploads"
+
+// uploadRoot holds the directory containing our upload-sessions.
+//
+// We open this before we chroot(), so that it remains accessible.
+var uploadRoot *os.Root
+
+// setUploadRoot stores the upload-session directory for use by handlers.
+func setUploadRoot(root *os.Root) {
+	uploadRoot = root
+}
+
+// getUploadRoot returns the upload-session directory.
+func getUploadRoot() *os.Root {
+	return uploadRoot
+}
+
+// uploadLocks holds a mutex for each upload-session, so that concurrent
+// requests against the same session cannot interleave their content.
+var uploadLocks sync.Map
+
+// lockUpload locks the given upload-session, returning the function
+// which releases it.
+func lockUpload(uid string) func() {
+	mutex, _ := uploadLocks.LoadOrStore(uid, new(sync.Mutex))
+	mutex.(*sync.Mutex).Lock()
+	return mutex.(*sync.Mutex).Unlock
+}
+
+// uploadSession is the state of an upload-session which is persisted,
+// alongside the partial content, for the lifetime of the session.
+type uploadSession struct {
+	// ID is the ID of the object being uploaded.
+	ID string `json:"id"`
+
+	// Meta is the meta-data to store alongside the object.
+	Meta Metadata `json:"meta"`
+}
+
+// uploadStatus is the JSON body returned by the session end-points.
+type uploadStatus struct {
+	Upload string `json:"upload"`
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+}
+
+// newUploadID generates a random ID for an upload-session.
+func newUploadID() string {
+	raw := make([]byte, 16)
+	_, _ = rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// readRootFile returns the contents of the named file, beneath the
+// given directory.
+func readRootFile(root *os.Root, name string) ([]byte, error) {
+	file, err := root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+// writeRootFile replaces the named file, beneath the given directory,
+// with the given contents.
+func writeRootFile(root *os.Root, name string, data []byte) error {
+	file, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// loadUploadSession returns the state of the given upload-session, and
+// the number of bytes which have been received so far.
+func loadUploadSession(uid string) (uploadSession, int64, error) {
+	var session uploadSession
+
+	if !idPattern.MatchString(uid) {
+		return session, 0, fs.ErrNotExist
+	}
+
+	encoded, err := readRootFile(getUploadRoot(), uid+".json")
+	if err != nil {
+		return session, 0, err
+	}
+	if err = json.Unmarshal(encoded, &session); err != nil {
+		return session, 0, err
+	}
+
+	info, err := getUploadRoot().Stat(uid)
+	if err != nil {
+		return session, 0, err
+	}
+	return session, info.Size(), nil
+}
+
+// writeUploadStatus reports the state of an upload-session to the client.
+func writeUploadStatus(res http.ResponseWriter, status int, uid string, id string, offset int64) {
+	body, _ := json.Marshal(uploadStatus{Upload: uid, ID: id, Offset: offset})
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	res.WriteHeader(status)
+	_, _ = res.Write(body)
+}
+
+// rangeStart returns the offset at which the given `Content-Range`
+// header, of the form `bytes START-END/TOTAL`, begins.
+func rangeStart(header string) (int64, error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, fmt.Errorf("invalid content-range '%s'", header)
+	}
+
+	start, _, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, fmt.Errorf("invalid content-range '%s'", header)
+	}
+	return strconv.ParseInt(start, 10, 64)
+}
+
+// findUploadSession returns the ID of an existing upload-session for the
+// given object, and the number of bytes it has received.
+func findUploadSession(id string) (string, int64, bool) {
+	dir, err := getUploadRoot().Open(".")
+	if err != nil {
+		return "", 0, false
+	}
+	defer dir.Close()
+
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		return "", 0, false
+	}
+
+	for _, entry := range entries {
+		uid, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if session, offset, loadErr := loadUploadSession(uid); loadErr == nil && session.ID == id {
+			return uid, offset, true
+		}
+	}
+	return "", 0, false
+}
+
+// CreateUploadHandler creates a new upload-session.
+//
+// This is called with requests like `POST /uploads?id=XXXXXX`, and any
+// X-headers are recorded to be stored alongside the completed object.
+//
+// If the `resume` parameter is given then an existing session for the
+// object is returned instead, if there is one, so that a client which
+// has lost track of its session may continue it.
+func CreateUploadHandler(res http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get("id")
+	if status, err := validateID(id); err != nil {
+		http.Error(res, err.Error(), status)
+		return
+	}
+
+	if req.URL.Query().Get("resume") == "true" {
+		if uid, offset, ok := findUploadSession(id); ok {
+			res.Header().Set("Location", "/uploads/"+uid)
+			writeUploadStatus(res, http.StatusOK, uid, id, offset)
+			return
+		}
+	}
+
+	if err := checkMetaHeaders(req.Header, getBlobOptions().maxMetaHeaders, getBlobOptions().maxMetaBytes); err != nil {
+		http.Error(res, err.Error(), http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+	if err := checkExpires(req.Header); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if diskNearlyFull() || objectLimitReached(id) {
+		http.Error(res, "insufficient storage", http.StatusInsufficientStorage)
+		return
+	}
+
+	uid := newUploadID()
+	encoded, _ := json.Marshal(uploadSession{ID: id, Meta: uploadMeta(req.Header)})
+
+	//
+	// Create the (empty) content first, so that a session is never
+	// visible without it.
+	//
+	if err := writeRootFile(getUploadRoot(), uid, nil); err != nil {
+		http.Error(res, "failed to create upload session", http.StatusInternalServerError)
+		return
+	}
+	if err := writeRootFile(getUploadRoot(), uid+".json", encoded); err != nil {
+		_ = getUploadRoot().Remove(uid)
+		http.Error(res, "failed to create upload session", http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Location", "/uploads/"+uid)
+	writeUploadStatus(res, http.StatusCreated, uid, id, 0)
+}
+
+// UploadStatusHandler reports how much of an upload has been received,
+// so that a client may resume an interrupted upload.
+//
+// This is called with requests like `HEAD /uploads/XXXXXX`.
+func UploadStatusHandler(res http.ResponseWriter, req *http.Request) {
+	uid := mux.Vars(req)["uid"]
+
+	session, offset, err := loadUploadSession(uid)
+	if err != nil {
+		writeJSONError(res, http.StatusNotFound, "upload session not found")
+		return
+	}
+	writeUploadStatus(res, http.StatusOK, uid, session.ID, offset)
+}
+
+// AppendUploadHandler appends the request body to an upload-session.
+//
+// This is called with requests like `PATCH /uploads/XXXXXX`.  If the
+// request carries a `Content-Range` header the range must begin at
+// the current end of the upload, otherwise the body is appended.
+func AppendUploadHandler(res http.ResponseWriter, req *http.Request) {
+	uid := mux.Vars(req)["uid"]
+	defer lockUpload(uid)()
+
+	session, offset, err := loadUploadSession(uid)
+	if err != nil {
+		writeJSONError(res, http.StatusNotFound, "upload session not found")
+		return
+	}
+
+	if header := req.Header.Get("Content-Range"); header != "" {
+		start, rangeErr := rangeStart(header)
+		if rangeErr != nil {
+			http.Error(res, rangeErr.Error(), http.StatusBadRequest)
+			return
+		}
+
+		//
+		// A mismatched range means the client has lost track of
+		// what we received, so tell them where to resume.
+		//
+		if start != offset {
+			writeUploadStatus(res, http.StatusConflict, uid, session.ID, offset)
+			return
+		}
+	}
+
+	file, err := getUploadRoot().OpenFile(uid, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		http.Error(res, "failed to open upload session", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	//
+	// Whatever we managed to receive is kept, even on error, so the
+	// client can resume from the offset we report.
+	//
+	written, err := io.Copy(file, req.Body)
+	offset += written
+	if err != nil {
+		GetLogger().Warn("Upload session interrupted", "upload", uid, "offset", offset, "error", err)
+		writeUploadStatus(res, http.StatusBadRequest, uid, session.ID, offset)
+		return
+	}
+	writeUploadStatus(res, http.StatusOK, uid, session.ID, offset)
+}
+
+// CompleteUploadHandler finishes an upload-session, moving the content
+// into storage once we've verified that it matches the object ID.
+//
+// This is called with requests like `POST /uploads/XXXXXX/complete`.
+func CompleteUploadHandler(res http.ResponseWriter, req *http.Request) {
+	uid := mux.Vars(req)["uid"]
+	defer lockUpload(uid)()
+
+	session, size, err := loadUploadSession(uid)
+	if err != nil {
+		writeJSONError(res, http.StatusNotFound, "upload session not found")
+		return
+	}
+
+	if size == 0 && !getBlobOptions().allowEmpty {
+		http.Error(res, "empty body", http.StatusBadRequest)
+		return
+	}
+
+	file, err := getUploadRoot().Open(uid)
+	if err != nil {
+		http.Error(res, "failed to read upload session", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	//
+	// The content is hashed as it is read from disk, along with its
+	// MD5 digest if we're S3-compatible.
+	//
+	hasher := sha256.New()
+	var digester hash.Hash
+	writer := io.Writer(hasher)
+	if getBlobOptions().s3compat {
+		digester = md5.New() //nolint:gosec // S3-compatible ETag, not security.
+		writer = io.MultiWriter(hasher, digester)
+	}
+	if _, err = io.Copy(writer, file); err != nil {
+		http.Error(res, "failed to read upload session", http.StatusInternalServerError)
+		return
+	}
+
+	//
+	// The session is retained on a mismatch, so that a client which
+	// has simply not finished sending the content may continue.
+	//
+	if hex.EncodeToString(hasher.Sum(nil)) != session.ID {
+		http.Error(res, "content does not match the object ID", http.StatusBadRequest)
+		return
+	}
+
+	meta := session.Meta
+	if meta == nil {
+		meta = make(Metadata)
+	}
+
+	//
+	// Only the start of the content is needed to sniff its type.
+	//
+	head := make([]byte, 512)
+	n, err := file.ReadAt(head, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(res, "failed to read upload session", http.StatusInternalServerError)
+		return
+	}
+
+	header := http.Header{}
+	header.Set("X-Mime-Type", meta.Get("X-Mime-Type"))
+	if err = checkMime(header, head[:n], meta); err != nil {
+		http.Error(res, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if digester != nil {
+		meta.Set(md5MetaKey, base64.StdEncoding.EncodeToString(digester.Sum(nil)))
+	}
+
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		http.Error(res, "failed to read upload session", http.StatusInternalServerError)
+		return
+	}
+	if !storeUploadWith(res, req, session.ID, size, meta, func() bool {
+		return countStored(session.ID, func() bool { return storeFrom(session.ID, file, meta) })
+	}) {
+		return
+	}
+
+	_ = getUploadRoot().Remove(uid + ".json")
+	_ = getUploadRoot().Remove(uid)
+	uploadLocks.Delete(uid)
+}
+
+// storeFrom stores the content of the given reader against the given ID,
+// streaming it into place if our storage allows, and otherwise reading
+// it into memory first.
+func storeFrom(id string, data io.Reader, meta Metadata) bool {
+	if storer, ok := getStorage().(ReaderStorer); ok {
+		return storer.StoreReader(id, data, meta)
+	}
+
+	content, err := io.ReadAll(data)
+	if err != nil {
+		return false
+	}
+	return getStorage().Store(id, content, meta)
+}
+
+// reapUploads removes the upload-sessions which have received nothing
+// for longer than the given period, returning how many were removed.
+func reapUploads(root *os.Root, ttl time.Duration, now time.Time) (int, error) {
+	dir, err := root.Open(".")
+	if err != nil {
+		return 0, err
+	}
+	entries, err := dir.ReadDir(-1)
+	_ = dir.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	//
+	// A session's content, and its state, are considered together,
+	// so that either being orphaned by a crash is also removed.
+	//
+	updated := make(map[string]time.Time)
+	for _, entry := range entries {
+		info, infoErr := entry.Info()
+		if infoErr != nil {
+			continue
+		}
+		uid := strings.TrimSuffix(entry.Name(), ".json")
+		if info.ModTime().After(updated[uid]) {
+			updated[uid] = info.ModTime()
+		}
+	}
+
+	reaped := 0
+	for uid, modified := range updated {
+		if now.Sub(modified) < ttl {
+			continue
+		}
+
+		unlock := lockUpload(uid)
+		_ = root.Remove(uid + ".json")
+		if removeErr := root.Remove(uid); removeErr == nil || errors.Is(removeErr, fs.ErrNotExist) {
+			reaped++
+		}
+		unlock()
+		uploadLocks.Delete(uid)
+	}
+	return reaped, nil
+}
+
+// uploadJanitor removes abandoned upload-sessions periodically, forever.
+func uploadJanitor(root *os.Root, ttl time.Duration) {
+	interval := min(ttl, maxJanitorInterval)
+
+	for {
+		time.Sleep(interval)
+
+		reaped, err := reapUploads(root, ttl, time.Now())
+		if err != nil {
+			GetLogger().Error("Failed to reap upload sessions", "error", err)
+			continue
+		}
+		if reaped > 0 {
+			GetLogger().Info("Reaped abandoned upload sessions", "count", reaped)
+		}
+	}
+}
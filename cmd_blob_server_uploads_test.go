@@ -0,0 +1,241 @@
+// Testing of resumable uploads to the blob-server.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupUploads prepares a blob-server router, with temporary storage and
+// a temporary upload-session directory.
+func setupUploads(t *testing.T) http.Handler {
+	t.Helper()
+
+	store := new(FilesystemStorage)
+	store.Setup(t.TempDir())
+	setStorage(store)
+
+	root, err := os.OpenRoot(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setUploadRoot(root)
+	t.Cleanup(func() {
+		_ = root.Close()
+		setUploadRoot(nil)
+		setStorage(nil)
+	})
+
+	return newBlobRouter("")
+}
+
+// sendUpload issues a request against the router, decoding the session
+// status from the response.
+func sendUpload(t *testing.T, router http.Handler, method string, path string, body string, header map[string]string) (int, uploadStatus) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var status uploadStatus
+	_ = json.Unmarshal(rr.Body.Bytes(), &status)
+	return rr.Code, status
+}
+
+// Test that an object may be uploaded in pieces.
+func TestResumableUpload(t *testing.T) {
+	router := setupUploads(t)
+
+	content := "This is a test of resumable uploads."
+	hash := sha256.Sum256([]byte(content))
+	id := hex.EncodeToString(hash[:])
+
+	code, session := sendUpload(t, router, http.MethodPost, "/uploads?id="+id, "", map[string]string{"X-Foo": "bar"})
+	if code != http.StatusCreated {
+		t.Fatalf("Unexpected status-code: %v", code)
+	}
+	uid := session.Upload
+
+	//
+	// Upload the first half, and then pretend we lost track.
+	//
+	code, session = sendUpload(t, router, http.MethodPatch, "/uploads/"+uid, content[:10], map[string]string{"Content-Range": "bytes 0-9/*"})
+	if code != http.StatusOK || session.Offset != 10 {
+		t.Fatalf("Unexpected response: %v %v", code, session)
+	}
+
+	code, session = sendUpload(t, router, http.MethodPatch, "/uploads/"+uid, content, map[string]string{"Content-Range": "bytes 0-35/*"})
+	if code != http.StatusConflict || session.Offset != 10 {
+		t.Fatalf("Unexpected response to a stale range: %v %v", code, session)
+	}
+
+	//
+	// Completing early fails, but the session survives.
+	//
+	code, _ = sendUpload(t, router, http.MethodPost, "/uploads/"+uid+"/complete", "", nil)
+	if code != http.StatusBadRequest {
+		t.Fatalf("Unexpected status-code: %v", code)
+	}
+
+	code, _ = sendUpload(t, router, http.MethodPatch, "/uploads/"+uid, content[10:], nil)
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", code)
+	}
+
+	code, _ = sendUpload(t, router, http.MethodPost, "/uploads/"+uid+"/complete", "", nil)
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", code)
+	}
+
+	data, meta := getStorage().Get(id)
+	if data == nil || string(*data) != content {
+		t.Fatalf("Completed upload was not stored")
+	}
+	if meta.Get("X-Foo") != "bar" {
+		t.Errorf("Meta-data was not stored: %v", meta)
+	}
+
+	//
+	// The session is gone.
+	//
+	code, _ = sendUpload(t, router, http.MethodHead, "/uploads/"+uid, "", nil)
+	if code != http.StatusNotFound {
+		t.Errorf("Unexpected status-code: %v", code)
+	}
+}
+
+// Test that an existing upload-session may be resumed.
+func TestResumableUploadResume(t *testing.T) {
+	router := setupUploads(t)
+
+	hash := sha256.Sum256([]byte("content"))
+	id := hex.EncodeToString(hash[:])
+
+	code, first := sendUpload(t, router, http.MethodPost, "/uploads?id="+id+"&resume=true", "", nil)
+	if code != http.StatusCreated {
+		t.Fatalf("Unexpected status-code: %v", code)
+	}
+	code, _ = sendUpload(t, router, http.MethodPatch, "/uploads/"+first.Upload, "cont", nil)
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", code)
+	}
+
+	code, second := sendUpload(t, router, http.MethodPost, "/uploads?id="+id+"&resume=true", "", nil)
+	if code != http.StatusOK || second.Upload != first.Upload || second.Offset != 4 {
+		t.Fatalf("Unexpected response: %v %v", code, second)
+	}
+
+	//
+	// Without the parameter a new session is created.
+	//
+	code, third := sendUpload(t, router, http.MethodPost, "/uploads?id="+id, "", nil)
+	if code != http.StatusCreated || third.Upload == first.Upload {
+		t.Errorf("Unexpected response: %v %v", code, third)
+	}
+}
+
+// Test that bogus upload-sessions are rejected.
+func TestResumableUploadMissing(t *testing.T) {
+	router := setupUploads(t)
+
+	for _, uid := range []string{"missing", "a_b_c", "x.json"} {
+		code, _ := sendUpload(t, router, http.MethodPatch, "/uploads/"+uid, "data", nil)
+		if code != http.StatusNotFound {
+			t.Errorf("Unexpected status-code for %s: %v", uid, code)
+		}
+	}
+
+	code, _ := sendUpload(t, router, http.MethodPost, "/uploads?id=a_b_c", "", nil)
+	if code == http.StatusCreated {
+		t.Errorf("Created a session with a bogus ID")
+	}
+}
+
+// Test that abandoned upload-sessions are reaped, and active ones kept.
+func TestReapUploads(t *testing.T) {
+	router := setupUploads(t)
+
+	hash := sha256.Sum256([]byte("content"))
+	id := hex.EncodeToString(hash[:])
+
+	code, stale := sendUpload(t, router, http.MethodPost, "/uploads?id="+id, "", nil)
+	if code != http.StatusCreated {
+		t.Fatalf("Unexpected status-code: %v", code)
+	}
+	code, active := sendUpload(t, router, http.MethodPost, "/uploads?id="+id, "", nil)
+	if code != http.StatusCreated {
+		t.Fatalf("Unexpected status-code: %v", code)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{stale.Upload, stale.Upload + ".json"} {
+		if err := os.Chtimes(filepath.Join(getUploadRoot().Name(), name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reaped, err := reapUploads(getUploadRoot(), time.Hour, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reaped != 1 {
+		t.Errorf("Unexpected count of reaped sessions: %v", reaped)
+	}
+
+	code, _ = sendUpload(t, router, http.MethodHead, "/uploads/"+stale.Upload, "", nil)
+	if code != http.StatusNotFound {
+		t.Errorf("Unexpected status-code for the abandoned session: %v", code)
+	}
+	code, _ = sendUpload(t, router, http.MethodHead, "/uploads/"+active.Upload, "", nil)
+	if code != http.StatusOK {
+		t.Errorf("Unexpected status-code for the active session: %v", code)
+	}
+}
+
+// Test that a completed upload records its MD5 digest when S3-compatible.
+func TestResumableUploadDigest(t *testing.T) {
+	router := setupUploads(t)
+	setBlobOptions(blobServerCmd{s3compat: true})
+	defer setBlobOptions(blobServerCmd{})
+
+	content := "This is a streamed upload."
+	hash := sha256.Sum256([]byte(content))
+	id := hex.EncodeToString(hash[:])
+
+	code, session := sendUpload(t, router, http.MethodPost, "/uploads?id="+id, "", nil)
+	if code != http.StatusCreated {
+		t.Fatalf("Unexpected status-code: %v", code)
+	}
+	code, _ = sendUpload(t, router, http.MethodPatch, "/uploads/"+session.Upload, content, nil)
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", code)
+	}
+	code, _ = sendUpload(t, router, http.MethodPost, "/uploads/"+session.Upload+"/complete", "", nil)
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", code)
+	}
+
+	data, meta := getStorage().Get(id)
+	if data == nil || string(*data) != content {
+		t.Fatalf("Completed upload was not stored")
+	}
+	if meta.Get(md5MetaKey) != contentMD5([]byte(content)) {
+		t.Errorf("Unexpected digest: %v", meta.Get(md5MetaKey))
+	}
+}
@@ -0,0 +1,66 @@
+//
+// Verification of objects, by the blob-server holding them.
+//
+// Since the ID of each object is the SHA256 hash of its content the
+// blob-server may check an object for corruption itself:
+//
+//   GET /verify/{id}  ->  {"id":"...","ok":true}
+//
+// This saves transferring the whole object just to hash it elsewhere,
+// and is used by `sos scrub -blob-server ...` to check a fleet.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// verifyResult is the document returned by our `/verify` end-point.
+type verifyResult struct {
+	ID     string `json:"id"`
+	OK     bool   `json:"ok"`
+	Actual string `json:"actual,omitempty"`
+}
+
+// VerifyHandler rehashes an object, and reports whether its content
+// still matches its ID.
+//
+// This is called with requests like `GET /verify/XXXXXX`.
+func VerifyHandler(res http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	if status, err := validateID(id); err != nil {
+		writeJSONError(res, status, err.Error())
+		return
+	}
+
+	//
+	// Objects which were not stored under their hash cannot be
+	// verified.
+	//
+	if !hashPattern.MatchString(id) {
+		writeJSONError(res, http.StatusBadRequest, "only objects stored under their SHA256 hash may be verified")
+		return
+	}
+
+	data, _ := getStorage().Get(id)
+	if data == nil {
+		writeJSONError(res, http.StatusNotFound, "not found")
+		return
+	}
+
+	sum := sha256.Sum256(*data)
+	result := verifyResult{ID: id, OK: true}
+	if actual := hex.EncodeToString(sum[:]); actual != id {
+		result.OK, result.Actual = false, actual
+	}
+
+	body, _ := json.Marshal(result)
+	res.Header().Set("Content-Type", "application/json")
+	_, _ = res.Write(body)
+}
@@ -0,0 +1,218 @@
+//
+// Webhooks for the blob-server.
+//
+// If the blob-server is launched with `-webhook-url` then each object
+// it stores is announced to that URL, so that an external service may
+// index it, via a POST of the JSON document:
+//
+//   {"id":"...","size":1234,"metadata":{"X-Mime-Type":["image/png"]}}
+//
+// If a secret is given, via `-webhook-secret` or the SOS_WEBHOOK_SECRET
+// environment variable, the body is signed with an HMAC-SHA256 which
+// is sent as the `X-Sos-Signature` header, in the form `sha256=HEX`.
+//
+// Delivery is best-effort: it happens after the upload has completed,
+// failures are retried a few times and then logged, and deliveries
+// beyond those already in progress are dropped.
+//
+// The blob-server may chroot() into its store, where neither the
+// certificate authorities of the system, nor its resolver, are found.
+// So the webhook's host is resolved, and the authorities loaded, when
+// we start; a webhook which later moves requires a restart.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// envWebhookSecret is the environment variable from which the webhook
+// secret is read, if the flag was not given.
+const envWebhookSecret = "SOS_WEBHOOK_SECRET"
+
+// webhookAttempts is the number of times we try to deliver each event.
+const webhookAttempts = 3
+
+// webhookTimeout is how long we allow for each delivery attempt.
+const webhookTimeout = 10 * time.Second
+
+// webhookBackoff is the delay before the first retry, which doubles
+// after each subsequent failure.
+var webhookBackoff = time.Second
+
+// webhookSlots bounds the number of deliveries in progress at once.
+var webhookSlots = make(chan struct{}, 64)
+
+// webhookClient delivers our webhooks.
+var webhookClient = http.DefaultClient
+
+// setupWebhookClient prepares the client which delivers webhooks to the
+// given URL, if any, resolving its host and loading the certificate
+// authorities of the system before we might chroot() away from them.
+func setupWebhookClient(target string) error {
+	if target == "" {
+		return nil
+	}
+
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	addrs, err := net.DefaultResolver.LookupHost(context.Background(), parsed.Hostname())
+	if err != nil {
+		return err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	if parsed.Scheme == "https" {
+		roots, rootsErr := x509.SystemCertPool()
+		if rootsErr != nil {
+			return rootsErr
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	}
+
+	//
+	// Each connection is made to one of the addresses we resolved,
+	// in turn, whatever the host of the request.
+	//
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		_, port, splitErr := net.SplitHostPort(addr)
+		if splitErr != nil {
+			return nil, splitErr
+		}
+
+		var errs []error
+		for _, ip := range addrs {
+			conn, dialErr := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if dialErr == nil {
+				return conn, nil
+			}
+			errs = append(errs, dialErr)
+		}
+		return nil, errors.Join(errs...)
+	}
+
+	webhookClient = &http.Client{Transport: transport}
+	return nil
+}
+
+// webhookEvent is the body we POST to the webhook.
+type webhookEvent struct {
+	ID       string   `json:"id"`
+	Size     int      `json:"size"`
+	Metadata Metadata `json:"metadata"`
+}
+
+// webhookSecret returns the secret used to sign webhook bodies, if any.
+func webhookSecret() []byte {
+	if secret := getBlobOptions().webhookSecret; secret != "" {
+		return []byte(secret)
+	}
+	return []byte(os.Getenv(envWebhookSecret))
+}
+
+// webhookSignature returns the signature of the given body.
+func webhookSignature(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyWebhook announces that the given object has been stored, if we
+// have a webhook.  It does not wait for the delivery.
+func notifyWebhook(id string, size int, meta Metadata) {
+	target := getBlobOptions().webhookURL
+	if target == "" {
+		return
+	}
+
+	if meta == nil {
+		meta = Metadata{}
+	}
+	body, _ := json.Marshal(webhookEvent{ID: id, Size: size, Metadata: meta})
+
+	select {
+	case webhookSlots <- struct{}{}:
+	default:
+		GetLogger().Warn("Too many webhook deliveries in progress, dropping", "object", id)
+		return
+	}
+
+	secret := webhookSecret()
+	go func() {
+		defer func() { <-webhookSlots }()
+
+		if err := deliverWebhook(target, secret, body); err != nil {
+			GetLogger().Error("Failed to deliver webhook", "object", id, "error", err)
+		}
+	}()
+}
+
+// deliverWebhook POSTs the given body to the webhook, retrying failures
+// other than those the webhook reports to be our fault.
+func deliverWebhook(target string, secret []byte, body []byte) error {
+	var err error
+	backoff := webhookBackoff
+
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		var retry bool
+		if retry, err = postWebhook(target, secret, body); err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// postWebhook makes a single attempt to deliver the given body, and
+// returns whether a failure is worth retrying.
+func postWebhook(target string, secret []byte, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if len(secret) > 0 {
+		request.Header.Set("X-Sos-Signature", webhookSignature(secret, body))
+	}
+
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return true, err
+	}
+	_ = response.Body.Close()
+
+	switch {
+	case response.StatusCode < 300:
+		return false, nil
+	case response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("webhook returned %s", response.Status)
+	default:
+		return false, fmt.Errorf("webhook returned %s", response.Status)
+	}
+}
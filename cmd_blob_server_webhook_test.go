@@ -0,0 +1,141 @@
+// Testing of blob-server webhooks.
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Test that stored objects are announced, with a signature, and that
+// failures are retried without failing the upload.
+func TestBlobWebhook(t *testing.T) {
+	webhookBackoff = time.Millisecond
+	defer func() { webhookBackoff = time.Second }()
+
+	var attempts atomic.Int32
+	events := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+
+	hook := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if attempts.Add(1) == 1 {
+			res.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		bodies <- body
+		events <- req
+	}))
+	defer hook.Close()
+
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+	setBlobOptions(blobServerCmd{webhookURL: hook.URL, webhookSecret: "secret"})
+	defer setBlobOptions(blobServerCmd{})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/blob/{id}", UploadHandler).Methods("POST")
+
+	req, err := http.NewRequest(http.MethodPost, "/blob/steve", strings.NewReader("Content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Project", "alpha")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+
+	var body []byte
+	select {
+	case body = <-bodies:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Webhook was not delivered")
+	}
+	event := <-events
+
+	var decoded webhookEvent
+	if err = json.Unmarshal(body, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ID != "steve" || decoded.Size != 7 || decoded.Metadata.Get("X-Project") != "alpha" {
+		t.Errorf("Unexpected event: %v", decoded)
+	}
+	if event.Header.Get("X-Sos-Signature") != webhookSignature([]byte("secret"), body) {
+		t.Errorf("Unexpected signature: %v", event.Header.Get("X-Sos-Signature"))
+	}
+	if attempts.Load() != 2 {
+		t.Errorf("Unexpected attempts: %v", attempts.Load())
+	}
+}
+
+// Test that failures are retried a bounded number of times, and that
+// client errors are not retried at all.
+func TestDeliverWebhook(t *testing.T) {
+	webhookBackoff = time.Millisecond
+	defer func() { webhookBackoff = time.Second }()
+
+	tests := []struct {
+		status   int
+		attempts int32
+		failed   bool
+	}{
+		{http.StatusNoContent, 1, false},
+		{http.StatusBadRequest, 1, true},
+		{http.StatusTooManyRequests, webhookAttempts, true},
+		{http.StatusInternalServerError, webhookAttempts, true},
+	}
+
+	for _, test := range tests {
+		var attempts atomic.Int32
+		hook := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+			attempts.Add(1)
+			res.WriteHeader(test.status)
+		}))
+
+		err := deliverWebhook(hook.URL, nil, []byte("{}"))
+		hook.Close()
+
+		if (err != nil) != test.failed {
+			t.Errorf("Unexpected result for %d: %v", test.status, err)
+		}
+		if attempts.Load() != test.attempts {
+			t.Errorf("Unexpected attempts for %d: %v", test.status, attempts.Load())
+		}
+	}
+}
+
+// Test that the webhook's host is resolved when we start, and that
+// deliveries are made to it.
+func TestSetupWebhookClient(t *testing.T) {
+	defer func() { webhookClient = http.DefaultClient }()
+
+	var attempts atomic.Int32
+	hook := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		attempts.Add(1)
+		res.WriteHeader(http.StatusNoContent)
+	}))
+	defer hook.Close()
+
+	target := strings.Replace(hook.URL, "127.0.0.1", "localhost", 1)
+	if err := setupWebhookClient(target); err != nil {
+		t.Fatalf("Failed to setup the webhook client: %v", err)
+	}
+	if err := deliverWebhook(target, nil, []byte("{}")); err != nil || attempts.Load() != 1 {
+		t.Errorf("Unexpected delivery: %v %d", err, attempts.Load())
+	}
+
+	if err := setupWebhookClient("http://missing.invalid/"); err == nil {
+		t.Errorf("Expected an unresolvable webhook to fail")
+	}
+}
@@ -0,0 +1,99 @@
+//
+// Simple client sub-commands, for storing and retrieving single
+// objects from the command-line.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/skx/sos/libclient"
+	"github.com/skx/sos/libconfig"
+)
+
+// put uploads each named file, or STDIN if there are none, via the
+// API-server, and shows the ID of each.
+func put(options putCmd, files []string, out io.Writer) error {
+	header := http.Header{}
+	if options.mime != "" {
+		header.Set("X-Mime-Type", options.mime)
+	}
+
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	for _, file := range files {
+		id, err := putFile(options.server, file, header)
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %w", file, err)
+		}
+		_, _ = fmt.Fprintln(out, id)
+	}
+	return nil
+}
+
+// putFile uploads the named file, or STDIN if the name is "-".
+func putFile(server string, file string, header http.Header) (string, error) {
+	if file == "-" {
+		return libclient.Upload(server, os.Stdin, header)
+	}
+
+	handle, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer handle.Close()
+
+	return libclient.Upload(server, handle, header)
+}
+
+// cat fetches each of the given objects, writing them to the writer.
+//
+// If blob-servers were specified the objects are fetched from them
+// directly, otherwise from the API-server.
+func cat(options catCmd, ids []string, out io.Writer) error {
+	if len(ids) == 0 {
+		return errors.New("no object IDs given")
+	}
+
+	if options.blob != "" {
+		libconfig.AddServers(options.blob)
+	}
+
+	for _, id := range ids {
+		body, err := catObject(options, id)
+		if err != nil {
+			return fmt.Errorf("failed to fetch %s: %w", id, err)
+		}
+
+		_, err = io.Copy(out, body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// catObject opens the object with the given ID, trying each blob-server
+// in turn if we have any, or the API-server otherwise.
+func catObject(options catCmd, id string) (io.ReadCloser, error) {
+	if options.blob == "" {
+		return libclient.Download(options.server, id)
+	}
+
+	err := errors.New("no blob-servers available")
+	for _, server := range libconfig.ServersFor(id) {
+		var body io.ReadCloser
+		if body, err = libclient.Fetch(libconfig.BlobURL(server.Location, id)); err == nil {
+			return body, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,66 @@
+// Testing of the put & cat client sub-commands.
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// Test that files may be uploaded, and fetched back, by ID.
+func TestPutCat(t *testing.T) {
+	objects := make(map[string]string)
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == http.MethodPost && req.URL.Path == "/upload":
+			body, _ := io.ReadAll(req.Body)
+			objects["abc"] = string(body)
+			_, _ = res.Write([]byte(`{"id":"abc","status":"OK","size":1}`))
+		case req.URL.Path == "/fetch/abc" || req.URL.Path == "/blob/abc":
+			_, _ = res.Write([]byte(objects["abc"]))
+		default:
+			http.Error(res, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	file := filepath.Join(t.TempDir(), "input")
+	if err := os.WriteFile(file, []byte("Some content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := put(putCmd{server: server.URL}, []string{file}, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if out.String() != "abc\n" {
+		t.Errorf("Unexpected output: %v", out.String())
+	}
+
+	//
+	// Fetch via the API-server, and directly from the blob-server.
+	//
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+
+	for _, options := range []catCmd{{server: server.URL}, {blob: server.URL}} {
+		out.Reset()
+		if err := cat(options, []string{"abc"}, &out); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if out.String() != "Some content" {
+			t.Errorf("Unexpected content: %v", out.String())
+		}
+	}
+
+	if err := cat(catCmd{server: server.URL}, []string{"missing"}, &out); err == nil {
+		t.Errorf("Expected an error fetching a missing object")
+	}
+}
@@ -5,67 +5,214 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"mime"
 	"net/http"
-	"os"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/skx/sos/libclient"
 	"github.com/skx/sos/libconfig"
 )
 
-// Objects reads the list of objects on the given server.
-func Objects(server string) []string {
-	type listStrings []string
-	var tmp listStrings
+// serversFromAPI populates our blob-servers from the `/config` end-point
+// of the API-server at the given URL.
+func serversFromAPI(server string) error {
+	body, err := libclient.Fetch(libconfig.Endpoint(server, "/config"))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var config apiConfig
+	if err = json.NewDecoder(body).Decode(&config); err != nil {
+		return err
+	}
+
+	for _, group := range config.Groups {
+		for _, member := range group.Members {
+			libconfig.AddServerWithWeight(group.Group, member.Location, member.Weight)
+		}
+	}
+
+	if len(libconfig.Servers()) == 0 {
+		return errors.New("no blob-servers configured")
+	}
+	return nil
+}
+
+// Objects reads the list of objects on the given server, optionally
+// only those whose IDs begin with the given prefix, and those stored at,
+// or after, the given time if it is non-zero.
+func Objects(ctx context.Context, server string, prefix string, since time.Time) ([]string, error) {
+	var tmp []string
 
 	//
 	// Make the request to get the list of objects.
 	//
-	ctx := context.Background()
-	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, server+"/blobs", nil)
-	client := &http.Client{}
+	query := url.Values{}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if !since.IsZero() {
+		query.Set("since", strconv.FormatInt(since.Unix(), 10))
+	}
+	path := "/blobs"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, libconfig.Endpoint(server, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	client := newBlobClient()
 	response, err := client.Do(request)
 	if err != nil {
-		GetLogger().Error("Failed to get blobs", "error", err)
-		os.Exit(1)
+		return nil, err
 	}
 	defer func() {
-		if response != nil {
-			if closeErr := response.Body.Close(); closeErr != nil {
-				GetLogger().Error("Failed to close response body", "error", closeErr)
-			}
+		if closeErr := response.Body.Close(); closeErr != nil {
+			GetLogger().Error("Failed to close response body", "error", closeErr)
 		}
 	}()
 
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status-code %d", response.StatusCode)
+	}
+
 	//
-	// Read the (JSON) response-body.
+	// A misbehaving proxy might answer with an HTML error-page, which
+	// must not be mistaken for an empty list.  Older blob-servers
+	// didn't declare their lists as JSON, so plain-text is accepted.
 	//
-	body, err := io.ReadAll(response.Body)
-	if err != nil {
-		GetLogger().Error("Failed to read response body", "error", err)
-		return nil
+	mediaType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "application/json" && mediaType != "text/plain") {
+		return nil, fmt.Errorf("unexpected content-type '%s'", response.Header.Get("Content-Type"))
 	}
 
 	//
-	// Decode into an array of strings, and return it.
+	// Decode the (JSON) response-body into an array of strings,
+	// and return it.
 	//
-	err = json.Unmarshal(body, &tmp)
+	decoder := json.NewDecoder(response.Body)
+	if err = decoder.Decode(&tmp); err != nil {
+		return nil, fmt.Errorf("failed to decode object list: %w", err)
+	}
+	if tmp == nil || decoder.More() {
+		return nil, errors.New("failed to decode object list: not a single array")
+	}
+	return tmp, nil
+}
+
+// Manifest reads the manifest of the objects on the given server,
+// optionally only those whose IDs begin with the given prefix.
+func Manifest(ctx context.Context, server string, prefix string) (blobManifest, error) {
+	var manifest blobManifest
+
+	path := "/manifest"
+	if prefix != "" {
+		path += "?prefix=" + url.QueryEscape(prefix)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, libconfig.Endpoint(server, path), nil)
 	if err != nil {
-		GetLogger().Error("Failed to unmarshal JSON", "error", err)
-		return nil
+		return manifest, err
+	}
+	client := newBlobClient()
+	response, err := client.Do(request)
+	if err != nil {
+		return manifest, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return manifest, fmt.Errorf("status-code %d", response.StatusCode)
+	}
+	if err = json.NewDecoder(response.Body).Decode(&manifest); err != nil {
+		return manifest, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if manifest.Digest == "" {
+		return manifest, errors.New("failed to decode manifest: missing digest")
+	}
+	return manifest, nil
+}
+
+// groupInSync returns true if every one of the given servers reports
+// the same manifest, in which case there is nothing to replicate.
+//
+// Any failure, including an older blob-server without manifests, means
+// the group must be compared in full.
+func groupInSync(ctx context.Context, servers []libconfig.BlobServer, options replicateCmd) bool {
+	var first blobManifest
+
+	for i, s := range servers {
+		manifest, err := Manifest(ctx, s.Location, options.prefix)
+		if err != nil {
+			if options.verbose {
+				GetLogger().Info("Failed to fetch manifest, listing objects instead",
+					"location", s.Location, "error", err)
+			}
+			return false
+		}
+
+		if i == 0 {
+			first = manifest
+			continue
+		}
+		if manifest != first {
+			return false
+		}
+	}
+	return true
+}
+
+// listGroup lists the objects upon each of the given servers, with at
+// most options.listConcurrency lists in flight at once, returning the
+// list, or error, of each in the same order as the servers.
+func listGroup(ctx context.Context, servers []libconfig.BlobServer, options replicateCmd, since time.Time) ([][]string, []error) {
+	lists := make([][]string, len(servers))
+	errs := make([]error, len(servers))
+
+	limit := options.listConcurrency
+	if limit <= 0 {
+		limit = len(servers)
 	}
-	return tmp
+	slots := make(chan struct{}, max(limit, 1))
+
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			lists[i], errs[i] = Objects(ctx, server.Location, options.prefix, since)
+		}()
+	}
+	wg.Wait()
+	return lists, errs
 }
 
 // HasObject tests if the specified server contains the given object.
-func HasObject(server string, object string) bool {
-	ctx := context.Background()
-	request, _ := http.NewRequestWithContext(ctx, http.MethodHead, server+"/blob/"+object, nil)
-	client := &http.Client{}
+func HasObject(ctx context.Context, server string, object string, options replicateCmd) bool {
+	request, _ := http.NewRequestWithContext(ctx, http.MethodHead, libconfig.BlobURL(server, object), nil)
+	client := newBlobClient()
+	start := time.Now()
 	response, err := client.Do(request)
+	recordLatency(server, request.Method, start, options.verbose)
 	if err != nil {
 		GetLogger().Error("Error fetching object", "server", server, "object", object, "error", err)
 		return false
@@ -83,7 +230,7 @@ func HasObject(server string, object string) bool {
 
 // MirrorObject attempts to replicate the specified object between the two
 // listed hosts.
-func MirrorObject(src string, dst string, obj string, options replicateCmd) bool {
+func MirrorObject(ctx context.Context, src string, dst string, obj string, options replicateCmd) bool {
 	if options.verbose {
 		GetLogger().Info("Mirroring object", "object", obj, "from", src, "to", dst)
 	}
@@ -91,13 +238,14 @@ func MirrorObject(src string, dst string, obj string, options replicateCmd) bool
 	//
 	// Prepare to download the object.
 	//
-	srcURL := fmt.Sprintf("%s%s%s", src, "/blob/", obj)
+	srcURL := libconfig.BlobURL(src, obj)
 	GetLogger().Info("Fetching object", "url", srcURL)
 
-	ctx := context.Background()
 	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, srcURL, nil)
-	client := &http.Client{}
+	client := newBlobClient()
+	start := time.Now()
 	response, err := client.Do(request)
+	recordLatency(src, request.Method, start, options.verbose)
 
 	//
 	// If there was an error we're done.
@@ -108,17 +256,65 @@ func MirrorObject(src string, dst string, obj string, options replicateCmd) bool
 	}
 	defer response.Body.Close()
 
+	//
+	// An object which has expired, or vanished, since it was listed
+	// must not be mirrored, since we'd store the error in its place.
+	//
+	if response.StatusCode != http.StatusOK {
+		GetLogger().Warn("Object not fetched", "object", obj, "src", src, "status", response.StatusCode)
+		return false
+	}
+
 	//
 	// Prepare to POST the body we've downloaded to
 	// the mirror-location
 	//
-	dstURL := fmt.Sprintf("%s%s%s", dst, "/blob/", obj)
+	dstURL := libconfig.BlobURL(dst, obj)
 	GetLogger().Info("Uploading object", "url", dstURL)
 
+	//
+	// If we're to verify the mirrored copy we hash the content as
+	// it is sent, so that we know what to expect.
+	//
+	var source io.Reader = response.Body
+	sent := sha256.New()
+	if options.verify {
+		source = io.TeeReader(response.Body, sent)
+	}
+	body := &mirrorBody{src: source}
+
+	//
+	// Wait for a free connection to the mirror, if they're limited.
+	//
+	release, err := acquireServer(ctx, dst)
+	if err != nil {
+		GetLogger().Error("Error sending object", "url", dstURL, "error", err)
+		return false
+	}
+	defer release()
+
+	//
+	// Large objects are sent via a resumable upload-session, where
+	// the mirror supports them.
+	//
+	start = time.Now()
+	if handled, ok := mirrorResumable(ctx, dst, obj, response.Header, body, response.ContentLength, options); handled {
+		if ok {
+			logMirrored(obj, dst, body.sent, time.Since(start))
+		}
+		if ok && options.verify {
+			return verifyMirror(ctx, dst, obj, hex.EncodeToString(sent.Sum(nil)), options)
+		}
+		return ok
+	}
+
 	//
 	// Build up a new request with context.
 	//
-	child, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, dstURL, response.Body)
+	child, _ := http.NewRequestWithContext(ctx, http.MethodPost, dstURL, body)
+	if response.ContentLength > 0 {
+		child.ContentLength = response.ContentLength
+	}
 
 	//
 	// Copy any X-Header which was present
@@ -126,32 +322,143 @@ func MirrorObject(src string, dst string, obj string, options replicateCmd) bool
 	//
 	for header, value := range response.Header {
 		if strings.HasPrefix(header, "X-") {
-			child.Header.Set(header, value[0])
+			child.Header[header] = slices.Clone(value)
 		}
 	}
 
+	//
+	// Preserve the modification time, so that every copy of the
+	// object reports the same one, and any disposition or expiry.
+	//
+	if modified := response.Header.Get("Last-Modified"); modified != "" {
+		child.Header.Set("Last-Modified", modified)
+	}
+	if disposition := response.Header.Get("Content-Disposition"); disposition != "" {
+		child.Header.Set("Content-Disposition", disposition)
+	}
+	if expires := response.Header.Get("Expires"); expires != "" {
+		child.Header.Set("Expires", expires)
+	}
+
 	//
 	// Send the request.
 	//
-	client = &http.Client{}
+	client = newBlobClient()
+	start = time.Now()
 	r, err := client.Do(child)
+	recordLatency(dst, child.Method, start, options.verbose)
 	if r != nil {
 		defer r.Body.Close()
 	}
 
 	//
-	// If there was no error we're good.
+	// If there was no error, and the mirror stored the object,
+	// we're good.
 	//
 	if err != nil {
 		GetLogger().Error("Error sending object", "url", dstURL, "error", err)
 		return false
 	}
+	if r.StatusCode != http.StatusOK {
+		GetLogger().Error("Error sending object", "url", dstURL, "status", r.StatusCode)
+		return false
+	}
+	logMirrored(obj, dst, body.sent, time.Since(start))
 
+	if options.verify {
+		return verifyMirror(ctx, dst, obj, hex.EncodeToString(sent.Sum(nil)), options)
+	}
 	return true
 }
 
+// verifyMirror fetches the given object from the server it was mirrored
+// to, and tests that its content has the expected SHA256 hash.
+//
+// The content is hashed as it is read, rather than buffered, so that
+// large objects may be verified without holding them in memory.
+func verifyMirror(ctx context.Context, server string, obj string, expected string, options replicateCmd) bool {
+	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, libconfig.BlobURL(server, obj), nil)
+	client := newBlobClient()
+	start := time.Now()
+	response, err := client.Do(request)
+	recordLatency(server, request.Method, start, options.verbose)
+	if err != nil {
+		GetLogger().Error("Error verifying object", "object", obj, "server", server, "error", err)
+		return false
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		GetLogger().Error("Mirrored object is missing", "object", obj, "server", server, "status", response.StatusCode)
+		return false
+	}
+
+	sum, err := hashCopy(io.Discard, response.Body, 0)
+	if err != nil {
+		GetLogger().Error("Error verifying object", "object", obj, "server", server, "error", err)
+		return false
+	}
+
+	if actual := hex.EncodeToString(sum[:]); actual != expected {
+		GetLogger().Error("Mirrored object is corrupt", "object", obj, "server", server, "expected", expected, "actual", actual)
+		return false
+	}
+
+	if options.verbose {
+		GetLogger().Info("Mirrored object verified", "object", obj, "server", server)
+	}
+	return true
+}
+
+// replicationShard is the subset of the keyspace a replicator owns,
+// when several are run in parallel.
+type replicationShard struct {
+	index int
+	count int
+}
+
+// parseShard parses a shard of the form `i/n`, where `i` counts from
+// zero.  An empty string selects every object.
+func parseShard(spec string) (replicationShard, error) {
+	if spec == "" {
+		return replicationShard{index: 0, count: 1}, nil
+	}
+
+	index, count, ok := strings.Cut(spec, "/")
+	if !ok {
+		return replicationShard{}, fmt.Errorf("invalid shard '%s', expected i/n", spec)
+	}
+
+	var shard replicationShard
+	var err error
+	if shard.index, err = strconv.Atoi(index); err != nil {
+		return replicationShard{}, fmt.Errorf("invalid shard '%s', expected i/n", spec)
+	}
+	if shard.count, err = strconv.Atoi(count); err != nil {
+		return replicationShard{}, fmt.Errorf("invalid shard '%s', expected i/n", spec)
+	}
+	if shard.count < 1 || shard.index < 0 || shard.index >= shard.count {
+		return replicationShard{}, fmt.Errorf("invalid shard '%s', expected 0 <= i < n", spec)
+	}
+	return shard, nil
+}
+
+// contains returns true if the given object belongs to the shard.
+func (s replicationShard) contains(id string) bool {
+	if s.count <= 1 {
+		return true
+	}
+
+	hasher := fnv.New32a()
+	_, _ = hasher.Write([]byte(id))
+	return int(hasher.Sum32()%uint32(s.count)) == s.index
+}
+
 // SyncGroup syncs the contents of the specified hosts.
-func SyncGroup(servers []libconfig.BlobServer, options replicateCmd) {
+//
+// If the context is cancelled, for example because the deadline of the
+// replication has passed, we stop as soon as possible.
+func SyncGroup(ctx context.Context, servers []libconfig.BlobServer, options replicateCmd) {
 	//
 	// If we're being verbose show the members
 	//
@@ -161,6 +468,17 @@ func SyncGroup(servers []libconfig.BlobServer, options replicateCmd) {
 		}
 	}
 
+	//
+	// If every member holds the same objects we're done, without
+	// fetching, and comparing, the full lists.
+	//
+	if groupInSync(ctx, servers, options) {
+		if options.verbose {
+			GetLogger().Info("Group members' manifests match, nothing to replicate")
+		}
+		return
+	}
+
 	//
 	// For each server - download the content-list here
 	//
@@ -173,10 +491,52 @@ func SyncGroup(servers []libconfig.BlobServer, options replicateCmd) {
 	//  Store the list of objects each server hosts in the
 	// hash, keyed upon the server-location/name.
 	//
-	for _, s := range servers {
-		objects[s.Location] = Objects(s.Location)
+	// Only those objects within our prefix, and shard, are
+	// considered; parseShard was checked when we started.
+	//
+	shard, _ := parseShard(options.shard)
+
+	//
+	// With -since only recently stored objects are considered, those
+	// older are presumed to have been replicated by an earlier pass.
+	//
+	var since time.Time
+	if options.since > 0 {
+		since = time.Now().Add(-options.since)
 	}
 
+	//
+	// The servers are listed concurrently, up to -list-concurrency at
+	// a time, so that a large group doesn't wait upon each in turn.
+	//
+	lists, errs := listGroup(ctx, servers, options, since)
+	if ctx.Err() != nil {
+		return
+	}
+
+	//
+	// A server we cannot list is skipped for this pass, both as a
+	// source and as a destination, rather than aborting the pass.
+	//
+	reachable := make([]libconfig.BlobServer, 0, len(servers))
+	var listed, skipped []string
+	for i, s := range servers {
+		if errs[i] != nil {
+			GetLogger().Error("Failed to list objects, skipping server for this pass",
+				"location", s.Location, "error", errs[i])
+			skipped = append(skipped, s.Location)
+			continue
+		}
+
+		objects[s.Location] = slices.DeleteFunc(lists[i], func(id string) bool {
+			return !shard.contains(id)
+		})
+		reachable = append(reachable, s)
+		listed = append(listed, s.Location)
+	}
+	servers = reachable
+	GetLogger().Info("Comparing objects", "servers", listed, "skipped", skipped)
+
 	//
 	// Right we have a list of servers.
 	//
@@ -201,9 +561,16 @@ func SyncGroup(servers []libconfig.BlobServer, options replicateCmd) {
 				// Ensure that src != dst.
 				//
 				if mirror.Location != server.Location {
+					if ctx.Err() != nil {
+						return
+					}
+					updateProgress(func(p *replicationProgress) { p.Examined++ })
+
 					// If the object is missing.
-					if !HasObject(mirror.Location, i) {
-						MirrorObject(server.Location, mirror.Location, i, options)
+					if !HasObject(ctx, mirror.Location, i, options) {
+						if MirrorObject(ctx, server.Location, mirror.Location, i, options) {
+							updateProgress(func(p *replicationProgress) { p.Mirrored++ })
+						}
 					}
 				}
 			}
@@ -212,23 +579,44 @@ func SyncGroup(servers []libconfig.BlobServer, options replicateCmd) {
 }
 
 // replicate is the entry-point to this sub-command.
-func replicate(options replicateCmd) {
-	//
-	// If we received blob-servers on the command-line use them too.
+//
+// An error is returned if a (single) replication pass did not complete
+// before the deadline.
+func replicate(options replicateCmd) error {
+	if _, err := parseShard(options.shard); err != nil {
+		GetLogger().Error("Invalid -shard", "error", err)
+		return err
+	}
+	if err := libconfig.SetBlobPath(cmp.Or(options.blobPath, libconfig.DefaultBlobPath)); err != nil {
+		GetLogger().Error("Invalid -blob-path", "error", err)
+		return err
+	}
+	setServerConnections(options.serverConnections)
+	setCopyBufferSize(options.copyBufferSize)
+	if err := setClientTLS(options.clientCert, options.clientKey, options.blobCA); err != nil {
+		GetLogger().Error("Invalid TLS configuration", "error", err)
+		return err
+	}
+
 	//
-	// NOTE: blob-servers added on the command-line are placed in the
-	// "default" group.
+	// Setup our blob-servers, preferring those given on the
+	// command-line, then those of a running API-server, then
+	// the environment, then our config file(s).
 	//
-	if options.blob != "" {
-		servers := strings.SplitSeq(options.blob, ",")
-		for entry := range servers {
-			libconfig.AddServer("default", entry)
+	if options.blob == "" && options.fromAPI != "" {
+		if err := serversFromAPI(options.fromAPI); err != nil {
+			GetLogger().Warn("Failed to read blob-servers from API-server, using local configuration",
+				"api_server", options.fromAPI, "error", err)
+			libconfig.InitServers()
 		}
 	} else {
-		//
-		//  Initialize the servers from our config file(s).
-		//
-		libconfig.InitServers()
+		libconfig.Configure(options.blob)
+	}
+	if options.configDir != "" {
+		if err := loadConfigDir(options.configDir); err != nil {
+			GetLogger().Error("Failed to read -config-dir", "error", err)
+			return err
+		}
 	}
 
 	//
@@ -241,6 +629,49 @@ func replicate(options replicateCmd) {
 		}
 	}
 
+	//
+	// If we've been asked to report our progress then launch
+	// the status-server.
+	//
+	if options.statusPort > 0 {
+		go startStatusServer(options.statusPort)
+	}
+
+	//
+	// Run a single replication pass, or loop forever if we've been
+	// configured to run as a daemon.
+	//
+	for {
+		err := replicationPass(options)
+
+		if options.loop <= 0 {
+			return err
+		}
+
+		next := time.Now().Add(options.loop)
+		updateProgress(func(p *replicationProgress) { p.NextRun = &next })
+		time.Sleep(options.loop)
+	}
+}
+
+// replicationPass syncs each of our groups, once.
+//
+// If a deadline was given the pass is abandoned when it passes, with
+// any transfers in-flight cancelled, and an error is returned.
+func replicationPass(options replicateCmd) error {
+	ctx := context.Background()
+	if options.deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.deadline)
+		defer cancel()
+	}
+
+	start := time.Now()
+	updateProgress(func(p *replicationProgress) {
+		*p = replicationProgress{Running: true, LastPass: p.LastPass}
+	})
+	resetLatency()
+
 	//
 	// Get a list of groups.
 	//
@@ -248,10 +679,35 @@ func replicate(options replicateCmd) {
 		if options.verbose {
 			GetLogger().Info("Syncing group", "group", entry)
 		}
+		updateProgress(func(p *replicationProgress) { p.Group = entry })
 
 		//
 		// For each group, get the members, and sync them.
 		//
-		SyncGroup(libconfig.GroupMembers(entry), options)
+		SyncGroup(ctx, libconfig.GroupMembers(entry), options)
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	updateProgress(func(p *replicationProgress) {
+		p.Running = false
+		p.Group = ""
+		p.LastPass = time.Since(start).String()
+	})
+
+	if options.verbose {
+		logLatency()
+	}
+
+	if err := ctx.Err(); err != nil {
+		done := getProgress()
+		GetLogger().Error("Replication deadline exceeded",
+			"deadline", options.deadline,
+			"examined", done.Examined,
+			"mirrored", done.Mirrored)
+		return err
 	}
+	return nil
 }
@@ -0,0 +1,68 @@
+//
+// Streaming of mirrored objects.
+//
+// An object being mirrored is streamed from the response of its source
+// into the request to its destination, without being held in memory.
+// Rather than leaving the transport to copy it, with a buffer allocated
+// for each request, the body is copied through one of our pooled
+// buffers, whose size may be tuned via the `-copy-buffer-size` flag of
+// `replicate`.
+//
+// The bytes sent, and the rate at which they were sent, are logged once
+// each object has been mirrored.
+//
+
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// mirrorBody is the body of a request which mirrors an object, counting
+// the bytes read from the source.
+type mirrorBody struct {
+	src  io.Reader
+	sent int64
+}
+
+// Read reads from the source, counting the bytes read.
+func (b *mirrorBody) Read(data []byte) (int, error) {
+	n, err := b.src.Read(data)
+	b.sent += int64(n)
+	return n, err
+}
+
+// WriteTo copies the source to the given writer through a pooled buffer.
+//
+// The transport uses this, via io.Copy, to send the body.  We hide any
+// ReadFrom method of the writer, and WriteTo of the source, so that the
+// copy cannot bypass our buffer.
+func (b *mirrorBody) WriteTo(w io.Writer) (int64, error) {
+	buf := getCopyBuffer()
+	defer putCopyBuffer(buf)
+
+	n, err := io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{b.src}, *buf)
+	b.sent += n
+	return n, err
+}
+
+// logMirrored logs the number of bytes of an object sent to the given
+// destination, and the rate at which they were sent.
+func logMirrored(obj string, dst string, sent int64, elapsed time.Duration) {
+	GetLogger().Info("Object mirrored",
+		"object", obj,
+		"dst", dst,
+		"bytes", sent,
+		"duration", elapsed,
+		"bytes_per_second", transferRate(sent, elapsed))
+}
+
+// transferRate returns the rate, in bytes per second, at which the given
+// number of bytes were sent.
+func transferRate(bytes int64, elapsed time.Duration) int64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return int64(float64(bytes) / elapsed.Seconds())
+}
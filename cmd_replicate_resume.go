@@ -0,0 +1,154 @@
+//
+// Resumable mirroring for the replicator.
+//
+// Mirroring a very large object restarts from the beginning if it fails
+// part-way through.  Objects of at least `-resumable-size` bytes are
+// therefore sent via an upload-session upon the destination, which keeps
+// whatever it received:
+//
+//   POST  /uploads?id=XXX&resume=true - find, or create, the session.
+//   PATCH /uploads/{uid}              - send the content beyond its offset.
+//   POST  /uploads/{uid}/complete     - verify, and store, the object.
+//
+// A later attempt finds the same session, and resumes from its offset.
+// The source is still read from the beginning, but the bytes which the
+// destination already holds are not sent again.
+//
+// Blob-servers without upload-sessions reply `404`, in which case the
+// object is simply POSTed as usual.  Since a session is verified against
+// the SHA256 of its content only objects named by their hash are sent
+// this way.
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// defaultResumableSize is the size of the smallest object mirrored via an
+// upload-session, by default.
+const defaultResumableSize = 64 * 1024 * 1024
+
+// mirrorResumable sends the given object to the destination via an
+// upload-session, resuming any which was interrupted.
+//
+// It returns false, for handled, if the object should be POSTed instead,
+// in which case nothing has been read from the body.  Otherwise it
+// returns whether the object was stored.
+func mirrorResumable(ctx context.Context, dst string, obj string, header http.Header, body io.Reader, size int64, options replicateCmd) (handled bool, ok bool) {
+	if options.resumableSize <= 0 || size < options.resumableSize || !hashPattern.MatchString(obj) {
+		return false, false
+	}
+
+	session, status, err := openMirrorSession(ctx, dst, obj, header, options)
+	if err != nil {
+		GetLogger().Error("Error creating upload session", "object", obj, "dst", dst, "error", err)
+		return true, false
+	}
+	if status != http.StatusOK && status != http.StatusCreated {
+		if options.verbose {
+			GetLogger().Info("Upload sessions unsupported, sending whole object", "dst", dst, "status", status)
+		}
+		return false, false
+	}
+	if session.Offset > size {
+		GetLogger().Error("Upload session is larger than the object", "object", obj, "dst", dst, "offset", session.Offset, "size", size)
+		return true, false
+	}
+
+	//
+	// Skip the content the destination already holds.
+	//
+	if session.Offset > 0 {
+		GetLogger().Info("Resuming upload session", "object", obj, "dst", dst, "offset", session.Offset, "size", size)
+		if _, err = io.CopyN(io.Discard, body, session.Offset); err != nil {
+			GetLogger().Error("Error fetching object", "object", obj, "error", err)
+			return true, false
+		}
+	}
+
+	sessionURL := libconfig.Endpoint(dst, "/uploads/"+session.Upload)
+	if session.Offset < size {
+		patch, _ := http.NewRequestWithContext(ctx, http.MethodPatch, sessionURL, body)
+		patch.ContentLength = size - session.Offset
+		patch.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", session.Offset, size-1, size))
+
+		if status, err = sendMirrorRequest(dst, patch, options); err != nil || status != http.StatusOK {
+			GetLogger().Error("Error sending object", "object", obj, "dst", dst, "status", status, "error", err)
+			return true, false
+		}
+	}
+
+	complete, _ := http.NewRequestWithContext(ctx, http.MethodPost, sessionURL+"/complete", nil)
+	if status, err = sendMirrorRequest(dst, complete, options); err != nil || status != http.StatusOK {
+		GetLogger().Error("Error completing upload session", "object", obj, "dst", dst, "status", status, "error", err)
+		return true, false
+	}
+	return true, true
+}
+
+// openMirrorSession finds, or creates, the upload-session for the given
+// object upon the destination, returning the status-code received.
+func openMirrorSession(ctx context.Context, dst string, obj string, header http.Header, options replicateCmd) (uploadStatus, int, error) {
+	var session uploadStatus
+
+	request, _ := http.NewRequestWithContext(ctx, http.MethodPost,
+		libconfig.Endpoint(dst, "/uploads?id="+url.QueryEscape(obj)+"&resume=true"), nil)
+	for name, value := range header {
+		if strings.HasPrefix(name, "X-") {
+			request.Header[name] = slices.Clone(value)
+		}
+	}
+	if modified := header.Get("Last-Modified"); modified != "" {
+		request.Header.Set("Last-Modified", modified)
+	}
+	if disposition := header.Get("Content-Disposition"); disposition != "" {
+		request.Header.Set("Content-Disposition", disposition)
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		request.Header.Set("Expires", expires)
+	}
+
+	client := newBlobClient()
+	start := time.Now()
+	response, err := client.Do(request)
+	recordLatency(dst, request.Method, start, options.verbose)
+	if err != nil {
+		return session, 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusCreated {
+		return session, response.StatusCode, nil
+	}
+	if err = json.NewDecoder(response.Body).Decode(&session); err != nil || session.Upload == "" {
+		return session, response.StatusCode, fmt.Errorf("invalid upload session: %v", err)
+	}
+	return session, response.StatusCode, nil
+}
+
+// sendMirrorRequest sends the given request to the destination, returning
+// the status-code received.
+func sendMirrorRequest(dst string, request *http.Request, options replicateCmd) (int, error) {
+	client := newBlobClient()
+	start := time.Now()
+	response, err := client.Do(request)
+	recordLatency(dst, request.Method, start, options.verbose)
+	if err != nil {
+		return 0, err
+	}
+	_, _ = io.Copy(io.Discard, response.Body)
+	_ = response.Body.Close()
+	return response.StatusCode, nil
+}
@@ -0,0 +1,92 @@
+//
+// Report upon the progress of the replication utility.
+//
+// When `sos replicate -loop` is running as a daemon the only insight
+// into what it is doing would otherwise come from its logs.  Launching
+// it with `-status-port` exposes its current state as JSON, so that it
+// may be polled by a dashboard.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// replicationProgress describes the state of the replication utility.
+type replicationProgress struct {
+	// Running is true while a replication pass is in progress.
+	Running bool `json:"running"`
+
+	// Group is the name of the group currently being synced.
+	Group string `json:"group"`
+
+	// Examined is the number of objects checked during this pass.
+	Examined int `json:"examined"`
+
+	// Mirrored is the number of objects copied during this pass.
+	Mirrored int `json:"mirrored"`
+
+	// LastPass is the duration of the most recently completed pass.
+	LastPass string `json:"last_pass_duration"`
+
+	// NextRun is the time at which the next pass will start.
+	NextRun *time.Time `json:"next_run,omitempty"`
+}
+
+var (
+	// progress holds our current state.
+	progress replicationProgress
+
+	// progressMutex guards access to progress.
+	progressMutex sync.Mutex
+)
+
+// updateProgress invokes the given function to update our state.
+func updateProgress(update func(p *replicationProgress)) {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+
+	update(&progress)
+}
+
+// getProgress returns a copy of our current state.
+func getProgress() replicationProgress {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+
+	return progress
+}
+
+// ReplicationStatusHandler returns our current state as JSON.
+func ReplicationStatusHandler(res http.ResponseWriter, _ *http.Request) {
+	body, _ := json.Marshal(getProgress())
+
+	res.Header().Set("Content-Type", "application/json")
+	_, _ = res.Write(body)
+}
+
+// startStatusServer serves our progress upon the given port.
+func startStatusServer(port int) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", ReplicationStatusHandler)
+
+	GetLogger().Info("replication status-server starting",
+		"url", "http://"+net.JoinHostPort("", strconv.Itoa(port))+"/status")
+
+	server := &http.Server{
+		Addr:         net.JoinHostPort("", strconv.Itoa(port)),
+		Handler:      mux,
+		ReadTimeout:  serverReadTimeout,
+		WriteTimeout: serverWriteTimeout,
+		IdleTimeout:  serverIdleTimeout,
+	}
+	if err := server.ListenAndServe(); err != nil {
+		GetLogger().Error("replication status-server failed", "error", err)
+	}
+}
@@ -0,0 +1,510 @@
+// Testing of the replication utility.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// Test that a replication pass is abandoned at its deadline.
+func TestReplicateDeadline(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/blobs" {
+			_, _ = res.Write([]byte(`["abc","def"]`))
+			return
+		}
+
+		// Every other request hangs, until cancelled.
+		select {
+		case <-req.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		res.WriteHeader(http.StatusNotFound)
+	}))
+	defer slow.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("default", slow.URL)
+	libconfig.AddServer("default", slow.URL+"/")
+
+	start := time.Now()
+	err := replicationPass(replicateCmd{deadline: 100 * time.Millisecond})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to be exceeded, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("Replication was not abandoned promptly")
+	}
+	if getProgress().Running {
+		t.Errorf("Replication is still reported as running")
+	}
+}
+
+// Test that shards are parsed, and partition the keyspace.
+func TestReplicateShard(t *testing.T) {
+	for _, spec := range []string{"0", "a/4", "0/b", "4/4", "-1/4", "0/0"} {
+		if _, err := parseShard(spec); err == nil {
+			t.Errorf("Expected an error parsing %s", spec)
+		}
+	}
+
+	var shards []replicationShard
+	for _, spec := range []string{"0/3", "1/3", "2/3"} {
+		shard, err := parseShard(spec)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", spec, err)
+		}
+		shards = append(shards, shard)
+	}
+
+	everything, _ := parseShard("")
+	for _, id := range []string{"abc", "def", "steve", "kemp", "0123456789"} {
+		owners := 0
+		for _, shard := range shards {
+			if shard.contains(id) {
+				owners++
+			}
+		}
+		if owners != 1 {
+			t.Errorf("Object %s belongs to %d shards", id, owners)
+		}
+		if !everything.contains(id) {
+			t.Errorf("Object %s is outside the default shard", id)
+		}
+	}
+}
+
+// Test that the prefix is passed along to the blob-servers.
+func TestReplicatePrefix(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("prefix") == "ab" {
+			_, _ = res.Write([]byte(`["abc"]`))
+			return
+		}
+		_, _ = res.Write([]byte(`["abc","def"]`))
+	}))
+	defer server.Close()
+
+	if objects, err := Objects(context.Background(), server.URL, "ab", time.Time{}); err != nil || len(objects) != 1 {
+		t.Errorf("Unexpected objects: %v %v", objects, err)
+	}
+	if objects, err := Objects(context.Background(), server.URL, "", time.Time{}); err != nil || len(objects) != 2 {
+		t.Errorf("Unexpected objects: %v %v", objects, err)
+	}
+}
+
+// Test that a server which cannot be listed is skipped, rather than
+// aborting the replication.
+func TestReplicateListFailure(t *testing.T) {
+	src := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/blobs" {
+			_, _ = res.Write([]byte(`["abc"]`))
+			return
+		}
+		_, _ = res.Write([]byte("Content"))
+	}))
+	defer src.Close()
+
+	var mirrored atomic.Int32
+	dst := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodPost:
+			mirrored.Add(1)
+		case http.MethodHead:
+			res.WriteHeader(http.StatusNotFound)
+		default:
+			_, _ = res.Write([]byte(`[]`))
+		}
+	}))
+	defer dst.Close()
+
+	var contacted atomic.Int32
+	broken := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		contacted.Add(1)
+		res.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	if _, err := Objects(context.Background(), broken.URL, "", time.Time{}); err == nil {
+		t.Errorf("Expected an error listing a broken server")
+	}
+
+	servers := []libconfig.BlobServer{
+		{Location: src.URL, Group: "default"},
+		{Location: broken.URL, Group: "default"},
+		{Location: dst.URL, Group: "default"},
+	}
+	SyncGroup(context.Background(), servers, replicateCmd{})
+
+	if count := mirrored.Load(); count != 1 {
+		t.Errorf("Unexpected mirror count: %d", count)
+	}
+	if count := contacted.Load(); count != 2 {
+		t.Errorf("Broken server was contacted beyond listing: %d", count)
+	}
+}
+
+// Test that the servers of a group are listed concurrently, no more than
+// -list-concurrency at a time.
+func TestReplicateListConcurrency(t *testing.T) {
+	var inflight, peak atomic.Int32
+	handler := http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		current := inflight.Add(1)
+		defer inflight.Add(-1)
+		for {
+			previous := peak.Load()
+			if current <= previous || peak.CompareAndSwap(previous, current) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		_, _ = res.Write([]byte(`["abc"]`))
+	})
+
+	var servers []libconfig.BlobServer
+	for range 6 {
+		server := httptest.NewServer(handler)
+		defer server.Close()
+		servers = append(servers, libconfig.BlobServer{Location: server.URL, Group: "default"})
+	}
+
+	for _, test := range []struct {
+		limit    int
+		expected int32
+	}{
+		{limit: 2, expected: 2},
+		{limit: 0, expected: 6},
+	} {
+		peak.Store(0)
+		lists, errs := listGroup(context.Background(), servers, replicateCmd{listConcurrency: test.limit}, time.Time{})
+		for i := range servers {
+			if errs[i] != nil || len(lists[i]) != 1 {
+				t.Errorf("Unexpected list of server %d: %v %v", i, lists[i], errs[i])
+			}
+		}
+		if peak.Load() != test.expected {
+			t.Errorf("Expected %d concurrent lists with a limit of %d, got %d", test.expected, test.limit, peak.Load())
+		}
+	}
+}
+
+// Test that a list which cannot be understood is an error, rather than
+// being mistaken for an empty server.
+func TestReplicateListValidation(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		valid       bool
+	}{
+		{"application/json", `[]`, true},
+		{"application/json; charset=utf-8", `["abc"]`, true},
+		{"text/plain; charset=utf-8", `["abc"]`, true},
+		{"text/html", `<html>Bad Gateway</html>`, false},
+		{"application/json", `null`, false},
+		{"application/json", `{"abc":1}`, false},
+		{"application/json", `["abc"] ["def"]`, false},
+		{"", `["abc"]`, false},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+			res.Header()["Content-Type"] = []string{test.contentType}
+			_, _ = res.Write([]byte(test.body))
+		}))
+
+		_, err := Objects(context.Background(), server.URL, "", time.Time{})
+		if test.valid && err != nil {
+			t.Errorf("Unexpected error for %s %s: %v", test.contentType, test.body, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Expected an error for %s %s", test.contentType, test.body)
+		}
+		server.Close()
+	}
+}
+
+// Test that a group whose manifests match is not listed in full.
+func TestReplicateManifest(t *testing.T) {
+	for _, match := range []bool{true, false} {
+		var listed atomic.Int32
+		startServer := func(ids ...string) *httptest.Server {
+			return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				res.Header().Set("Content-Type", "application/json")
+				switch req.URL.Path {
+				case "/manifest":
+					body, _ := json.Marshal(newManifest(ids))
+					_, _ = res.Write(body)
+				case "/blobs":
+					listed.Add(1)
+					body, _ := json.Marshal(ids)
+					_, _ = res.Write(body)
+				default:
+					// Every object is present.
+				}
+			}))
+		}
+
+		first := startServer("abc", "def")
+		second := startServer("def", "abc")
+		if !match {
+			second.Close()
+			second = startServer("abc")
+		}
+
+		servers := []libconfig.BlobServer{
+			{Location: first.URL, Group: "default"},
+			{Location: second.URL, Group: "default"},
+		}
+		SyncGroup(context.Background(), servers, replicateCmd{})
+
+		if count := listed.Load(); (count == 0) != match {
+			t.Errorf("Unexpected listings with matching=%v: %d", match, count)
+		}
+		first.Close()
+		second.Close()
+	}
+}
+
+// Test that mirrored objects are verified, when requested.
+func TestReplicateVerify(t *testing.T) {
+	src := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		_, _ = res.Write([]byte("Content"))
+	}))
+	defer src.Close()
+
+	for stored, expected := range map[string]bool{"Content": true, "Corrupt": false} {
+		var fetched atomic.Int32
+		dst := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if req.Method == http.MethodGet {
+				fetched.Add(1)
+				_, _ = res.Write([]byte(stored))
+			}
+		}))
+
+		if ok := MirrorObject(context.Background(), src.URL, dst.URL, "abc", replicateCmd{}); !ok || fetched.Load() != 0 {
+			t.Errorf("Unexpected result mirroring without verification: %v", ok)
+		}
+		if ok := MirrorObject(context.Background(), src.URL, dst.URL, "abc", replicateCmd{verify: true}); ok != expected {
+			t.Errorf("Unexpected result verifying %s: %v", stored, ok)
+		}
+		if fetched.Load() != 1 {
+			t.Errorf("The mirrored object was not re-fetched")
+		}
+		dst.Close()
+	}
+}
+
+// Test that an object refused by the mirror is not reported as mirrored.
+func TestReplicateRefused(t *testing.T) {
+	src := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		_, _ = res.Write([]byte("Content"))
+	}))
+	defer src.Close()
+
+	dst := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		res.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer dst.Close()
+
+	if MirrorObject(context.Background(), src.URL, dst.URL, "abc", replicateCmd{}) {
+		t.Errorf("An object refused by the mirror was reported as mirrored")
+	}
+}
+
+// Test that large objects are mirrored via a resumable upload-session.
+func TestReplicateResumable(t *testing.T) {
+	content := "This is a test of resumable mirroring."
+	hash := sha256.Sum256([]byte(content))
+	id := hex.EncodeToString(hash[:])
+	modified := time.Date(2020, time.January, 2, 3, 4, 5, 0, time.UTC).Format(http.TimeFormat)
+
+	src := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		res.Header().Set("Last-Modified", modified)
+		_, _ = res.Write([]byte(content))
+	}))
+	defer src.Close()
+
+	//
+	// The mirror already holds the start of the object.
+	//
+	router := setupUploads(t)
+	_, session := sendUpload(t, router, http.MethodPost, "/uploads?id="+id, "", nil)
+	sendUpload(t, router, http.MethodPatch, "/uploads/"+session.Upload, content[:10], nil)
+
+	var sent atomic.Int64
+	dst := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPatch {
+			sent.Add(req.ContentLength)
+		}
+		router.ServeHTTP(res, req)
+	}))
+	defer dst.Close()
+
+	if !MirrorObject(context.Background(), src.URL, dst.URL, id, replicateCmd{resumableSize: 1, verify: true}) {
+		t.Fatalf("Failed to mirror the object")
+	}
+	if sent.Load() != int64(len(content)-10) {
+		t.Errorf("Unexpected bytes sent: %d", sent.Load())
+	}
+	if data, _ := getStorage().Get(id); data == nil || string(*data) != content {
+		t.Errorf("The mirrored object was not stored")
+	}
+
+	//
+	// A new upload-session preserves the modification time.
+	//
+	if !getStorage().(Deleter).Delete(id) {
+		t.Fatalf("Failed to remove the mirrored object")
+	}
+	if !MirrorObject(context.Background(), src.URL, dst.URL, id, replicateCmd{resumableSize: 1}) {
+		t.Fatalf("Failed to mirror the object")
+	}
+	if _, meta := getStorage().Get(id); meta.Get("Last-Modified") != modified {
+		t.Errorf("The modification time was not preserved: %v", meta.Get("Last-Modified"))
+	}
+
+	//
+	// Mirrors without upload-sessions receive the whole object.
+	//
+	var posted atomic.Int32
+	plain := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/uploads") {
+			res.WriteHeader(http.StatusNotFound)
+			return
+		}
+		posted.Add(1)
+	}))
+	defer plain.Close()
+
+	if !MirrorObject(context.Background(), src.URL, plain.URL, id, replicateCmd{resumableSize: 1}) || posted.Load() != 1 {
+		t.Errorf("Failed to fall back to a plain upload")
+	}
+}
+
+// Test that -since restricts replication to recently stored objects.
+func TestReplicateSince(t *testing.T) {
+	var since atomic.Value
+	src := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/blobs" {
+			since.Store(req.URL.Query().Get("since"))
+		}
+		res.WriteHeader(http.StatusNotFound)
+	}))
+	defer src.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("default", src.URL)
+
+	SyncGroup(context.Background(), libconfig.Servers(), replicateCmd{})
+	if value, _ := since.Load().(string); value != "" {
+		t.Errorf("Unexpected since without -since: %s", value)
+	}
+
+	SyncGroup(context.Background(), libconfig.Servers(), replicateCmd{since: time.Hour})
+	value, _ := since.Load().(string)
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || time.Since(time.Unix(seconds, 0)).Round(time.Minute) != time.Hour {
+		t.Errorf("Unexpected since with -since: %s", value)
+	}
+}
+
+// zeroReader is an endless source of zero bytes, used to serve large
+// objects without holding them in memory.
+type zeroReader struct{}
+
+// Read fills the given slice with zeros.
+func (zeroReader) Read(data []byte) (int, error) {
+	clear(data)
+	return len(data), nil
+}
+
+// newSizedBlobServers returns a blob-server which serves objects of the
+// given size, and one which discards the objects mirrored to it, counting
+// the bytes received.
+func newSizedBlobServers(size int64, received *atomic.Int64) (*httptest.Server, *httptest.Server) {
+	src := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		res.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		_, _ = io.CopyN(res, zeroReader{}, size)
+	}))
+	dst := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.ContentLength != size {
+			res.WriteHeader(http.StatusLengthRequired)
+			return
+		}
+		n, _ := io.Copy(io.Discard, req.Body)
+		received.Add(n)
+	}))
+	return src, dst
+}
+
+// Test that mirrored objects are streamed in full, with their length.
+func TestReplicateStreaming(t *testing.T) {
+	const size = 4*1024*1024 + 17
+
+	var received atomic.Int64
+	src, dst := newSizedBlobServers(size, &received)
+	defer src.Close()
+	defer dst.Close()
+
+	setCopyBufferSize(64 * 1024)
+	defer setCopyBufferSize(0)
+
+	if !MirrorObject(context.Background(), src.URL, dst.URL, "abc", replicateCmd{}) {
+		t.Fatalf("Failed to mirror object")
+	}
+	if received.Load() != size {
+		t.Errorf("Unexpected size of mirrored object: %d", received.Load())
+	}
+}
+
+// Benchmark mirroring a large object between two blob-servers, with a
+// number of buffer sizes.
+//
+// The peak heap is reported, which should remain flat however large the
+// object.
+func BenchmarkMirrorObject(b *testing.B) {
+	const size = 64 * 1024 * 1024
+
+	var received atomic.Int64
+	src, dst := newSizedBlobServers(size, &received)
+	defer src.Close()
+	defer dst.Close()
+	defer setCopyBufferSize(0)
+
+	for _, buffer := range []int{4 * 1024, copyChunkSize, 256 * 1024, 1024 * 1024} {
+		b.Run(fmt.Sprintf("buffer-%dKiB", buffer/1024), func(b *testing.B) {
+			setCopyBufferSize(buffer)
+
+			var peak uint64
+			var stats runtime.MemStats
+
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for b.Loop() {
+				if !MirrorObject(context.Background(), src.URL, dst.URL, "abc", replicateCmd{}) {
+					b.Fatalf("Failed to mirror object")
+				}
+				runtime.ReadMemStats(&stats)
+				peak = max(peak, stats.HeapInuse)
+			}
+			b.ReportMetric(float64(peak)/(1024*1024), "peak-heap-MiB")
+		})
+	}
+}
@@ -0,0 +1,186 @@
+//
+// Verify the integrity of a blob-server's local store.
+//
+// Since the ID of each object is the SHA256 hash of its content we can
+// detect silent corruption (bitrot) by rehashing every object, and
+// comparing the result against the ID it is stored under.
+//
+// With `-blob-server` the objects of each of the given blob-servers are
+// verified remotely instead, via their `/verify` end-point, so that the
+// hashing happens upon the node holding the data.
+//
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// quarantineDirectory is the directory, beneath the store, into which
+// corrupt objects are moved.
+const quarantineDirectory = ".quarantine"
+
+// hashPattern matches IDs which are SHA256 hashes.
+var hashPattern = regexp.MustCompile("^[a-f0-9]{64}$")
+
+// scrubStore checks every object within the given storage, returning
+// the IDs of those whose content no longer matches their ID.
+func scrubStore(fss *FilesystemStorage, options scrubCmd) ([]string, error) {
+	var corrupt []string
+
+	list, err := fss.Existing()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range list {
+		//
+		// Objects which were not stored under their hash cannot
+		// be verified.
+		//
+		if !hashPattern.MatchString(id) {
+			if options.verbose {
+				GetLogger().Info("Skipping object with a non-hash ID", "object", id)
+			}
+			continue
+		}
+
+		//
+		// Read the content, and compare its hash with the ID.
+		//
+		data, _ := fss.Get(id)
+		if data != nil {
+			sum := sha256.Sum256(*data)
+			if hex.EncodeToString(sum[:]) == id {
+				if options.verbose {
+					GetLogger().Info("Object verified", "object", id)
+				}
+				continue
+			}
+		}
+
+		GetLogger().Error("Object is corrupt", "object", id)
+		corrupt = append(corrupt, id)
+
+		//
+		// Move the object out of the way, if we should.
+		//
+		if options.quarantine {
+			if err := fss.quarantine(id, quarantineDirectory); err != nil {
+				GetLogger().Error("Failed to quarantine object", "object", id, "error", err)
+			}
+		}
+	}
+	return corrupt, nil
+}
+
+// verifyRemote asks the given blob-server to verify one of its objects.
+func verifyRemote(ctx context.Context, server string, id string) (verifyResult, error) {
+	var result verifyResult
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, libconfig.Endpoint(server, "/verify/"+id), nil)
+	if err != nil {
+		return result, err
+	}
+
+	client := newBlobClient()
+	response, err := client.Do(request)
+	if err != nil {
+		return result, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("status-code %d", response.StatusCode)
+	}
+	err = json.NewDecoder(response.Body).Decode(&result)
+	return result, err
+}
+
+// scrubServer asks the given blob-server to verify each of its objects,
+// returning the IDs of those which are corrupt.
+func scrubServer(ctx context.Context, server string, options scrubCmd) ([]string, error) {
+	var corrupt []string
+
+	list, err := Objects(ctx, server, "", time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range list {
+		if !hashPattern.MatchString(id) {
+			if options.verbose {
+				GetLogger().Info("Skipping object with a non-hash ID", "server", server, "object", id)
+			}
+			continue
+		}
+
+		result, verifyErr := verifyRemote(ctx, server, id)
+		if verifyErr != nil {
+			GetLogger().Error("Failed to verify object", "server", server, "object", id, "error", verifyErr)
+			continue
+		}
+		if result.OK {
+			if options.verbose {
+				GetLogger().Info("Object verified", "server", server, "object", id)
+			}
+			continue
+		}
+
+		GetLogger().Error("Object is corrupt", "server", server, "object", id, "actual", result.Actual)
+		corrupt = append(corrupt, id)
+	}
+	return corrupt, nil
+}
+
+// scrubRemote verifies the objects of each of the given blob-servers,
+// returning the number which are corrupt.
+func scrubRemote(options scrubCmd) (int, error) {
+	libconfig.Configure(options.blob)
+
+	total := 0
+	var failed error
+	for _, server := range libconfig.Servers() {
+		corrupt, err := scrubServer(context.Background(), server.Location, options)
+		if err != nil {
+			GetLogger().Error("Failed to list objects", "server", server.Location, "error", err)
+			failed = err
+			continue
+		}
+
+		GetLogger().Info("Scrub complete", "server", server.Location, "corrupt", len(corrupt))
+		total += len(corrupt)
+	}
+	return total, failed
+}
+
+// scrub is the entry-point to this sub-command.
+//
+// It returns the number of corrupt objects which were found, or an
+// error if the objects could not be listed.
+func scrub(options scrubCmd) (int, error) {
+	if options.blob != "" {
+		return scrubRemote(options)
+	}
+
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(options.store)
+
+	corrupt, err := scrubStore(storageHandler, options)
+	if err != nil {
+		GetLogger().Error("Failed to list objects", "store", options.store, "error", err)
+		return 0, err
+	}
+
+	GetLogger().Info("Scrub complete", "store", options.store, "corrupt", len(corrupt))
+	return len(corrupt), nil
+}
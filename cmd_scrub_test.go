@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// Test that scrubbing detects, and quarantines, corrupt objects.
+func TestScrub(t *testing.T) {
+	//
+	// Create a temporary directory.
+	//
+	p := t.TempDir()
+
+	//
+	// Init the filesystem storage-class
+	//
+	storage := new(FilesystemStorage)
+	storage.Setup(p)
+
+	//
+	// Store a valid object, a corrupt one, and one which
+	// wasn't stored under its hash.
+	//
+	good := "a8a2f6ebe286697c527eb35a58b5539532e9b3ae3b64d4eb0a46fb657b41562c"
+	bad := "0000000000000000000000000000000000000000000000000000000000000000"
+
+	storage.Store(good, []byte("This is a test."), nil)
+	storage.Store(bad, []byte("This is a test."), Metadata{"X-Foo": {"bar"}})
+	storage.Store("steve", []byte("This is a test."), nil)
+
+	corrupt, err := scrubStore(storage, scrubCmd{quarantine: true})
+	if err != nil {
+		t.Fatalf("Failed to scrub: %v", err)
+	}
+	if len(corrupt) != 1 || corrupt[0] != bad {
+		t.Fatalf("Unexpected corrupt objects: %v", corrupt)
+	}
+
+	//
+	// The corrupt object, and its meta-data, should have moved.
+	//
+	if storage.Exists(bad) {
+		t.Errorf("Corrupt object was not quarantined")
+	}
+	for _, name := range []string{bad, bad + ".json"} {
+		if _, err := os.Stat(filepath.Join(p, quarantineDirectory, name)); err != nil {
+			t.Errorf("Quarantined file is missing: %v", err)
+		}
+	}
+
+	//
+	// And the quarantine directory must not be listed as an object.
+	//
+	if list, _ := storage.Existing(); len(list) != 2 {
+		t.Errorf("Unexpected objects remaining: %v", list)
+	}
+}
+
+// Test that blob-servers may be asked to verify their own objects.
+func TestScrubRemote(t *testing.T) {
+	storage := new(FilesystemStorage)
+	storage.Setup(t.TempDir())
+	setStorage(storage)
+
+	good := "a8a2f6ebe286697c527eb35a58b5539532e9b3ae3b64d4eb0a46fb657b41562c"
+	bad := "0000000000000000000000000000000000000000000000000000000000000000"
+
+	storage.Store(good, []byte("This is a test."), nil)
+	storage.Store(bad, []byte("This is a test."), nil)
+	storage.Store("steve", []byte("This is a test."), nil)
+
+	server := httptest.NewServer(newBlobRouter(""))
+	defer server.Close()
+
+	//
+	// The end-point itself.
+	//
+	tests := []struct {
+		id     string
+		status int
+		ok     bool
+	}{
+		{good, http.StatusOK, true},
+		{bad, http.StatusOK, false},
+		{"steve", http.StatusBadRequest, false},
+		{"1111111111111111111111111111111111111111111111111111111111111111", http.StatusNotFound, false},
+	}
+	for _, test := range tests {
+		result, err := verifyRemote(context.Background(), server.URL, test.id)
+		if test.status != http.StatusOK {
+			if err == nil || !strings.Contains(err.Error(), strconv.Itoa(test.status)) {
+				t.Errorf("Unexpected result for %s: %v %v", test.id, result, err)
+			}
+			continue
+		}
+		if err != nil || result.OK != test.ok {
+			t.Errorf("Unexpected result for %s: %v %v", test.id, result, err)
+		}
+	}
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+
+	corrupt, err := scrub(scrubCmd{blob: server.URL})
+	if err != nil || corrupt != 1 {
+		t.Errorf("Unexpected scrub: %v %v", corrupt, err)
+	}
+	if !storage.Exists(bad) {
+		t.Errorf("Remote scrubbing removed the corrupt object")
+	}
+}
@@ -0,0 +1,179 @@
+//
+// Smoke-test a deployment, end to end.
+//
+// The `smoke-test` sub-command uploads a small object via the API-server,
+// fetches it back by the ID returned, and checks the content matches.
+// Optionally it asks whether the object exists, via HEAD, and finally it
+// removes the object from each blob-server the API-server is using.
+//
+// Each step is reported along with its duration, and the command fails
+// if any of them did, so that it may be used to validate a deployment
+// after a change.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/skx/sos/libclient"
+	"github.com/skx/sos/libconfig"
+)
+
+// smokeStep is the result of a single step of the smoke-test.
+type smokeStep struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+// smokeUpload uploads the given content, returning its ID.
+func smokeUpload(options smokeTestCmd, content []byte) (string, error) {
+	header := http.Header{}
+	header.Set("X-Mime-Type", "text/plain")
+	return libclient.Upload(options.upload, bytes.NewReader(content), header)
+}
+
+// smokeDownload fetches the object with the given ID, and tests that it
+// has the expected content.
+func smokeDownload(options smokeTestCmd, id string, content []byte) error {
+	body, err := libclient.Download(options.download, id)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	fetched, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(fetched, content) {
+		return fmt.Errorf("content mismatch, fetched %d bytes, expected %d", len(fetched), len(content))
+	}
+	return nil
+}
+
+// smokeHead asks whether the object with the given ID exists, and tests
+// that its size is reported correctly.
+func smokeHead(options smokeTestCmd, id string, size int) error {
+	response, err := libclient.Client.Head(strings.TrimSuffix(options.download, "/") + "/fetch/" + id)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("status-code %d", response.StatusCode)
+	}
+	if length := response.Header.Get("Content-Length"); length != "" && length != strconv.Itoa(size) {
+		return fmt.Errorf("unexpected Content-Length %s, expected %d", length, size)
+	}
+	return nil
+}
+
+// smokeDelete removes the object with the given ID from each blob-server
+// the API-server is using.
+//
+// The API-server has no means of deleting objects, so we ask it for its
+// blob-servers, and delete the object from each of them directly.  This
+// requires that they were launched with `-soft-delete`, though the
+// object is removed immediately rather than moved to the trash.
+func smokeDelete(options smokeTestCmd, id string) error {
+	var config apiConfig
+	if err := getJSON(libconfig.Endpoint(options.upload, "/config"), &config); err != nil {
+		return fmt.Errorf("failed to list blob-servers: %w", err)
+	}
+
+	deleted := 0
+	for _, group := range config.Groups {
+		for _, member := range group.Members {
+			request, _ := http.NewRequest(http.MethodDelete, libconfig.BlobURL(member.Location, id)+"?hard=true", nil)
+			response, err := libclient.Client.Do(request)
+			if err != nil {
+				return fmt.Errorf("failed to delete from %s: %w", member.Location, err)
+			}
+
+			var failure errorResponse
+			_ = json.NewDecoder(io.LimitReader(response.Body, 1024)).Decode(&failure)
+			response.Body.Close()
+
+			switch {
+			case response.StatusCode == http.StatusOK || response.StatusCode == http.StatusNoContent:
+				deleted++
+			case failure.Error == "deletion is disabled":
+				return fmt.Errorf("deletion is disabled upon %s, launch it with -soft-delete, or give -keep", member.Location)
+			case response.StatusCode == http.StatusNotFound:
+				// Not every blob-server holds every object.
+			default:
+				return fmt.Errorf("failed to delete from %s: status-code %d", member.Location, response.StatusCode)
+			}
+		}
+	}
+
+	if deleted == 0 {
+		return errors.New("the object was not found upon any blob-server")
+	}
+	return nil
+}
+
+// timeStep runs a single step of the smoke-test, recording its duration.
+func timeStep(steps []smokeStep, name string, step func() error) ([]smokeStep, error) {
+	start := time.Now()
+	err := step()
+	return append(steps, smokeStep{Name: name, Duration: time.Since(start), Err: err}), err
+}
+
+// smokeTest is our entry-point to the sub-command, it runs each step and
+// returns the results.
+func smokeTest(options smokeTestCmd) []smokeStep {
+	var steps []smokeStep
+
+	content := []byte("sos smoke-test " + time.Now().UTC().Format(time.RFC3339Nano) + "\n")
+
+	var id string
+	steps, err := timeStep(steps, "upload", func() (err error) {
+		id, err = smokeUpload(options, content)
+		return err
+	})
+	if err != nil {
+		return steps
+	}
+
+	steps, _ = timeStep(steps, "download", func() error { return smokeDownload(options, id, content) })
+	if options.head {
+		steps, _ = timeStep(steps, "head", func() error { return smokeHead(options, id, len(content)) })
+	}
+	if !options.keep {
+		steps, _ = timeStep(steps, "delete", func() error { return smokeDelete(options, id) })
+	}
+	return steps
+}
+
+// showSmokeTest writes the result of each step to the writer, and returns
+// the number which failed.
+func showSmokeTest(steps []smokeStep, out io.Writer) int {
+	failed := 0
+
+	table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(table, "STEP\tRESULT\tDURATION")
+	for _, step := range steps {
+		result := "pass"
+		if step.Err != nil {
+			result = "FAIL: " + step.Err.Error()
+			failed++
+		}
+		_, _ = fmt.Fprintf(table, "%s\t%s\t%s\n", step.Name, result, step.Duration.Round(time.Microsecond))
+	}
+	_ = table.Flush()
+
+	return failed
+}
@@ -0,0 +1,73 @@
+// Testing of the smoke-test sub-command.
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/skx/sos/libconfig"
+)
+
+// Test that a working deployment passes, and a broken one fails.
+func TestSmokeTest(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+	defer setStorage(nil)
+
+	root, err := os.OpenRoot(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTrashRoot(root)
+	defer func() {
+		_ = root.Close()
+		setTrashRoot(nil)
+	}()
+
+	blob := httptest.NewServer(newBlobRouter(""))
+	defer blob.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("default", blob.URL)
+
+	up := mux.NewRouter()
+	up.HandleFunc("/upload", APIUploadHandler).Methods("POST")
+	up.HandleFunc("/config", APIConfigHandler).Methods("GET")
+	upload := httptest.NewServer(up)
+	defer upload.Close()
+
+	down := mux.NewRouter()
+	down.HandleFunc("/fetch/{id}", APIDownloadHandler).Methods("GET")
+	down.HandleFunc("/fetch/{id}", APIExistsHandler).Methods("HEAD")
+	download := httptest.NewServer(down)
+	defer download.Close()
+
+	steps := smokeTest(smokeTestCmd{upload: upload.URL, download: download.URL, head: true})
+	var out bytes.Buffer
+	if failed := showSmokeTest(steps, &out); failed != 0 || len(steps) != 4 {
+		t.Fatalf("Unexpected result: %s", out.String())
+	}
+
+	//
+	// The object was removed.
+	//
+	if objects, _ := storageHandler.Existing(); len(objects) != 0 {
+		t.Errorf("The object was not deleted: %v", objects)
+	}
+
+	//
+	// Without the blob-server nothing but the upload is attempted.
+	//
+	blob.Close()
+	steps = smokeTest(smokeTestCmd{upload: upload.URL, download: download.URL})
+	out.Reset()
+	if failed := showSmokeTest(steps, &out); failed != 1 || len(steps) != 1 || !strings.Contains(out.String(), "FAIL") {
+		t.Errorf("Unexpected result: %s", out.String())
+	}
+}
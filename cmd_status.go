@@ -0,0 +1,168 @@
+//
+// Report upon the health of each of our blob-servers.
+//
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// statusClient is the HTTP-client used to query each blob-server, it is
+// shared so that connections are pooled between requests.
+var statusClient = &http.Client{Timeout: 10 * time.Second}
+
+// nodeStatus describes the health of a single blob-server.
+type nodeStatus struct {
+	Group     string `json:"group"`
+	Location  string `json:"location"`
+	Alive     bool   `json:"alive"`
+	Error     string `json:"error,omitempty"`
+	Objects   int    `json:"objects"`
+	DiskFree  uint64 `json:"disk_free,omitempty"`
+	DiskTotal uint64 `json:"disk_total,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Storage   string `json:"storage,omitempty"`
+}
+
+// getJSON fetches the given URL, decoding the JSON response.
+func getJSON(url string, out any) error {
+	response, err := statusClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("status-code %d", response.StatusCode)
+	}
+	return json.NewDecoder(response.Body).Decode(out)
+}
+
+// nodeHealth queries the given blob-server.
+func nodeHealth(server libconfig.BlobServer) nodeStatus {
+	status := nodeStatus{Group: server.Group, Location: server.Location, Objects: -1}
+
+	response, err := statusClient.Get(libconfig.Endpoint(server.Location, "/alive"))
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	_, _ = io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		status.Error = fmt.Sprintf("status-code %d", response.StatusCode)
+		return status
+	}
+	status.Alive = true
+
+	//
+	// Older blob-servers don't describe themselves.
+	//
+	var info serverInfo
+	if getJSON(libconfig.Endpoint(server.Location, "/info"), &info) == nil {
+		status.Version, status.Storage = info.Version, info.Storage
+	}
+
+	//
+	// Older blob-servers have no `/stats` end-point, in which case
+	// we count the objects they list instead.
+	//
+	var stats blobStats
+	if getJSON(libconfig.Endpoint(server.Location, "/stats"), &stats) == nil {
+		status.Objects = stats.Objects
+		status.DiskFree, status.DiskTotal = stats.DiskFree, stats.DiskTotal
+		return status
+	}
+
+	var list []string
+	if getJSON(libconfig.Endpoint(server.Location, "/blobs"), &list) == nil {
+		status.Objects = len(list)
+	}
+	return status
+}
+
+// clusterHealth queries each of our blob-servers, concurrently.
+func clusterHealth() []nodeStatus {
+	servers := libconfig.Servers()
+	result := make([]nodeStatus, len(servers))
+
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result[i] = nodeHealth(server)
+		}()
+	}
+	wg.Wait()
+
+	return result
+}
+
+// showStatus writes the health of each blob-server to the writer, as a
+// table or as JSON, and returns the number which were unreachable.
+func showStatus(nodes []nodeStatus, asJSON bool, out io.Writer) int {
+	down := 0
+	for _, node := range nodes {
+		if !node.Alive {
+			down++
+		}
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(nodes)
+		return down
+	}
+
+	table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(table, "GROUP\tLOCATION\tSTATUS\tOBJECTS\tDISK USED\tSTORAGE\tVERSION")
+	for _, node := range nodes {
+		state := "up"
+		if !node.Alive {
+			state = "down: " + node.Error
+		}
+
+		objects := "-"
+		if node.Objects >= 0 {
+			objects = fmt.Sprintf("%d", node.Objects)
+		}
+
+		disk := "-"
+		if node.DiskTotal > 0 {
+			disk = fmt.Sprintf("%.1f%%", float64(node.DiskTotal-node.DiskFree)*100/float64(node.DiskTotal))
+		}
+
+		storage, version := cmp.Or(node.Storage, "-"), cmp.Or(node.Version, "-")
+
+		_, _ = fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", node.Group, node.Location, state, objects, disk, storage, version)
+	}
+	_ = table.Flush()
+
+	return down
+}
+
+// status is our entry-point to the sub-command, returning the number
+// of blob-servers which were unreachable.
+func status(options statusCmd, out io.Writer) int {
+	libconfig.Configure(options.blob)
+	if options.configDir != "" {
+		if err := loadConfigDir(options.configDir); err != nil {
+			GetLogger().Error("Failed to read -config-dir", "error", err)
+		}
+	}
+
+	return showStatus(clusterHealth(), options.json, out)
+}
@@ -0,0 +1,60 @@
+// Testing of the status sub-command.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// Test that we report upon live, and dead, blob-servers.
+func TestStatus(t *testing.T) {
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+	storageHandler.Store("steve", []byte("Content"), nil)
+	setBlobOptions(blobServerCmd{storage: "filesystem"})
+	defer setBlobOptions(blobServerCmd{})
+
+	up := httptest.NewServer(newBlobRouter(""))
+	defer up.Close()
+
+	down := httptest.NewServer(newBlobRouter(""))
+	down.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+
+	var out bytes.Buffer
+	failed := status(statusCmd{blob: up.URL + "," + down.URL, json: true}, &out)
+	if failed != 1 {
+		t.Errorf("Unexpected failure count: %d", failed)
+	}
+
+	var nodes []nodeStatus
+	if err := json.Unmarshal(out.Bytes(), &nodes); err != nil {
+		t.Fatalf("Output was not JSON: %v", err)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("Unexpected output: %v", out.String())
+	}
+	if !nodes[0].Alive || nodes[0].Objects != 1 || nodes[0].Storage != "filesystem" || nodes[0].Version != version {
+		t.Errorf("Unexpected status of live server: %v", nodes[0])
+	}
+	if nodes[1].Alive || nodes[1].Error == "" {
+		t.Errorf("Unexpected status of dead server: %v", nodes[1])
+	}
+
+	//
+	// The table shows the same.
+	//
+	out.Reset()
+	showStatus(nodes, false, &out)
+	if !strings.Contains(out.String(), "up") || !strings.Contains(out.String(), "down: ") {
+		t.Errorf("Unexpected table: %v", out.String())
+	}
+}
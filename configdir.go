@@ -0,0 +1,35 @@
+//
+// Blob-servers from a directory of configuration files.
+//
+// Deployments which use configuration management may drop a file per
+// group of blob-servers into a directory, rather than maintaining a
+// single `/etc/sos.conf`.  Given `-config-dir /etc/sos/conf.d` each of
+// the `*.conf` files within it is read, in order of name, and its
+// servers merged with those configured otherwise.  A file which lists
+// servers places them in the group named after it, so `1.conf` fills
+// group `1`, while an INI-file may name its own groups.
+//
+
+package main
+
+import (
+	"github.com/skx/sos/libconfig"
+)
+
+// loadConfigDir adds the blob-servers of each file within the given
+// directory, logging which servers each contributed.
+func loadConfigDir(dir string) error {
+	sources, err := libconfig.ServersLoadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, source := range sources {
+		locations := make([]string, 0, len(source.Servers))
+		for _, server := range source.Servers {
+			locations = append(locations, server.Group+"="+server.Location)
+		}
+		GetLogger().Info("Read blob-servers from configuration file", "file", source.File, "servers", locations)
+	}
+	return nil
+}
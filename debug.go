@@ -0,0 +1,57 @@
+//
+// Profiling support.
+//
+// If the global `-debug-addr` flag is given we launch a separate
+// HTTP-server which exposes the pprof profiles, expvar variables, and
+// request metrics, of the running process.  This is never enabled by
+// default since it exposes the internals of the process to anybody who
+// can reach it.
+//
+
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+)
+
+// newDebugMux creates the handler for our debug-server.
+//
+// We register the handlers explicitly, rather than relying upon
+// http.DefaultServeMux, so they are never served by our other servers.
+func newDebugMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/metrics", MetricsHandler)
+	return mux
+}
+
+// startDebugServer launches the debug-server, in the background, upon
+// the given address.
+func startDebugServer(addr string) {
+	GetLogger().Warn("debug-server enabled, exposing pprof, expvar & metrics",
+		"addr", addr)
+
+	expvar.Publish("upstream_latency", expvar.Func(func() any {
+		return latencySnapshot()
+	}))
+
+	server := &http.Server{
+		Addr:        addr,
+		Handler:     newDebugMux(),
+		ReadTimeout: serverReadTimeout,
+		IdleTimeout: serverIdleTimeout,
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			GetLogger().Error("debug-server failed", "addr", addr, "error", err)
+		}
+	}()
+}
@@ -0,0 +1,95 @@
+//
+// Latency of the blob-servers.
+//
+// For capacity planning it is useful to know which blob-servers are
+// slow, so we time each request made to them.  With `-verbose` each
+// request is logged along with its duration, and the replicator logs
+// a per-server summary at the end of each pass.
+//
+// The summary is also available via expvar, as `upstream_latency`, if
+// the global `-debug-addr` flag is given.
+//
+
+package main
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// serverLatency summarises the response-times of a single blob-server.
+type serverLatency struct {
+	Requests int           `json:"requests"`
+	Min      time.Duration `json:"min"`
+	Max      time.Duration `json:"max"`
+	Total    time.Duration `json:"total"`
+}
+
+// Average returns the mean response-time.
+func (s serverLatency) Average() time.Duration {
+	if s.Requests == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Requests)
+}
+
+// latencies holds the summary of each blob-server, keyed by location.
+var latencies = struct {
+	sync.Mutex
+	servers map[string]serverLatency
+}{servers: make(map[string]serverLatency)}
+
+// recordLatency notes the time taken by a request to the given server,
+// logging it if we're being verbose.
+func recordLatency(server string, method string, start time.Time, verbose bool) {
+	elapsed := time.Since(start)
+
+	if verbose {
+		GetLogger().Info("Blob-server request", "server", server, "method", method, "duration", elapsed)
+	}
+
+	latencies.Lock()
+	defer latencies.Unlock()
+
+	summary := latencies.servers[server]
+	if summary.Requests == 0 || elapsed < summary.Min {
+		summary.Min = elapsed
+	}
+	summary.Max = max(summary.Max, elapsed)
+	summary.Total += elapsed
+	summary.Requests++
+	latencies.servers[server] = summary
+}
+
+// latencySnapshot returns a copy of the summary of each blob-server.
+func latencySnapshot() map[string]serverLatency {
+	latencies.Lock()
+	defer latencies.Unlock()
+
+	return maps.Clone(latencies.servers)
+}
+
+// resetLatency discards the summary of each blob-server.
+func resetLatency() {
+	latencies.Lock()
+	defer latencies.Unlock()
+
+	clear(latencies.servers)
+}
+
+// logLatency logs the summary of each blob-server.
+func logLatency() {
+	snapshot := latencySnapshot()
+
+	for _, server := range slices.Sorted(maps.Keys(snapshot)) {
+		summary := snapshot[server]
+		GetLogger().Info("Blob-server latency",
+			"server", server,
+			"requests", summary.Requests,
+			"min", summary.Min,
+			"avg", summary.Average(),
+			"max", summary.Max)
+	}
+}
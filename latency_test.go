@@ -0,0 +1,36 @@
+// Testing of our blob-server latency summaries.
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Test that request-times are summarised per server.
+func TestRecordLatency(t *testing.T) {
+	resetLatency()
+	defer resetLatency()
+
+	now := time.Now()
+	recordLatency("http://a", "GET", now.Add(-10*time.Millisecond), false)
+	recordLatency("http://a", "GET", now.Add(-30*time.Millisecond), false)
+	recordLatency("http://b", "POST", now.Add(-5*time.Millisecond), true)
+
+	snapshot := latencySnapshot()
+	if len(snapshot) != 2 {
+		t.Fatalf("Unexpected servers: %v", snapshot)
+	}
+
+	a := snapshot["http://a"]
+	if a.Requests != 2 || a.Min < 10*time.Millisecond || a.Max < 30*time.Millisecond || a.Min > a.Max {
+		t.Errorf("Unexpected summary: %+v", a)
+	}
+	if avg := a.Average(); avg < a.Min || avg > a.Max {
+		t.Errorf("Unexpected average: %v", avg)
+	}
+
+	resetLatency()
+	if len(latencySnapshot()) != 0 {
+		t.Errorf("Reset did not discard the summaries")
+	}
+}
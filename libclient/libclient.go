@@ -0,0 +1,95 @@
+//
+// A simple client for the simple-object-storage service.
+//
+// This allows objects to be uploaded to, and fetched from, an
+// API-server, or fetched directly from a blob-server.
+//
+
+package libclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxErrorLength is the longest error-body we include in our errors.
+const maxErrorLength = 256
+
+// Client is the HTTP-client we use for all requests.
+var Client = &http.Client{Timeout: 5 * time.Minute}
+
+// uploadResponse is the body returned by a successful upload.
+type uploadResponse struct {
+	ID   string `json:"id"`
+	Size int    `json:"size"`
+}
+
+// Upload sends the given content to the API-server at the given URL,
+// along with any headers, and returns the ID of the stored object.
+func Upload(server string, body io.Reader, header http.Header) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(server, "/")+"/upload", body)
+	if err != nil {
+		return "", err
+	}
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	response, err := Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if err = checkStatus(response); err != nil {
+		return "", err
+	}
+
+	var out uploadResponse
+	if err = json.NewDecoder(response.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("invalid upload response: %w", err)
+	}
+	if out.ID == "" {
+		return "", errors.New("upload response did not contain an ID")
+	}
+	return out.ID, nil
+}
+
+// Download fetches the object with the given ID from the API-server at
+// the given URL.  The caller must close the returned body.
+func Download(server string, id string) (io.ReadCloser, error) {
+	return Fetch(strings.TrimSuffix(server, "/") + "/fetch/" + id)
+}
+
+// Fetch retrieves the given URL, returning the body of a successful
+// response.  The caller must close the returned body.
+func Fetch(url string) (io.ReadCloser, error) {
+	response, err := Client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkStatus(response); err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+// checkStatus returns an error, including the start of the body, if the
+// response was not successful.
+func checkStatus(response *http.Response) error {
+	if response.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(response.Body, maxErrorLength))
+	return fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,61 @@
+package libclient
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test that uploads send our content, and return the ID.
+func TestUpload(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if req.URL.Path != "/upload" || string(body) != "content" || req.Header.Get("X-Mime-Type") != "text/plain" {
+			http.Error(res, "bad request", http.StatusBadRequest)
+			return
+		}
+		_, _ = res.Write([]byte(`{"id":"abc123","status":"OK","size":7}`))
+	}))
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set("X-Mime-Type", "text/plain")
+
+	id, err := Upload(server.URL+"/", strings.NewReader("content"), header)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if id != "abc123" {
+		t.Errorf("Unexpected ID: %v", id)
+	}
+}
+
+// Test that downloads return the content, or a useful error.
+func TestDownload(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/fetch/abc123" {
+			http.Error(res, "not found", http.StatusNotFound)
+			return
+		}
+		_, _ = res.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	body, err := Download(server.URL, "abc123")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer body.Close()
+
+	content, _ := io.ReadAll(body)
+	if string(content) != "content" {
+		t.Errorf("Unexpected content: %v", string(content))
+	}
+
+	_, err = Download(server.URL, "missing")
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected an error, got %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+//
+// A simple circuit-breaker for our blob-servers.
+//
+// If a blob-server is down every upload & download would still try it,
+// and wait for the connection to time out, before moving on to the next
+// server.  To avoid that the API-server records the outcome of each
+// request it makes, and once a server has failed sufficiently many times
+// in a row it is removed from OrderedServers() for a cooldown period.
+//
+// Once the cooldown has passed the server's `/alive` end-point is probed,
+// and if that succeeds the server is re-admitted.
+//
+
+package libconfig
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// breaker records the health of a single blob-server.
+type breaker struct {
+	// failures is the number of consecutive failures we've seen.
+	failures int
+
+	// tripped is the time at which the breaker was last opened,
+	// or the zero-time if the server is considered healthy.
+	tripped time.Time
+}
+
+var (
+	// breakers holds the state of each server, by location.
+	breakers = make(map[string]*breaker)
+
+	// breakerMutex guards access to breakers.
+	breakerMutex sync.Mutex
+
+	// breakerThreshold is the number of consecutive failures which
+	// trip the breaker.  Zero disables the breaker entirely.
+	breakerThreshold int
+
+	// breakerCooldown is how long a tripped server is avoided.
+	breakerCooldown time.Duration
+
+	// probe tests whether the server at the given location is alive.
+	probe = probeAlive
+
+	// probeClient makes the requests of probeAlive, if set.
+	probeClient atomic.Pointer[http.Client]
+)
+
+// SetProbeClient sets the HTTP-client with which tripped servers are
+// probed, so that it matches that used for every other request made to
+// them.  By default http.DefaultClient is used.
+func SetProbeClient(client *http.Client) {
+	probeClient.Store(client)
+}
+
+// SetBreaker configures the circuit-breaker.
+//
+// A server which fails threshold times in a row will be avoided for
+// the given cooldown.  A threshold of zero disables the breaker.
+func SetBreaker(threshold int, cooldown time.Duration) {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+
+	breakerThreshold = threshold
+	breakerCooldown = cooldown
+	breakers = make(map[string]*breaker)
+}
+
+// RecordSuccess records that a request to the given server succeeded.
+func RecordSuccess(location string) {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+
+	delete(breakers, location)
+}
+
+// RecordFailure records that a request to the given server failed.
+func RecordFailure(location string) {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+
+	if breakerThreshold <= 0 {
+		return
+	}
+
+	b, ok := breakers[location]
+	if !ok {
+		b = &breaker{}
+		breakers[location] = b
+	}
+
+	b.failures++
+	if b.failures >= breakerThreshold && b.tripped.IsZero() {
+		b.tripped = time.Now()
+	}
+}
+
+// Available returns true if the given server should be used.
+//
+// Servers whose breaker has tripped are unavailable until the cooldown
+// has passed, at which point they're probed before being re-admitted.
+func Available(location string) bool {
+	breakerMutex.Lock()
+	b, ok := breakers[location]
+	if !ok || b.tripped.IsZero() {
+		breakerMutex.Unlock()
+		return true
+	}
+	if time.Since(b.tripped) < breakerCooldown {
+		breakerMutex.Unlock()
+		return false
+	}
+
+	//
+	// Restart the cooldown before we probe, so that concurrent
+	// callers don't all probe the server at once.
+	//
+	b.tripped = time.Now()
+	breakerMutex.Unlock()
+
+	if !probe(location) {
+		return false
+	}
+
+	RecordSuccess(location)
+	return true
+}
+
+// probeAlive tests whether the blob-server at the given location responds
+// to its health-check.
+func probeAlive(location string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, Endpoint(location, "/alive"), nil)
+	if err != nil {
+		return false
+	}
+
+	client := probeClient.Load()
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	return response.StatusCode == http.StatusOK
+}
@@ -24,13 +24,22 @@
 //
 // See `SCALING.md` for the rationale behind this setup.
 //
+// Deployments managed by configuration management may instead drop a
+// file per group into a directory, such as `/etc/sos/conf.d`, which is
+// read via ServersLoadDir.
+//
 
 package libconfig
 
 import (
 	"bufio"
+	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/go-ini/ini"
 )
@@ -41,14 +50,23 @@ import (
 //
 //   - A location (host:port).
 //   - A group to which it belongs.
+//   - A weight, used to share uploads between servers.
 type BlobServer struct {
 	Location string
 	Group    string
+	Weight   int
 }
 
 // The list of servers we've identified.
 var servers []BlobServer
 
+// current holds the running weight of each server, by location, for our
+// weighted round-robin selection.
+var current = make(map[string]int)
+
+// currentMutex guards access to current.
+var currentMutex sync.Mutex
+
 // Servers returns the list of servers we've discovered.
 func Servers() []BlobServer {
 	return (servers)
@@ -168,24 +186,287 @@ func OrderedServers() []BlobServer {
 		}
 	}
 
-	// Return the magically reshuffled set of servers.
-	return (res)
+	// Return the magically reshuffled set of servers, skipping
+	// any which have been failing.
+	return available(res)
+}
+
+// available removes any servers which have been failing from the list,
+// unless that would leave us with nothing to try at all.
+func available(list []BlobServer) []BlobServer {
+	var healthy []BlobServer
+	for _, entry := range list {
+		if Available(entry.Location) {
+			healthy = append(healthy, entry)
+		}
+	}
+	if len(healthy) > 0 {
+		return healthy
+	}
+	return list
+}
+
+// Endpoint returns the URL of the given path upon the blob-server with
+// the specified location.
+//
+// A blob-server which is mounted beneath a path-prefix, for example
+// behind a reverse-proxy, is configured by including that prefix in its
+// location, e.g. `http://proxy.example.com/sos`.
+func Endpoint(location string, path string) string {
+	return strings.TrimSuffix(location, "/") + path
+}
+
+// DefaultBlobPath is the path beneath which blob-servers serve objects,
+// unless configured otherwise.
+const DefaultBlobPath = "/blob/{id}"
+
+// blobPath holds the path-template of objects upon the blob-servers.
+var blobPath = DefaultBlobPath
+
+// blobPathMutex guards access to blobPath.
+var blobPathMutex sync.RWMutex
+
+// SetBlobPath changes the path beneath which blob-servers serve objects,
+// for interoperability with an existing store.
+//
+// The path must contain `{id}`, which is replaced by the ID of each
+// object, and may contain `{shard}`, which is replaced by the first two
+// characters of the ID, e.g. `/objects/{shard}/{id}`.
+func SetBlobPath(path string) error {
+	if err := CheckBlobPath(path); err != nil {
+		return err
+	}
+
+	blobPathMutex.Lock()
+	defer blobPathMutex.Unlock()
+	blobPath = path
+	return nil
+}
+
+// CheckBlobPath tests that the given path is usable by SetBlobPath.
+func CheckBlobPath(path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("invalid blob path '%s', it must begin with /", path)
+	}
+
+	//
+	// Each placeholder must be a whole segment, so that the
+	// blob-server's router captures it.
+	//
+	found := make(map[string]int)
+	for _, segment := range strings.Split(path[1:], "/") {
+		switch {
+		case segment == "{id}" || segment == "{shard}":
+			found[segment]++
+		case segment == "" || strings.ContainsAny(segment, "{}?#%"):
+			return fmt.Errorf("invalid blob path '%s', only whole {id} and {shard} segments are supported", path)
+		}
+	}
+	if found["{id}"] != 1 || found["{shard}"] > 1 {
+		return fmt.Errorf("invalid blob path '%s', expected a single {id} segment", path)
+	}
+	return nil
+}
+
+// BlobPath returns the path-template of objects upon the blob-servers.
+func BlobPath() string {
+	blobPathMutex.RLock()
+	defer blobPathMutex.RUnlock()
+	return blobPath
+}
+
+// BlobURL returns the URL of the given object upon the blob-server with
+// the specified location.
+func BlobURL(location string, id string) string {
+	shard := id
+	if len(shard) > 2 {
+		shard = shard[:2]
+	}
+	return Endpoint(location, strings.NewReplacer("{id}", id, "{shard}", shard).Replace(BlobPath()))
+}
+
+// UploadServers returns the list of servers which will be used for an
+// upload, in the order they should be tried.
+//
+// If there are several groups defined this is the same as
+// OrderedServers().  If all servers are within a single group, however,
+// that would mean the first server received every upload until it
+// failed.  Instead we use a (smooth) weighted round-robin to pick the
+// server to try first, so that uploads are spread across the group in
+// proportion to the weight of each server.  The remaining servers
+// follow, in their usual order, as fall-backs.
+func UploadServers() []BlobServer {
+	ordered := OrderedServers()
+	if len(Groups()) != 1 {
+		return ordered
+	}
+
+	currentMutex.Lock()
+	defer currentMutex.Unlock()
+
+	//
+	// Increase the running weight of each server by its weight,
+	// and pick the server with the highest running weight.
+	//
+	total := 0
+	best := -1
+	for i, entry := range ordered {
+		current[entry.Location] += entry.Weight
+		total += entry.Weight
+
+		if best < 0 || current[entry.Location] > current[ordered[best].Location] {
+			best = i
+		}
+	}
+
+	//
+	// The chosen server is penalized by the total weight, so that
+	// the others will catch up with it.
+	//
+	current[ordered[best].Location] -= total
+
+	res := []BlobServer{ordered[best]}
+	res = append(res, ordered[:best]...)
+	res = append(res, ordered[best+1:]...)
+	return res
+}
+
+// EnvServers is the environment variable from which our list of servers
+// may be read, in the same format as the `-blob-server` flag.
+const EnvServers = "SOS_BLOB_SERVERS"
+
+// Configure initializes our list of servers, from the first of these
+// which is available:
+//
+//   - The given value of a `-blob-server` flag.
+//   - The SOS_BLOB_SERVERS environment variable.
+//   - Our configuration files.
+func Configure(flag string) {
+	if flag != "" {
+		AddServers(flag)
+		return
+	}
+	InitServers()
 }
 
-// InitServers initializes our list of servers.
+// InitServers initializes our list of servers, from the environment
+// if SOS_BLOB_SERVERS is set, otherwise from our config file(s).
 func InitServers() {
+	if value := os.Getenv(EnvServers); value != "" {
+		AddServers(value)
+		return
+	}
+
 	ServersLoad("/etc/sos.conf")
 	ServersLoad(os.ExpandEnv("$HOME/.sos.conf"))
 }
 
+// AddServers adds each server from the given comma-separated list.
+//
+// Each entry may be prefixed with a group, otherwise it is placed in
+// the "default" group, for example:
+//
+//	http://node1:3001,1=http://node2:3001,2=http://node3:3001
+func AddServers(list string) {
+	for entry := range strings.SplitSeq(list, ",") {
+		group := "default"
+		if name, location, ok := strings.Cut(entry, "="); ok && !strings.Contains(name, "/") {
+			group, entry = strings.TrimSpace(name), location
+		}
+		addEntry(group, entry)
+	}
+}
+
 // AddServer adds an entry to our server-list.
 func AddServer(group string, entry string) {
-	tmp := BlobServer{Location: entry, Group: group}
+	AddServerWithWeight(group, entry, 1)
+}
+
+// AddServerWithWeight adds an entry to our server-list, with the given
+// weight.
+//
+// A server with weight 2 will receive twice as many uploads as a server
+// with weight 1, when they're in the same group.
+func AddServerWithWeight(group string, entry string, weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	tmp := BlobServer{Location: entry, Group: group, Weight: weight}
 	servers = append(servers, tmp)
+	invalidateRing()
+}
+
+// addEntry adds an entry read from a configuration file to our
+// server-list.
+//
+// Entries may optionally be followed by a weight, for example:
+//
+//	http://node1.example.com:1234 3
+func addEntry(group string, entry string) {
+	fields := strings.Fields(entry)
+	if len(fields) == 0 {
+		return
+	}
+
+	weight := 1
+	if len(fields) > 1 {
+		if w, err := strconv.Atoi(fields[1]); err == nil {
+			weight = w
+		}
+	}
+	AddServerWithWeight(group, fields[0], weight)
+}
+
+// ResetServers forgets every server we've previously been told about.
+func ResetServers() {
+	servers = nil
+	invalidateRing()
+
+	currentMutex.Lock()
+	defer currentMutex.Unlock()
+	current = make(map[string]int)
 }
 
 // ServersLoad reads/parses the list of servers from the specified file.
 func ServersLoad(file string) {
+	serversLoad(file, "default")
+}
+
+// ConfigSource records the servers read from a single configuration file.
+type ConfigSource struct {
+	File    string
+	Servers []BlobServer
+}
+
+// ServersLoadDir reads/parses the list of servers from each `*.conf` file
+// within the given directory, in order of their names, returning the
+// servers each contributed.
+//
+// A file which merely lists servers contributes them to the group named
+// after the file, e.g. `1.conf` to the group `1`, while an INI-file
+// contributes to the groups named by its sections.
+func ServersLoadDir(dir string) ([]ConfigSource, error) {
+	if _, err := os.ReadDir(dir); err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.conf"))
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []ConfigSource
+	for _, file := range files {
+		before := len(servers)
+		serversLoad(file, strings.TrimSuffix(filepath.Base(file), ".conf"))
+		sources = append(sources, ConfigSource{File: file, Servers: slices.Clone(servers[before:])})
+	}
+	return sources, nil
+}
+
+// serversLoad reads/parses the list of servers from the specified file,
+// placing those which aren't within an INI-section into the given group.
+func serversLoad(file string, group string) {
 	inFile, err := os.Open(file)
 	if err != nil {
 		return
@@ -258,7 +539,7 @@ func ServersLoad(file string) {
 					//
 					// For each entry add to the server-list.
 					//
-					AddServer(name.Name(), val.String())
+					addEntry(name.Name(), val.String())
 				}
 			}
 		}
@@ -267,11 +548,10 @@ func ServersLoad(file string) {
 
 	//
 	// This was not an INI-file, so we just create a new
-	// entry for each line we read natively.
-	//
-	// We'll call the (anonymous) group "default".
+	// entry for each line we read natively, within the given
+	// group.
 	for _, s := range tmp {
-		AddServer("default", s)
+		addEntry(group, s)
 	}
 }
 
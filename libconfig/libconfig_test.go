@@ -0,0 +1,238 @@
+package libconfig
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Test that uploads are shared within a group according to weight.
+func TestUploadServersWeighted(t *testing.T) {
+	ResetServers()
+	defer ResetServers()
+
+	AddServerWithWeight("default", "http://a", 1)
+	AddServerWithWeight("default", "http://b", 2)
+
+	//
+	// Over three uploads "a" should be tried first once, and
+	// "b" twice.
+	//
+	counts := make(map[string]int)
+	for range 3 {
+		list := UploadServers()
+		if len(list) != 2 {
+			t.Fatalf("Unexpected server count: %v", list)
+		}
+		counts[list[0].Location]++
+	}
+
+	if counts["http://a"] != 1 || counts["http://b"] != 2 {
+		t.Errorf("Unexpected distribution: %v", counts)
+	}
+}
+
+// Test that weights may be given in a configuration file.
+func TestServersLoadWeights(t *testing.T) {
+	ResetServers()
+	defer ResetServers()
+
+	path := filepath.Join(t.TempDir(), "sos.conf")
+	content := []byte("# Comment\nhttp://a:1234 3\nhttp://b:1234\n")
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ServersLoad(path)
+
+	list := Servers()
+	if len(list) != 2 {
+		t.Fatalf("Unexpected servers: %v", list)
+	}
+	if list[0].Location != "http://a:1234" || list[0].Weight != 3 {
+		t.Errorf("Unexpected first server: %v", list[0])
+	}
+	if list[1].Location != "http://b:1234" || list[1].Weight != 1 {
+		t.Errorf("Unexpected second server: %v", list[1])
+	}
+}
+
+// Test that failing servers are skipped, and later re-admitted.
+func TestBreaker(t *testing.T) {
+	ResetServers()
+	defer ResetServers()
+
+	AddServer("default", "http://a")
+	AddServer("default", "http://b")
+
+	SetBreaker(2, time.Millisecond*20)
+	defer SetBreaker(0, 0)
+
+	alive := false
+	probe = func(_ string) bool { return alive }
+	defer func() { probe = probeAlive }()
+
+	//
+	// A single failure isn't enough to trip the breaker.
+	//
+	RecordFailure("http://a")
+	if len(OrderedServers()) != 2 {
+		t.Fatalf("Server was removed too soon")
+	}
+
+	//
+	// But a second one is.
+	//
+	RecordFailure("http://a")
+	list := OrderedServers()
+	if len(list) != 1 || list[0].Location != "http://b" {
+		t.Fatalf("Failing server was not removed: %v", list)
+	}
+
+	//
+	// After the cooldown a failing probe keeps it out.
+	//
+	time.Sleep(time.Millisecond * 30)
+	if len(OrderedServers()) != 1 {
+		t.Fatalf("Server was re-admitted despite failing its probe")
+	}
+
+	//
+	// While a successful probe re-admits it.
+	//
+	alive = true
+	time.Sleep(time.Millisecond * 30)
+	if len(OrderedServers()) != 2 {
+		t.Fatalf("Server was not re-admitted")
+	}
+}
+
+// Test that the breaker's probes are made with the client we're given.
+func TestProbeClient(t *testing.T) {
+	alive := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}))
+	defer alive.Close()
+
+	server := httptest.NewServer(http.RedirectHandler(alive.URL+"/alive", http.StatusFound))
+	defer server.Close()
+
+	if !probeAlive(server.URL) {
+		t.Errorf("Expected the default client to follow the redirect")
+	}
+
+	SetProbeClient(&http.Client{CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+		return http.ErrUseLastResponse
+	}})
+	defer SetProbeClient(nil)
+	if probeAlive(server.URL) {
+		t.Errorf("Expected our client to refuse the redirect")
+	}
+}
+
+// Test that servers are read from the flag, then the environment.
+func TestConfigurePrecedence(t *testing.T) {
+	ResetServers()
+	defer ResetServers()
+
+	t.Setenv(EnvServers, "http://env1,2=http://env2 3")
+
+	//
+	// The environment is used in the absence of a flag.
+	//
+	Configure("")
+	expected := []BlobServer{
+		{Location: "http://env1", Group: "default", Weight: 1},
+		{Location: "http://env2", Group: "2", Weight: 3},
+	}
+	if !reflect.DeepEqual(Servers(), expected) {
+		t.Errorf("Unexpected servers: got %v want %v", Servers(), expected)
+	}
+
+	//
+	// The flag overrides the environment.
+	//
+	ResetServers()
+	Configure("http://flag")
+	expected = []BlobServer{{Location: "http://flag", Group: "default", Weight: 1}}
+	if !reflect.DeepEqual(Servers(), expected) {
+		t.Errorf("Unexpected servers: got %v want %v", Servers(), expected)
+	}
+}
+
+// Test that the path of objects may be changed, and is validated.
+func TestBlobPath(t *testing.T) {
+	defer func() { _ = SetBlobPath(DefaultBlobPath) }()
+
+	if url := BlobURL("http://a/", "abcdef"); url != "http://a/blob/abcdef" {
+		t.Errorf("Unexpected default URL: %s", url)
+	}
+
+	for _, path := range []string{"", "blob/{id}", "/blob", "/blob/x{id}", "/{id}/{id}", "/{shard}/{shard}/{id}", "/a//{id}", "/{name}/{id}", "/blob/{id}?x=1"} {
+		if err := SetBlobPath(path); err == nil {
+			t.Errorf("Expected an error setting '%s'", path)
+		}
+	}
+	if BlobPath() != DefaultBlobPath {
+		t.Errorf("An invalid path was stored: %s", BlobPath())
+	}
+
+	tests := map[string]string{
+		"/objects/{id}":         "http://a/objects/abcdef",
+		"/objects/{shard}/{id}": "http://a/objects/ab/abcdef",
+		"/{id}":                 "http://a/abcdef",
+	}
+	for path, expected := range tests {
+		if err := SetBlobPath(path); err != nil {
+			t.Fatalf("Unexpected error setting '%s': %s", path, err)
+		}
+		if url := BlobURL("http://a", "abcdef"); url != expected {
+			t.Errorf("Unexpected URL for '%s': got %s want %s", path, url, expected)
+		}
+	}
+}
+
+// Test that each file of a configuration directory contributes its
+// servers, to the group named after it unless it is an INI-file.
+func TestServersLoadDir(t *testing.T) {
+	ResetServers()
+	defer ResetServers()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"1.conf":       "http://a:1234\nhttp://b:1234 2\n",
+		"2.conf":       "http://c:1234\n",
+		"groups.conf":  "[3]\nserver = http://d:1234\n",
+		"ignored.txt":  "http://e:1234\n",
+		"disabled.bak": "http://f:1234\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sources, err := ServersLoadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to load directory: %v", err)
+	}
+	if len(sources) != 3 || filepath.Base(sources[0].File) != "1.conf" || len(sources[0].Servers) != 2 {
+		t.Fatalf("Unexpected sources: %v", sources)
+	}
+
+	expected := []BlobServer{
+		{Location: "http://a:1234", Group: "1", Weight: 1},
+		{Location: "http://b:1234", Group: "1", Weight: 2},
+		{Location: "http://c:1234", Group: "2", Weight: 1},
+		{Location: "http://d:1234", Group: "3", Weight: 1},
+	}
+	if list := Servers(); !reflect.DeepEqual(list, expected) {
+		t.Errorf("Unexpected servers: %v", list)
+	}
+
+	if _, err = ServersLoadDir(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("Expected a missing directory to fail")
+	}
+}
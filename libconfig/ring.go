@@ -0,0 +1,158 @@
+//
+// Consistent-hashing server selection.
+//
+// By default servers are tried in the order described by OrderedServers,
+// which is the same for every object.  Alternatively the servers may be
+// placed upon a hash-ring, in which case the order depends upon the ID
+// of the object, and adding or removing a server only moves the objects
+// which hashed to it.
+//
+
+package libconfig
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sync"
+)
+
+// virtualNodes is the number of points each unit of weight gives a
+// server upon the ring.  More points give a more even distribution.
+const virtualNodes = 100
+
+// Selection modes we support.
+const (
+	SelectGroups = "groups"
+	SelectRing   = "ring"
+)
+
+// ringPoint is a single (virtual) node upon the ring.
+type ringPoint struct {
+	hash   uint64
+	server int
+}
+
+// selection holds the current selection mode.
+var selection = SelectGroups
+
+// ring holds the points of our ring, sorted by hash, it is rebuilt
+// whenever our list of servers changes.
+var ring []ringPoint
+
+// ringMutex guards access to selection & ring.
+var ringMutex sync.Mutex
+
+// SetSelection chooses how servers are ordered, either "groups", the
+// default, or "ring" for consistent-hashing.
+func SetSelection(mode string) error {
+	if mode != SelectGroups && mode != SelectRing {
+		return fmt.Errorf("unknown server selection '%s'", mode)
+	}
+
+	ringMutex.Lock()
+	defer ringMutex.Unlock()
+	selection = mode
+	return nil
+}
+
+// invalidateRing discards our ring, so that it will be rebuilt when it
+// is next required.
+func invalidateRing() {
+	ringMutex.Lock()
+	defer ringMutex.Unlock()
+	ring = nil
+}
+
+// hashKey returns the position of the given key upon the ring.
+func hashKey(key string) uint64 {
+	hasher := fnv.New64a()
+	_, _ = hasher.Write([]byte(key))
+
+	//
+	// FNV alone clusters similar keys, so mix the bits.
+	//
+	sum := hasher.Sum64()
+	sum ^= sum >> 33
+	sum *= 0xff51afd7ed558ccd
+	sum ^= sum >> 33
+	return sum
+}
+
+// buildRing places each server upon the ring, with a number of points
+// proportional to its weight.
+func buildRing() []ringPoint {
+	var points []ringPoint
+	for i, entry := range servers {
+		for v := range entry.Weight * virtualNodes {
+			points = append(points, ringPoint{hash: hashKey(fmt.Sprintf("%s#%d", entry.Location, v)), server: i})
+		}
+	}
+
+	slices.SortFunc(points, func(a, b ringPoint) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+	return points
+}
+
+// ringServers returns every server, in the order they are found when
+// walking the ring clockwise from the position of the given ID.
+func ringServers(id string) []BlobServer {
+	ringMutex.Lock()
+	if ring == nil {
+		ring = buildRing()
+	}
+	points := ring
+	ringMutex.Unlock()
+
+	if len(points) == 0 {
+		return nil
+	}
+
+	hash := hashKey(id)
+	start, _ := slices.BinarySearchFunc(points, hash, func(p ringPoint, h uint64) int {
+		return cmp.Compare(p.hash, h)
+	})
+
+	var res []BlobServer
+	seen := make(map[int]bool)
+	for i := range points {
+		point := points[(start+i)%len(points)]
+		if !seen[point.server] {
+			seen[point.server] = true
+			res = append(res, servers[point.server])
+		}
+	}
+	return res
+}
+
+// ServersFor returns the servers to try, in order, when fetching the
+// object with the given ID.
+//
+// With the default selection this is the same as OrderedServers().
+func ServersFor(id string) []BlobServer {
+	ringMutex.Lock()
+	mode := selection
+	ringMutex.Unlock()
+
+	if mode != SelectRing {
+		return OrderedServers()
+	}
+	return available(ringServers(id))
+}
+
+// UploadServersFor returns the servers to try, in order, when uploading
+// the object with the given ID.
+//
+// With the default selection this is the same as UploadServers().
+func UploadServersFor(id string) []BlobServer {
+	ringMutex.Lock()
+	mode := selection
+	ringMutex.Unlock()
+
+	if mode != SelectRing {
+		return UploadServers()
+	}
+	return available(ringServers(id))
+}
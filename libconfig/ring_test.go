@@ -0,0 +1,86 @@
+package libconfig
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Test that the ring orders servers by object, and that adding a server
+// only moves a share of the objects.
+func TestRing(t *testing.T) {
+	ResetServers()
+	defer ResetServers()
+
+	if err := SetSelection("bogus"); err == nil {
+		t.Errorf("Expected an error selecting a bogus mode")
+	}
+	if err := SetSelection(SelectRing); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer func() { _ = SetSelection(SelectGroups) }()
+
+	for _, location := range []string{"http://a", "http://b", "http://c", "http://d"} {
+		AddServer("default", location)
+	}
+
+	//
+	// Record the first server of each object.
+	//
+	count := 10000
+	before := make(map[string]string)
+	for i := range count {
+		id := fmt.Sprintf("object-%d", i)
+
+		list := ServersFor(id)
+		if len(list) != 4 {
+			t.Fatalf("Unexpected servers: %v", list)
+		}
+		if UploadServersFor(id)[0] != list[0] {
+			t.Fatalf("Uploads and downloads disagree for %s", id)
+		}
+		before[id] = list[0].Location
+	}
+
+	//
+	// Adding a fifth server should move roughly a fifth of the
+	// objects, and only to the new server.
+	//
+	AddServer("default", "http://e")
+
+	moved := 0
+	for id, location := range before {
+		now := ServersFor(id)[0].Location
+		if now != location {
+			moved++
+			if now != "http://e" {
+				t.Errorf("Object %s moved from %s to %s", id, location, now)
+			}
+		}
+	}
+	if moved < count/10 || moved > count*3/10 {
+		t.Errorf("Unexpected number of objects moved: %d of %d", moved, count)
+	}
+}
+
+// Test that a heavier server owns more of the ring.
+func TestRingWeighted(t *testing.T) {
+	ResetServers()
+	defer ResetServers()
+
+	if err := SetSelection(SelectRing); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer func() { _ = SetSelection(SelectGroups) }()
+
+	AddServerWithWeight("default", "http://a", 1)
+	AddServerWithWeight("default", "http://b", 3)
+
+	counts := make(map[string]int)
+	for i := range 10000 {
+		counts[ServersFor(fmt.Sprintf("object-%d", i))[0].Location]++
+	}
+
+	if counts["http://b"] < counts["http://a"]*2 {
+		t.Errorf("Weight was not respected: %v", counts)
+	}
+}
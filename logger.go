@@ -6,6 +6,7 @@ package main
 
 import (
 	"log/slog"
+	"os"
 )
 
 // logger is the centralized logger instance for the application.
@@ -16,6 +17,24 @@ func initLogger() {
 	logger = slog.Default()
 }
 
+// GetLogger returns the logger, initializing it if necessary.
 func GetLogger() *slog.Logger {
+	if logger == nil {
+		initLogger()
+	}
 	return logger
 }
+
+// setLoggerNode attaches the given node-name to every subsequent log
+// line, so that the logs of several servers may be told apart once
+// they're aggregated.
+func setLoggerNode(name string) {
+	logger = GetLogger().With("node", name)
+}
+
+// hostname returns the name of this host, which is the default name of
+// our nodes, or an empty string if it is unknown.
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
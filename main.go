@@ -21,10 +21,30 @@ func main() {
 
 	subcommands.Register(&apiServerCmd{}, "")
 	subcommands.Register(&blobServerCmd{}, "")
+	subcommands.Register(&catCmd{}, "")
+	subcommands.Register(&putCmd{}, "")
 	subcommands.Register(&replicateCmd{}, "")
+	subcommands.Register(&scrubCmd{}, "")
+	subcommands.Register(&smokeTestCmd{}, "")
+	subcommands.Register(&statusCmd{}, "")
 	subcommands.Register(&versionCmd{}, "")
 
-	flag.Parse()
+	debugAddr := flag.String("debug-addr", "", "Serve pprof & expvar on this address, e.g. 127.0.0.1:6060 (exposes internals).")
+	subcommands.ImportantFlag("debug-addr")
+
+	args, printFlags := takeHiddenFlag(flag.CommandLine, os.Args[1:], "print-flags-json")
+	_ = flag.CommandLine.Parse(args)
+	if printFlags {
+		if err := printFlagsJSON(os.Stdout, subcommands.DefaultCommander, flag.Arg(0)); err != nil {
+			GetLogger().Error("Failed to describe flags", "error", err)
+			os.Exit(int(subcommands.ExitUsageError))
+		}
+		os.Exit(int(subcommands.ExitSuccess))
+	}
+	if *debugAddr != "" {
+		startDebugServer(*debugAddr)
+	}
+
 	ctx := context.Background()
 	os.Exit(int(subcommands.Execute(ctx)))
 }
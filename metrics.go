@@ -0,0 +1,240 @@
+//
+// Request metrics.
+//
+// Counters tell us how busy we are, but not where the time goes, so both
+// servers record histograms of the duration of their requests, and the
+// number of bytes received and sent by each, labeled by the endpoint and
+// the class of the status-code.
+//
+// The histograms are served in the Prometheus text format, as `/metrics`,
+// upon the debug-server launched by the global `-debug-addr` flag.
+//
+
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the buckets of our
+// request-duration histograms.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// sizeBuckets are the upper bounds, in bytes, of the buckets of our
+// request-size histograms.
+var sizeBuckets = []float64{1 << 10, 1 << 12, 1 << 14, 1 << 16, 1 << 18, 1 << 20, 1 << 22, 1 << 24, 1 << 26, 1 << 28, 1 << 30}
+
+// histogram counts observations in buckets, without locking.
+type histogram struct {
+	bounds []float64
+	counts []atomic.Int64
+	count  atomic.Int64
+
+	// sum is the total of the observations, as float64 bits.
+	sum atomic.Uint64
+}
+
+// newHistogram creates a histogram with the given bucket bounds.
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Int64, len(bounds))}
+}
+
+// observe records a single value.
+func (h *histogram) observe(value float64) {
+	if i, _ := slices.BinarySearch(h.bounds, value); i < len(h.bounds) {
+		h.counts[i].Add(1)
+	}
+	h.count.Add(1)
+
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+value)) {
+			return
+		}
+	}
+}
+
+// metricLabels identify the requests a set of histograms describes.
+type metricLabels struct {
+	service  string
+	endpoint string
+	status   string
+}
+
+// requestMetrics holds the histograms of a single set of labels.
+type requestMetrics struct {
+	duration *histogram
+	received *histogram
+	sent     *histogram
+}
+
+// metrics maps metricLabels to their *requestMetrics.
+var metrics sync.Map
+
+// observeRequest records the duration of a request, and the number of
+// bytes it received and sent.
+func observeRequest(labels metricLabels, elapsed time.Duration, received int64, sent int64) {
+	value, ok := metrics.Load(labels)
+	if !ok {
+		value, _ = metrics.LoadOrStore(labels, &requestMetrics{
+			duration: newHistogram(durationBuckets),
+			received: newHistogram(sizeBuckets),
+			sent:     newHistogram(sizeBuckets),
+		})
+	}
+
+	entry := value.(*requestMetrics)
+	entry.duration.observe(elapsed.Seconds())
+	entry.received.observe(float64(received))
+	entry.sent.observe(float64(sent))
+}
+
+// resetMetrics discards every histogram.
+func resetMetrics() {
+	metrics.Clear()
+}
+
+// statusClass returns the class of the given status-code, e.g. "2xx".
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// instrument wraps the handler of the given route so that its requests
+// are recorded in our histograms.
+//
+// The endpoint is labeled with the method of the request, since several
+// of our routes serve more than one.
+func instrument(service string, route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		body := &countingReader{ReadCloser: req.Body}
+		if req.Body != nil {
+			req.Body = body
+		}
+		recorder := &metricsWriter{ResponseWriter: res}
+
+		next(recorder, req)
+
+		observeRequest(metricLabels{
+			service:  service,
+			endpoint: req.Method + " " + route,
+			status:   statusClass(cmp.Or(recorder.status, http.StatusOK)),
+		}, time.Since(start), body.count, recorder.count)
+	}
+}
+
+// countingReader counts the bytes read from a request-body.
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+// Read reads from the body, counting the bytes read.
+func (r *countingReader) Read(data []byte) (int, error) {
+	n, err := r.ReadCloser.Read(data)
+	r.count += int64(n)
+	return n, err
+}
+
+// metricsWriter records the status-code of a response, and counts the
+// bytes written to it.
+type metricsWriter struct {
+	http.ResponseWriter
+	status int
+	count  int64
+}
+
+// WriteHeader records the status-code, then sends it.
+func (w *metricsWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write counts the data, then writes it to the response.
+func (w *metricsWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.count += int64(n)
+	return n, err
+}
+
+// Unwrap returns the underlying response, so that deadlines may be set,
+// and flushes made, via a http.ResponseController.
+func (w *metricsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// MetricsHandler serves our histograms in the Prometheus text format.
+func MetricsHandler(res http.ResponseWriter, _ *http.Request) {
+	type entry struct {
+		labels metricLabels
+		value  *requestMetrics
+	}
+
+	var entries []entry
+	metrics.Range(func(key, value any) bool {
+		entries = append(entries, entry{key.(metricLabels), value.(*requestMetrics)})
+		return true
+	})
+	slices.SortFunc(entries, func(a, b entry) int {
+		return cmp.Or(cmp.Compare(a.labels.service, b.labels.service),
+			cmp.Compare(a.labels.endpoint, b.labels.endpoint),
+			cmp.Compare(a.labels.status, b.labels.status))
+	})
+
+	families := []struct {
+		name string
+		help string
+		get  func(*requestMetrics) *histogram
+	}{
+		{"sos_request_duration_seconds", "Duration of requests, in seconds.", func(m *requestMetrics) *histogram { return m.duration }},
+		{"sos_request_received_bytes", "Bytes received in request bodies.", func(m *requestMetrics) *histogram { return m.received }},
+		{"sos_request_sent_bytes", "Bytes sent in response bodies.", func(m *requestMetrics) *histogram { return m.sent }},
+	}
+
+	var out strings.Builder
+	for _, family := range families {
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s histogram\n", family.name, family.help, family.name)
+		for _, e := range entries {
+			writeHistogram(&out, family.name, e.labels, family.get(e.value))
+		}
+	}
+	writeMissingMetrics(&out)
+
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = io.WriteString(res, out.String())
+}
+
+// writeHistogram writes a single histogram in the Prometheus text format.
+func writeHistogram(out *strings.Builder, name string, labels metricLabels, h *histogram) {
+	prefix := fmt.Sprintf("service=%q,endpoint=%q,status=%q", labels.service, labels.endpoint, labels.status)
+
+	//
+	// Prometheus buckets are cumulative.
+	//
+	var total int64
+	for i, bound := range h.bounds {
+		total += h.counts[i].Load()
+		fmt.Fprintf(out, "%s_bucket{%s,le=%q} %d\n", name, prefix, strconv.FormatFloat(bound, 'g', -1, 64), total)
+	}
+
+	count := h.count.Load()
+	fmt.Fprintf(out, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, prefix, count)
+	fmt.Fprintf(out, "%s_sum{%s} %s\n", name, prefix, strconv.FormatFloat(math.Float64frombits(h.sum.Load()), 'g', -1, 64))
+	fmt.Fprintf(out, "%s_count{%s} %d\n", name, prefix, count)
+}
@@ -0,0 +1,64 @@
+// Testing of our request metrics.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test that instrumented requests are recorded, and served.
+func TestMetrics(t *testing.T) {
+	resetMetrics()
+	defer resetMetrics()
+
+	handler := instrument("blob-server", "/blob/{id}", func(res http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPost {
+			buf := make([]byte, 8)
+			for {
+				if _, err := req.Body.Read(buf); err != nil {
+					break
+				}
+			}
+			res.WriteHeader(http.StatusCreated)
+			return
+		}
+		if req.URL.Path == "/blob/missing" {
+			http.NotFound(res, req)
+			return
+		}
+		_, _ = res.Write([]byte(strings.Repeat("x", 2000)))
+	})
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/blob/abc", nil),
+		httptest.NewRequest(http.MethodGet, "/blob/abc", nil),
+		httptest.NewRequest(http.MethodGet, "/blob/missing", nil),
+		httptest.NewRequest(http.MethodPost, "/blob/abc", strings.NewReader("content")),
+	} {
+		handler(httptest.NewRecorder(), req)
+	}
+
+	rr := httptest.NewRecorder()
+	MetricsHandler(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Unexpected status-code: %v", rr.Code)
+	}
+
+	output := rr.Body.String()
+	for _, expected := range []string{
+		"# TYPE sos_request_duration_seconds histogram",
+		`sos_request_duration_seconds_count{service="blob-server",endpoint="GET /blob/{id}",status="2xx"} 2`,
+		`sos_request_duration_seconds_count{service="blob-server",endpoint="GET /blob/{id}",status="4xx"} 1`,
+		`sos_request_sent_bytes_bucket{service="blob-server",endpoint="GET /blob/{id}",status="2xx",le="1024"} 0`,
+		`sos_request_sent_bytes_bucket{service="blob-server",endpoint="GET /blob/{id}",status="2xx",le="4096"} 2`,
+		`sos_request_sent_bytes_sum{service="blob-server",endpoint="GET /blob/{id}",status="2xx"} 4000`,
+		`sos_request_received_bytes_sum{service="blob-server",endpoint="POST /blob/{id}",status="2xx"} 7`,
+		`sos_request_received_bytes_bucket{service="blob-server",endpoint="POST /blob/{id}",status="2xx",le="+Inf"} 1`,
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Missing '%s' in:\n%s", expected, output)
+		}
+	}
+}
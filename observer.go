@@ -0,0 +1,105 @@
+//
+// Observation hooks.
+//
+// Rather than tie ourselves to a particular metrics, or tracing, library
+// both servers report their uploads, downloads, and errors to an
+// Observer.  The default does nothing; to export them elsewhere, e.g. to
+// OpenTelemetry, implement the interface and pass it to RegisterObserver
+// before the servers are launched.
+//
+// The API-server reports each request it makes to a blob-server, naming
+// that server, and the blob-server reports each object it stores or
+// serves.
+//
+
+package main
+
+import (
+	"time"
+)
+
+// ObservedEvent describes a single upload, or download.
+type ObservedEvent struct {
+	// Service is the server reporting the event: "api-server" or
+	// "blob-server".
+	Service string
+
+	// Server is the location of the blob-server the API-server made
+	// its request to, and empty for events of the blob-server.
+	Server string
+
+	// ID is the ID of the object.
+	ID string
+
+	// Size is the number of bytes transferred.
+	Size int64
+
+	// Status is the HTTP status-code of the response, if any.
+	Status int
+
+	// Duration is the time taken.
+	Duration time.Duration
+}
+
+// Observer receives the events of our servers.
+//
+// The methods are called synchronously, from the goroutine handling the
+// request, so they should return promptly.
+type Observer interface {
+	// OnUpload is called when an object has been stored.
+	OnUpload(event ObservedEvent)
+
+	// OnDownload is called when an object has been sent.
+	OnDownload(event ObservedEvent)
+
+	// OnError is called when an upload, or download, failed.
+	OnError(event ObservedEvent, err error)
+}
+
+// nopObserver is the default Observer, which ignores every event.
+type nopObserver struct{}
+
+func (nopObserver) OnUpload(ObservedEvent)       {}
+func (nopObserver) OnDownload(ObservedEvent)     {}
+func (nopObserver) OnError(ObservedEvent, error) {}
+
+// observer receives our events.
+var observer Observer = nopObserver{}
+
+// RegisterObserver sets the Observer which receives our events, or
+// restores the default if given nil.
+//
+// It must be called before the servers are launched.
+func RegisterObserver(o Observer) {
+	if o == nil {
+		o = nopObserver{}
+	}
+	observer = o
+}
+
+// getObserver returns the Observer which receives our events.
+func getObserver() Observer {
+	return observer
+}
+
+// observeUpload reports the result of an upload which began at the
+// given time.
+func observeUpload(event ObservedEvent, start time.Time, err error) {
+	event.Duration = time.Since(start)
+	if err != nil {
+		getObserver().OnError(event, err)
+		return
+	}
+	getObserver().OnUpload(event)
+}
+
+// observeDownload reports the result of a download which began at the
+// given time.
+func observeDownload(event ObservedEvent, start time.Time, err error) {
+	event.Duration = time.Since(start)
+	if err != nil {
+		getObserver().OnError(event, err)
+		return
+	}
+	getObserver().OnDownload(event)
+}
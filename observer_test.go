@@ -0,0 +1,94 @@
+// Testing of the observation hooks.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/skx/sos/libconfig"
+)
+
+// recordingObserver records the events it receives.
+type recordingObserver struct {
+	sync.Mutex
+	events []string
+}
+
+func (r *recordingObserver) record(kind string, event ObservedEvent) {
+	r.Lock()
+	defer r.Unlock()
+
+	if event.Server != "" {
+		event.Server = "server"
+	}
+	r.events = append(r.events, kind+" "+event.Service+" "+event.Server+" "+event.ID+" "+http.StatusText(event.Status)+" "+strings.Repeat("#", int(event.Size)))
+}
+
+func (r *recordingObserver) OnUpload(event ObservedEvent)         { r.record("upload", event) }
+func (r *recordingObserver) OnDownload(event ObservedEvent)       { r.record("download", event) }
+func (r *recordingObserver) OnError(event ObservedEvent, _ error) { r.record("error", event) }
+
+// Test that uploads, downloads, and failures are reported, by both of
+// our servers.
+func TestObserver(t *testing.T) {
+	recorder := &recordingObserver{}
+	RegisterObserver(recorder)
+	defer RegisterObserver(nil)
+
+	bad := fakeBlobServer(http.StatusInternalServerError)
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		_, _ = res.Write([]byte("Data"))
+	}))
+	defer good.Close()
+
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("first", bad.URL)
+	libconfig.AddServer("second", good.URL)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/upload", APIUploadHandler).Methods("POST")
+	router.HandleFunc("/fetch/{id}", APIDownloadHandler).Methods("GET")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("Data")))
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/fetch/abc", nil))
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+
+	blob := newBlobRouter("")
+	rr = httptest.NewRecorder()
+	blob.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/blob/steve", strings.NewReader("Data")))
+	rr = httptest.NewRecorder()
+	blob.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/blob/steve", nil))
+	rr = httptest.NewRecorder()
+	blob.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/blob/missing", nil))
+
+	id := "cec3a9b89b2e391393d0f68e4bc12a9fa6cf358b3cdf79496dc442d52b8dd528"
+	expected := []string{
+		"error api-server server " + id + " Internal Server Error ####",
+		"upload api-server server " + id + " OK ####",
+		"error api-server server abc Internal Server Error ",
+		"download api-server server abc OK ####",
+		"upload blob-server  steve OK ####",
+		"download blob-server  steve OK ####",
+	}
+	if strings.Join(recorder.events, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected events:\n%s", strings.Join(recorder.events, "\n"))
+	}
+}
@@ -0,0 +1,48 @@
+//
+// Redirects from blob-servers.
+//
+// A blob-server behind a misconfigured proxy might answer with a redirect.
+// By default net/http follows these silently, which could send the body
+// of an object to an unexpected host.  The clients we use to contact the
+// blob-servers therefore follow redirects only to the host the request
+// was made to, and refuse, and log, any others.
+//
+
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// maxRedirects is the number of redirects we follow for a single request,
+// matching the default of net/http.
+const maxRedirects = 10
+
+// errRedirectRefused is returned when a blob-server redirected us to
+// another host.
+var errRedirectRefused = errors.New("refusing to follow redirect to another host")
+
+// checkBlobRedirect decides whether the given redirect should be followed,
+// given the requests which preceded it.
+func checkBlobRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.New("stopped after too many redirects")
+	}
+
+	original := via[0].URL
+	if req.URL.Scheme != original.Scheme || req.URL.Host != original.Host {
+		GetLogger().Error("Blob-server redirected to another host",
+			"method", via[0].Method,
+			"url", original.Redacted(),
+			"location", req.URL.Redacted())
+		return errRedirectRefused
+	}
+	return nil
+}
+
+// newBlobClient returns the HTTP-client used to make a request to a
+// blob-server.
+func newBlobClient() *http.Client {
+	return &http.Client{CheckRedirect: checkBlobRedirect}
+}
@@ -0,0 +1,59 @@
+// Testing of our handling of redirects from blob-servers.
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// Test that redirects are only followed to the same host.
+func TestBlobRedirects(t *testing.T) {
+	var leaked atomic.Int32
+	other := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		leaked.Add(1)
+	}))
+	defer other.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/blob/local":
+			http.Redirect(res, req, "/blob/moved", http.StatusTemporaryRedirect)
+		case strings.HasPrefix(req.URL.Path, "/remote/"):
+			http.Redirect(res, req, other.URL+req.URL.Path, http.StatusTemporaryRedirect)
+		default:
+			_, _ = res.Write([]byte(`{"id":"moved"}`))
+		}
+	}))
+	defer server.Close()
+
+	request, _ := http.NewRequest(http.MethodPost, server.URL+"/blob/local", strings.NewReader("Content"))
+	response, err := newBlobClient().Do(request)
+	if err != nil {
+		t.Fatalf("Failed to follow a redirect to the same host: %v", err)
+	}
+	response.Body.Close()
+
+	request, _ = http.NewRequest(http.MethodPost, server.URL+"/remote/blob/abc", strings.NewReader("Content"))
+	if _, err = newBlobClient().Do(request); !errors.Is(err, errRedirectRefused) {
+		t.Errorf("Unexpected error following a redirect to another host: %v", err)
+	}
+
+	//
+	// Nor does an upload via the API-server leak the object.
+	//
+	libconfig.ResetServers()
+	defer libconfig.ResetServers()
+	libconfig.AddServer("default", server.URL+"/remote")
+
+	rr := httptest.NewRecorder()
+	APIUploadHandler(rr, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("Content")))
+	if rr.Code == http.StatusOK || leaked.Load() != 0 {
+		t.Errorf("The object was sent to another host")
+	}
+}
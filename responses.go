@@ -0,0 +1,90 @@
+//
+// Helpers for building consistent HTTP responses.
+//
+// Both the API-server and the blob-server use these, so that clients
+// receive the same machine-readable shape regardless of which server
+// they were talking to.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// copyChunkSize is the default amount of data we write between extending
+// the write-deadline of a streaming response.
+const copyChunkSize = 32 * 1024
+
+// flushInterval is the amount of data we write between flushes of a
+// streaming response, so that clients see progress without us flushing
+// every small write.
+const flushInterval = 256 * 1024
+
+// errorResponse is the JSON body we return for error responses.
+type errorResponse struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+// writeJSONError sends a JSON-encoded error with the given status-code.
+func writeJSONError(res http.ResponseWriter, status int, message string) {
+	body, _ := json.Marshal(errorResponse{Error: message, Status: status})
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	if _, err := res.Write(body); err != nil {
+		panic(err)
+	}
+}
+
+// copyWithDeadline streams the given reader to the client, extending the
+// write-deadline of the connection as each chunk is written.
+//
+// This means a large response is only abandoned if the client stops
+// reading for the given timeout, rather than being truncated when the
+// total time exceeds the server's WriteTimeout.  A zero timeout leaves
+// the deadline alone.
+//
+// The response is flushed every flushInterval bytes, so that clients on
+// slow links, and proxies, receive large responses incrementally.
+func copyWithDeadline(res http.ResponseWriter, src io.Reader, timeout time.Duration) (int64, error) {
+	buf := getCopyBuffer()
+	defer putCopyBuffer(buf)
+
+	//
+	// The source is wrapped so that io.CopyBuffer can't bypass our
+	// buffer, and write everything at once, via io.WriterTo.
+	//
+	dst := &deadlineWriter{res: res, rc: http.NewResponseController(res), timeout: timeout}
+	return io.CopyBuffer(dst, struct{ io.Reader }{src}, *buf)
+}
+
+// deadlineWriter extends the write-deadline of a response before each
+// write made to it, and flushes it periodically.
+type deadlineWriter struct {
+	res       http.ResponseWriter
+	rc        *http.ResponseController
+	timeout   time.Duration
+	unflushed int
+}
+
+// Write extends the deadline, then writes the data to the response.
+func (w *deadlineWriter) Write(data []byte) (int, error) {
+	if w.timeout > 0 {
+		// Not every ResponseWriter supports deadlines; that's fine.
+		_ = w.rc.SetWriteDeadline(time.Now().Add(w.timeout))
+	}
+
+	n, err := w.res.Write(data)
+	w.unflushed += n
+	if err == nil && w.unflushed >= flushInterval {
+		// Nor does every ResponseWriter support flushing.
+		_ = w.rc.Flush()
+		w.unflushed = 0
+	}
+	return n, err
+}
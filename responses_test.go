@@ -0,0 +1,89 @@
+// Testing of our shared response helpers.
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowReader returns a chunk of data each time it is read, pausing
+// before each read.
+type slowReader struct {
+	chunks int
+	pause  time.Duration
+}
+
+// Read implements io.Reader.
+func (s *slowReader) Read(p []byte) (int, error) {
+	if s.chunks == 0 {
+		return 0, io.EOF
+	}
+	s.chunks--
+	time.Sleep(s.pause)
+	return copy(p, "0123456789"), nil
+}
+
+// Test that streaming responses outlive the server's WriteTimeout,
+// providing data keeps flowing.
+func TestCopyWithDeadline(t *testing.T) {
+	timeout := 100 * time.Millisecond
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		_, _ = copyWithDeadline(res, &slowReader{chunks: 8, pause: 25 * time.Millisecond}, timeout)
+	}))
+	server.Config.WriteTimeout = timeout
+	server.Start()
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("Response was truncated: %v", err)
+	}
+
+	expected := strings.Repeat("0123456789", 8)
+	if string(body) != expected {
+		t.Errorf("Unexpected body: got '%v' want '%v'", string(body), expected)
+	}
+}
+
+// flushCounter is a ResponseWriter which counts how often it is flushed.
+type flushCounter struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+// Flush implements http.Flusher.
+func (f *flushCounter) Flush() {
+	f.flushes++
+}
+
+// Test that large responses are flushed periodically, and small ones not.
+func TestCopyWithDeadlineFlush(t *testing.T) {
+	tests := map[int]int{
+		1024:              0,
+		flushInterval:     1,
+		4 * flushInterval: 4,
+	}
+
+	for size, expected := range tests {
+		res := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+
+		copied, err := copyWithDeadline(res, strings.NewReader(strings.Repeat("x", size)), 0)
+		if err != nil || copied != int64(size) {
+			t.Fatalf("Failed to copy %d bytes: %v %v", size, copied, err)
+		}
+		if res.flushes != expected {
+			t.Errorf("Unexpected flushes for %d bytes: %d", size, res.flushes)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+//
+// Connection-level tuning shared by our HTTP-servers.
+//
+// Without TLS, browsers and most clients only speak HTTP/1.1, but our
+// own tooling, and proxies, may multiplex many downloads over a single
+// connection via unencrypted HTTP/2 ("h2c").  Both servers accept
+// `-h2c` to enable this, alongside HTTP/1.1, which remains available
+// to existing clients.
+//
+// When a server is restarted the previous process may not yet have
+// released its port, so binding is retried a few times, as configured
+// via `-bind-attempts` and `-bind-backoff`, before we give up.
+//
+// The size of request headers may be limited via `-max-header-bytes`, and
+// requests with absurdly long URLs are rejected, before they're routed,
+// via `-max-url-length`.
+//
+// The API-server runs two listeners.  If either fails, or panics, the
+// failure is logged, along with the stack, and the other is shut down
+// cleanly, rather than leaving a half-working server.
+//
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"syscall"
+	"time"
+)
+
+// defaultBindAttempts is the number of times we try to bind a port, by
+// default.
+const defaultBindAttempts = 5
+
+// defaultBindBackoff is the delay before we first retry binding a port,
+// by default.
+const defaultBindBackoff = 250 * time.Millisecond
+
+// defaultMaxURLLength is the length of the longest request URL we accept,
+// by default.
+const defaultMaxURLLength = 8192
+
+// shutdownTimeout is how long we wait for the requests in progress upon
+// a listener to complete, when it is shut down.
+const shutdownTimeout = 10 * time.Second
+
+// newServer returns an HTTP-server for the given handler, with the
+// given timeouts and protocol settings.
+//
+// A maxStreams of zero leaves the number of concurrent HTTP/2 streams
+// per connection at the default of net/http.
+func newServer(addr string, handler http.Handler, read, write, idle time.Duration, h2c bool, maxStreams int, keepAlive bool) *http.Server {
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  read,
+		WriteTimeout: write,
+		IdleTimeout:  idle,
+	}
+
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(h2c)
+	server.Protocols = protocols
+
+	if maxStreams > 0 {
+		server.HTTP2 = &http.HTTP2Config{MaxConcurrentStreams: maxStreams}
+	}
+
+	server.SetKeepAlivesEnabled(keepAlive)
+	return server
+}
+
+// limitServer applies the given limits to the requests of the server.
+//
+// A maxHeaderBytes of zero leaves the limit at the default of net/http,
+// and a maxURLLength of zero accepts URLs of any length.
+func limitServer(server *http.Server, maxHeaderBytes int, maxURLLength int) {
+	server.MaxHeaderBytes = maxHeaderBytes
+	if maxURLLength > 0 {
+		server.Handler = limitURLLength(maxURLLength, server.Handler)
+	}
+}
+
+// limitURLLength rejects requests whose URL is longer than the given
+// length, before they reach the handler.
+func limitURLLength(limit int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		uri := req.RequestURI
+		if uri == "" {
+			uri = req.URL.RequestURI()
+		}
+		if len(uri) > limit {
+			writeJSONError(res, http.StatusRequestURITooLong, "URL too long")
+			return
+		}
+		next.ServeHTTP(res, req)
+	})
+}
+
+// listen binds the given address, retrying while it is in use up to the
+// given number of attempts, with a delay which doubles after each.
+func listen(addr string, attempts int, backoff time.Duration) (net.Listener, error) {
+	for attempt := 1; ; attempt++ {
+		listener, err := net.Listen("tcp", addr)
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) || attempt >= attempts {
+			return listener, err
+		}
+
+		GetLogger().Warn("Address in use, retrying", "address", addr, "attempt", attempt, "delay", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// listenAndServe binds the address of the given server, retrying as
+// listen does, and then serves it.
+//
+// A server with a TLS configuration serves HTTPS, using the certificates
+// it holds.
+func listenAndServe(server *http.Server, attempts int, backoff time.Duration) error {
+	listener, err := listen(server.Addr, attempts, backoff)
+	if err != nil {
+		return err
+	}
+	if server.TLSConfig != nil {
+		return server.ServeTLS(listener, "", "")
+	}
+	return server.Serve(listener)
+}
+
+// serveAll serves each of the given servers, as listenAndServe does,
+// until one of them fails.  The others are then shut down, and the
+// failure returned.
+//
+// A listener which panics is recovered, and treated as having failed.
+func serveAll(attempts int, backoff time.Duration, servers ...*http.Server) error {
+	failed := make(chan error, len(servers))
+
+	for _, server := range servers {
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					GetLogger().Error("Listener panicked", "address", server.Addr, "panic", r, "stack", string(debug.Stack()))
+					failed <- fmt.Errorf("listener %s panicked: %v", server.Addr, r)
+				}
+			}()
+			failed <- listenAndServe(server, attempts, backoff)
+		}()
+	}
+
+	err := <-failed
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		_ = server.Shutdown(ctx)
+	}
+	for range len(servers) - 1 {
+		<-failed
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
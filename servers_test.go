@@ -0,0 +1,250 @@
+// Testing, and benchmarking, of our server tuning.
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/subcommands"
+)
+
+// startTunedServer launches a test-server configured via newServer.
+func startTunedServer(handler http.Handler, h2c bool) *httptest.Server {
+	tuned := newServer("", handler, time.Minute, time.Minute, time.Minute, h2c, 0, true)
+
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.Protocols = tuned.Protocols
+	server.Config.HTTP2 = tuned.HTTP2
+	server.Start()
+	return server
+}
+
+// newClient returns a client speaking only HTTP/1.1, or only h2c.
+func newClient(h2c bool) *http.Client {
+	protocols := new(http.Protocols)
+	if h2c {
+		protocols.SetUnencryptedHTTP2(true)
+	} else {
+		protocols.SetHTTP1(true)
+	}
+	return &http.Client{Transport: &http.Transport{Protocols: protocols}}
+}
+
+// Test that HTTP/1.1 clients work whether or not h2c is enabled, and
+// that h2c clients work when it is.
+func TestServerProtocols(t *testing.T) {
+	handler := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		_, _ = res.Write([]byte(req.Proto))
+	})
+
+	tests := []struct {
+		server   bool
+		client   bool
+		expected string
+	}{
+		{false, false, "HTTP/1.1"},
+		{true, false, "HTTP/1.1"},
+		{true, true, "HTTP/2.0"},
+		{false, true, ""},
+	}
+
+	for _, test := range tests {
+		server := startTunedServer(handler, test.server)
+
+		response, err := newClient(test.client).Get(server.URL)
+		if err != nil {
+			if test.expected != "" {
+				t.Errorf("Unexpected error with h2c=%v/%v: %v", test.server, test.client, err)
+			}
+			server.Close()
+			continue
+		}
+
+		body, _ := io.ReadAll(response.Body)
+		_ = response.Body.Close()
+		if string(body) != test.expected {
+			t.Errorf("Unexpected protocol with h2c=%v/%v: %s", test.server, test.client, body)
+		}
+		server.Close()
+	}
+}
+
+// Benchmark many parallel downloads over HTTP/1.1, and over h2c.
+func BenchmarkParallelDownload(b *testing.B) {
+	const parallelDownloads = 32
+	content := strings.Repeat("x", 1024*1024)
+	handler := http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		_, _ = copyWithDeadline(res, strings.NewReader(content), 0)
+	})
+
+	for _, h2c := range []bool{false, true} {
+		name := "http1"
+		if h2c {
+			name = "h2c"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			server := startTunedServer(handler, h2c)
+			defer server.Close()
+			client := newClient(h2c)
+
+			b.SetBytes(int64(len(content) * parallelDownloads))
+			for b.Loop() {
+				var wg sync.WaitGroup
+				for range parallelDownloads {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						response, err := client.Get(server.URL)
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						_, _ = io.Copy(io.Discard, response.Body)
+						_ = response.Body.Close()
+					}()
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
+
+// Test that binding an address in use is retried, until it is free or
+// we run out of attempts.
+func TestListenRetry(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := busy.Addr().String()
+
+	if _, err = listen(addr, 1, time.Millisecond); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("Unexpected error binding a busy address: %v", err)
+	}
+
+	//
+	// Free the address while we're retrying.
+	//
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = busy.Close()
+	}()
+
+	listener, err := listen(addr, 10, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to bind once the address was free: %v", err)
+	}
+	_ = listener.Close()
+}
+
+// freeAddress returns a local address which is not in use.
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// Test that a listener which fails, or panics, shuts down the others.
+func TestServeAll(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	healthy := &http.Server{Addr: freeAddress(t), Handler: http.NotFoundHandler()}
+	failing := &http.Server{Addr: busy.Addr().String(), Handler: http.NotFoundHandler()}
+	if err = serveAll(1, time.Millisecond, healthy, failing); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	healthy = &http.Server{Addr: freeAddress(t), Handler: http.NotFoundHandler()}
+	panicking := &http.Server{
+		Addr:    freeAddress(t),
+		Handler: http.NotFoundHandler(),
+		ConnContext: func(context.Context, net.Conn) context.Context {
+			panic("broken")
+		},
+	}
+
+	go func() {
+		for range 50 {
+			if conn, dialErr := net.Dial("tcp", panicking.Addr); dialErr == nil {
+				_ = conn.Close()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	if err = serveAll(1, time.Millisecond, healthy, panicking); err == nil || !strings.Contains(err.Error(), "panicked") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+// Test that requests with long URLs, or large headers, are rejected.
+func TestLimitServer(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		_, _ = res.Write([]byte("OK"))
+	}))
+	limitServer(server.Config, 1024, 64)
+	server.Start()
+	defer server.Close()
+
+	tests := []struct {
+		path     string
+		header   string
+		expected int
+	}{
+		{"/blob/abc", "", http.StatusOK},
+		{"/blob/" + strings.Repeat("a", 64), "", http.StatusRequestURITooLong},
+		{"/blob/abc", strings.Repeat("x", 16*1024), http.StatusRequestHeaderFieldsTooLarge},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, server.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.header != "" {
+			req.Header.Set("X-Large", test.header)
+		}
+
+		response, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		if response.StatusCode != test.expected {
+			t.Errorf("Unexpected status-code for %s: got %v want %v", test.path, response.StatusCode, test.expected)
+		}
+	}
+}
+
+// Test that servers which fail to start exit with a failure, so that
+// they may be restarted by their supervisor.
+func TestServerExitStatus(t *testing.T) {
+	api := &apiServerCmd{blobPath: "/no-id"}
+	if status := api.Execute(context.Background(), nil); status != subcommands.ExitFailure {
+		t.Errorf("Unexpected API-server exit-status: %v", status)
+	}
+
+	blob := &blobServerCmd{tlsCert: "server.pem"}
+	if status := blob.Execute(context.Background(), nil); status != subcommands.ExitFailure {
+		t.Errorf("Unexpected blob-server exit-status: %v", status)
+	}
+}
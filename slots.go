@@ -0,0 +1,63 @@
+//
+// Per-server connection limits.
+//
+// When many objects are copied to the same blob-server at once, during
+// replication or the fan-out of uploads, that server's accept queue may
+// be saturated.  The API-server and the replicator therefore accept a
+// `-server-connections` flag, which limits the number of requests which
+// may be in flight to any single blob-server.  Further requests wait
+// for a slot to become free.
+//
+// The default, zero, imposes no limit.
+//
+
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// serverSlots holds a semaphore for each blob-server, keyed by location.
+var serverSlots = struct {
+	sync.Mutex
+	limit   int
+	servers map[string]chan struct{}
+}{servers: make(map[string]chan struct{})}
+
+// setServerConnections changes the number of requests which may be in
+// flight to each blob-server, zero meaning no limit.
+//
+// Requests already holding a slot are unaffected.
+func setServerConnections(limit int) {
+	serverSlots.Lock()
+	defer serverSlots.Unlock()
+
+	serverSlots.limit = max(limit, 0)
+	clear(serverSlots.servers)
+}
+
+// acquireServer waits for a slot upon the given blob-server, returning
+// the function which releases it, or an error if the context ends first.
+func acquireServer(ctx context.Context, location string) (func(), error) {
+	serverSlots.Lock()
+	if serverSlots.limit == 0 {
+		serverSlots.Unlock()
+		return func() {}, nil
+	}
+	slots, ok := serverSlots.servers[location]
+	if !ok {
+		slots = make(chan struct{}, serverSlots.limit)
+		serverSlots.servers[location] = slots
+	}
+	serverSlots.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	var once sync.Once
+	return func() { once.Do(func() { <-slots }) }, nil
+}
@@ -0,0 +1,49 @@
+// Testing of per-server connection limits.
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Test that requests to each server are limited independently.
+func TestServerConnections(t *testing.T) {
+	setServerConnections(2)
+	defer setServerConnections(0)
+
+	ctx := context.Background()
+	first, err := acquireServer(ctx, "http://a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = acquireServer(ctx, "http://a"); err != nil {
+		t.Fatal(err)
+	}
+
+	//
+	// The third request must wait, but another server is unaffected.
+	//
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err = acquireServer(short, "http://a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected to wait for a slot, got %v", err)
+	}
+	if _, err = acquireServer(ctx, "http://b"); err != nil {
+		t.Errorf("Unexpected error for another server: %v", err)
+	}
+
+	first()
+	first()
+	if _, err = acquireServer(ctx, "http://a"); err != nil {
+		t.Errorf("A released slot was not reused: %v", err)
+	}
+
+	setServerConnections(0)
+	for range 10 {
+		if _, err = acquireServer(ctx, "http://a"); err != nil {
+			t.Errorf("Unexpected error without a limit: %v", err)
+		}
+	}
+}
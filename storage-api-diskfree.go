@@ -0,0 +1,26 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// SOSDiskFree returns the free, and total, bytes of the filesystem
+// holding the given (open) directory.
+func SOSDiskFree(dir *os.File) (uint64, uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Fstatfs(int(dir.Fd()), &stat); err != nil {
+		return 0, 0, err
+	}
+
+	//
+	// The field types vary by platform, hence the conversions.
+	//
+	//nolint:gosec,unconvert // These are never negative.
+	size := uint64(stat.Bsize)
+	//nolint:gosec,unconvert // These are never negative.
+	return uint64(stat.Bavail) * size, uint64(stat.Blocks) * size, nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// SOSDiskFree returns the free, and total, bytes of the filesystem
+// holding the given (open) directory.
+//
+// This is not implemented for this platform.
+func SOSDiskFree(dir *os.File) (uint64, uint64, error) {
+	return 0, 0, errors.New("not implemented on this platform")
+}
@@ -0,0 +1,92 @@
+//
+// Serialization of concurrent stores.
+//
+// Two simultaneous uploads of the same content have the same ID, and
+// writing both to the same file at once could leave it torn.  Instead
+// the filesystem storage holds a lock for each ID while it is stored,
+// sharded so that the locks need never be cleaned up, and writes each
+// file to a temporary name before renaming it into place.  A reader
+// therefore sees either the previous file or the new one, never a mix.
+//
+// The second of two stores with identical content is a no-op.
+//
+
+package main
+
+import (
+	"bytes"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// idLockShards is the number of locks which the IDs are spread across.
+const idLockShards = 256
+
+// tempPrefix begins the names of the files we write before renaming
+// them into place, which are never listed as objects.
+const tempPrefix = ".tmp-"
+
+// idLocks serializes changes to each ID.
+type idLocks struct {
+	shards [idLockShards]sync.Mutex
+}
+
+// lock acquires the lock of the given ID, returning the function which
+// releases it.
+func (l *idLocks) lock(id string) func() {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(id))
+
+	shard := &l.shards[hash.Sum32()%idLockShards]
+	shard.Lock()
+	return shard.Unlock
+}
+
+// isTempFile returns true if the given name is that of a file which is
+// being written.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, tempPrefix)
+}
+
+// writeFileAtomic writes the given data to a temporary file beside the
+// target, and then renames it into place.
+func writeFileAtomic(target string, data []byte) error {
+	return writeReaderAtomic(target, bytes.NewReader(data))
+}
+
+// writeReaderAtomic is writeFileAtomic, copying the content from the
+// given reader rather than from memory.
+func writeReaderAtomic(target string, data io.Reader) error {
+	file, err := os.CreateTemp(filepath.Dir(target), tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), target)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+	}
+	return err
+}
+
+// sameFile returns true if the given file exists with exactly the given
+// content.
+func sameFile(target string, data []byte) bool {
+	info, err := os.Stat(target)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != int64(len(data)) {
+		return false
+	}
+
+	existing, err := os.ReadFile(target)
+	return err == nil && bytes.Equal(existing, data)
+}
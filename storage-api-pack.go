@@ -0,0 +1,355 @@
+//
+// Pack-file storage.
+//
+// Storing millions of tiny blobs as individual files wastes inodes, so
+// this storage-class appends each blob to a single large pack-file
+// instead.
+//
+// Alongside the pack-file we keep a journal, which contains one JSON
+// record per line.  Each record either notes the offset & length of a
+// blob within the pack, along with its meta-data, or is a tombstone
+// recording that a blob was deleted.  Replaying the journal at startup
+// gives us our index.
+//
+// Since blobs are never modified in-place the space used by deleted (or
+// overwritten) blobs is only reclaimed when the pack is compacted.
+//
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// The names of the files we maintain beneath our directory.
+const (
+	packFile    = "blobs.pack"
+	journalFile = "blobs.idx"
+)
+
+// packEntry is a single record from our journal.
+type packEntry struct {
+	ID      string   `json:"id"`
+	Offset  int64    `json:"offset,omitempty"`
+	Length  int64    `json:"length,omitempty"`
+	Meta    Metadata `json:"meta,omitempty"`
+	Deleted bool     `json:"deleted,omitempty"`
+}
+
+// PackStorage is a concrete type which implements the StorageHandler
+// interface, by appending blobs to a pack-file.
+type PackStorage struct {
+	// mutex guards all of the fields below.
+	mutex sync.RWMutex
+
+	// dir is the directory holding our pack & journal.
+	dir string
+
+	// pack is the open pack-file.
+	pack *os.File
+
+	// journal is the open journal.
+	journal *os.File
+
+	// size is the current size of the pack-file.
+	size int64
+
+	// index maps each ID to its location within the pack.
+	index map[string]packEntry
+}
+
+// Setup opens the pack-file & journal beneath the given directory,
+// creating them if necessary.
+func (ps *PackStorage) Setup(connection string) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	ps.dir = connection
+	_ = os.MkdirAll(connection, 0750)
+
+	if err := ps.open(); err != nil {
+		panic(err)
+	}
+
+	//
+	// If more than half the pack is garbage then reclaim it.
+	//
+	live := int64(0)
+	for _, entry := range ps.index {
+		live += entry.Length
+	}
+	if ps.size > 2*live {
+		if err := ps.compact(); err != nil {
+			GetLogger().Error("Failed to compact pack-file", "error", err)
+		}
+	}
+}
+
+// open finishes any interrupted compaction, then opens our files and
+// replays the journal to build up the index.
+func (ps *PackStorage) open() error {
+	packPath := filepath.Join(ps.dir, packFile)
+	journalPath := filepath.Join(ps.dir, journalFile)
+
+	//
+	// Compaction writes new files, then renames the pack followed by
+	// the journal.  If the new pack is still present we were
+	// interrupted before either rename, so the old files are intact.
+	// Otherwise if the new journal is present we must complete the
+	// second rename.
+	//
+	if _, err := os.Stat(packPath + ".new"); err == nil {
+		_ = os.Remove(packPath + ".new")
+		_ = os.Remove(journalPath + ".new")
+	} else if _, err = os.Stat(journalPath + ".new"); err == nil {
+		if err = os.Rename(journalPath+".new", journalPath); err != nil {
+			return err
+		}
+	}
+
+	pack, err := os.OpenFile(packPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := pack.Stat()
+	if err != nil {
+		_ = pack.Close()
+		return err
+	}
+
+	journal, err := os.OpenFile(journalPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		_ = pack.Close()
+		return err
+	}
+
+	ps.pack = pack
+	ps.journal = journal
+	ps.size = info.Size()
+	ps.index = make(map[string]packEntry)
+
+	//
+	// Replay the journal, later records override earlier ones.
+	//
+	scanner := bufio.NewScanner(journal)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry packEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		if entry.Deleted {
+			delete(ps.index, entry.ID)
+		} else if entry.Offset+entry.Length <= ps.size {
+			ps.index[entry.ID] = entry
+		}
+	}
+	return scanner.Err()
+}
+
+// record appends the given entry to the journal.
+func (ps *PackStorage) record(entry packEntry) error {
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = ps.journal.Write(append(encoded, '\n'))
+	return err
+}
+
+// Get the contents of a given ID.
+func (ps *PackStorage) Get(id string) (*[]byte, Metadata) {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	entry, ok := ps.index[id]
+	if !ok {
+		return nil, nil
+	}
+
+	data := make([]byte, entry.Length)
+	if _, err := ps.pack.ReadAt(data, entry.Offset); err != nil && !errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	return &data, entry.Meta
+}
+
+// GetReader returns a reader of the section of the pack holding the
+// given ID, along with its meta-data.
+//
+// The pack is only appended to while objects are served, so the section
+// remains valid after the lock is released; Compact must not be called
+// while a reader is in use.
+func (ps *PackStorage) GetReader(id string) (io.ReadCloser, Metadata) {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	entry, ok := ps.index[id]
+	if !ok {
+		return nil, nil
+	}
+	return io.NopCloser(io.NewSectionReader(ps.pack, entry.Offset, entry.Length)), entry.Meta
+}
+
+// Store the specified data against the given ID.
+func (ps *PackStorage) Store(id string, data []byte, params Metadata) bool {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	//
+	// Append the data to the end of the pack.
+	//
+	if _, err := ps.pack.WriteAt(data, ps.size); err != nil {
+		return false
+	}
+
+	entry := packEntry{ID: id, Offset: ps.size, Length: int64(len(data))}
+	if len(params) != 0 {
+		entry.Meta = params
+	}
+
+	//
+	// The data only becomes visible once it has been journaled.
+	//
+	if err := ps.record(entry); err != nil {
+		return false
+	}
+
+	ps.size += entry.Length
+	ps.index[id] = entry
+	return true
+}
+
+// Existing returns all known IDs.
+func (ps *PackStorage) Existing() ([]string, error) {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	return slices.Sorted(maps.Keys(ps.index)), nil
+}
+
+// Meta returns the meta-data of the given ID, from our index.
+func (ps *PackStorage) Meta(id string) Metadata {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	return maps.Clone(ps.index[id].Meta)
+}
+
+// Exists tests whether the given ID exists.
+func (ps *PackStorage) Exists(id string) bool {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	_, ok := ps.index[id]
+	return ok
+}
+
+// Size returns the size of the given ID, from our index.
+func (ps *PackStorage) Size(id string) (int64, bool) {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	entry, ok := ps.index[id]
+	return entry.Length, ok
+}
+
+// Delete removes the given ID, by journaling a tombstone.
+//
+// The space the object occupied is not reclaimed until the pack is
+// next compacted.
+func (ps *PackStorage) Delete(id string) bool {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if _, ok := ps.index[id]; !ok {
+		return false
+	}
+
+	if err := ps.record(packEntry{ID: id, Deleted: true}); err != nil {
+		return false
+	}
+	delete(ps.index, id)
+	return true
+}
+
+// Compact rewrites the pack-file, and journal, to contain only the
+// objects which are still live.
+func (ps *PackStorage) Compact() error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	return ps.compact()
+}
+
+// compact implements Compact, with the mutex already held.
+func (ps *PackStorage) compact() error {
+	packPath := filepath.Join(ps.dir, packFile)
+	journalPath := filepath.Join(ps.dir, journalFile)
+
+	pack, err := os.OpenFile(packPath+".new", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = pack.Close() }()
+
+	journal, err := os.OpenFile(journalPath+".new", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = journal.Close() }()
+
+	//
+	// Copy each live object into the new pack, journaling as we go.
+	//
+	offset := int64(0)
+	for _, id := range slices.Sorted(maps.Keys(ps.index)) {
+		entry := ps.index[id]
+
+		section := io.NewSectionReader(ps.pack, entry.Offset, entry.Length)
+		if _, err = pack.ReadFrom(section); err != nil {
+			return err
+		}
+
+		entry.Offset = offset
+		offset += entry.Length
+
+		encoded, _ := json.Marshal(entry)
+		if _, err = journal.Write(append(encoded, '\n')); err != nil {
+			return err
+		}
+	}
+
+	if err = pack.Sync(); err != nil {
+		return err
+	}
+	if err = journal.Sync(); err != nil {
+		return err
+	}
+
+	//
+	// Swap the new files into place, see open() for how an
+	// interruption here is recovered from.
+	//
+	_ = ps.pack.Close()
+	_ = ps.journal.Close()
+
+	err = os.Rename(packPath+".new", packPath)
+	if err == nil {
+		err = os.Rename(journalPath+".new", journalPath)
+	}
+	if openErr := ps.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
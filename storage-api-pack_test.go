@@ -0,0 +1,83 @@
+//
+//  Testing of our pack-file storage.
+//
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test the pack storage conforms to our expectations.
+func TestPackConformance(t *testing.T) {
+	storage := new(PackStorage)
+	storage.Setup(t.TempDir())
+
+	testStorageConformance(t, storage)
+}
+
+// Test that objects persist when the pack is re-opened.
+func TestPackReopen(t *testing.T) {
+	p := t.TempDir()
+
+	storage := new(PackStorage)
+	storage.Setup(p)
+	storage.Store("steve", []byte("Content"), Metadata{"X-Foo": {"bar"}})
+	storage.Store("kemp", []byte("More content"), nil)
+	storage.Delete("kemp")
+
+	reopened := new(PackStorage)
+	reopened.Setup(p)
+
+	data, meta := reopened.Get("steve")
+	if data == nil || string(*data) != "Content" || meta.Get("X-Foo") != "bar" {
+		t.Errorf("Object was not persisted")
+	}
+	if reopened.Exists("kemp") {
+		t.Errorf("Deleted object was resurrected")
+	}
+}
+
+// Test that compaction reclaims the space used by deleted objects.
+func TestPackCompact(t *testing.T) {
+	p := t.TempDir()
+
+	storage := new(PackStorage)
+	storage.Setup(p)
+	storage.Store("steve", []byte("Content"), nil)
+	storage.Store("kemp", []byte("More content"), nil)
+
+	if !storage.Delete("kemp") {
+		t.Fatalf("Delete failed")
+	}
+	if storage.Delete("kemp") {
+		t.Errorf("Deleting a missing object succeeded")
+	}
+
+	if err := storage.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(p, packFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len("Content")) {
+		t.Errorf("Unexpected pack size after compaction: %d", info.Size())
+	}
+
+	data, _ := storage.Get("steve")
+	if data == nil || string(*data) != "Content" {
+		t.Errorf("Live object was lost during compaction")
+	}
+
+	//
+	// New objects may still be stored after compacting.
+	//
+	storage.Store("new", []byte("New"), nil)
+	if data, _ = storage.Get("new"); data == nil || string(*data) != "New" {
+		t.Errorf("Failed to store after compaction")
+	}
+}
@@ -0,0 +1,88 @@
+//
+// Multiple storage roots for the filesystem backend.
+//
+// A storage node with several disks may use each of them, without RAID,
+// by giving the blob-server a comma-separated list of directories:
+//
+//   sos blob-server -store /disk1/sos,/disk2/sos,/disk3/sos
+//
+// Each object is placed upon the root chosen by hashing its ID.  Reads
+// fall back to searching the other roots, so objects remain available
+// if the list of roots is changed, although they are not moved.
+//
+// Since we cannot chroot() into several directories at once the
+// blob-server does not chroot() when given more than one root.
+//
+
+package main
+
+import (
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// storeRoots splits the given store, which may name several directories
+// separated by commas, into its roots.
+func storeRoots(store string) []string {
+	var roots []string
+	for _, root := range strings.Split(store, ",") {
+		if root = strings.TrimSpace(root); root != "" {
+			roots = append(roots, root)
+		}
+	}
+	return roots
+}
+
+// primaryRoot returns the first root of the given store, which holds
+// the upload-sessions, aliases, and trash, of the blob-server.
+func primaryRoot(store string) string {
+	if roots := storeRoots(store); len(roots) > 0 {
+		return roots[0]
+	}
+	return store
+}
+
+// rootIndex returns the index of the root, of the given number, upon
+// which the given ID is placed.
+func rootIndex(id string, count int) int {
+	hasher := fnv.New64a()
+	_, _ = hasher.Write([]byte(id))
+	return int(hasher.Sum64() % uint64(count)) //nolint:gosec // count is small, and positive.
+}
+
+// locate returns the path to the file which holds the given ID, upon
+// one of our several roots.
+//
+// If the file is not present upon the root its ID hashes to, but is
+// present upon another, that is returned instead.
+func (fss *FilesystemStorage) locate(id string) string {
+	home := rootIndex(id, len(fss.roots))
+
+	target := filepath.Join(fss.roots[home], id)
+	if _, err := os.Lstat(target); err == nil {
+		return target
+	}
+
+	for i, root := range fss.roots {
+		if i == home {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(root, id)); err == nil {
+			return filepath.Join(root, id)
+		}
+	}
+	return target
+}
+
+// directories returns each of the directories which hold our objects.
+func (fss *FilesystemStorage) directories() []string {
+	if len(fss.roots) > 1 {
+		return fss.roots
+	}
+	if !fss.cwd {
+		return []string{fss.prefix}
+	}
+	return []string{"."}
+}
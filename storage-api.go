@@ -20,11 +20,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"syscall"
+	"time"
 )
 
 // StorageHandler is the interface for a storage class.
@@ -45,7 +49,15 @@ type StorageHandler interface {
 	// key=value parameters which were stored when
 	// the content was uploaded.
 	//
-	Get(id string) (*[]byte, map[string]string)
+	Get(id string) (*[]byte, Metadata)
+
+	//
+	// Retrieve only the (optional) key=value parameters
+	// which were stored alongside the blob with the given ID.
+	//
+	// This is cheaper than Get, as the data isn't read.
+	//
+	Meta(id string) Metadata
 
 	//
 	// Store some data against the given ID.
@@ -53,17 +65,107 @@ type StorageHandler interface {
 	// If any optional `key=value` parameters have been
 	// sent then store them too, alongside the data.
 	//
-	Store(id string, data []byte, params map[string]string) bool
+	Store(id string, data []byte, params Metadata) bool
 
 	//
 	// Get all known IDs.
 	//
-	Existing() []string
+	// An error is returned if they could not be enumerated,
+	// which must not be mistaken for an empty store.
+	//
+	Existing() ([]string, error)
 
 	//
 	// Does the given ID exist?
 	//
 	Exists(id string) bool
+
+	//
+	// Return the size of the blob with the given ID, and
+	// whether it exists, without reading it.
+	//
+	Size(id string) (int64, bool)
+}
+
+// AccessRecorder is an optional interface which a storage class may
+// implement to persist the time at which an object was last read.
+type AccessRecorder interface {
+	RecordAccess(id string, when time.Time)
+}
+
+// Enumerator is an optional interface which a storage class may
+// implement to visit each known ID in turn, in no particular order,
+// rather than returning them all at once.
+//
+// The enumeration stops at the first error returned by the callback,
+// and that error is returned.
+type Enumerator interface {
+	Enumerate(fn func(id string) error) error
+}
+
+// Streamer is an optional interface which a storage class may implement
+// to allow an object to be read as it is sent, rather than into memory.
+//
+// The reader, and any meta-data, are nil if the object is missing.
+type Streamer interface {
+	GetReader(id string) (io.ReadCloser, Metadata)
+}
+
+// ReaderStorer is an optional interface which a storage class may
+// implement to allow an object to be stored from a reader, rather than
+// from memory.
+type ReaderStorer interface {
+	StoreReader(id string, data io.Reader, params Metadata) bool
+}
+
+// Deleter is an optional interface which a storage class may implement
+// to allow objects to be removed.
+type Deleter interface {
+	Delete(id string) bool
+}
+
+// Metadata holds the (optional) key=value parameters stored alongside
+// a blob.  As with HTTP-headers a key may have several values, which
+// are kept in the order they were received.
+type Metadata map[string][]string
+
+// Get returns the first value of the given key, or "" if it is unset.
+func (m Metadata) Get(key string) string {
+	if len(m[key]) == 0 {
+		return ""
+	}
+	return m[key][0]
+}
+
+// Set replaces any values of the given key with the single value.
+func (m Metadata) Set(key string, value string) {
+	m[key] = []string{value}
+}
+
+// UnmarshalJSON decodes meta-data, also accepting the older encoding
+// in which each key had a single string value.
+func (m *Metadata) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	meta := make(Metadata, len(raw))
+	for key, value := range raw {
+		var values []string
+		if err := json.Unmarshal(value, &values); err == nil {
+			meta[key] = values
+			continue
+		}
+
+		var single string
+		if err := json.Unmarshal(value, &single); err != nil {
+			return err
+		}
+		meta.Set(key, single)
+	}
+	*m = meta
+	return nil
 }
 
 // FilesystemStorage is a concrete type which implements
@@ -74,10 +176,31 @@ type FilesystemStorage struct {
 
 	// prefix holds our prefix directory if we didn't chroot
 	prefix string
+
+	// roots holds each of our directories, if we were given more
+	// than one.
+	roots []string
+
+	// locks serializes stores of the same ID.
+	locks idLocks
 }
 
 // Setup method to ensure we have a data-directory.
 func (fss *FilesystemStorage) Setup(connection string) {
+	//
+	// Several directories are used without chroot(), since we can't
+	// chroot() into each of them.
+	//
+	if roots := storeRoots(connection); len(roots) > 1 {
+		for _, root := range roots {
+			_ = os.MkdirAll(root, 0750)
+		}
+		fss.cwd = false
+		fss.prefix = roots[0]
+		fss.roots = roots
+		return
+	}
+
 	//
 	// If the data-directory does not exist create it.
 	//
@@ -89,8 +212,7 @@ func (fss *FilesystemStorage) Setup(connection string) {
 	// But we can't do that when testing.
 	//
 	if flag.Lookup("test.v") != nil {
-		fss.cwd = false
-		fss.prefix = connection
+		fss.SetupInPlace(connection)
 		return
 	}
 
@@ -111,16 +233,41 @@ func (fss *FilesystemStorage) Setup(connection string) {
 	fss.cwd = true
 }
 
+// SetupInPlace ensures we have a data-directory, which is accessed via
+// its path rather than by changing into it and chroot()ing.
+//
+// This is used when we share our process, and so cannot move it.
+func (fss *FilesystemStorage) SetupInPlace(connection string) {
+	if len(storeRoots(connection)) > 1 {
+		fss.Setup(connection)
+		return
+	}
+
+	_ = os.MkdirAll(connection, 0750)
+	fss.cwd = false
+	fss.prefix = connection
+}
+
+// path returns the path to the file which holds the given ID.
+//
+// If we're not using the cwd we need to build up the complete path
+// beneath our prefix, or the appropriate one of our roots.
+func (fss *FilesystemStorage) path(id string) string {
+	if len(fss.roots) > 1 {
+		return fss.locate(id)
+	}
+	if !fss.cwd {
+		return filepath.Join(fss.prefix, id)
+	}
+	return id
+}
+
 // Get the contents of a given ID.
-func (fss *FilesystemStorage) Get(id string) (*[]byte, map[string]string) {
+func (fss *FilesystemStorage) Get(id string) (*[]byte, Metadata) {
 	//
-	// If we're not using the cwd we need to build up the complete
-	// path to the file.
+	// Build up the complete path to the file.
 	//
-	target := id
-	if !fss.cwd {
-		target = filepath.Join(fss.prefix, id)
-	}
+	target := fss.path(id)
 
 	//
 	// If the file is missing we return nil.
@@ -142,7 +289,7 @@ func (fss *FilesystemStorage) Get(id string) (*[]byte, map[string]string) {
 	//
 	// Now attempt to return the meta-data too.
 	//
-	meta := make(map[string]string)
+	meta := make(Metadata)
 
 	//
 	// Attempt to read the meta-data file.
@@ -164,26 +311,86 @@ func (fss *FilesystemStorage) Get(id string) (*[]byte, map[string]string) {
 	return &x, nil
 }
 
-// Store the specified data against the given file.
-func (fss *FilesystemStorage) Store(id string, data []byte, params map[string]string) bool {
-	//
-	// If we're not using the cwd we need to build up the complete
-	// path to the file.
-	//
-	target := id
-	if !fss.cwd {
-		target = filepath.Join(fss.prefix, id)
+// GetReader opens the file holding the given ID, for reading as it is
+// sent, and returns it along with the meta-data of the object.
+func (fss *FilesystemStorage) GetReader(id string) (io.ReadCloser, Metadata) {
+	file, err := os.Open(fss.path(id))
+	if err != nil {
+		return nil, nil
+	}
+	return file, fss.Meta(id)
+}
+
+// Meta returns the meta-data stored alongside the given ID, by reading
+// the JSON sidecar-file, without reading the data itself.
+func (fss *FilesystemStorage) Meta(id string) Metadata {
+	encoded, err := os.ReadFile(fss.path(id) + ".json")
+	if err != nil {
+		return nil
 	}
 
+	meta := make(Metadata)
+	if err = json.Unmarshal(encoded, &meta); err != nil {
+		return nil
+	}
+	return meta
+}
+
+// Store the specified data against the given file.
+//
+// Concurrent stores of the same ID are serialized, and each file is
+// written to a temporary name and then renamed into place, so that it
+// is never torn.
+func (fss *FilesystemStorage) Store(id string, data []byte, params Metadata) bool {
+	return fss.store(id, params, func(target string) error {
+		//
+		// Write out the data, unless an identical copy is present
+		// already.
+		//
+		if sameFile(target, data) {
+			return nil
+		}
+		return writeFileAtomic(target, data)
+	})
+}
+
+// StoreReader stores the content of the given reader against the given
+// ID, without holding it in memory.
+func (fss *FilesystemStorage) StoreReader(id string, data io.Reader, params Metadata) bool {
+	return fss.store(id, params, func(target string) error {
+		return writeReaderAtomic(target, data)
+	})
+}
+
+// store writes an object, via the given function, and then its
+// meta-data, while holding the lock of its ID.
+func (fss *FilesystemStorage) store(id string, params Metadata, write func(target string) error) bool {
+	unlock := fss.locks.lock(id)
+	defer unlock()
+
 	//
-	// Write out the data.
+	// Build up the complete path to the file.
 	//
-	err := os.WriteFile(target, data, 0600)
+	target := fss.path(id)
 
 	//
-	// If there was an error we abort.
+	// Objects within a bucket are stored in its sub-directory.
 	//
-	if err != nil {
+	// A flat object may not share its name with a bucket, nor a
+	// bucket with a flat object, since either would hide the other.
+	//
+	if bucket, _, ok := splitBucket(id); ok {
+		if info, err := os.Stat(fss.path(bucket)); err == nil && !info.IsDir() {
+			return false
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+			return false
+		}
+	} else if info, err := os.Stat(target); err == nil && info.IsDir() {
+		return false
+	}
+
+	if err := write(target); err != nil {
 		return false
 	}
 
@@ -205,12 +412,13 @@ func (fss *FilesystemStorage) Store(id string, data []byte, params map[string]st
 		}
 
 		// Write out to a .json-suffixed file.
-		err = os.WriteFile(target+".json", encoded, 0600)
-
+		//
 		// If the data was saved but the meta-data wasn't
 		// this is still a failure.
-		if err != nil {
-			return false
+		if !sameFile(target+".json", encoded) {
+			if err := writeFileAtomic(target+".json", encoded); err != nil {
+				return false
+			}
 		}
 	}
 
@@ -226,41 +434,157 @@ func (fss *FilesystemStorage) Store(id string, data []byte, params map[string]st
 //
 // We assume we've been chdir() + chroot() into the data-directory
 // so we just need to read the filenames we can find.
-func (fss *FilesystemStorage) Existing() []string {
+func (fss *FilesystemStorage) Existing() ([]string, error) {
 	var list []string
 
 	//
-	// If we're not using the cwd we need to use our prefix, explicitly
+	// If we're not using the cwd we need to use our prefix, or our
+	// roots, explicitly.
 	//
-	target := "."
-	if !fss.cwd {
-		target = fss.prefix
+	directories := fss.directories()
+	for _, target := range directories {
+		files, err := os.ReadDir(target)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range files {
+			name := f.Name()
+
+			if !f.IsDir() && !strings.HasSuffix(name, ".json") && !isTempFile(name) {
+				list = append(list, name)
+			}
+		}
+	}
+
+	//
+	// An object might be present upon several roots.
+	//
+	if len(directories) > 1 {
+		slices.Sort(list)
+		list = slices.Compact(list)
+	}
+	return list, nil
+}
+
+// enumerateBatch is the number of directory entries we read at a time
+// when enumerating our objects.
+const enumerateBatch = 1024
+
+// Enumerate calls the given function with each known ID, reading the
+// directory a batch at a time so that large stores need not be held in
+// memory at once.
+//
+// Unlike Existing the IDs are not sorted, and an object present upon
+// several of our roots is visited once for each.
+func (fss *FilesystemStorage) Enumerate(fn func(id string) error) error {
+	for _, target := range fss.directories() {
+		if err := enumerateDirectory(target, fn); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	files, _ := os.ReadDir(target)
-	for _, f := range files {
-		name := f.Name()
+// enumerateDirectory calls the given function with the ID of each object
+// in the given directory.
+func enumerateDirectory(target string, fn func(id string) error) error {
+	dir, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	for {
+		files, readErr := dir.ReadDir(enumerateBatch)
+		for _, f := range files {
+			name := f.Name()
+
+			if f.IsDir() || strings.HasSuffix(name, ".json") || isTempFile(name) {
+				continue
+			}
+			if err = fn(name); err != nil {
+				return err
+			}
+		}
 
-		if !strings.HasSuffix(name, ".json") {
-			list = append(list, name)
+		if errors.Is(readErr, io.EOF) {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
 		}
 	}
-	return list
 }
 
 // Exists tests whether the given ID exists (as a file).
 func (fss *FilesystemStorage) Exists(id string) bool {
 	//
-	// If we're not using the cwd we need to build up the complete
-	// path to the file.
+	// Build up the complete path to the file.
 	//
-	target := id
-	if !fss.cwd {
-		target = filepath.Join(fss.prefix, id)
+	target := fss.path(id)
+
+	//
+	// The directory of a bucket is not an object.
+	//
+	info, err := os.Stat(target)
+	if os.IsNotExist(err) {
+		return false
 	}
+	return err != nil || !info.IsDir()
+}
 
-	if _, err := os.Stat(target); os.IsNotExist(err) {
+// Size returns the size of the file holding the given ID.
+func (fss *FilesystemStorage) Size(id string) (int64, bool) {
+	info, err := os.Stat(fss.path(id))
+	if err != nil || !info.Mode().IsRegular() {
+		return 0, false
+	}
+	return info.Size(), true
+}
+
+// RecordAccess updates the access-time of the file holding the given ID,
+// leaving the modification-time alone.
+//
+// This works even if the filesystem is mounted with `noatime`, and lets
+// external tools find the least-recently used objects.
+func (fss *FilesystemStorage) RecordAccess(id string, when time.Time) {
+	_ = os.Chtimes(fss.path(id), when, time.Time{})
+}
+
+// Delete removes the file holding the given ID, along with any
+// meta-data.
+func (fss *FilesystemStorage) Delete(id string) bool {
+	if err := os.Remove(fss.path(id)); err != nil {
 		return false
 	}
-	return true
+
+	err := os.Remove(fss.path(id) + ".json")
+	return err == nil || os.IsNotExist(err)
+}
+
+// quarantine moves the object with the given ID, along with any
+// meta-data, into the named directory beneath the root which holds it.
+//
+// Directories are ignored by Existing(), so a quarantined object
+// is no longer listed, or replicated.
+func (fss *FilesystemStorage) quarantine(id string, directory string) error {
+	dir := filepath.Join(filepath.Dir(fss.path(id)), directory)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+
+	if err := os.Rename(fss.path(id), filepath.Join(dir, id)); err != nil {
+		return err
+	}
+
+	//
+	// The meta-data is optional, so a failure to move it is only
+	// a problem if it existed in the first place.
+	//
+	err := os.Rename(fss.path(id)+".json", filepath.Join(dir, id)+".json")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
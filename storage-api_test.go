@@ -5,8 +5,14 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -26,7 +32,10 @@ func TestList(t *testing.T) {
 	//
 	// Get the list of entries, which should be empty
 	//
-	list := storage.Existing()
+	list, err := storage.Existing()
+	if err != nil {
+		t.Fatalf("Failed to list: %v", err)
+	}
 
 	//
 	// To start with our storage-path will be empty.
@@ -69,7 +78,7 @@ func TestList(t *testing.T) {
 	//
 	// Get the updated entries beneath our storage-prefix.
 	//
-	list = storage.Existing()
+	list, _ = storage.Existing()
 
 	//
 	// We should have exactly as many as in our list of filenames.
@@ -160,8 +169,8 @@ func TestStore(t *testing.T) {
 		//
 		// Meta-Data
 		//
-		meta := make(map[string]string)
-		meta["filename"] = id
+		meta := make(Metadata)
+		meta.Set("filename", id)
 
 		//
 		// File won't exist
@@ -186,7 +195,7 @@ func TestStore(t *testing.T) {
 		// Retrieve it to ensure the meta-data matches
 		//
 		_, metaOut := storage.Get(id)
-		if metaOut["filename"] != meta["filename"] {
+		if metaOut.Get("filename") != meta.Get("filename") {
 			t.Errorf("meta-data mismatch after round-trip!")
 		}
 	}
@@ -196,3 +205,285 @@ func TestStore(t *testing.T) {
 	//
 	_ = os.RemoveAll(p)
 }
+
+// testStorageConformance exercises the behaviour every StorageHandler
+// must implement, against the given (empty) storage.
+func testStorageConformance(t *testing.T, storage StorageHandler) {
+	t.Helper()
+
+	if list, err := storage.Existing(); err != nil || len(list) != 0 {
+		t.Fatalf("Empty storage contains results!")
+	}
+
+	//
+	// Missing objects are missing.
+	//
+	if storage.Exists("steve") {
+		t.Errorf("Exists(missing-file) succeeded!")
+	}
+	if data, _ := storage.Get("steve"); data != nil {
+		t.Errorf("Get(missing-file) succeeded!")
+	}
+
+	//
+	// Store some objects, with & without meta-data.
+	//
+	if !storage.Store("steve", []byte("steve"), Metadata{"X-Foo": {"bar"}}) {
+		t.Fatalf("Store failed")
+	}
+	if !storage.Store("kemp", []byte("kemp"), nil) {
+		t.Fatalf("Store failed")
+	}
+
+	for _, id := range []string{"steve", "kemp"} {
+		if !storage.Exists(id) {
+			t.Errorf("Exists(%s) failed after storing", id)
+		}
+
+		data, _ := storage.Get(id)
+		if data == nil || string(*data) != id {
+			t.Errorf("Get(%s) returned the wrong content", id)
+		}
+	}
+
+	if _, meta := storage.Get("steve"); meta.Get("X-Foo") != "bar" {
+		t.Errorf("meta-data mismatch after round-trip!")
+	}
+	if storage.Meta("steve").Get("X-Foo") != "bar" {
+		t.Errorf("Meta(steve) mismatch after round-trip!")
+	}
+	if len(storage.Meta("missing")) != 0 {
+		t.Errorf("Meta(missing-file) returned meta-data!")
+	}
+	if size, ok := storage.Size("steve"); !ok || size != 5 {
+		t.Errorf("Size(steve) returned %d, %v", size, ok)
+	}
+	if _, ok := storage.Size("missing"); ok {
+		t.Errorf("Size(missing-file) succeeded!")
+	}
+
+	if list, _ := storage.Existing(); len(list) != 2 {
+		t.Errorf("Unexpected listing: %v", list)
+	}
+
+	//
+	// Overwriting an object replaces it.
+	//
+	storage.Store("kemp", []byte("replaced"), nil)
+	if data, _ := storage.Get("kemp"); data == nil || string(*data) != "replaced" {
+		t.Errorf("Overwritten object has the wrong content")
+	}
+	if list, _ := storage.Existing(); len(list) != 2 {
+		t.Errorf("Unexpected listing after overwrite: %v", list)
+	}
+}
+
+// Test the filesystem storage conforms to our expectations.
+func TestFilesystemConformance(t *testing.T) {
+	storage := new(FilesystemStorage)
+	storage.Setup(t.TempDir())
+
+	testStorageConformance(t, storage)
+}
+
+// Test that meta-data written by older releases, with a single value
+// for each key, may still be read.
+func TestLegacyMetadata(t *testing.T) {
+	p := t.TempDir()
+
+	storage := new(FilesystemStorage)
+	storage.Setup(p)
+
+	if !storage.Store("steve", []byte("steve"), nil) {
+		t.Fatalf("Store failed")
+	}
+	err := os.WriteFile(filepath.Join(p, "steve.json"), []byte(`{"X-Foo":"bar","X-Tag":["red","blue"]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := storage.Meta("steve")
+	if meta.Get("X-Foo") != "bar" {
+		t.Errorf("Legacy meta-data was not decoded: %v", meta)
+	}
+	if len(meta["X-Tag"]) != 2 {
+		t.Errorf("Multi-valued meta-data was not decoded: %v", meta)
+	}
+}
+
+// Test that a store which cannot be read is not reported as empty.
+func TestListFailure(t *testing.T) {
+	storage := new(FilesystemStorage)
+	storage.Setup(t.TempDir())
+	storage.prefix = filepath.Join(storage.prefix, "missing")
+
+	if list, err := storage.Existing(); err == nil {
+		t.Errorf("Listing a missing store succeeded: %v", list)
+	}
+}
+
+// Test that enumeration visits each object, in batches, and stops upon
+// the first error.
+func TestEnumerate(t *testing.T) {
+	storage := new(FilesystemStorage)
+	storage.Setup(t.TempDir())
+
+	for i := range enumerateBatch + 10 {
+		storage.Store(fmt.Sprintf("object%d", i), []byte("Content"), Metadata{"X-Test": {"yes"}})
+	}
+	if err := os.Mkdir(filepath.Join(storage.prefix, ".trash"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	err := storage.Enumerate(func(id string) error {
+		seen[id] = true
+		return nil
+	})
+	if err != nil || len(seen) != enumerateBatch+10 {
+		t.Errorf("Unexpected enumeration: %d %v", len(seen), err)
+	}
+
+	stop := errors.New("stop")
+	count := 0
+	err = storage.Enumerate(func(string) error {
+		count++
+		return stop
+	})
+	if !errors.Is(err, stop) || count != 1 {
+		t.Errorf("Enumeration did not stop: %d %v", count, err)
+	}
+}
+
+// Test that objects are spread across several roots, and found upon any
+// of them.
+func TestMultipleRoots(t *testing.T) {
+	roots := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+
+	storage := new(FilesystemStorage)
+	storage.Setup(strings.Join(roots, ","))
+
+	var ids []string
+	for i := range 30 {
+		id := fmt.Sprintf("object%02d", i)
+		ids = append(ids, id)
+		if !storage.Store(id, []byte(id), Metadata{"X-Test": {id}}) {
+			t.Fatalf("Failed to store %s", id)
+		}
+	}
+
+	//
+	// Every root should be used, and each object placed upon the
+	// root its ID hashes to.
+	//
+	for i, root := range roots {
+		files, err := os.ReadDir(root)
+		if err != nil || len(files) == 0 {
+			t.Errorf("Root %d was not used: %v", i, err)
+		}
+	}
+	for _, id := range ids {
+		if _, err := os.Stat(filepath.Join(roots[rootIndex(id, len(roots))], id)); err != nil {
+			t.Errorf("%s is not upon its root: %v", id, err)
+		}
+	}
+
+	list, err := storage.Existing()
+	if err != nil || !slices.Equal(list, ids) {
+		t.Errorf("Unexpected listing: %v %v", list, err)
+	}
+
+	//
+	// An object upon another root is still found, e.g. after a root
+	// has been added.
+	//
+	moved := ids[0]
+	source := storage.path(moved)
+	other := roots[(rootIndex(moved, len(roots))+1)%len(roots)]
+	for _, suffix := range []string{"", ".json"} {
+		if err = os.Rename(source+suffix, filepath.Join(other, moved)+suffix); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, meta := storage.Get(moved)
+	if data == nil || string(*data) != moved || meta.Get("X-Test") != moved {
+		t.Errorf("Object upon another root was not found")
+	}
+	if size, ok := storage.Size(moved); !ok || size != int64(len(moved)) {
+		t.Errorf("Unexpected size: %v %v", size, ok)
+	}
+	if !storage.Delete(moved) || storage.Exists(moved) {
+		t.Errorf("Object upon another root was not deleted")
+	}
+}
+
+// Test that concurrent stores of the same ID leave the object complete
+// and correct, without any temporary files.
+func TestStoreConcurrent(t *testing.T) {
+	p := t.TempDir()
+
+	storage := new(FilesystemStorage)
+	storage.Setup(p)
+
+	//
+	// Half of the writers store one content, and half another, so
+	// the object must hold exactly one of them.
+	//
+	contents := [][]byte{
+		bytes.Repeat([]byte("a"), 1024*1024),
+		bytes.Repeat([]byte("b"), 512*1024),
+	}
+
+	var wg sync.WaitGroup
+	for i := range 32 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			meta := make(Metadata)
+			meta.Set("X-Writer", fmt.Sprintf("%d", i%2))
+			if !storage.Store("steve", contents[i%2], meta) {
+				t.Errorf("Store failed")
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, meta := storage.Get("steve")
+	if data == nil {
+		t.Fatalf("Object was not stored")
+	}
+	if !bytes.Equal(*data, contents[0]) && !bytes.Equal(*data, contents[1]) {
+		t.Errorf("Object was torn, holding %d bytes", len(*data))
+	}
+	expected := "0"
+	if bytes.Equal(*data, contents[1]) {
+		expected = "1"
+	}
+	if writer := meta.Get("X-Writer"); writer != expected {
+		t.Errorf("Meta-data of writer %s does not match the data", writer)
+	}
+
+	//
+	// Storing identical content again is a no-op, which succeeds.
+	//
+	if !storage.Store("steve", *data, meta) {
+		t.Errorf("Storing identical content failed")
+	}
+
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if isTempFile(entry.Name()) {
+			t.Errorf("Temporary file left behind: %s", entry.Name())
+		}
+	}
+
+	ids, err := storage.Existing()
+	if err != nil || !slices.Equal(ids, []string{"steve"}) {
+		t.Errorf("Unexpected objects: %v %v", ids, err)
+	}
+}
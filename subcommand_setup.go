@@ -6,9 +6,13 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"net/http"
+	"os"
 	"time"
 
 	"github.com/google/subcommands"
+	"github.com/skx/sos/libconfig"
 )
 
 // Default port constants.
@@ -19,12 +23,25 @@ const (
 )
 
 // HTTP server timeout constants.
+//
+// The api-server and blob-server use these as the defaults of their
+// -read-timeout, -write-timeout, and -idle-timeout flags.
 const (
 	serverReadTimeout  = 15 * time.Second
 	serverWriteTimeout = 15 * time.Second
 	serverIdleTimeout  = 60 * time.Second
 )
 
+// Default limits upon the X-headers stored alongside each object.
+const (
+	defaultMaxMetaHeaders = 64
+	defaultMaxMetaBytes   = 16 * 1024
+)
+
+// defaultBreakerCooldown is how long a failing blob-server is avoided,
+// by default.
+const defaultBreakerCooldown = 30 * time.Second
+
 //
 // This file contains the boiler-plate for the subcommands.
 //
@@ -36,12 +53,76 @@ const (
 
 // Options which may be set via flags for the "api-server" subcommand.
 type apiServerCmd struct {
-	host    string
-	blob    string
-	dport   int
-	uport   int
-	dump    bool
-	verbose bool
+	host     string
+	blob     string
+	dport    int
+	uport    int
+	replicas int
+	quorum   int
+	dump     bool
+	verbose  bool
+
+	allowEmpty  bool
+	selection   string
+	serviceName string
+	pullThrough string
+
+	embeddedBlob string
+
+	probeServers      bool
+	requireAllServers bool
+
+	signingKey       string
+	requireSignature bool
+
+	adminToken         string
+	maintenanceMessage string
+	maintenanceRetry   time.Duration
+
+	maxMetaHeaders int
+	maxMetaBytes   int
+
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	downloadParallelism int
+	readRepair          bool
+	blobServerHeader    bool
+	serverConnections   int
+
+	idScheme string
+
+	blobPath string
+
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	idleTimeout    time.Duration
+	copyBufferSize int
+	hashChunkSize  int
+
+	h2c        bool
+	maxStreams int
+	keepAlive  bool
+
+	maxHeaderBytes int
+	maxURLLength   int
+	minUploadRate  int64
+
+	bindAttempts int
+	bindBackoff  time.Duration
+
+	clientCert string
+	clientKey  string
+	blobCA     string
+
+	notFoundTTL time.Duration
+
+	manifest string
+
+	namespaceUploads bool
+	namespaceSalt    string
+
+	configDir string
 }
 
 // Glue.
@@ -57,23 +138,131 @@ func (*apiServerCmd) Usage() string {
 func (p *apiServerCmd) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&p.host, "api-host", "0.0.0.0", "The IP to listen upon.")
 	f.StringVar(&p.blob, "blob-server", "", "Comma-separated list of blob-servers to contact.")
+	f.StringVar(&p.embeddedBlob, "embedded-blob", "", "Store objects in this directory, via an in-process blob-server, rather than contacting blob-servers.")
 	f.IntVar(&p.dport, "download-port", defaultAPIDownloadPort, "The port to bind upon for downloading objects.")
 	f.IntVar(&p.uport, "upload-port", defaultAPIUploadPort, "The port to bind upon for uploading objects.")
+	f.IntVar(&p.replicas, "replicas", 0, "Upload to this many blob-servers concurrently (0 to try each in turn).")
+	f.IntVar(&p.quorum, "write-quorum", 0, "How many replicas must succeed for an upload to succeed (0 for a majority).")
+	f.IntVar(&p.serverConnections, "server-connections", 0, "The number of requests which may be in flight to each blob-server (0 for no limit).")
+	f.IntVar(&p.downloadParallelism, "download-parallelism", 1, "How many blob-servers to ask for an object at once, the first response winning.")
+	f.IntVar(&p.breakerThreshold, "breaker-threshold", 0, "Avoid blob-servers after this many consecutive failures (0 to disable).")
+	f.DurationVar(&p.breakerCooldown, "breaker-cooldown", defaultBreakerCooldown, "How long to avoid a failing blob-server.")
+	f.DurationVar(&p.readTimeout, "read-timeout", serverReadTimeout, "The maximum time to read an entire request, including the body.")
+	f.DurationVar(&p.writeTimeout, "write-timeout", serverWriteTimeout, "The maximum time to write a response.")
+	f.DurationVar(&p.idleTimeout, "idle-timeout", serverIdleTimeout, "How long to keep idle connections open.")
+	f.BoolVar(&p.keepAlive, "keep-alive", true, "Keep connections open between requests, for up to -idle-timeout.")
+	f.BoolVar(&p.h2c, "h2c", false, "Accept unencrypted HTTP/2 connections, as well as HTTP/1.1.")
+	f.IntVar(&p.maxStreams, "max-concurrent-streams", 0, "The number of concurrent HTTP/2 requests per connection (0 for the default).")
+	f.IntVar(&p.maxHeaderBytes, "max-header-bytes", 0, "The maximum size of the headers of a request (0 for the default of 1MiB).")
+	f.IntVar(&p.maxURLLength, "max-url-length", defaultMaxURLLength, "Reject requests whose URL is longer than this (0 to disable).")
+	f.Int64Var(&p.minUploadRate, "min-upload-rate", 0, "Abort uploads whose body arrives slower than this many bytes per second (0 to disable).")
+	f.IntVar(&p.bindAttempts, "bind-attempts", defaultBindAttempts, "How many times to try binding our port, while it is in use by a previous process.")
+	f.DurationVar(&p.bindBackoff, "bind-backoff", defaultBindBackoff, "The delay before retrying to bind our port, which doubles after each attempt.")
+	f.IntVar(&p.copyBufferSize, "copy-buffer-size", copyChunkSize, "The size of the pooled buffers used to copy responses.")
+	f.IntVar(&p.hashChunkSize, "hash-chunk-size", hashChunkSize, "The amount of an upload to read, and hash, at a time.")
+	f.BoolVar(&p.probeServers, "probe-servers", false, "Test that each blob-server is reachable at startup.")
+	f.BoolVar(&p.requireAllServers, "require-all-servers", false, "Refuse to start unless every blob-server is reachable (implies -probe-servers).")
+	f.BoolVar(&p.allowEmpty, "allow-empty-objects", false, "Allow zero-length objects to be uploaded.")
+	f.StringVar(&p.idScheme, "id-scheme", idSchemeSHA256, "How to name uploaded objects, 'sha256' of their content, 'uuid', or 'random'.")
+	f.StringVar(&p.blobPath, "blob-path", libconfig.DefaultBlobPath, "The path of objects upon the blob-servers, containing {id}, and optionally {shard}.")
+	f.StringVar(&p.serviceName, "service-name", "sos", "The name of the service, as reported at the root of each port.")
+	f.IntVar(&p.maxMetaHeaders, "max-meta-headers", defaultMaxMetaHeaders, "Refuse uploads with more X-headers than this (0 for no limit).")
+	f.IntVar(&p.maxMetaBytes, "max-meta-bytes", defaultMaxMetaBytes, "Refuse uploads whose X-headers total more bytes than this (0 for no limit).")
+	f.StringVar(&p.adminToken, "admin-token", "", "The token which authorizes requests to /admin (default $"+envAdminToken+").")
+	f.StringVar(&p.maintenanceMessage, "maintenance-message", defaultMaintenanceMessage, "The error returned to requests in maintenance mode.")
+	f.DurationVar(&p.maintenanceRetry, "maintenance-retry-after", defaultMaintenanceRetry, "The Retry-After sent to requests in maintenance mode.")
+	f.StringVar(&p.signingKey, "signing-key", "", "The key used to sign download URLs (default $"+envSigningKey+").")
+	f.BoolVar(&p.requireSignature, "require-signature", false, "Refuse downloads which don't have a valid signature.")
+	f.BoolVar(&p.readRepair, "read-repair", false, "Copy downloaded objects back to the members of their group which were missing them.")
+	f.BoolVar(&p.blobServerHeader, "blob-server-header", false, "Name the blob-server which answered each download in the X-Blob-Server header.")
+	f.StringVar(&p.clientCert, "client-cert", "", "Present the PEM-encoded certificate in this file to the blob-servers.")
+	f.StringVar(&p.clientKey, "client-key", "", "The PEM-encoded private key of the -client-cert.")
+	f.StringVar(&p.blobCA, "blob-ca", "", "Trust blob-servers whose certificates are signed by the PEM-encoded authority in this file.")
+	f.DurationVar(&p.notFoundTTL, "not-found-ttl", 0, "Remember objects missing from every blob-server for this long, e.g. 5s (0 to disable).")
+	f.StringVar(&p.manifest, "manifest", "", "Append a JSON record of the ID and size of each object stored to this file.")
+	f.BoolVar(&p.namespaceUploads, "namespace-uploads", false, "Mix the X-Tenant header of each upload into its ID, so that tenants never share objects.")
+	f.StringVar(&p.namespaceSalt, "namespace-salt", "", "The secret mixed into namespaced IDs, so that they cannot be guessed (default $"+envNamespaceSalt+").")
+	f.StringVar(&p.configDir, "config-dir", "", "Merge in the blob-servers of each *.conf file within this directory, e.g. /etc/sos/conf.d.")
+	f.StringVar(&p.pullThrough, "pull-through", "", "Copy objects downloaded from other groups into this, local, group.")
+	f.StringVar(&p.selection, "selection", "groups", "How to order blob-servers, 'groups' or 'ring' for consistent-hashing.")
 	f.BoolVar(&p.dump, "dump", false, "Dump configuration and exit?")
 	f.BoolVar(&p.verbose, "verbose", false, "Show more output from the API-server.")
 }
 
 // Entry-point - pass control to the API-server setup function.
 func (p *apiServerCmd) Execute(_ context.Context, _ *flag.FlagSet, _ ...any) subcommands.ExitStatus {
-	apiServer(*p)
+	if err := apiServer(*p); err != nil {
+		GetLogger().Error("API-server failed", "error", err)
+		return subcommands.ExitFailure
+	}
 	return subcommands.ExitSuccess
 }
 
 // Options which may be set via flags for the "blob-server" subcommand.
 type blobServerCmd struct {
-	store string
-	port  int
-	host  string
+	store    string
+	storage  string
+	port     int
+	host     string
+	prefix   string
+	idLength int
+	s3compat bool
+	check    bool
+
+	notFoundBlob   string
+	notFoundStatus int
+	trackAccess    bool
+	aliases        bool
+	allowEmpty     bool
+	maxObjects     int
+	minFreePercent float64
+	allowMime      string
+	denyMime       string
+	maxMetaHeaders int
+	maxMetaBytes   int
+
+	defaultCacheControl string
+	softDelete          time.Duration
+
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	idleTimeout    time.Duration
+	copyBufferSize int
+
+	h2c        bool
+	maxStreams int
+	keepAlive  bool
+
+	maxHeaderBytes int
+	maxURLLength   int
+	minUploadRate  int64
+
+	bindAttempts int
+	bindBackoff  time.Duration
+
+	webhookURL    string
+	webhookSecret string
+
+	auditLog string
+
+	name     string
+	servedBy bool
+
+	buckets bool
+
+	blobPath string
+
+	tlsCert  string
+	tlsKey   string
+	clientCA string
+
+	streamThreshold int64
+
+	uploadTTL time.Duration
+
+	// embedded is set for the blob-server within the API-server,
+	// which must not chroot() the process it shares.
+	embedded bool
 }
 
 // Glue.
@@ -90,18 +279,93 @@ func (p *blobServerCmd) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&p.host, "host", "127.0.0.1", "The IP to listen upon")
 	f.IntVar(&p.port, "port", defaultBlobServerPort, "The port to bind upon")
 	f.StringVar(&p.store, "store", "data", "The location to write the data  to")
+	f.StringVar(&p.storage, "storage", "filesystem", "The storage backend to use, 'filesystem' or 'pack'.")
+	f.StringVar(&p.prefix, "path-prefix", "", "A prefix to place before each of our routes, e.g. /sos")
+	f.IntVar(&p.idLength, "id-length", 0, "Reject IDs which are not exactly this long (0 to disable).")
+	f.BoolVar(&p.s3compat, "s3-compat", false, "Verify Content-MD5 on upload, and return MD5 ETags on download.")
+	f.BoolVar(&p.check, "check", false, "Validate the configuration and exit, without serving.")
+	f.StringVar(&p.notFoundBlob, "not-found-blob", "", "The ID of an object to serve in place of missing objects.")
+	f.StringVar(&p.defaultCacheControl, "default-cache-control", "", "The Cache-Control sent with objects uploaded without one, e.g. 'public, max-age=3600'.")
+	f.IntVar(&p.notFoundStatus, "not-found-status", http.StatusNotFound, "The status-code to send with the -not-found-blob, 404 or 200.")
+	f.DurationVar(&p.readTimeout, "read-timeout", serverReadTimeout, "The maximum time to read an entire request, including the body.")
+	f.DurationVar(&p.writeTimeout, "write-timeout", serverWriteTimeout, "The maximum time to write a response.")
+	f.DurationVar(&p.idleTimeout, "idle-timeout", serverIdleTimeout, "How long to keep idle connections open.")
+	f.BoolVar(&p.keepAlive, "keep-alive", true, "Keep connections open between requests, for up to -idle-timeout.")
+	f.BoolVar(&p.h2c, "h2c", false, "Accept unencrypted HTTP/2 connections, as well as HTTP/1.1.")
+	f.IntVar(&p.maxStreams, "max-concurrent-streams", 0, "The number of concurrent HTTP/2 requests per connection (0 for the default).")
+	f.IntVar(&p.maxHeaderBytes, "max-header-bytes", 0, "The maximum size of the headers of a request (0 for the default of 1MiB).")
+	f.IntVar(&p.maxURLLength, "max-url-length", defaultMaxURLLength, "Reject requests whose URL is longer than this (0 to disable).")
+	f.Int64Var(&p.minUploadRate, "min-upload-rate", 0, "Abort uploads whose body arrives slower than this many bytes per second (0 to disable).")
+	f.IntVar(&p.bindAttempts, "bind-attempts", defaultBindAttempts, "How many times to try binding our port, while it is in use by a previous process.")
+	f.DurationVar(&p.bindBackoff, "bind-backoff", defaultBindBackoff, "The delay before retrying to bind our port, which doubles after each attempt.")
+	f.IntVar(&p.copyBufferSize, "copy-buffer-size", copyChunkSize, "The size of the pooled buffers used to copy responses.")
+	f.BoolVar(&p.allowEmpty, "allow-empty-objects", false, "Allow zero-length objects to be stored.")
+	f.IntVar(&p.maxMetaHeaders, "max-meta-headers", defaultMaxMetaHeaders, "Refuse uploads with more X-headers than this (0 for no limit).")
+	f.IntVar(&p.maxMetaBytes, "max-meta-bytes", defaultMaxMetaBytes, "Refuse uploads whose X-headers total more bytes than this (0 for no limit).")
+	f.StringVar(&p.allowMime, "allow-mime", "", "Only store uploads with these content-types, comma-separated, e.g. 'image/*'.")
+	f.StringVar(&p.denyMime, "deny-mime", "", "Refuse uploads with these content-types, comma-separated, e.g. 'text/html'.")
+	f.StringVar(&p.webhookURL, "webhook-url", "", "Announce each object stored by POSTing its ID, size, and meta-data, to this URL.")
+	f.StringVar(&p.webhookSecret, "webhook-secret", "", "The secret with which webhook bodies are signed (default $"+envWebhookSecret+").")
+	f.StringVar(&p.name, "name", hostname(), "The name of this node, attached to each log line.")
+	f.BoolVar(&p.servedBy, "served-by", false, "Send our -name as the X-Served-By header of each download.")
+	f.StringVar(&p.auditLog, "audit-log", "", "Append a JSON record of each object stored or deleted to this file.")
+	f.DurationVar(&p.softDelete, "soft-delete", 0, "Allow objects to be deleted, keeping them in a trash for this long (0 to disable deletion).")
+	f.DurationVar(&p.uploadTTL, "upload-ttl", 24*time.Hour, "Remove upload-sessions which receive nothing for this long (0 to keep them forever).")
+	f.BoolVar(&p.buckets, "buckets", false, "Allow objects to be stored, and fetched, as bucket/key via /b/{bucket}/{key}.")
+	f.StringVar(&p.blobPath, "blob-path", libconfig.DefaultBlobPath, "The path of objects upon the blob-servers, containing {id}, and optionally {shard}.")
+	f.BoolVar(&p.aliases, "aliases", false, "Allow names to be pointed at objects, via /alias/{name}.")
+	f.BoolVar(&p.trackAccess, "track-access", false, "Count the reads of each object, and record the time of the last.")
+	f.Float64Var(&p.minFreePercent, "min-free-percent", 0, "Refuse uploads when less than this percentage of the disk is free (0 to disable).")
+	f.IntVar(&p.maxObjects, "max-objects", 0, "Refuse uploads of new objects once this many are stored (0 to disable).")
+	f.StringVar(&p.tlsCert, "tls-cert", "", "Serve HTTPS, with the PEM-encoded certificate in this file.")
+	f.StringVar(&p.tlsKey, "tls-key", "", "The PEM-encoded private key of the -tls-cert.")
+	f.StringVar(&p.clientCA, "client-ca", "", "Require clients to present a certificate signed by the PEM-encoded authority in this file.")
+	f.Int64Var(&p.streamThreshold, "stream-threshold", 0, "Stream objects of at least this many bytes from disk, rather than reading them into memory (0 to disable).")
 }
 
 // Entry-point.
 func (p *blobServerCmd) Execute(_ context.Context, _ *flag.FlagSet, _ ...any) subcommands.ExitStatus {
-	blobServer(*p)
+	if p.check {
+		if !checkBlobServer(*p) {
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	}
+	if err := blobServer(*p); err != nil {
+		GetLogger().Error("Blob-server failed", "error", err)
+		return subcommands.ExitFailure
+	}
 	return subcommands.ExitSuccess
 }
 
 // Options which may be set via flags for the "replicate" subcommand.
 type replicateCmd struct {
-	blob    string
-	verbose bool
+	blob       string
+	fromAPI    string
+	prefix     string
+	shard      string
+	deadline   time.Duration
+	loop       time.Duration
+	statusPort int
+	verify     bool
+	verbose    bool
+
+	serverConnections int
+	resumableSize     int64
+
+	blobPath string
+
+	since time.Duration
+
+	copyBufferSize int
+
+	clientCert string
+	clientKey  string
+	blobCA     string
+
+	configDir string
+
+	listConcurrency int
 }
 
 // Glue.
@@ -116,12 +380,192 @@ func (*replicateCmd) Usage() string {
 // Flag setup.
 func (p *replicateCmd) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&p.blob, "blob-server", "", "Comma-separated list of blob-servers to contact.")
+	f.StringVar(&p.fromAPI, "from-api", "", "Read the blob-servers from the API-server at this (upload) URL.")
+	f.StringVar(&p.prefix, "prefix", "", "Only replicate objects whose IDs begin with this prefix.")
+	f.DurationVar(&p.since, "since", 0, "Only replicate objects stored within this long, e.g. 2h (0 for every object).")
+	f.IntVar(&p.copyBufferSize, "copy-buffer-size", copyChunkSize, "The size of the pooled buffers used to stream objects between blob-servers.")
+	f.StringVar(&p.configDir, "config-dir", "", "Merge in the blob-servers of each *.conf file within this directory, e.g. /etc/sos/conf.d.")
+	f.StringVar(&p.clientCert, "client-cert", "", "Present the PEM-encoded certificate in this file to the blob-servers.")
+	f.StringVar(&p.clientKey, "client-key", "", "The PEM-encoded private key of the -client-cert.")
+	f.StringVar(&p.blobCA, "blob-ca", "", "Trust blob-servers whose certificates are signed by the PEM-encoded authority in this file.")
+	f.StringVar(&p.shard, "shard", "", "Only replicate the objects within shard i of n, e.g. '0/4'.")
+	f.DurationVar(&p.deadline, "deadline", 0, "Abandon a replication pass which takes longer than this (0 for no limit).")
+	f.DurationVar(&p.loop, "loop", 0, "Repeat the replication with this delay between passes, rather than running once.")
+	f.IntVar(&p.statusPort, "status-port", 0, "Serve our progress, as JSON, upon this port (0 to disable).")
+	f.IntVar(&p.serverConnections, "server-connections", 0, "The number of requests which may be in flight to each blob-server (0 for no limit).")
+	f.IntVar(&p.listConcurrency, "list-concurrency", 8, "The number of blob-servers whose objects are listed at once (0 for every server in a group).")
+	f.Int64Var(&p.resumableSize, "resumable-size", defaultResumableSize, "Mirror objects of at least this many bytes via resumable upload-sessions (0 to disable).")
+	f.StringVar(&p.blobPath, "blob-path", libconfig.DefaultBlobPath, "The path of objects upon the blob-servers, containing {id}, and optionally {shard}.")
+	f.BoolVar(&p.verify, "verify", false, "Re-fetch each mirrored object, and check its content matches that which was sent.")
 	f.BoolVar(&p.verbose, "verbose", false, "Be more verbose?")
 }
 
 // Entry-point - invoke the main replication-routine.
 func (p *replicateCmd) Execute(_ context.Context, _ *flag.FlagSet, _ ...any) subcommands.ExitStatus {
-	replicate(*p)
+	if replicate(*p) != nil {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// Options which may be set via flags for the "scrub" subcommand.
+type scrubCmd struct {
+	store      string
+	blob       string
+	quarantine bool
+	verbose    bool
+}
+
+// Glue.
+func (*scrubCmd) Name() string     { return "scrub" }
+func (*scrubCmd) Synopsis() string { return "Verify the integrity of a local store." }
+func (*scrubCmd) Usage() string {
+	return `scrub :
+  Rehash every object beneath a blob-server's store, and report those
+  which do not match their ID.  With -blob-server each of the given
+  blob-servers is asked to verify its own objects instead.
+`
+}
+
+// Flag setup.
+func (p *scrubCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.store, "store", "data", "The location of the data to verify")
+	f.StringVar(&p.blob, "blob-server", "", "Comma-separated list of blob-servers to verify, remotely, rather than a local store.")
+	f.BoolVar(&p.quarantine, "quarantine", false, "Move corrupt objects into the "+quarantineDirectory+" directory.")
+	f.BoolVar(&p.verbose, "verbose", false, "Report upon every object examined.")
+}
+
+// Entry-point - fail if any corrupt objects were found.
+func (p *scrubCmd) Execute(_ context.Context, _ *flag.FlagSet, _ ...any) subcommands.ExitStatus {
+	if corrupt, err := scrub(*p); err != nil || corrupt > 0 {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// Options which may be set via flags for the "put" subcommand.
+type putCmd struct {
+	server string
+	mime   string
+}
+
+// Glue.
+func (*putCmd) Name() string     { return "put" }
+func (*putCmd) Synopsis() string { return "Upload objects via an API-server." }
+func (*putCmd) Usage() string {
+	return `put [file...] :
+  Upload the named files, or STDIN, and show the ID of each.
+`
+}
+
+// Flag setup.
+func (p *putCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.server, "api-server", fmt.Sprintf("http://localhost:%d", defaultAPIUploadPort), "The upload URL of the API-server.")
+	f.StringVar(&p.mime, "mime", "", "The MIME-type to store alongside the objects.")
+}
+
+// Entry-point.
+func (p *putCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...any) subcommands.ExitStatus {
+	if err := put(*p, f.Args(), os.Stdout); err != nil {
+		GetLogger().Error("Upload failed", "error", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// Options which may be set via flags for the "cat" subcommand.
+type catCmd struct {
+	server string
+	blob   string
+}
+
+// Glue.
+func (*catCmd) Name() string     { return "cat" }
+func (*catCmd) Synopsis() string { return "Fetch objects, by ID." }
+func (*catCmd) Usage() string {
+	return `cat id [id...] :
+  Fetch the objects with the given IDs, and write them to STDOUT.
+`
+}
+
+// Flag setup.
+func (p *catCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.server, "api-server", fmt.Sprintf("http://localhost:%d", defaultAPIDownloadPort), "The download URL of the API-server.")
+	f.StringVar(&p.blob, "blob-server", "", "Comma-separated list of blob-servers to fetch from directly, instead.")
+}
+
+// Entry-point.
+func (p *catCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...any) subcommands.ExitStatus {
+	if err := cat(*p, f.Args(), os.Stdout); err != nil {
+		GetLogger().Error("Fetch failed", "error", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// Options which may be set via flags for the "smoke-test" subcommand.
+type smokeTestCmd struct {
+	upload   string
+	download string
+	head     bool
+	keep     bool
+}
+
+// Glue.
+func (*smokeTestCmd) Name() string     { return "smoke-test" }
+func (*smokeTestCmd) Synopsis() string { return "Test a deployment, end to end." }
+func (*smokeTestCmd) Usage() string {
+	return `smoke-test :
+  Upload a small object via the API-server, fetch it back, check that
+  its content matches, and remove it again, reporting each step.
+`
+}
+
+// Flag setup.
+func (p *smokeTestCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.upload, "api-server", fmt.Sprintf("http://localhost:%d", defaultAPIUploadPort), "The upload URL of the API-server.")
+	f.StringVar(&p.download, "download-server", fmt.Sprintf("http://localhost:%d", defaultAPIDownloadPort), "The download URL of the API-server.")
+	f.BoolVar(&p.head, "head", false, "Also test that the object exists, via a HEAD request.")
+	f.BoolVar(&p.keep, "keep", false, "Leave the uploaded object in place, rather than deleting it.")
+}
+
+// Entry-point - fail if any step did.
+func (p *smokeTestCmd) Execute(_ context.Context, _ *flag.FlagSet, _ ...any) subcommands.ExitStatus {
+	if showSmokeTest(smokeTest(*p), os.Stdout) > 0 {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// Options which may be set via flags for the "status" subcommand.
+type statusCmd struct {
+	blob      string
+	configDir string
+	json      bool
+}
+
+// Glue.
+func (*statusCmd) Name() string     { return "status" }
+func (*statusCmd) Synopsis() string { return "Report upon the health of our blob-servers." }
+func (*statusCmd) Usage() string {
+	return `status :
+  Query each blob-server, and report which are up, how many objects
+  they hold, and how full their disks are.
+`
+}
+
+// Flag setup.
+func (p *statusCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.blob, "blob-server", "", "Comma-separated list of blob-servers to contact.")
+	f.StringVar(&p.configDir, "config-dir", "", "Merge in the blob-servers of each *.conf file within this directory, e.g. /etc/sos/conf.d.")
+	f.BoolVar(&p.json, "json", false, "Output JSON, rather than a table.")
+}
+
+// Entry-point - fail if any blob-server was unreachable.
+func (p *statusCmd) Execute(_ context.Context, _ *flag.FlagSet, _ ...any) subcommands.ExitStatus {
+	if status(*p, os.Stdout) > 0 {
+		return subcommands.ExitFailure
+	}
 	return subcommands.ExitSuccess
 }
 
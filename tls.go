@@ -0,0 +1,115 @@
+//
+// Mutual TLS between our components.
+//
+// The blob-server may serve HTTPS, via `-tls-cert` and `-tls-key`, and
+// may additionally require that each client presents a certificate signed
+// by the authority given as `-client-ca`.  This locks the internal blob
+// API down to trusted components, without sharing a bearer token.
+//
+// The API-server, and replicate, present the certificate given by their
+// `-client-cert` and `-client-key` flags to the blob-servers, and trust
+// the blob-servers' certificates if they are signed by `-blob-ca`.
+//
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// loadCertPool reads the PEM-encoded certificates in the given file.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// serverTLSConfig returns the TLS configuration of a blob-server, or nil
+// if it is to serve plain HTTP.
+//
+// If a clientCA is given then each client must present a certificate
+// signed by it.
+func serverTLSConfig(certFile string, keyFile string, clientCA string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCA != "" {
+			return nil, errors.New("-client-ca requires -tls-cert and -tls-key")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("-tls-cert and -tls-key must be given together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCA != "" {
+		pool, err := loadCertPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// clientTLSConfig returns the TLS configuration with which we contact the
+// blob-servers, or nil if none of the files are given.
+func clientTLSConfig(certFile string, keyFile string, serverCA string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" && serverCA == "" {
+		return nil, nil
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("-client-cert and -client-key must be given together")
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if serverCA != "" {
+		pool, err := loadCertPool(serverCA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// setClientTLS configures the TLS used by our outbound requests, which
+// are all made via the default transport.
+func setClientTLS(certFile string, keyFile string, serverCA string) error {
+	config, err := clientTLSConfig(certFile, keyFile, serverCA)
+	if err != nil || config == nil {
+		return err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport)
+	transport.TLSClientConfig = config
+	transport.CloseIdleConnections()
+	return nil
+}
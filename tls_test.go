@@ -0,0 +1,133 @@
+// Testing of mutual TLS between our components.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert creates a certificate, signed by the given parent, or
+// self-signed if there is none, and writes it, and its key, to the
+// given directory.
+func writeCert(t *testing.T, dir string, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	_ = os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return cert, key
+}
+
+// Test that a blob-server requiring client certificates only accepts
+// requests from clients presenting one.
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "client", ca, caKey)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	config, err := serverTLSConfig(path("server.pem"), path("server.key"), path("ca.pem"))
+	if err != nil {
+		t.Fatalf("Failed to configure the server: %v", err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		res.WriteHeader(http.StatusNoContent)
+	}))
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	//
+	// Without a client certificate we're refused.
+	//
+	anonymous, err := clientTLSConfig("", "", path("ca.pem"))
+	if err != nil {
+		t.Fatalf("Failed to configure the client: %v", err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: anonymous}}
+	if response, err := client.Get(server.URL); err == nil {
+		response.Body.Close()
+		t.Errorf("Expected a request without a client certificate to fail")
+	}
+
+	//
+	// With one we're accepted.
+	//
+	defaults := http.DefaultTransport.(*http.Transport)
+	previous := defaults.TLSClientConfig
+	defer func() {
+		defaults.TLSClientConfig = previous
+		defaults.CloseIdleConnections()
+	}()
+
+	if err := setClientTLS(path("client.pem"), path("client.key"), path("ca.pem")); err != nil {
+		t.Fatalf("Failed to configure the client: %v", err)
+	}
+	response, err := newBlobClient().Get(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to make a request with a client certificate: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		t.Errorf("Unexpected status-code: %v", response.StatusCode)
+	}
+}
+
+// Test that incomplete TLS configurations are rejected.
+func TestTLSConfigInvalid(t *testing.T) {
+	if config, err := serverTLSConfig("", "", ""); config != nil || err != nil {
+		t.Errorf("Expected plain HTTP without certificates, got %v %v", config, err)
+	}
+	if _, err := serverTLSConfig("", "", "ca.pem"); err == nil {
+		t.Errorf("Expected -client-ca without a certificate to fail")
+	}
+	if _, err := serverTLSConfig("server.pem", "", ""); err == nil {
+		t.Errorf("Expected -tls-cert without -tls-key to fail")
+	}
+	if _, err := clientTLSConfig("client.pem", "", ""); err == nil {
+		t.Errorf("Expected -client-cert without -client-key to fail")
+	}
+	if _, err := clientTLSConfig("", "", filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Errorf("Expected a missing -blob-ca to fail")
+	}
+}
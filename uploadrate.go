@@ -0,0 +1,105 @@
+//
+// Minimum upload rate.
+//
+// A client which trickles the body of an upload, a byte at a time, keeps
+// a connection, and a goroutine, busy for as long as it likes, within
+// the -read-timeout.  Both servers accept `-min-upload-rate`, in bytes
+// per second, in which case the read-deadline of an upload is advanced
+// as its body arrives: after a short grace period the body must keep up
+// with the given rate, on average, or the upload is aborted with a
+// `408 Request Timeout`.
+//
+// Large uploads which arrive steadily are unaffected, no matter how long
+// they take, other than remaining subject to any -read-timeout.
+//
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// uploadRateGrace is how long an upload may take before its rate is
+// considered, to allow for slow starts.
+//
+// This is a variable so that it may be shortened by our tests.
+var uploadRateGrace = 10 * time.Second
+
+// errUploadTooSlow is returned when reading an upload which has fallen
+// below the minimum rate.
+var errUploadTooSlow = errors.New("upload too slow")
+
+// minRateBody is a request-body which must be read at, or above, a
+// minimum rate.
+type minRateBody struct {
+	io.ReadCloser
+	rc *http.ResponseController
+
+	// rate is the minimum rate, in bytes per second.
+	rate int64
+
+	// start is the time the upload began, and limit the latest
+	// deadline we'll set, or zero for none.
+	start time.Time
+	limit time.Time
+
+	// read is the number of bytes read so far.
+	read int64
+}
+
+// deadline returns the time by which the next byte must arrive.
+func (b *minRateBody) deadline() time.Time {
+	deadline := b.start.Add(uploadRateGrace + time.Duration(b.read+1)*time.Second/time.Duration(b.rate))
+	if !b.limit.IsZero() && deadline.After(b.limit) {
+		return b.limit
+	}
+	return deadline
+}
+
+// Read extends the read-deadline, in proportion to the bytes received so
+// far, then reads from the body.
+func (b *minRateBody) Read(data []byte) (int, error) {
+	_ = b.rc.SetReadDeadline(b.deadline())
+
+	n, err := b.ReadCloser.Read(data)
+	b.read += int64(n)
+
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		err = errUploadTooSlow
+	case errors.Is(err, io.EOF):
+		//
+		// Our deadline must not outlive the body, lest it break
+		// the next request upon the connection.
+		//
+		_ = b.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+// limitUploadRate arranges for the body of the given request to be read
+// at, or above, the given rate in bytes per second.
+//
+// Nothing is done if the rate is zero, or the connection doesn't support
+// read-deadlines.  A non-zero readTimeout is the longest the upload may
+// take, as the server would otherwise enforce.
+func limitUploadRate(res http.ResponseWriter, req *http.Request, rate int64, readTimeout time.Duration) {
+	if rate <= 0 || req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+
+	now := time.Now()
+	body := &minRateBody{ReadCloser: req.Body, rc: http.NewResponseController(res), rate: rate, start: now}
+	if readTimeout > 0 {
+		body.limit = now.Add(readTimeout)
+	}
+
+	if err := body.rc.SetReadDeadline(body.deadline()); err != nil {
+		return
+	}
+	req.Body = body
+}
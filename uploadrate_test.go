@@ -0,0 +1,69 @@
+// Testing of the minimum upload rate.
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Test that stalled uploads are aborted, and steady ones are not.
+func TestMinUploadRate(t *testing.T) {
+	uploadRateGrace = 100 * time.Millisecond
+	defer func() { uploadRateGrace = 10 * time.Second }()
+
+	storageHandler := new(FilesystemStorage)
+	storageHandler.Setup(t.TempDir())
+	setStorage(storageHandler)
+	defer setStorage(nil)
+
+	setBlobOptions(blobServerCmd{minUploadRate: 1024})
+	defer setBlobOptions(blobServerCmd{})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/blob/{id}", UploadHandler).Methods("POST")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	//
+	// A steady upload succeeds.
+	//
+	response, err := http.Post(server.URL+"/blob/steady", "", strings.NewReader(strings.Repeat("x", 64*1024)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", response.StatusCode)
+	}
+
+	//
+	// An upload which trickles a few bytes, then stalls, does not.
+	//
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	go func() {
+		_, _ = writer.Write([]byte("slow"))
+	}()
+
+	start := time.Now()
+	response, err = http.Post(server.URL+"/blob/stalled", "", reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("Unexpected status-code: %v", response.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("The stalled upload took too long to abort: %v", elapsed)
+	}
+	if storageHandler.Exists("stalled") {
+		t.Errorf("The stalled upload was stored")
+	}
+}
@@ -0,0 +1,143 @@
+//
+// Machine-readable usage information.
+//
+// Wrappers which build user-interfaces, or validation, around our
+// sub-commands would otherwise need to scrape the output of `-help`.
+// Instead the hidden global `-print-flags-json` option prints the flags
+// of the named sub-command, or the global flags if none is named, as
+// JSON and exits:
+//
+//	$ sos -print-flags-json blob-server
+//
+// The option is removed from our arguments before they are parsed, rather
+// than being registered, so that it isn't shown by `sos flags`, or in the
+// usage of the global flags.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/subcommands"
+)
+
+// flagDescription describes a single flag.
+type flagDescription struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Default string `json:"default"`
+	Usage   string `json:"usage"`
+}
+
+// commandDescription describes a sub-command, and its flags.
+type commandDescription struct {
+	Command  string            `json:"command,omitempty"`
+	Synopsis string            `json:"synopsis,omitempty"`
+	Flags    []flagDescription `json:"flags"`
+}
+
+// describeFlag returns the description of the given flag.
+func describeFlag(f *flag.Flag) flagDescription {
+	kind := "string"
+	if getter, ok := f.Value.(flag.Getter); ok {
+		switch getter.Get().(type) {
+		case bool:
+			kind = "bool"
+		case int, int64, uint, uint64:
+			kind = "int"
+		case float64:
+			kind = "float"
+		case time.Duration:
+			kind = "duration"
+		}
+	}
+	return flagDescription{Name: f.Name, Type: kind, Default: f.DefValue, Usage: f.Usage}
+}
+
+// describeFlags returns the description of each flag visited by the
+// given function.
+func describeFlags(visit func(func(*flag.Flag))) []flagDescription {
+	flags := []flagDescription{}
+	visit(func(f *flag.Flag) {
+		flags = append(flags, describeFlag(f))
+	})
+	return flags
+}
+
+// describeCommand returns the description of the given sub-command.
+func describeCommand(cmd subcommands.Command) commandDescription {
+	set := flag.NewFlagSet(cmd.Name(), flag.ContinueOnError)
+	cmd.SetFlags(set)
+
+	return commandDescription{
+		Command:  cmd.Name(),
+		Synopsis: cmd.Synopsis(),
+		Flags:    describeFlags(set.VisitAll),
+	}
+}
+
+// takeHiddenFlag removes the named boolean flag from the given arguments,
+// if it is present before the sub-command, returning the remaining
+// arguments and whether it was present.
+//
+// The flags of the given set are consulted so that the value of a global
+// flag isn't mistaken for the name of the sub-command.
+func takeHiddenFlag(flags *flag.FlagSet, args []string, name string) ([]string, bool) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			break
+		}
+
+		flagName, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if flagName == name {
+			enabled := true
+			if hasValue {
+				enabled, _ = strconv.ParseBool(value)
+			}
+			remaining := append([]string{}, args[:i]...)
+			return append(remaining, args[i+1:]...), enabled
+		}
+
+		//
+		// Skip the value of a non-boolean flag given as `-flag value`.
+		//
+		if registered := flags.Lookup(flagName); registered != nil && !hasValue {
+			if boolean, ok := registered.Value.(interface{ IsBoolFlag() bool }); !ok || !boolean.IsBoolFlag() {
+				i++
+			}
+		}
+	}
+	return args, false
+}
+
+// printFlagsJSON writes the description of the named sub-command of the
+// given commander, or of its global flags if name is empty, as JSON.
+func printFlagsJSON(out io.Writer, commander *subcommands.Commander, name string) error {
+	description := commandDescription{Flags: describeFlags(commander.VisitAll)}
+
+	if name != "" {
+		var found subcommands.Command
+		commander.VisitCommands(func(_ *subcommands.CommandGroup, cmd subcommands.Command) {
+			if cmd.Name() == name {
+				found = cmd
+			}
+		})
+		if found == nil {
+			return fmt.Errorf("unknown sub-command '%s'", name)
+		}
+		description = describeCommand(found)
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(description)
+}
@@ -0,0 +1,90 @@
+// Test our machine-readable usage information.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/google/subcommands"
+)
+
+// Test that the flags of a sub-command are described, with their types.
+func TestPrintFlagsJSON(t *testing.T) {
+	commander := subcommands.NewCommander(flag.NewFlagSet("sos", flag.ContinueOnError), "sos")
+	commander.Register(&blobServerCmd{}, "")
+	commander.Register(&versionCmd{}, "")
+
+	var out bytes.Buffer
+	if err := printFlagsJSON(&out, commander, "blob-server"); err != nil {
+		t.Fatal(err)
+	}
+
+	var description commandDescription
+	if err := json.Unmarshal(out.Bytes(), &description); err != nil {
+		t.Fatal(err)
+	}
+	if description.Command != "blob-server" {
+		t.Errorf("Unexpected command: %s", description.Command)
+	}
+
+	expected := map[string]flagDescription{
+		"port":             {Name: "port", Type: "int", Default: "3001"},
+		"aliases":          {Name: "aliases", Type: "bool", Default: "false"},
+		"store":            {Name: "store", Type: "string", Default: "data"},
+		"read-timeout":     {Name: "read-timeout", Type: "duration", Default: "15s"},
+		"min-free-percent": {Name: "min-free-percent", Type: "float", Default: "0"},
+	}
+	for _, f := range description.Flags {
+		want, ok := expected[f.Name]
+		if !ok {
+			continue
+		}
+		if f.Type != want.Type || f.Default != want.Default || f.Usage == "" {
+			t.Errorf("Unexpected description of %s: %v", f.Name, f)
+		}
+		delete(expected, f.Name)
+	}
+	if len(expected) != 0 {
+		t.Errorf("Missing flags: %v", expected)
+	}
+
+	if err := printFlagsJSON(&out, commander, "missing"); err == nil {
+		t.Errorf("Expected an error describing an unknown sub-command")
+	}
+}
+
+// Test that the hidden flag is removed only from before the sub-command.
+func TestTakeHiddenFlag(t *testing.T) {
+	flags := flag.NewFlagSet("sos", flag.ContinueOnError)
+	flags.String("debug-addr", "", "")
+	flags.Bool("verbose", false, "")
+
+	tests := []struct {
+		args      []string
+		remaining string
+		found     bool
+	}{
+		{[]string{"-print-flags-json", "blob-server"}, "blob-server", true},
+		{[]string{"--print-flags-json=true", "blob-server"}, "blob-server", true},
+		{[]string{"-debug-addr", ":6060", "-print-flags-json", "put"}, "-debug-addr :6060 put", true},
+		{[]string{"-verbose", "-print-flags-json"}, "-verbose", true},
+		{[]string{"-print-flags-json=false", "put"}, "put", false},
+		{[]string{"-debug-addr", "-print-flags-json", "put"}, "-debug-addr -print-flags-json put", false},
+		{[]string{"put", "-print-flags-json"}, "put -print-flags-json", false},
+		{[]string{"--", "-print-flags-json"}, "-- -print-flags-json", false},
+	}
+
+	for _, test := range tests {
+		remaining, found := takeHiddenFlag(flags, test.args, "print-flags-json")
+		if found != test.found || strings.Join(remaining, " ") != test.remaining {
+			t.Errorf("Unexpected result for %v: %v %v", test.args, remaining, found)
+		}
+	}
+
+	if flags.Lookup("print-flags-json") != nil {
+		t.Errorf("The hidden flag was registered")
+	}
+}